@@ -0,0 +1,128 @@
+package buildkite
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/logging"
+	"github.com/buildkite/buildkite-agent-scaler/version"
+)
+
+const (
+	// DefaultAPIEndpoint is the Buildkite REST API.
+	DefaultAPIEndpoint = "https://api.buildkite.com/v2"
+
+	// InstanceIDMetaDataKey is the agent meta-data key holding the EC2
+	// instance ID, as set by --tags-from-ec2-meta-data.
+	InstanceIDMetaDataKey = "aws:instance-id"
+
+	agentsPerPage = 100
+	maxAgentPages = 50
+)
+
+// APIClient is a client for the Buildkite REST API. Unlike Client, which uses
+// an agent registration token, it needs an API access token with the
+// read_agents scope.
+type APIClient struct {
+	Endpoint   string
+	Token      string
+	UserAgent  string
+	HTTPClient *http.Client // nil uses http.DefaultClient
+}
+
+func NewAPIClient(token, endpoint string) *APIClient {
+	if endpoint == "" {
+		endpoint = DefaultAPIEndpoint
+	}
+	return &APIClient{
+		Endpoint:  endpoint,
+		Token:     token,
+		UserAgent: fmt.Sprintf("buildkite-agent-scaler/%s", version.VersionString()),
+	}
+}
+
+// Agent is an agent as returned by the REST API.
+type Agent struct {
+	ID              string    `json:"id"`
+	Name            string    `json:"name"`
+	ConnectionState string    `json:"connection_state"`
+	MetaData        []string  `json:"meta_data"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// MetaDataValue returns the value of the agent's key=value meta-data entry
+// for key, or "" if there isn't one.
+func (a Agent) MetaDataValue(key string) string {
+	for _, md := range a.MetaData {
+		if k, v, ok := strings.Cut(md, "="); ok && k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// ListConnectedAgents returns the organization's connected agents. The REST
+// API can only filter agents by name, hostname and version, none of which
+// identify a queue or instance, so this pages through every agent in the
+// organization. Callers should not call it on every poll.
+func (c *APIClient) ListConnectedAgents(ctx context.Context, orgSlug string) ([]Agent, error) {
+	logger := logging.FromContext(ctx)
+	logger.Debug("Listing connected Buildkite agents")
+	t := time.Now()
+
+	var agents []Agent
+	for page := 1; page <= maxAgentPages; page++ {
+		var batch []Agent
+		if err := c.get(ctx, "/organizations/"+url.PathEscape(orgSlug)+"/agents", url.Values{
+			"page":     {strconv.Itoa(page)},
+			"per_page": {strconv.Itoa(agentsPerPage)},
+		}, &batch); err != nil {
+			return nil, err
+		}
+		for _, agent := range batch {
+			if agent.ConnectionState == "connected" {
+				agents = append(agents, agent)
+			}
+		}
+		if len(batch) < agentsPerPage {
+			logger.Info("Listed connected Buildkite agents", "connected", len(agents), slog.Duration("took", time.Since(t)))
+			return agents, nil
+		}
+	}
+	return nil, fmt.Errorf("more than %d pages of agents in org %q", maxAgentPages, orgSlug)
+}
+
+func (c *APIClient) get(ctx context.Context, path string, query url.Values, into interface{}) error {
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return err
+	}
+	endpoint.Path += path
+	endpoint.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("User-Agent", c.UserAgent)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+
+	res, err := httpClient(c.HTTPClient).Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s: %s", req.Method, endpoint, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(into)
+}
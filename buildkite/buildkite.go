@@ -4,12 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strconv"
 	"time"
 
+	"github.com/buildkite/buildkite-agent-scaler/logging"
 	"github.com/buildkite/buildkite-agent-scaler/version"
 )
 
@@ -21,6 +22,7 @@ type Client struct {
 	Endpoint   string
 	AgentToken string
 	UserAgent  string
+	HTTPClient *http.Client // nil uses http.DefaultClient
 }
 
 func NewClient(agentToken, agentEndpoint string) *Client {
@@ -45,7 +47,8 @@ type AgentMetrics struct {
 }
 
 func (c *Client) GetAgentMetrics(ctx context.Context, queue string) (AgentMetrics, error) {
-	log.Printf("Collecting Buildkite metrics for queue %q", queue)
+	logger := logging.FromContext(ctx)
+	logger.Debug("Collecting Buildkite metrics")
 
 	var resp struct {
 		Organization struct {
@@ -64,7 +67,7 @@ func (c *Client) GetAgentMetrics(ctx context.Context, queue string) (AgentMetric
 	}
 
 	t := time.Now()
-	pollDuration, err := c.queryMetrics(ctx, &resp, queue)
+	pollDuration, serverTime, err := c.queryMetrics(ctx, &resp, queue)
 	if err != nil {
 		return AgentMetrics{}, err
 	}
@@ -75,7 +78,14 @@ func (c *Client) GetAgentMetrics(ctx context.Context, queue string) (AgentMetric
 	metrics.OrgSlug = resp.Organization.Slug
 	metrics.Queue = queue
 	metrics.PollDuration = pollDuration
-	metrics.Timestamp = time.Now() // Record when these metrics were collected
+
+	// Use the server's Date header so freshness checks see how old the
+	// response really is (e.g. one replayed by a caching proxy). Fall back to
+	// the local clock when the header is missing or unparseable.
+	metrics.Timestamp = serverTime
+	if metrics.Timestamp.IsZero() {
+		metrics.Timestamp = time.Now()
+	}
 
 	metrics.IdleAgents = resp.Agents.Idle
 	metrics.BusyAgents = resp.Agents.Busy
@@ -85,18 +95,26 @@ func (c *Client) GetAgentMetrics(ctx context.Context, queue string) (AgentMetric
 	metrics.RunningJobs = resp.Jobs.Running
 	metrics.WaitingJobs = resp.Jobs.Waiting
 
-	log.Printf("↳ Agents: idle=%d, busy=%d, total=%d",
-		metrics.IdleAgents, metrics.BusyAgents, metrics.TotalAgents)
-	log.Printf("↳ Jobs: scheduled=%d, running=%d, waiting=%d (took %v)",
-		metrics.ScheduledJobs, metrics.RunningJobs, metrics.WaitingJobs, queryDuration)
+	logger.Info("Collected Buildkite metrics",
+		slog.Group("agents", "idle", metrics.IdleAgents, "busy", metrics.BusyAgents, "total", metrics.TotalAgents),
+		slog.Group("jobs", "scheduled", metrics.ScheduledJobs, "running", metrics.RunningJobs, "waiting", metrics.WaitingJobs),
+		slog.Duration("took", queryDuration))
 
 	return metrics, nil
 }
 
-func (c *Client) queryMetrics(ctx context.Context, into interface{}, queue string) (pollDuration time.Duration, err error) {
+// httpClient returns client, or http.DefaultClient if it is nil.
+func httpClient(client *http.Client) *http.Client {
+	if client == nil {
+		return http.DefaultClient
+	}
+	return client
+}
+
+func (c *Client) queryMetrics(ctx context.Context, into interface{}, queue string) (pollDuration time.Duration, serverTime time.Time, err error) {
 	endpoint, err := url.Parse(c.Endpoint)
 	if err != nil {
-		return time.Duration(0), err
+		return time.Duration(0), time.Time{}, err
 	}
 	endpoint.Path += "/metrics/queue"
 	q := url.Values{"name": []string{queue}}
@@ -104,30 +122,37 @@ func (c *Client) queryMetrics(ctx context.Context, into interface{}, queue strin
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint.String(), nil)
 	if err != nil {
-		return time.Duration(0), err
+		return time.Duration(0), time.Time{}, err
 	}
 
 	req.Header.Set("User-Agent", c.UserAgent)
 	req.Header.Set("Authorization", fmt.Sprintf("Token %s", c.AgentToken))
 
-	res, err := http.DefaultClient.Do(req)
+	res, err := httpClient(c.HTTPClient).Do(req)
 	if err != nil {
-		return time.Duration(0), err
+		return time.Duration(0), time.Time{}, err
 	}
 	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		return time.Duration(0), fmt.Errorf("%s %s: %s", req.Method, endpoint, res.Status)
+		return time.Duration(0), time.Time{}, fmt.Errorf("%s %s: %s", req.Method, endpoint, res.Status)
 	}
 
 	// Check if we get a poll duration header from server
 	if pollSeconds := res.Header.Get(PollDurationHeader); pollSeconds != "" {
 		pollSecondsInt, err := strconv.ParseInt(pollSeconds, 10, 64)
 		if err != nil {
-			log.Printf("Failed to parse %s header: %v", PollDurationHeader, err)
+			logging.FromContext(ctx).Warn("Failed to parse poll duration header", "header", PollDurationHeader, "error", err)
 		} else {
 			pollDuration = time.Duration(pollSecondsInt) * time.Second
 		}
 	}
 
-	return pollDuration, json.NewDecoder(res.Body).Decode(into)
+	if date := res.Header.Get("Date"); date != "" {
+		if serverTime, err = http.ParseTime(date); err != nil {
+			logging.FromContext(ctx).Warn("Failed to parse Date header", "error", err)
+			serverTime = time.Time{}
+		}
+	}
+
+	return pollDuration, serverTime, json.NewDecoder(res.Body).Decode(into)
 }
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestHappy(t *testing.T) {
@@ -39,3 +40,48 @@ func TestUnauthorizedResponse(t *testing.T) {
 		t.Error("expected error representing non-200 HTTP status")
 	}
 }
+
+func TestTimestampFromDateHeader(t *testing.T) {
+	date := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", date.Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, `{"organization": {"slug": "llamacorp"}}`)
+	}))
+	c := NewClient("testtoken", "https://agent.buildkite.com/v3")
+	c.Endpoint = s.URL
+	m, err := c.GetAgentMetrics(context.Background(), "default")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !m.Timestamp.Equal(date) {
+		t.Errorf("Timestamp: wanted %v from Date header, got %v", date, m.Timestamp)
+	}
+}
+
+func TestListConnectedAgents(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got, want := r.URL.Path, "/organizations/llamacorp/agents"; got != want {
+			t.Errorf("path: wanted %s, got %s", want, got)
+		}
+		if got, want := r.Header.Get("Authorization"), "Bearer apitoken"; got != want {
+			t.Errorf("Authorization: wanted %q, got %q", want, got)
+		}
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, `[
+			{"id": "a1", "connection_state": "connected", "meta_data": ["queue=default", "aws:instance-id=i-0123456789abcdef0"]},
+			{"id": "a2", "connection_state": "disconnected", "meta_data": ["aws:instance-id=i-0fedcba9876543210"]}
+		]`)
+	}))
+	c := NewAPIClient("apitoken", s.URL)
+	agents, err := c.ListConnectedAgents(context.Background(), "llamacorp")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(agents) != 1 || agents[0].ID != "a1" {
+		t.Fatalf("agents: wanted only a1, got %+v", agents)
+	}
+	if got, want := agents[0].MetaDataValue(InstanceIDMetaDataKey), "i-0123456789abcdef0"; got != want {
+		t.Errorf("MetaDataValue: wanted %s, got %s", want, got)
+	}
+}
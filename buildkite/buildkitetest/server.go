@@ -0,0 +1,263 @@
+// Package buildkitetest provides a fake Buildkite server for testing code
+// that uses the buildkite package, without network access.
+//
+// The Server serves the agent API's queue metrics endpoint, as used by
+// buildkite.Client, and the REST API's agents endpoint, as used by
+// buildkite.APIClient. Responses are programmable per queue, faults such as
+// rate limiting, server errors and slow responses can be injected, and every
+// request is recorded.
+package buildkitetest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+// Paths under Server.URL of the two APIs. Pass Server.AgentEndpoint and
+// Server.RESTEndpoint to the buildkite clients.
+const (
+	agentAPIPath = "/v3"
+	restAPIPath  = "/v2"
+)
+
+// Server is a fake Buildkite API server. Its methods are safe for
+// concurrent use, including while requests are being served.
+type Server struct {
+	*httptest.Server
+
+	mu         sync.Mutex
+	agentToken string // Empty to accept any
+	apiToken   string // Empty to accept any
+	orgSlug    string
+	metrics    map[string]buildkite.AgentMetrics // By queue
+	agents     []buildkite.Agent
+	faults     []fault
+	requests   []Request
+}
+
+// Request is a request the Server received.
+type Request struct {
+	Time      time.Time
+	Method    string
+	Path      string
+	Queue     string // The name query parameter of metrics requests
+	Token     string // From the Authorization header, without its scheme
+	UserAgent string
+	Status    int // The status the Server responded with, 0 if the client gave up first
+}
+
+// Fault is an injected failure.
+type Fault struct {
+	Status     int           // Respond with this status instead, e.g. 429 or 503. 0 responds normally, after Delay.
+	RetryAfter time.Duration // Retry-After header to send with Status, rounded to seconds
+	Body       string        // Response body to send with Status
+	Delay      time.Duration // How long to wait before responding, or until the client gives up
+}
+
+type fault struct {
+	Fault
+	remaining int // Requests left to fail, or -1 for all of them
+}
+
+// NewServer starts a Server for the organization orgSlug. Its agent and API
+// tokens accept any value until set with RequireTokens. Close it when done.
+func NewServer(orgSlug string) *Server {
+	s := &Server{
+		orgSlug: orgSlug,
+		metrics: make(map[string]buildkite.AgentMetrics),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("GET "+agentAPIPath+"/metrics/queue",
+		s.handler("Token", func() string { return s.agentToken }, s.queueMetrics))
+	mux.Handle("GET "+restAPIPath+"/organizations/{org}/agents",
+		s.handler("Bearer", func() string { return s.apiToken }, s.listAgents))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// AgentEndpoint is the endpoint to pass to buildkite.NewClient.
+func (s *Server) AgentEndpoint() string {
+	return s.URL + agentAPIPath
+}
+
+// RESTEndpoint is the endpoint to pass to buildkite.NewAPIClient.
+func (s *Server) RESTEndpoint() string {
+	return s.URL + restAPIPath
+}
+
+// RequireTokens makes the Server reject requests without the given agent
+// registration token (for metrics) or API access token (for the REST API)
+// with 401 Unauthorized. An empty token accepts any.
+func (s *Server) RequireTokens(agentToken, apiToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.agentToken, s.apiToken = agentToken, apiToken
+}
+
+// SetQueueMetrics sets the metrics reported for queue. OrgSlug and Queue are
+// ignored: the organization is the Server's. PollDuration is sent as the poll
+// duration header, and a non-zero Timestamp as the Date header, so clients
+// see metrics of that age. Queues without metrics report zeros.
+func (s *Server) SetQueueMetrics(queue string, metrics buildkite.AgentMetrics) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics[queue] = metrics
+}
+
+// SetAgents sets the organization's agents, listed by the REST API. List
+// disconnected agents too, as Buildkite does, to check that clients skip
+// them.
+func (s *Server) SetAgents(agents []buildkite.Agent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.agents = append([]buildkite.Agent(nil), agents...)
+}
+
+// Fail injects f into the next times requests, or every request until
+// ClearFaults if times <= 0. Faults apply in the order they're injected.
+func (s *Server) Fail(f Fault, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if times <= 0 {
+		times = -1
+	}
+	s.faults = append(s.faults, fault{Fault: f, remaining: times})
+}
+
+// ClearFaults removes every injected fault.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Requests returns the requests received so far, oldest first.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// response is what a handler responds with.
+type response struct {
+	status int
+	header http.Header
+	body   any // Encoded as JSON, unless it's a string
+}
+
+// handler serves requests with respond, after checking the Authorization
+// header has scheme and the token returned by wantToken, and applying any
+// injected fault. The request is recorded with the status it got.
+func (s *Server) handler(scheme string, wantToken func() string, respond func(r *http.Request) response) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req := Request{
+			Time:      time.Now(),
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			Queue:     r.URL.Query().Get("name"),
+			UserAgent: r.UserAgent(),
+		}
+		req.Token, _ = strings.CutPrefix(r.Header.Get("Authorization"), scheme+" ")
+
+		s.mu.Lock()
+		var f Fault
+		var resp response
+		switch want := wantToken(); {
+		case want != "" && req.Token != want:
+			resp = response{status: http.StatusUnauthorized, body: map[string]string{"message": "Invalid or missing token"}}
+		case len(s.faults) > 0:
+			f = s.faults[0].Fault
+			if s.faults[0].remaining > 0 {
+				if s.faults[0].remaining--; s.faults[0].remaining == 0 {
+					s.faults = s.faults[1:]
+				}
+			}
+		}
+		if f.Status != 0 {
+			resp = response{status: f.Status, header: http.Header{}, body: f.Body}
+			if f.RetryAfter > 0 {
+				resp.header.Set("Retry-After", strconv.Itoa(int(f.RetryAfter.Round(time.Second)/time.Second)))
+			}
+		} else if resp.status == 0 {
+			resp = respond(r)
+		}
+		s.mu.Unlock()
+
+		if f.Delay > 0 {
+			select {
+			case <-r.Context().Done():
+				resp.status = 0 // The client gave up
+			case <-time.After(f.Delay):
+			}
+		}
+		if resp.status != 0 {
+			for k, v := range resp.header {
+				w.Header()[k] = v
+			}
+			if body, ok := resp.body.(string); ok {
+				w.WriteHeader(resp.status)
+				io.WriteString(w, body)
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(resp.status)
+				_ = json.NewEncoder(w).Encode(resp.body)
+			}
+		}
+
+		req.Status = resp.status
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		s.mu.Unlock()
+	}
+}
+
+func (s *Server) queueMetrics(r *http.Request) response {
+	m := s.metrics[r.URL.Query().Get("name")]
+	var body struct {
+		Organization struct {
+			Slug string `json:"slug"`
+		} `json:"organization"`
+		Agents struct {
+			Busy  int64 `json:"busy"`
+			Idle  int64 `json:"idle"`
+			Total int64 `json:"total"`
+		} `json:"agents"`
+		Jobs struct {
+			Scheduled int64 `json:"scheduled"`
+			Running   int64 `json:"running"`
+			Waiting   int64 `json:"waiting"`
+		} `json:"jobs"`
+	}
+	body.Organization.Slug = s.orgSlug
+	body.Agents.Busy, body.Agents.Idle, body.Agents.Total = m.BusyAgents, m.IdleAgents, m.TotalAgents
+	body.Jobs.Scheduled, body.Jobs.Running, body.Jobs.Waiting = m.ScheduledJobs, m.RunningJobs, m.WaitingJobs
+
+	header := http.Header{}
+	if m.PollDuration > 0 {
+		header.Set(buildkite.PollDurationHeader, strconv.Itoa(int(m.PollDuration/time.Second)))
+	}
+	if !m.Timestamp.IsZero() {
+		header.Set("Date", m.Timestamp.UTC().Format(http.TimeFormat))
+	}
+	return response{status: http.StatusOK, header: header, body: body}
+}
+
+func (s *Server) listAgents(r *http.Request) response {
+	if r.PathValue("org") != s.orgSlug {
+		return response{status: http.StatusNotFound, body: map[string]string{"message": "No organization found"}}
+	}
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	perPage, _ := strconv.Atoi(r.URL.Query().Get("per_page"))
+	page, perPage = max(page, 1), max(perPage, 1)
+	start := min((page-1)*perPage, len(s.agents))
+	end := min(start+perPage, len(s.agents))
+	return response{status: http.StatusOK, body: s.agents[start:end]}
+}
@@ -0,0 +1,148 @@
+package buildkitetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+func TestQueueMetrics(t *testing.T) {
+	s := NewServer("llamacorp")
+	defer s.Close()
+	timestamp := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	s.SetQueueMetrics("default", buildkite.AgentMetrics{
+		ScheduledJobs: 3,
+		RunningJobs:   2,
+		IdleAgents:    1,
+		BusyAgents:    2,
+		TotalAgents:   3,
+		PollDuration:  15 * time.Second,
+		Timestamp:     timestamp,
+	})
+
+	m, err := buildkite.NewClient("agenttoken", s.AgentEndpoint()).GetAgentMetrics(context.Background(), "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := buildkite.AgentMetrics{
+		OrgSlug:       "llamacorp",
+		Queue:         "default",
+		ScheduledJobs: 3,
+		RunningJobs:   2,
+		IdleAgents:    1,
+		BusyAgents:    2,
+		TotalAgents:   3,
+		PollDuration:  15 * time.Second,
+		Timestamp:     timestamp,
+	}
+	if m != want {
+		t.Errorf("GetAgentMetrics() = %+v, want %+v", m, want)
+	}
+	reqs := s.Requests()
+	if len(reqs) != 1 || reqs[0].Queue != "default" || reqs[0].Token != "agenttoken" || reqs[0].Status != http.StatusOK {
+		t.Errorf("Requests() = %+v, want one for the default queue with the agent token", reqs)
+	}
+	if !strings.HasPrefix(reqs[0].UserAgent, "buildkite-agent-scaler/") {
+		t.Errorf("User-Agent = %q", reqs[0].UserAgent)
+	}
+}
+
+func TestRequireTokens(t *testing.T) {
+	s := NewServer("llamacorp")
+	defer s.Close()
+	s.RequireTokens("agenttoken", "apitoken")
+
+	if _, err := buildkite.NewClient("wrong", s.AgentEndpoint()).GetAgentMetrics(context.Background(), "default"); err == nil {
+		t.Error("GetAgentMetrics() with the wrong agent token succeeded")
+	}
+	if _, err := buildkite.NewClient("agenttoken", s.AgentEndpoint()).GetAgentMetrics(context.Background(), "default"); err != nil {
+		t.Errorf("GetAgentMetrics() with the agent token: %v", err)
+	}
+	// The REST API takes the API token, not the agent token
+	if _, err := buildkite.NewAPIClient("agenttoken", s.RESTEndpoint()).ListConnectedAgents(context.Background(), "llamacorp"); err == nil {
+		t.Error("ListConnectedAgents() with the agent token succeeded")
+	}
+
+	var statuses []int
+	for _, req := range s.Requests() {
+		statuses = append(statuses, req.Status)
+	}
+	if want := []int{401, 200, 401}; !slices.Equal(statuses, want) {
+		t.Errorf("statuses = %v, want %v", statuses, want)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	s := NewServer("llamacorp")
+	defer s.Close()
+	c := buildkite.NewClient("agenttoken", s.AgentEndpoint())
+	s.Fail(Fault{Status: http.StatusTooManyRequests, RetryAfter: 30 * time.Second}, 2)
+	s.Fail(Fault{Status: http.StatusBadGateway, Body: "<html>Bad Gateway</html>"}, 1)
+
+	for _, want := range []string{"429", "429", "502", ""} {
+		_, err := c.GetAgentMetrics(context.Background(), "default")
+		switch {
+		case want == "" && err != nil:
+			t.Errorf("GetAgentMetrics() after the faults: %v", err)
+		case want != "" && (err == nil || !strings.Contains(err.Error(), want)):
+			t.Errorf("GetAgentMetrics() = %v, want a %s error", err, want)
+		}
+	}
+
+	s.Fail(Fault{Status: http.StatusServiceUnavailable}, 0)
+	for range 3 {
+		if _, err := c.GetAgentMetrics(context.Background(), "default"); err == nil {
+			t.Error("GetAgentMetrics() succeeded with a standing fault")
+		}
+	}
+	s.ClearFaults()
+	if _, err := c.GetAgentMetrics(context.Background(), "default"); err != nil {
+		t.Errorf("GetAgentMetrics() after ClearFaults: %v", err)
+	}
+}
+
+func TestSlowResponse(t *testing.T) {
+	s := NewServer("llamacorp")
+	defer s.Close()
+	s.Fail(Fault{Delay: time.Minute}, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := buildkite.NewClient("agenttoken", s.AgentEndpoint()).GetAgentMetrics(ctx, "default")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetAgentMetrics() = %v, want the context's deadline exceeded", err)
+	}
+}
+
+func TestListAgentsPages(t *testing.T) {
+	s := NewServer("llamacorp")
+	defer s.Close()
+	var agents []buildkite.Agent
+	for i := range 150 {
+		state := "connected"
+		if i%3 == 0 {
+			state = "disconnected"
+		}
+		agents = append(agents, buildkite.Agent{ID: fmt.Sprintf("agent-%d", i), ConnectionState: state})
+	}
+	s.SetAgents(agents)
+
+	connected, err := buildkite.NewAPIClient("apitoken", s.RESTEndpoint()).ListConnectedAgents(context.Background(), "llamacorp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(connected) != 100 {
+		t.Errorf("got %d connected agents, want 100", len(connected))
+	}
+	if reqs := s.Requests(); len(reqs) != 2 {
+		t.Errorf("got %d requests, want one per page of 100", len(reqs))
+	}
+}
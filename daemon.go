@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/buildkite/buildkite-agent-scaler/scaler"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// daemonMetrics are the Prometheus metrics served with --listen.
+type daemonMetrics struct {
+	registry *prometheus.Registry
+
+	queueJobs   *prometheus.GaugeVec
+	queueAgents *prometheus.GaugeVec
+	capacity    *prometheus.GaugeVec
+	runs        *prometheus.CounterVec
+	decisions   *prometheus.CounterVec
+	cooldown    *prometheus.GaugeVec
+	dangling    prometheus.Counter
+	apiDuration *prometheus.HistogramVec
+}
+
+// apiDurationBuckets reach past the SDK's retries of a slow call.
+var apiDurationBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+func newDaemonMetrics() *daemonMetrics {
+	m := &daemonMetrics{
+		registry: prometheus.NewRegistry(),
+
+		queueJobs: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "buildkite_scaler_queue_jobs",
+			Help: "Jobs on the queue by state, as of the last run.",
+		}, []string{"state"}),
+		queueAgents: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "buildkite_scaler_queue_agents",
+			Help: "Agents on the queue by state, as of the last run.",
+		}, []string{"state"}),
+		capacity: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "buildkite_scaler_asg_capacity",
+			Help: "The ASG's desired, actual and pending instances, and the desired capacity the last run settled on.",
+		}, []string{"kind"}),
+		runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "buildkite_scaler_runs_total",
+			Help: "Scaler runs by outcome.",
+		}, []string{"outcome"}),
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "buildkite_scaler_decisions_total",
+			Help: "Scaling decisions by action and the reason no action was taken, if any.",
+		}, []string{"action", "reason"}),
+		cooldown: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "buildkite_scaler_cooldown_remaining_seconds",
+			Help: "How long until the scaler may next scale in or out.",
+		}, []string{"direction"}),
+		dangling: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "buildkite_scaler_dangling_instances_found_total",
+			Help: "Instances found with their agent stopped.",
+		}),
+		apiDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "buildkite_scaler_api_request_duration_seconds",
+			Help:    "Latency of calls to AWS and Buildkite APIs, including retries, by outcome.",
+			Buckets: apiDurationBuckets,
+		}, []string{"dependency", "operation", "outcome"}),
+	}
+	m.registry.MustRegister(m.queueJobs, m.queueAgents, m.capacity, m.runs, m.decisions, m.cooldown, m.dangling, m.apiDuration)
+	return m
+}
+
+// observeRun records the outcome of a Run and what it decided.
+func (m *daemonMetrics) observeRun(sc *scaler.Scaler, err error) {
+	m.runs.WithLabelValues(outcome(err)).Inc()
+
+	scaleIn, scaleOut := sc.CooldownRemaining()
+	m.cooldown.WithLabelValues("scale_in").Set(scaleIn.Seconds())
+	m.cooldown.WithLabelValues("scale_out").Set(scaleOut.Seconds())
+
+	d := sc.LastDecision()
+	if d.Time.IsZero() {
+		// The ASG couldn't be described, so nothing was decided
+		return
+	}
+	m.decisions.WithLabelValues(d.Action, d.Reason).Inc()
+	m.capacity.WithLabelValues("desired").Set(float64(d.Current))
+	m.capacity.WithLabelValues("actual").Set(float64(d.Actual))
+	m.capacity.WithLabelValues("pending").Set(float64(d.Pending))
+	m.capacity.WithLabelValues("decided").Set(float64(d.Desired))
+	m.dangling.Add(float64(d.DanglingInstances))
+
+	if q := d.Metrics; q != nil {
+		m.queueJobs.WithLabelValues("scheduled").Set(float64(q.ScheduledJobs))
+		m.queueJobs.WithLabelValues("running").Set(float64(q.RunningJobs))
+		m.queueJobs.WithLabelValues("waiting").Set(float64(q.WaitingJobs))
+		m.queueAgents.WithLabelValues("idle").Set(float64(q.IdleAgents))
+		m.queueAgents.WithLabelValues("busy").Set(float64(q.BusyAgents))
+		m.queueAgents.WithLabelValues("total").Set(float64(q.TotalAgents))
+	}
+}
+
+// awsAPIOption times every AWS API call made with the config it is added to,
+// by service and operation.
+func (m *daemonMetrics) awsAPIOption(stack *middleware.Stack) error {
+	// After the service metadata is registered, and before retries
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("ScalerAPIMetrics", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		start := time.Now()
+		out, metadata, err := next.HandleInitialize(ctx, in)
+		m.apiDuration.WithLabelValues(awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx), outcome(err)).Observe(time.Since(start).Seconds())
+		return out, metadata, err
+	}), middleware.After)
+}
+
+// httpClient returns an HTTP client that times each request as an operation
+// of dependency.
+func (m *daemonMetrics) httpClient(dependency, operation string) *http.Client {
+	return &http.Client{Transport: &timedTransport{
+		base:       http.DefaultTransport,
+		observe:    m.apiDuration,
+		dependency: dependency,
+		operation:  operation,
+	}}
+}
+
+type timedTransport struct {
+	base       http.RoundTripper
+	observe    *prometheus.HistogramVec
+	dependency string
+	operation  string
+}
+
+func (t *timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := t.base.RoundTrip(req)
+	result := outcome(err)
+	if err == nil && res.StatusCode >= 400 {
+		result = "error"
+	}
+	t.observe.WithLabelValues(t.dependency, t.operation, result).Observe(time.Since(start).Seconds())
+	return res, err
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// health tracks runs for the /healthz and /readyz endpoints. The daemon is
+// healthy while runs keep finishing, and ready once a run has succeeded and
+// fewer than failureThreshold of the latest runs have failed in a row.
+type health struct {
+	failureThreshold int
+	stallTimeout     time.Duration
+
+	mu                  sync.Mutex
+	started             time.Time
+	lastRun             time.Time
+	succeeded           bool
+	consecutiveFailures int
+}
+
+func newHealth(failureThreshold int, stallTimeout time.Duration) *health {
+	return &health{
+		failureThreshold: max(failureThreshold, 1),
+		stallTimeout:     stallTimeout,
+		started:          time.Now(),
+	}
+}
+
+func (h *health) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastRun = time.Now()
+	if err != nil {
+		h.consecutiveFailures++
+		return
+	}
+	h.succeeded = true
+	h.consecutiveFailures = 0
+}
+
+func (h *health) healthz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	last := h.lastRun
+	if last.IsZero() {
+		last = h.started
+	}
+	h.mu.Unlock()
+
+	if h.stallTimeout > 0 && time.Since(last) > h.stallTimeout {
+		http.Error(w, fmt.Sprintf("no run has finished for %s", time.Since(last).Round(time.Second)), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (h *health) readyz(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	succeeded, failures := h.succeeded, h.consecutiveFailures
+	h.mu.Unlock()
+
+	switch {
+	case failures >= h.failureThreshold:
+		http.Error(w, fmt.Sprintf("the last %d runs failed", failures), http.StatusServiceUnavailable)
+	case !succeeded:
+		http.Error(w, "no run has succeeded yet", http.StatusServiceUnavailable)
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// serveDaemon serves /metrics, /healthz and /readyz on addr in the
+// background, exiting if the listener fails.
+func serveDaemon(logger *slog.Logger, addr string, m *daemonMetrics, h *health) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := server.ListenAndServe()
+		logger.Error("Metrics server failed", "addr", addr, "error", err)
+		os.Exit(1)
+	}()
+	logger.Info("📈 Serving Prometheus metrics on /metrics, health checks on /healthz and /readyz", "addr", addr)
+}
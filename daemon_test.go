@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthReadyz(t *testing.T) {
+	errRun := errors.New("run failed")
+
+	for _, tc := range []struct {
+		name string
+		runs []error
+		want int
+	}{
+		{"no runs", nil, http.StatusServiceUnavailable},
+		{"success", []error{nil}, http.StatusOK},
+		{"failures only", []error{errRun}, http.StatusServiceUnavailable},
+		{"failures below threshold", []error{nil, errRun, errRun}, http.StatusOK},
+		{"failures at threshold", []error{nil, errRun, errRun, errRun}, http.StatusServiceUnavailable},
+		{"recovered", []error{nil, errRun, errRun, errRun, nil}, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newHealth(3, 0)
+			for _, err := range tc.runs {
+				h.record(err)
+			}
+			rec := httptest.NewRecorder()
+			h.readyz(rec, httptest.NewRequest("GET", "/readyz", nil))
+			if rec.Code != tc.want {
+				t.Errorf("readyz = %d %q, want %d", rec.Code, rec.Body.String(), tc.want)
+			}
+		})
+	}
+}
+
+func TestHealthHealthz(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		stallTimeout time.Duration
+		started      time.Duration
+		lastRun      time.Duration
+		want         int
+	}{
+		{"fresh", time.Minute, 0, 0, http.StatusOK},
+		{"recent run", time.Minute, time.Hour, time.Second, http.StatusOK},
+		{"stalled since start", time.Minute, time.Hour, 0, http.StatusServiceUnavailable},
+		{"stalled since run", time.Minute, time.Hour, 2 * time.Minute, http.StatusServiceUnavailable},
+		{"no stall timeout", 0, time.Hour, time.Hour, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newHealth(1, tc.stallTimeout)
+			h.started = time.Now().Add(-tc.started)
+			if tc.lastRun > 0 {
+				h.lastRun = time.Now().Add(-tc.lastRun)
+			}
+			rec := httptest.NewRecorder()
+			h.healthz(rec, httptest.NewRequest("GET", "/healthz", nil))
+			if rec.Code != tc.want {
+				t.Errorf("healthz = %d %q, want %d", rec.Code, rec.Body.String(), tc.want)
+			}
+		})
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestTimedTransport(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		status  int
+		err     error
+		outcome string
+	}{
+		{"ok", http.StatusOK, nil, "ok"},
+		{"client error", http.StatusNotFound, nil, "error"},
+		{"server error", http.StatusInternalServerError, nil, "error"},
+		{"transport error", 0, errors.New("connection refused"), "error"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newDaemonMetrics()
+			client := m.httpClient("buildkite", "GetMetrics")
+			client.Transport.(*timedTransport).base = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+				if tc.err != nil {
+					return nil, tc.err
+				}
+				return &http.Response{StatusCode: tc.status, Body: http.NoBody, Request: req}, nil
+			})
+
+			res, err := client.Get("http://agent.buildkite.test/v3/metrics")
+			if err == nil {
+				res.Body.Close()
+			}
+
+			if got := requestCount(t, m, "buildkite", "GetMetrics", tc.outcome); got != 1 {
+				t.Errorf("requests with outcome %q = %d, want 1", tc.outcome, got)
+			}
+		})
+	}
+}
+
+// requestCount returns how many API requests were observed with the labels.
+func requestCount(t *testing.T, m *daemonMetrics, dependency, operation, outcome string) uint64 {
+	t.Helper()
+	families, err := m.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"dependency": dependency, "operation": operation, "outcome": outcome}
+	for _, family := range families {
+		if family.GetName() != "buildkite_scaler_api_request_duration_seconds" {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if want[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric.GetHistogram().GetSampleCount()
+		}
+	}
+	return 0
+}
@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"hash/fnv"
-	"log"
+	"log/slog"
 	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/logging"
 )
 
 func deterministicJitter(key string, max time.Duration) time.Duration {
@@ -40,6 +42,6 @@ func applyStartupJitter(ctx context.Context, key string, max time.Duration) erro
 		return nil
 	}
 
-	log.Printf("Waiting %v before polling to stagger scheduled scaler invocations", jitter)
+	logging.FromContext(ctx).Info("Waiting before polling to stagger scheduled scaler invocations", slog.Duration("jitter", jitter))
 	return sleepWithContext(ctx, jitter)
 }
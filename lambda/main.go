@@ -4,15 +4,18 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"log"
+	"log/slog"
 	"math"
 	"os"
 	"sync"
 	"time"
 
 	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+	"github.com/buildkite/buildkite-agent-scaler/logging"
 	"github.com/buildkite/buildkite-agent-scaler/scaler"
+	"github.com/buildkite/buildkite-agent-scaler/tracing"
 	"github.com/buildkite/buildkite-agent-scaler/version"
 )
 
@@ -22,13 +25,18 @@ var (
 	lastScaleMu               sync.Mutex
 	lastScaleTimesFetched     bool
 	lastScaleIn, lastScaleOut time.Time
+	lastState                 scaler.State
 )
 
+// How long to wait for spans to be exported
+const tracingFlushTimeout = 5 * time.Second
+
 func main() {
 	if EnvBool("DEBUG") {
 		_, err := Handler(context.Background(), json.RawMessage([]byte{}))
 		if err != nil {
-			log.Fatal(err)
+			slog.Error("Scaler failed", "error", err)
+			os.Exit(1)
 		}
 		return
 	}
@@ -36,7 +44,14 @@ func main() {
 }
 
 func Handler(ctx context.Context, evt json.RawMessage) (string, error) {
-	log.Printf("buildkite-agent-scaler version %s", version.VersionString())
+	// Set up logging first, so everything after logs in the chosen format,
+	// including the standard logger's output
+	baseLogger, err := logging.NewLogger(os.Stderr, EnvString("LOG_FORMAT", logging.FormatText), EnvString("LOG_LEVEL", "info"))
+	if err != nil {
+		return "", err
+	}
+	slog.SetDefault(baseLogger)
+	baseLogger.Info("Starting buildkite-agent-scaler", "version", version.VersionString())
 
 	// optional agent endpoint
 	buildkiteAgentEndpoint := EnvString("BUILDKITE_AGENT_ENDPOINT", "https://agent.buildkite.com/v3")
@@ -46,6 +61,9 @@ func Handler(ctx context.Context, evt json.RawMessage) (string, error) {
 	asgName := RequireEnvString("ASG_NAME")
 	agentsPerInstance := RequireEnvInt("AGENTS_PER_INSTANCE")
 
+	logger := baseLogger.With(logging.KeyASG, asgName, logging.KeyQueue, buildkiteQueue)
+	ctx = logging.WithLogger(ctx, logger)
+
 	// Optional environment variables (but they must parse correctly if set).
 	startupJitterMax := EnvDuration("LAMBDA_STARTUP_JITTER_MAX", 0)
 	interval := EnvDuration("LAMBDA_INTERVAL", 10*time.Second)
@@ -85,19 +103,82 @@ func Handler(ctx context.Context, evt json.RawMessage) (string, error) {
 	minimumInstanceUptime := EnvDuration("DANGLING_CHECK_MINIMUM_INSTANCE_UPTIME", 1*time.Hour)
 	maxDanglingInstancesToCheck := EnvInt("MAX_DANGLING_INSTANCES_TO_CHECK", 5) // Maximum number of instances to check for dangling instances (only used for dangling instance scanning, not for normal scale-in)
 
+	scaleInPolicies, err := scaler.ParseScalingPolicies(EnvString("SCALE_IN_POLICIES", ""))
+	if err != nil {
+		return "", err
+	}
+	scaleInSelectPolicy, err := scaler.ParseSelectPolicy(EnvString("SCALE_IN_SELECT_POLICY", scaler.SelectPolicyMax))
+	if err != nil {
+		return "", err
+	}
+	scaleOutPolicies, err := scaler.ParseScalingPolicies(EnvString("SCALE_OUT_POLICIES", ""))
+	if err != nil {
+		return "", err
+	}
+	scaleOutSelectPolicy, err := scaler.ParseSelectPolicy(EnvString("SCALE_OUT_SELECT_POLICY", scaler.SelectPolicyMax))
+	if err != nil {
+		return "", err
+	}
+
+	stopProcedure, err := scaler.ParseStopProcedure(
+		EnvString("STOP_DOCUMENT", ""),
+		EnvString("STOP_DOCUMENT_PARAMETERS", ""),
+		EnvString("STOP_COMMAND", ""),
+		EnvString("PRE_STOP_COMMANDS", ""),
+	)
+	if err != nil {
+		return "", err
+	}
+	signal := scaler.SignalParams{
+		Concurrency: EnvInt("SIGNAL_CONCURRENCY", 10),
+		// Shorter than the CLI's default, to fit inside LAMBDA_TIMEOUT
+		Deadline: EnvDuration("SIGNAL_DEADLINE", 30*time.Second),
+	}
+
+	metricsGuard := scaler.MetricsGuardParams{
+		MaxMetricsAge:        EnvDuration("METRICS_MAX_AGE", 0),
+		MaxJobSwing:          int64(EnvInt("METRICS_MAX_JOB_SWING", 0)),
+		MaxRepeatedResponses: EnvInt("METRICS_MAX_REPEATED_RESPONSES", 0),
+		DetectAgentsVanished: EnvBool("METRICS_DETECT_AGENTS_VANISHED"),
+		BreakerThreshold:     EnvInt("METRICS_BREAKER_THRESHOLD", 0),
+		SafeFloor:            int64(EnvInt("METRICS_BREAKER_SAFE_FLOOR", 0)),
+	}
+
+	controller := scaler.ControllerParams{
+		Mode:          EnvString("CONTROLLER_MODE", scaler.ControllerModeStep),
+		Signal:        EnvString("CONTROLLER_SIGNAL", scaler.ControllerSignalBacklog),
+		Kp:            EnvFloat("CONTROLLER_KP", 1),
+		Ki:            EnvFloat("CONTROLLER_KI"),
+		Kd:            EnvFloat("CONTROLLER_KD"),
+		IntegralLimit: EnvFloat("CONTROLLER_INTEGRAL_LIMIT"),
+	}
+
 	publishCloudWatchMetrics := EnvBool("CLOUDWATCH_METRICS")
 	if publishCloudWatchMetrics {
-		log.Print("Publishing cloudwatch metrics")
+		logger.Info("Publishing cloudwatch metrics")
+	}
+
+	cloudWatchDimensions, err := scaler.ParseMetricDimensions(EnvString("CLOUDWATCH_METRICS_DIMENSIONS", ""))
+	if err != nil {
+		return "", err
+	}
+	cloudWatchMetrics := scaler.CloudWatchMetricsParams{
+		Format:         EnvString("CLOUDWATCH_METRICS_FORMAT", scaler.MetricsFormatAPI),
+		Namespace:      EnvString("CLOUDWATCH_METRICS_NAMESPACE", "Buildkite"),
+		Dimensions:     cloudWatchDimensions,
+		ASGDimension:   EnvBool("CLOUDWATCH_METRICS_ASG_DIMENSION"),
+		HighResolution: EnvBool("CLOUDWATCH_METRICS_HIGH_RESOLUTION"),
+		Extended:       EnvBool("CLOUDWATCH_METRICS_EXTENDED"),
 	}
 
 	disableScaleIn := EnvBool("DISABLE_SCALE_IN")
 	if disableScaleIn {
-		log.Print("Disabling scale-in 🙅🏼‍")
+		logger.Info("Disabling scale-in 🙅🏼‍")
 	}
 
 	disableScaleOut := EnvBool("DISABLE_SCALE_OUT")
 	if disableScaleOut {
-		log.Print("Disabling scale-out 🙅🏼‍♂️")
+		logger.Info("Disabling scale-out 🙅🏼‍♂️")
 	}
 
 	// establish an AWS session to be re-used
@@ -106,7 +187,8 @@ func Handler(ctx context.Context, evt json.RawMessage) (string, error) {
 		return "", err
 	}
 
-	// get last scale in and out from asg's activities
+	// get last scale in and out from the scaler's records in the asg's tags,
+	// falling back to the asg's activities
 	// This is wrapped in a mutex to avoid multiple outbound requests if the
 	// lambda ever runs multiple times in parallel.
 	func() {
@@ -128,38 +210,40 @@ func Handler(ctx context.Context, evt json.RawMessage) (string, error) {
 		defer cancel()
 
 		scalingLastActivityStartTime := time.Now()
-		scaleOutOutput, scaleInOutput, err := asg.GetLastScalingInAndOutActivity(cctx, !disableScaleOut, !disableScaleIn)
+		scaleOutTime, scaleInTime, err := asg.GetLastScalingInAndOutEvents(cctx, !disableScaleOut, !disableScaleIn)
 		if errors.Is(err, context.DeadlineExceeded) {
-			log.Printf("Failed to retrieve last scaling activity events due to %v timeout", asgActivityTimeoutDuration)
+			logger.Warn("Failed to retrieve last scaling activity events due to timeout", slog.Duration("timeout", asgActivityTimeoutDuration))
 			return
 		}
 		if err != nil { // Some other error.
-			log.Printf("Encountered error when retrieving last scaling activities: %s", err)
+			logger.Warn("Encountered error when retrieving last scaling activities", "error", err)
 			return
 		}
 
 		lastScaleInStr := "never"
-		if scaleInOutput != nil && scaleInOutput.StartTime != nil {
-			lastScaleIn = *scaleInOutput.StartTime
+		if !scaleInTime.IsZero() {
+			lastScaleIn = scaleInTime
 			lastScaleInStr = lastScaleIn.Format(time.RFC3339Nano)
 		}
 		lastScaleOutStr := "never"
-		if scaleOutOutput != nil && scaleOutOutput.StartTime != nil {
-			lastScaleOut = *scaleOutOutput.StartTime
+		if !scaleOutTime.IsZero() {
+			lastScaleOut = scaleOutTime
 			lastScaleOutStr = lastScaleOut.Format(time.RFC3339Nano)
 		}
 
 		lastScaleTimesFetched = true
 
 		scalingTimeDiff := time.Since(scalingLastActivityStartTime)
-		log.Printf("Successfully retrieved last scaling activity events. Last scale out %s, last scale in %s. Discovery took %s.", lastScaleOutStr, lastScaleInStr, scalingTimeDiff)
+		logger.Info("Successfully retrieved last scaling activity events",
+			"last_scale_out", lastScaleOutStr, "last_scale_in", lastScaleInStr, slog.Duration("took", scalingTimeDiff))
 	}()
 
 	token := os.Getenv("BUILDKITE_AGENT_TOKEN")
 	ssmTokenKey := os.Getenv("BUILDKITE_AGENT_TOKEN_SSM_KEY")
 
+	ssmClient := ssm.NewFromConfig(cfg)
 	if ssmTokenKey != "" {
-		tk, err := scaler.RetrieveFromParameterStore(cfg, ssmTokenKey)
+		tk, err := scaler.RetrieveFromParameterStore(ctx, ssmClient, ssmTokenKey)
 		if err != nil {
 			return "", err
 		}
@@ -172,6 +256,43 @@ func Handler(ctx context.Context, evt json.RawMessage) (string, error) {
 
 	client := buildkite.NewClient(token, buildkiteAgentEndpoint)
 
+	// An optional REST API token lets the scaler check connected agents
+	// against instances, instead of asking each instance over SSM
+	apiToken := os.Getenv("BUILDKITE_API_TOKEN")
+	if ssmAPITokenKey := os.Getenv("BUILDKITE_API_TOKEN_SSM_KEY"); ssmAPITokenKey != "" {
+		tk, err := scaler.RetrieveFromParameterStore(ctx, ssmClient, ssmAPITokenKey)
+		if err != nil {
+			return "", err
+		}
+		apiToken = tk
+	}
+	danglingAgents := scaler.DanglingAgentParams{
+		GracePeriod:    EnvDuration("DANGLING_AGENT_GRACE_PERIOD", 15*time.Minute),
+		ConfirmWithSSM: EnvBool("DANGLING_AGENT_CONFIRM_WITH_SSM"),
+	}
+	bootFailures := scaler.BootFailureParams{
+		RegistrationDeadline: EnvDuration("BOOT_REGISTRATION_DEADLINE", 0),
+		AlertThreshold:       EnvInt("BOOT_FAILURE_ALERT_THRESHOLD", 3),
+		AlertWindow:          EnvDuration("BOOT_FAILURE_ALERT_WINDOW", time.Hour),
+	}
+	forensics := scaler.ForensicsParams{
+		S3Bucket:    EnvString("FORENSICS_S3_BUCKET", ""),
+		S3KeyPrefix: EnvString("FORENSICS_S3_KEY_PREFIX", ""),
+		LogGroup:    EnvString("FORENSICS_LOG_GROUP", ""),
+	}
+	quarantine := scaler.QuarantineParams{
+		MaxInstances: EnvInt("QUARANTINE_MAX_INSTANCES", 0),
+		Expiry:       EnvDuration("QUARANTINE_EXPIRY", 24*time.Hour),
+	}
+	instanceStatus := scaler.InstanceStatusParams{
+		Enabled:      EnvBool("INSTANCE_STATUS_CHECKS"),
+		DrainTimeout: EnvDuration("SCHEDULED_EVENT_DRAIN_TIMEOUT", time.Hour),
+	}
+
+	lastScaleMu.Lock()
+	scaleInEvent, scaleOutEvent, state := lastScaleIn, lastScaleOut, lastState
+	lastScaleMu.Unlock()
+
 	params := scaler.Params{
 		BuildkiteQueue:       buildkiteQueue,
 		AutoScalingGroupName: asgName,
@@ -180,55 +301,121 @@ func Handler(ctx context.Context, evt json.RawMessage) (string, error) {
 		ScaleInParams: scaler.ScaleParams{
 			CooldownPeriod: scaleInCooldownPeriod,
 			Factor:         scaleInFactor,
-			LastEvent:      lastScaleIn,
+			LastEvent:      scaleInEvent,
 			Disable:        disableScaleIn,
+			Policies:       scaleInPolicies,
+			SelectPolicy:   scaleInSelectPolicy,
 		},
 		ScaleOutParams: scaler.ScaleParams{
 			CooldownPeriod: scaleOutCooldownPeriod,
 			Factor:         scaleOutFactor,
-			LastEvent:      lastScaleOut,
+			LastEvent:      scaleOutEvent,
 			Disable:        disableScaleOut,
+			Policies:       scaleOutPolicies,
+			SelectPolicy:   scaleOutSelectPolicy,
 		},
 		InstanceBuffer:                 instanceBuffer,
 		ScaleOnlyAfterAllEvent:         scaleOnlyAfterAllEvent,
 		PublishCloudWatchMetrics:       publishCloudWatchMetrics,
+		CloudWatchMetrics:              cloudWatchMetrics,
 		AvailabilityThreshold:          availabilityThreshold,
 		ElasticCIMode:                  elasticCIMode,
 		MinimumInstanceUptime:          minimumInstanceUptime,
 		MaxDanglingInstancesToCheck:    maxDanglingInstancesToCheck,
 		MaxInstanceCap:                 maxInstanceCap,
 		DanglingInstancesCheckInterval: interval,
+		Controller:                     controller,
+		MetricsGuard:                   metricsGuard,
+		MinSize:                        int64(EnvInt("MIN_SIZE", 0)),
+		MaxSize:                        int64(EnvInt("MAX_SIZE", 0)),
+		RuntimeConfigParameter:         EnvString("RUNTIME_CONFIG_SSM_PARAMETER", ""),
+		ExternalChangeGracePeriod:      EnvDuration("EXTERNAL_CHANGE_GRACE_PERIOD", 0),
+		Shadow:                         EnvBool("SHADOW_MODE"),
+		BuildkiteAPIToken:              apiToken,
+		BuildkiteAPIEndpoint:           EnvString("BUILDKITE_API_ENDPOINT", buildkite.DefaultAPIEndpoint),
+		DanglingAgents:                 danglingAgents,
+		BootFailures:                   bootFailures,
+		InstanceStatus:                 instanceStatus,
+		Forensics:                      forensics,
+		Quarantine:                     quarantine,
+		StopProcedure:                  stopProcedure,
+		Signal:                         signal,
+		State:                          state,
+		Logger:                         baseLogger, // The scaler adds the ASG and queue itself
+	}
+
+	if candidateConfig := EnvString("CANDIDATE_CONFIG", ""); candidateConfig != "" {
+		candidate, err := scaler.ParseCandidateParams(params, candidateConfig)
+		if err != nil {
+			return "", err
+		}
+		params.Candidate = &candidate
+	}
+
+	flushTraces := func() {}
+	var opts []scaler.Option
+	if EnvBool("TRACING") {
+		tp, err := tracing.NewTracerProvider(ctx, EnvString("TRACING_ENDPOINT", ""))
+		if err != nil {
+			return "", err
+		}
+		defer func() {
+			// The invocation's context may be nearly out of time, so
+			// give the last spans their own deadline
+			sctx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+			defer cancel()
+			if err := tp.Shutdown(sctx); err != nil {
+				logger.Warn("Failed to flush traces", "error", err)
+			}
+		}()
+		flushTraces = func() {
+			fctx, cancel := context.WithTimeout(context.Background(), tracingFlushTimeout)
+			defer cancel()
+			if err := tp.ForceFlush(fctx); err != nil {
+				logger.Warn("Failed to flush traces", "error", err)
+			}
+		}
+		opts = append(opts, scaler.WithTracerProvider(tp))
+		logger.Info("Exporting traces")
 	}
 
-	scaler, err := scaler.NewScaler(client, cfg, params)
+	scaler, err := scaler.NewScaler(client, cfg, params, opts...)
 	if err != nil {
-		log.Fatalf("Couldn't create new scaler: %v", err)
+		logger.Error("Couldn't create new scaler", "error", err)
+		os.Exit(1)
 	}
 
 	for {
 		minPollDuration, err := scaler.Run(ctx)
 		if err != nil {
-			log.Printf("Scaling error: %v", err)
+			logger.Error("Scaling error", "error", err)
 		}
 
+		// Export each run's trace as it finishes, in case the invocation
+		// times out before the next
+		flushTraces()
+
 		if interval < minPollDuration {
 			interval = minPollDuration
-			log.Printf("Increasing poll interval to %v based on rate limit", interval)
+			logger.Info("Increasing poll interval based on rate limit", slog.Duration("interval", interval))
 		}
 
 		// Persist the times back into the global state
+		lastScaleMu.Lock()
 		lastScaleIn = scaler.LastScaleIn()
 		lastScaleOut = scaler.LastScaleOut()
+		lastState = scaler.State()
+		lastScaleMu.Unlock()
 
-		logMsg := "Waiting for LAMBDA_INTERVAL (%v)"
+		logMsg := "Waiting for LAMBDA_INTERVAL"
 		if timeout != nil {
 			logMsg += " or timeout"
 		}
-		log.Printf(logMsg, interval)
+		logger.Debug(logMsg, slog.Duration("interval", interval))
 
 		select {
 		case <-timeout:
-			log.Printf("Exiting due to LAMBDA_TIMEOUT (%v)", timeoutDuration)
+			logger.Info("Exiting due to LAMBDA_TIMEOUT", slog.Duration("timeout", timeoutDuration))
 			return "", nil
 		case <-time.After(interval):
 			// Continue
@@ -0,0 +1,65 @@
+// Package logging sets up the scaler's structured logs, and carries a logger
+// through a context so records made deep inside a scaler run, e.g. by the
+// AWS and Buildkite drivers, carry the run's attributes.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Formats a handler can write.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// Attribute keys every record made during a scaler run carries.
+const (
+	KeyRunID = "run_id"
+	KeyASG   = "asg"
+	KeyQueue = "queue"
+	KeyOrg   = "org"
+)
+
+// KeyTraceID is the attribute that ties a run's records to its trace, when
+// the run is traced.
+const KeyTraceID = "trace_id"
+
+// NewLogger returns a logger writing records at level or above to w, as
+// FormatText or FormatJSON. level is one of debug, info, warn or error.
+func NewLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: expected debug, info, warn or error", level)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+
+	switch strings.ToLower(format) {
+	case FormatText, "":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q: expected %q or %q", format, FormatText, FormatJSON)
+	}
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx carrying l.
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// FromContext returns the logger ctx carries, or slog.Default if it carries
+// none.
+func FromContext(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
@@ -0,0 +1,56 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	var out bytes.Buffer
+	l, err := NewLogger(&out, "json", "info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Debug("hidden")
+	l.With(KeyRunID, "abc").Info("📋 Decision", "action", "scale-out")
+
+	var record map[string]any
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("want one JSON record at info: %v: %s", err, out.String())
+	}
+	if record["msg"] != "📋 Decision" || record[KeyRunID] != "abc" || record["action"] != "scale-out" || record["level"] != "INFO" {
+		t.Errorf("record = %v", record)
+	}
+
+	out.Reset()
+	l, err = NewLogger(&out, "text", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Debug("shown", "instance", "i-a")
+	if got := out.String(); !strings.Contains(got, "level=DEBUG") || !strings.Contains(got, "instance=i-a") {
+		t.Errorf("text record = %q", got)
+	}
+
+	for _, args := range [][2]string{{"xml", "info"}, {"json", "loud"}} {
+		if _, err := NewLogger(&out, args[0], args[1]); err == nil {
+			t.Errorf("NewLogger(%q, %q) succeeded, want an error", args[0], args[1])
+		}
+	}
+}
+
+func TestFromContext(t *testing.T) {
+	if FromContext(context.Background()) == nil {
+		t.Fatal("FromContext without a logger returned nil, want slog.Default")
+	}
+
+	var out bytes.Buffer
+	l, _ := NewLogger(&out, "text", "info")
+	FromContext(WithLogger(context.Background(), l.With(KeyQueue, "default"))).Info("hello")
+	if !strings.Contains(out.String(), "queue=default") {
+		t.Errorf("record = %q, want the context logger's attributes", out.String())
+	}
+}
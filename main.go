@@ -4,41 +4,120 @@ import (
 	"context"
 	"flag"
 	"log"
+	"log/slog"
+	"os"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+	"github.com/buildkite/buildkite-agent-scaler/logging"
 	"github.com/buildkite/buildkite-agent-scaler/scaler"
+	"github.com/buildkite/buildkite-agent-scaler/tracing"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			runReplay(os.Args[2:])
+			return
+		case "tune":
+			runTune(os.Args[2:])
+			return
+		}
+	}
+
+	scaling := addScalingFlags(flag.CommandLine)
 	var (
 		// aws params
-		asgName           = flag.String("asg-name", "", "The name of the autoscaling group")
-		agentsPerInstance = flag.Int("agents-per-instance", 1, "The number of agents per instance")
-		cwMetrics         = flag.Bool("cloudwatch-metrics", false, "Whether to publish cloudwatch metrics")
-		ssmTokenKey       = flag.String("agent-token-ssm-key", "", "The AWS SSM Parameter Store key for the agent token")
+		asgName     = flag.String("asg-name", "", "The name of the autoscaling group")
+		cwMetrics   = flag.Bool("cloudwatch-metrics", false, "Whether to publish cloudwatch metrics")
+		ssmTokenKey = flag.String("agent-token-ssm-key", "", "The AWS SSM Parameter Store key for the agent token")
+
+		// cloudwatch metrics params
+		cwMetricsFormat         = flag.String("cloudwatch-metrics-format", scaler.MetricsFormatAPI, "How to publish cloudwatch metrics: \"api\" calls PutMetricData, \"emf\" writes Embedded Metric Format lines to stdout")
+		cwMetricsNamespace      = flag.String("cloudwatch-metrics-namespace", "Buildkite", "The cloudwatch namespace to publish metrics under")
+		cwMetricsDimensions     = flag.String("cloudwatch-metrics-dimensions", "", "Extra dimensions for every metric, e.g. \"Stack=ci,Team=platform\"")
+		cwMetricsASGDimension   = flag.Bool("cloudwatch-metrics-asg-dimension", false, "Whether to add an AutoScalingGroup dimension with the ASG's name to every metric")
+		cwMetricsHighResolution = flag.Bool("cloudwatch-metrics-high-resolution", false, "Whether to store metrics at 1-second resolution")
+		cwMetricsExtended       = flag.Bool("cloudwatch-metrics-extended", false, "Whether to also publish agents, instances, availability, dangling instances and agent stop signals")
 
 		// buildkite params
 		buildkiteAgentEndpoint = flag.String("agent-endpoint", "https://agent.buildkite.com/v3", "The buildkite agent API endpoint")
 		buildkiteQueue         = flag.String("queue", "default", "The queue to watch in the metrics")
 		buildkiteAgentToken    = flag.String("agent-token", "", "A buildkite agent registration token")
-		includeWaiting         = flag.Bool("include-waiting", false, "Whether to include jobs behind a wait step for scaling")
 
-		// scale in/out params
-		scaleInFactor    = flag.Float64("scale-in-factor", 1.0, "A factor to apply to scale ins")
-		scaleOutFactor   = flag.Float64("scale-out-factor", 1.0, "A factor to apply to scale outs")
-		scaleInCooldown  = flag.Duration("scale-in-cooldown", 1*time.Hour, "How long to wait between scale in events")
-		scaleOutCooldown = flag.Duration("scale-out-cooldown", 0, "How long to wait between scale out events")
-		instanceBuffer   = flag.Int("instance-buffer", 0, "Keep this many instances as extra capacity")
+		// metrics guard params
+		metricsMaxAge               = flag.Duration("metrics-max-age", 0, "Ignore Buildkite metrics whose server time is older than this (0 disables)")
+		metricsMaxJobSwing          = flag.Int64("metrics-max-job-swing", 0, "Ignore Buildkite metrics where scheduled+running jobs move by more than this between polls (0 disables)")
+		metricsMaxRepeatedResponses = flag.Int("metrics-max-repeated-responses", 0, "Ignore Buildkite metrics repeated identically more than this many times (0 disables)")
+		metricsDetectAgentsVanished = flag.Bool("metrics-detect-agents-vanished", false, "Ignore Buildkite metrics where total agents drop to 0 while instances are InService")
+		metricsBreakerThreshold     = flag.Int("metrics-breaker-threshold", 0, "Open the metrics circuit breaker after this many consecutive failures or anomalies (0 disables)")
+		metricsBreakerSafeFloor     = flag.Int64("metrics-breaker-safe-floor", 0, "Keep at least this many instances while the metrics circuit breaker is open")
+
+		// runtime config params
+		runtimeConfigParameter = flag.String("runtime-config-parameter", "", "SSM parameter with key=value runtime overrides, e.g. \"max-size=10\"")
+
+		// manual override params
+		externalChangeGracePeriod = flag.Duration("external-change-grace-period", 0, "Hold a desired capacity set outside the scaler for this long before scaling again (0 disables)")
+
+		// dangling agent params
+		buildkiteAPIToken           = flag.String("api-token", "", "A Buildkite REST API token with read_agents scope, for checking connected agents against instances")
+		buildkiteAPIEndpoint        = flag.String("api-endpoint", buildkite.DefaultAPIEndpoint, "The Buildkite REST API endpoint")
+		danglingAgentGracePeriod    = flag.Duration("dangling-agent-grace-period", 15*time.Minute, "How long an InService instance may run without a connected agent before it is replaced (needs --api-token)")
+		danglingAgentConfirmWithSSM = flag.Bool("dangling-agent-confirm-with-ssm", false, "Confirm instances without a connected agent over SSM before replacing them")
+
+		// boot failure params
+		bootRegistrationDeadline  = flag.Duration("boot-registration-deadline", 0, "How long a new InService instance has to connect an agent before it is replaced as a boot failure, e.g. 10m (needs --api-token, 0 disables)")
+		bootFailureAlertThreshold = flag.Int("boot-failure-alert-threshold", 3, "Boot failures on one launch template version within the alert window that raise an alert")
+		bootFailureAlertWindow    = flag.Duration("boot-failure-alert-window", time.Hour, "The window boot failures are counted over for alerts")
+
+		// instance status params
+		instanceStatusChecks       = flag.Bool("instance-status-checks", false, "Drain then replace instances with impaired EC2 status checks or scheduled EC2 events")
+		scheduledEventDrainTimeout = flag.Duration("scheduled-event-drain-timeout", time.Hour, "How long agents on an impaired instance, or one with a scheduled EC2 event, get to finish their jobs before it is replaced")
+
+		// forensics and quarantine params
+		forensicsS3Bucket      = flag.String("forensics-s3-bucket", "", "S3 bucket to collect logs from dangling instances to before they are replaced")
+		forensicsS3KeyPrefix   = flag.String("forensics-s3-key-prefix", "", "Key prefix for forensics collected to S3")
+		forensicsLogGroup      = flag.String("forensics-log-group", "", "CloudWatch Logs group to collect logs from dangling instances to before they are replaced")
+		quarantineMaxInstances = flag.Int("quarantine-max-instances", 0, "Detach up to this many dangling instances for inspection instead of terminating them (0 disables)")
+		quarantineExpiry       = flag.Duration("quarantine-expiry", 24*time.Hour, "How long a quarantined instance is kept before it is terminated")
+
+		// stop procedure params
+		stopDocument           = flag.String("stop-document", "", "SSM document that stops the agents on an instance being scaled in, instead of the built-in commands")
+		stopDocumentParameters = flag.String("stop-document-parameters", "", "Parameters for --stop-document as key=value pairs, e.g. \"InstanceId={{.InstanceID}}\"")
+		stopCommand            = flag.String("stop-command", "", "Command template that stops the agents on an instance being scaled in, instead of the built-in commands")
+		preStopCommands        = flag.String("pre-stop-commands", "", "Command templates to run on an instance before its agents are stopped, one per line")
+		signalConcurrency      = flag.Int("signal-concurrency", 10, "How many batches of instances to stop agents on at once")
+		signalDeadline         = flag.Duration("signal-deadline", 2*time.Minute, "Overall time allowed for stopping agents during a scale-in")
+
+		// daemon params
+		listen                = flag.String("listen", "", "Address to serve Prometheus metrics on /metrics and health checks on /healthz and /readyz, e.g. \":9090\"")
+		readyFailureThreshold = flag.Int("ready-failure-threshold", 3, "How many runs in a row must fail before /readyz does")
+		healthStallTimeout    = flag.Duration("health-stall-timeout", 5*time.Minute, "How long without a run finishing before /healthz fails (0 disables)")
+
+		// logging params
+		logFormat = flag.String("log-format", logging.FormatText, "How to write logs: \"text\" or \"json\"")
+		logLevel  = flag.String("log-level", "info", "The lowest level to log: debug, info, warn or error")
+
+		// tracing params
+		tracingEnabled  = flag.Bool("tracing", false, "Whether to export a trace of each run over OTLP/HTTP")
+		tracingEndpoint = flag.String("tracing-endpoint", "", "The OTLP/HTTP traces URL, e.g. \"http://localhost:4318/v1/traces\" (defaults to the OTEL_EXPORTER_OTLP_* environment variables)")
 
 		// general params
 		dryRun                      = flag.Bool("dry-run", false, "Whether to just show what would be done")
-		elasticCIMode               = flag.Bool("elastic-ci-mode", false, "Whether to enable Elastic CI mode with additional safety checks")
-		minimumInstanceUptime       = flag.Duration("minimum-instance-uptime", 1*time.Hour, "Minimum instance uptime before being eligible for dangling instance check")
+		shadow                      = flag.Bool("shadow", false, "Whether to read the real ASG and instances and log the changes that would be made, without making them")
+		candidateConfig             = flag.String("candidate-config", "", "Scaling flag overrides to evaluate alongside the live config without acting on them, e.g. \"scale-in-cooldown=30m,availability-threshold=0.7\"")
 		maxDanglingInstancesToCheck = flag.Int("max-dangling-instances-to-check", 5, "Maximum number of instances to check for dangling instances (only used for dangling instance scanning, not for normal scale-in)")
 	)
 	flag.Parse()
 
+	logger, err := logging.NewLogger(os.Stderr, *logFormat, *logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	slog.SetDefault(logger)
+
 	interval := 10 * time.Second
 
 	// establish an AWS session to be re-used
@@ -48,8 +127,18 @@ func main() {
 		log.Fatal("unable to load SDK config, ", err)
 	}
 
+	var (
+		daemon *daemonMetrics
+		health *health
+	)
+	if *listen != "" {
+		daemon = newDaemonMetrics()
+		health = newHealth(*readyFailureThreshold, *healthStallTimeout)
+		cfg.APIOptions = append(cfg.APIOptions, daemon.awsAPIOption)
+	}
+
 	if *ssmTokenKey != "" {
-		token, err := scaler.RetrieveFromParameterStore(cfg, *ssmTokenKey)
+		token, err := scaler.RetrieveFromParameterStore(ctx, ssm.NewFromConfig(cfg), *ssmTokenKey)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -57,49 +146,144 @@ func main() {
 	}
 
 	client := buildkite.NewClient(*buildkiteAgentToken, *buildkiteAgentEndpoint)
+	var opts []scaler.Option
+	if daemon != nil {
+		client.HTTPClient = daemon.httpClient("Buildkite Agent API", "GetAgentMetrics")
+		if *buildkiteAPIToken != "" {
+			apiClient := buildkite.NewAPIClient(*buildkiteAPIToken, *buildkiteAPIEndpoint)
+			apiClient.HTTPClient = daemon.httpClient("Buildkite REST API", "ListConnectedAgents")
+			opts = append(opts, scaler.WithAgentLister(apiClient))
+		}
+	}
 
-	scaler, err := scaler.NewScaler(client, cfg, scaler.Params{
-		BuildkiteQueue:           *buildkiteQueue,
-		AutoScalingGroupName:     *asgName,
-		AgentsPerInstance:        *agentsPerInstance,
-		PublishCloudWatchMetrics: *cwMetrics,
-		DryRun:                   *dryRun,
-		IncludeWaiting:           *includeWaiting,
-		ScaleInParams: scaler.ScaleParams{
-			Factor:         *scaleInFactor,
-			CooldownPeriod: *scaleInCooldown,
-		},
-		ScaleOutParams: scaler.ScaleParams{
-			Factor:         *scaleOutFactor,
-			CooldownPeriod: *scaleOutCooldown,
-		},
-		InstanceBuffer:                 *instanceBuffer,
-		ElasticCIMode:                  *elasticCIMode,
-		MinimumInstanceUptime:          *minimumInstanceUptime,
-		MaxDanglingInstancesToCheck:    *maxDanglingInstancesToCheck,
-		DanglingInstancesCheckInterval: interval,
-	})
+	// Spans are exported in batches as the scaler runs, and flushed before a
+	// fatal scaling error
+	flushTraces := func() {}
+	if *tracingEnabled {
+		tp, err := tracing.NewTracerProvider(ctx, *tracingEndpoint)
+		if err != nil {
+			log.Fatal(err)
+		}
+		flushTraces = func() {
+			fctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			defer cancel()
+			if err := tp.ForceFlush(fctx); err != nil {
+				logger.Warn("Failed to flush traces", "error", err)
+			}
+		}
+		opts = append(opts, scaler.WithTracerProvider(tp))
+	}
+
+	params, err := scaling.params()
+	if err != nil {
+		log.Fatal(err)
+	}
+	stopProcedure, err := scaler.ParseStopProcedure(*stopDocument, *stopDocumentParameters, *stopCommand, *preStopCommands)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	params.BuildkiteQueue = *buildkiteQueue
+	params.AutoScalingGroupName = *asgName
+	params.PublishCloudWatchMetrics = *cwMetrics
+	cwDimensions, err := scaler.ParseMetricDimensions(*cwMetricsDimensions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	params.CloudWatchMetrics = scaler.CloudWatchMetricsParams{
+		Format:         *cwMetricsFormat,
+		Namespace:      *cwMetricsNamespace,
+		Dimensions:     cwDimensions,
+		ASGDimension:   *cwMetricsASGDimension,
+		HighResolution: *cwMetricsHighResolution,
+		Extended:       *cwMetricsExtended,
+	}
+	params.Logger = logger
+	params.DryRun = *dryRun
+	params.Shadow = *shadow
+	params.MaxDanglingInstancesToCheck = *maxDanglingInstancesToCheck
+	params.DanglingInstancesCheckInterval = interval
+	params.MetricsGuard = scaler.MetricsGuardParams{
+		MaxMetricsAge:        *metricsMaxAge,
+		MaxJobSwing:          *metricsMaxJobSwing,
+		MaxRepeatedResponses: *metricsMaxRepeatedResponses,
+		DetectAgentsVanished: *metricsDetectAgentsVanished,
+		BreakerThreshold:     *metricsBreakerThreshold,
+		SafeFloor:            *metricsBreakerSafeFloor,
+	}
+	params.RuntimeConfigParameter = *runtimeConfigParameter
+	params.ExternalChangeGracePeriod = *externalChangeGracePeriod
+	params.BuildkiteAPIToken = *buildkiteAPIToken
+	params.BuildkiteAPIEndpoint = *buildkiteAPIEndpoint
+	params.DanglingAgents = scaler.DanglingAgentParams{
+		GracePeriod:    *danglingAgentGracePeriod,
+		ConfirmWithSSM: *danglingAgentConfirmWithSSM,
+	}
+	params.BootFailures = scaler.BootFailureParams{
+		RegistrationDeadline: *bootRegistrationDeadline,
+		AlertThreshold:       *bootFailureAlertThreshold,
+		AlertWindow:          *bootFailureAlertWindow,
+	}
+	params.InstanceStatus = scaler.InstanceStatusParams{
+		Enabled:      *instanceStatusChecks,
+		DrainTimeout: *scheduledEventDrainTimeout,
+	}
+	params.Forensics = scaler.ForensicsParams{
+		S3Bucket:    *forensicsS3Bucket,
+		S3KeyPrefix: *forensicsS3KeyPrefix,
+		LogGroup:    *forensicsLogGroup,
+	}
+	params.Quarantine = scaler.QuarantineParams{
+		MaxInstances: *quarantineMaxInstances,
+		Expiry:       *quarantineExpiry,
+	}
+	params.StopProcedure = stopProcedure
+	params.Signal = scaler.SignalParams{
+		Concurrency: *signalConcurrency,
+		Deadline:    *signalDeadline,
+	}
+
+	if *candidateConfig != "" {
+		candidate, err := scaler.ParseCandidateParams(params, *candidateConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		params.Candidate = &candidate
+	}
+
+	scaler, err := scaler.NewScaler(client, cfg, params, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
 
 	if *dryRun {
-		log.Printf("Running as a dry-run, no changes will be made")
+		logger.Info("Running as a dry-run, no changes will be made")
+	}
+
+	if daemon != nil {
+		serveDaemon(logger, *listen, daemon, health)
 	}
 
 	for {
 		minPollDuration, err := scaler.Run(ctx)
-		if err != nil {
+		if daemon != nil {
+			// Keep running, and let health checks report failures
+			daemon.observeRun(scaler, err)
+			health.record(err)
+			if err != nil {
+				logger.Error("Scaling error", "error", err)
+			}
+		} else if err != nil {
+			flushTraces()
 			log.Fatal(err)
 		}
 
 		if interval < minPollDuration {
 			interval = minPollDuration
-			log.Printf("Increasing poll interval to %v based on rate limit", interval)
+			logger.Info("Increasing poll interval based on rate limit", slog.Duration("interval", interval))
 		}
 
-		log.Printf("Waiting for %v", interval)
-		log.Println("")
+		logger.Debug("Waiting for the next run", slog.Duration("interval", interval))
 		time.Sleep(interval)
 	}
 }
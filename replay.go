@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/scaler/replay"
+)
+
+// replayFlags are the flags for the timeline and simulated fleet, shared by
+// the replay and tune commands.
+type replayFlags struct {
+	timelinePath *string
+	format       *string
+	verbose      *bool
+
+	// simulated fleet params
+	interval             *time.Duration
+	asgMinSize           *int64
+	asgMaxSize           *int64
+	initialDesired       *int64
+	bootDelay            *time.Duration
+	registrationDelay    *time.Duration
+	lifecycleHookTimeout *time.Duration
+	idleTimeout          *time.Duration
+	instanceHourlyCost   *float64
+}
+
+func addReplayFlags(fs *flag.FlagSet) *replayFlags {
+	return &replayFlags{
+		timelinePath: fs.String("timeline", "", "Recorded queue metrics: CSV, JSONL, or JSON from aws cloudwatch get-metric-data"),
+		format:       fs.String("format", "", "The timeline's format, csv, jsonl or cloudwatch (default from its extension)"),
+		verbose:      fs.Bool("verbose", false, "Show the scaler's logs as it replays"),
+
+		interval:             fs.Duration("interval", 10*time.Second, "How often the scaler runs"),
+		asgMinSize:           fs.Int64("asg-min-size", 0, "The ASG's MinSize"),
+		asgMaxSize:           fs.Int64("asg-max-size", 100, "The ASG's MaxSize"),
+		initialDesired:       fs.Int64("initial-desired", 0, "Instances running when the timeline starts (0 uses --asg-min-size)"),
+		bootDelay:            fs.Duration("boot-delay", 90*time.Second, "How long an instance takes from launch to InService"),
+		registrationDelay:    fs.Duration("registration-delay", 30*time.Second, "How long agents take to connect once their instance is InService"),
+		lifecycleHookTimeout: fs.Duration("lifecycle-hook-timeout", 0, "How long a termination lifecycle hook waits for agents to finish their jobs (0 for no hook)"),
+		idleTimeout:          fs.Duration("idle-timeout", 0, "How long an idle agent waits before stopping and terminating its instance (0 never stops)"),
+		instanceHourlyCost:   fs.Float64("instance-hourly-cost", 0, "The cost of an instance per hour, for the estimated cost"),
+	}
+}
+
+// usage sets the flag set's usage message, for a command that takes a
+// timeline.
+func usage(fs *flag.FlagSet, description string) {
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s --timeline FILE [flags]\n\n", os.Args[0], fs.Name())
+		fmt.Fprintln(fs.Output(), description)
+		fmt.Fprintln(fs.Output(), "")
+		fs.PrintDefaults()
+	}
+}
+
+// timeline reads the timeline, exiting with usage if there isn't one.
+func (f *replayFlags) timeline(fs *flag.FlagSet) replay.Timeline {
+	if *f.timelinePath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	format := *f.format
+	if format == "" {
+		var err error
+		if format, err = replay.FormatFromPath(*f.timelinePath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	file, err := os.Open(*f.timelinePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer file.Close()
+	timeline, err := replay.ReadTimeline(file, format)
+	if err != nil {
+		log.Fatalf("reading %s: %v", *f.timelinePath, err)
+	}
+	return timeline
+}
+
+func (f *replayFlags) config() replay.Config {
+	return replay.Config{
+		Interval:             *f.interval,
+		MinSize:              *f.asgMinSize,
+		MaxSize:              *f.asgMaxSize,
+		InitialDesired:       *f.initialDesired,
+		BootDelay:            *f.bootDelay,
+		RegistrationDelay:    *f.registrationDelay,
+		LifecycleHookTimeout: *f.lifecycleHookTimeout,
+		IdleTimeout:          *f.idleTimeout,
+		InstanceHourlyCost:   *f.instanceHourlyCost,
+	}
+}
+
+// quiet silences the scaler's logs, unless --verbose is set, until the
+// returned function is called.
+func (f *replayFlags) quiet() func() {
+	out := log.Writer()
+	if !*f.verbose {
+		log.SetOutput(io.Discard)
+	}
+	return func() { log.SetOutput(out) }
+}
+
+// runReplay runs the replay command: it replays a recorded timeline of queue
+// metrics through the scaler, configured by the usual scaling flags, against
+// a simulated fleet and reports what it would have cost.
+func runReplay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	usage(fs, "Replays recorded queue metrics through the scaler against a simulated fleet.")
+	scaling := addScalingFlags(fs)
+	flags := addReplayFlags(fs)
+	_ = fs.Parse(args)
+
+	timeline := flags.timeline(fs)
+	params, err := scaling.params()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	restore := flags.quiet()
+	report, err := replay.Run(context.Background(), timeline, params, flags.config())
+	restore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := report.Write(os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
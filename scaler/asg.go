@@ -5,7 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"regexp"
 	"slices"
 	"sort"
@@ -20,10 +20,14 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
 	"github.com/aws/smithy-go"
+	"github.com/buildkite/buildkite-agent-scaler/logging"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-// ErrWindowsGracefulScaleInNotSupported is returned when attempting graceful scale-in on Windows instances.
-// Windows instances don't support SIGTERM-based graceful shutdown; they rely on lifecycle hooks instead.
+// ErrWindowsGracefulScaleInNotSupported was returned when attempting graceful scale-in on Windows instances.
+//
+// Deprecated: Windows instances are now stopped gracefully through nssm, see
+// StopProcedure, so SendSIGTERMToAgents no longer returns it.
 var ErrWindowsGracefulScaleInNotSupported = errors.New("graceful scale-in not supported on Windows")
 
 const (
@@ -31,8 +35,16 @@ const (
 	userRequestForChangingDesiredCapacity = "a user request explicitly set group desired capacity changing the desired capacity"
 	scalingOutKey                         = "increasing the capacity"
 	shrinkingKey                          = "shrinking the capacity"
+
+	// Bounds how far back ActivityCausesSince reads, at 100 activities a page
+	maxActivityCausePages = 5
 )
 
+// checkCommandComment marks the SSM commands that only check whether the
+// agent service is running. Shadow mode sends them, as decisions depend on
+// their results.
+const checkCommandComment = "Check if buildkite-agent service is running"
+
 type AutoscaleGroupDetails struct {
 	Pending      int64
 	DesiredCount int64
@@ -40,6 +52,18 @@ type AutoscaleGroupDetails struct {
 	MaxSize      int64
 	InstanceIDs  []string // Instance IDs in the ASG
 	ActualCount  int64    // Actual number of running instances
+
+	Tags      map[string]string // ASG tags, used for runtime overrides under RuntimeTagPrefix
+	Instances []InstanceDetails // Instances in the ASG, in the same order as InstanceIDs
+}
+
+// InstanceDetails describes one instance in the ASG.
+type InstanceDetails struct {
+	ID                    string
+	LifecycleState        string
+	AvailabilityZone      string
+	LaunchTemplate        string // Launch template name (or ID), or launch configuration name
+	LaunchTemplateVersion string
 }
 
 type ASGDriver struct {
@@ -51,39 +75,27 @@ type ASGDriver struct {
 	MaxDanglingInstancesToCheck       int           // Maximum number of instances to check for dangling instances (only used for dangling instance scanning, not for normal scale-in)
 	DanglingInstancesCheckInterval    time.Duration // Interval between dangling-instance checks; used to rotate the check window. Defaults to 60s when 0.
 
+	StopProcedure StopProcedure // How agents are stopped on instances being scaled in
+	Signal        SignalParams  // Concurrency and deadline for stopping agents
+
+	Forensics  ForensicsParams  // Optional log collection from dangling instances before they are replaced
+	Quarantine QuarantineParams // Optional detaching of dangling instances for inspection
+
 	// SSM Run Command timings for checkAndMarkUnhealthy. Zero values fall back
 	// to the defaults below; set only in tests to avoid real sleeps.
 	ssmRegistrationDelay time.Duration
 	ssmPollInterval      time.Duration
 	ssmPollDeadline      time.Duration
-}
 
-// waitForSSMReady blocks until the SSM agent on instanceID reports PingStatus="Online",
-// or until timeout elapses.
-func (a *ASGDriver) waitForSSMReady(ctx context.Context, instanceID string, timeout time.Duration) error {
-	ssmSvc := ssm.NewFromConfig(a.Cfg)
-	deadline := time.Now().Add(timeout)
-
-	for time.Now().Before(deadline) {
-		resp, err := ssmSvc.DescribeInstanceInformation(ctx, &ssm.DescribeInstanceInformationInput{
-			Filters: []ssmTypes.InstanceInformationStringFilter{
-				{
-					Key:    aws.String("InstanceIds"),
-					Values: []string{instanceID},
-				},
-			},
-		})
-		if err != nil {
-			log.Printf("[SSM] DescribeInstanceInformation failed for %s: %v", instanceID, err)
-		} else if len(resp.InstanceInformationList) > 0 &&
-			resp.InstanceInformationList[0].PingStatus == ssmTypes.PingStatusOnline {
-			return nil
-		}
+	// AWS clients, see autoscalingClient, ec2Client and ssmClient
+	autoscalingSvc AutoScalingAPI
+	ec2Svc         EC2API
+	ssmSvc         SSMAPI
 
-		time.Sleep(5 * time.Second)
-	}
+	clock Clock // nil means the wall clock, see now and sleep
 
-	return fmt.Errorf("timed out waiting for SSM agent to become ready on %s", instanceID)
+	danglingFound  int // Dangling instances found since the Scaler last took the count
+	danglingMarked int // Dangling instances marked unhealthy or quarantined, likewise
 }
 
 // getASGPlatform detects whether the ASG contains Linux or Windows instances.
@@ -104,6 +116,11 @@ func (a *ASGDriver) getASGPlatform(ctx context.Context, instances []ec2Types.Ins
 func (a *ASGDriver) getCheckCommand(platform string) string {
 	if platform == "windows" {
 		return `
+if (Test-Path "C:\buildkite-agent-termination-marker") {
+    Write-Output "MARKER_EXISTS: Instance is already marked for termination"
+    exit 0
+}
+
 $AgentStatus = nssm status buildkite-agent 2>&1
 if ($AgentStatus -match "SERVICE_RUNNING") {
     Write-Output "RUNNING"
@@ -148,32 +165,60 @@ type asgHealthAPI interface {
 // SendCommand would either fail or sit Pending until it times out.
 // https://docs.aws.amazon.com/systems-manager/latest/APIReference/API_InstanceInformation.html
 func filterOnlineSSMInstances(ctx context.Context, ssmSvc ssmCheckAPI, instanceIDs []string) ([]string, error) {
-	resp, err := ssmSvc.DescribeInstanceInformation(ctx, &ssm.DescribeInstanceInformationInput{
-		Filters: []ssmTypes.InstanceInformationStringFilter{
-			{Key: aws.String("InstanceIds"), Values: instanceIDs},
-		},
-	})
+	pingStatus, err := ssmPingStatuses(ctx, ssmSvc, instanceIDs)
 	if err != nil {
 		return nil, err
 	}
-	online := make([]string, 0, len(resp.InstanceInformationList))
-	for _, info := range resp.InstanceInformationList {
-		if info.PingStatus == ssmTypes.PingStatusOnline && info.InstanceId != nil {
-			online = append(online, *info.InstanceId)
+	var online []string
+	for _, id := range instanceIDs {
+		if pingStatus[id] == string(ssmTypes.PingStatusOnline) {
+			online = append(online, id)
 		}
 	}
 	return online, nil
 }
 
+// ssmPingStatuses returns the SSM ping status of each instance SSM knows. The
+// InstanceIds filter takes at most 50 values, and a response may still be
+// split across pages.
+func ssmPingStatuses(ctx context.Context, ssmSvc ssmCheckAPI, instanceIDs []string) (map[string]string, error) {
+	pingStatus := make(map[string]string, len(instanceIDs))
+	for chunk := range slices.Chunk(instanceIDs, sendCommandMaxTargets) {
+		paginator := ssm.NewDescribeInstanceInformationPaginator(ssmSvc, &ssm.DescribeInstanceInformationInput{
+			Filters: []ssmTypes.InstanceInformationStringFilter{
+				{Key: aws.String("InstanceIds"), Values: chunk},
+			},
+			MaxResults: aws.Int32(sendCommandMaxTargets),
+		})
+		for paginator.HasMorePages() {
+			resp, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, info := range resp.InstanceInformationList {
+				pingStatus[aws.ToString(info.InstanceId)] = string(info.PingStatus)
+			}
+		}
+	}
+	return pingStatus, nil
+}
+
 // pollCommandInvocations polls ListCommandInvocations every interval until
 // every expected invocation reaches a terminal status or the deadline elapses.
 // On timeout it returns whatever invocations exist so far. Each poll lists every
 // commandID, following NextToken so fleets larger than one response page (50)
 // are fully collected.
 // https://docs.aws.amazon.com/systems-manager/latest/APIReference/API_ListCommandInvocations.html
-func pollCommandInvocations(ctx context.Context, ssmSvc ssmCheckAPI, commandIDs []string, expected int, interval, deadline time.Duration) (map[string]ssmTypes.CommandInvocation, error) {
-	end := time.Now().Add(deadline)
-	results := make(map[string]ssmTypes.CommandInvocation, expected)
+func pollCommandInvocations(ctx context.Context, clock Clock, ssmSvc ssmCheckAPI, commandIDs []string, expected int, interval, deadline time.Duration) (results map[string]ssmTypes.CommandInvocation, err error) {
+	ctx, span := startSpan(ctx, "ssm.PollCommandInvocations",
+		attribute.Int("ssm.commands", len(commandIDs)), attribute.Int("ssm.invocations.expected", expected))
+	defer func() {
+		span.SetAttributes(attribute.Int("ssm.invocations", len(results)))
+		endSpan(span, err)
+	}()
+
+	end := clock.Now().Add(deadline)
+	results = make(map[string]ssmTypes.CommandInvocation, expected)
 	for {
 		allTerminal := true
 		for _, commandID := range commandIDs {
@@ -211,13 +256,11 @@ func pollCommandInvocations(ctx context.Context, ssmSvc ssmCheckAPI, commandIDs
 		if len(results) >= expected && allTerminal {
 			return results, nil
 		}
-		if !time.Now().Before(end) {
+		if !clock.Now().Before(end) {
 			return results, nil
 		}
-		select {
-		case <-ctx.Done():
-			return results, ctx.Err()
-		case <-time.After(interval):
+		if err := clock.Sleep(ctx, interval); err != nil {
+			return results, err
 		}
 	}
 }
@@ -259,13 +302,14 @@ func (a *ASGDriver) checkAndMarkUnhealthy(
 	if len(instances) == 0 {
 		return 0, 0, nil
 	}
+	logger := logging.FromContext(ctx)
 
 	onlineIDs, err := filterOnlineSSMInstances(ctx, ssmSvc, instances)
 	if err != nil {
 		return 0, 0, fmt.Errorf("DescribeInstanceInformation failed: %w", err)
 	}
 	if offline := len(instances) - len(onlineIDs); offline > 0 {
-		log.Printf("[Elastic CI Mode] SSM agent not online for %d of %d instance(s); skipping those", offline, len(instances))
+		logger.Info("[Elastic CI Mode] SSM agent not online for some instances; skipping those", "offline", offline, "instances", len(instances))
 	}
 	if len(onlineIDs) == 0 {
 		return 0, 0, nil
@@ -278,14 +322,13 @@ func (a *ASGDriver) checkAndMarkUnhealthy(
 	// SendCommand accepts at most 50 instance IDs per call, so fan out one
 	// command per batch and poll them together.
 	// https://docs.aws.amazon.com/systems-manager/latest/APIReference/API_SendCommand.html
-	const sendCommandMaxTargets = 50
 	var commandIDs []string
 	for batch := range slices.Chunk(onlineIDs, sendCommandMaxTargets) {
 		sendOut, err := ssmSvc.SendCommand(ctx, &ssm.SendCommandInput{
 			InstanceIds:  batch,
 			DocumentName: aws.String(documentName),
 			Parameters:   map[string][]string{"commands": {a.getCheckCommand(platform)}},
-			Comment:      aws.String("Check if buildkite-agent service is running"),
+			Comment:      aws.String(checkCommandComment),
 		})
 		if err != nil {
 			return 0, 0, fmt.Errorf("SendCommand failed: %w", err)
@@ -300,22 +343,22 @@ func (a *ASGDriver) checkAndMarkUnhealthy(
 	registrationDelay := cmp.Or(a.ssmRegistrationDelay, 3*time.Second)
 	pollInterval := cmp.Or(a.ssmPollInterval, 3*time.Second)
 	pollDeadline := cmp.Or(a.ssmPollDeadline, 60*time.Second)
-	time.Sleep(registrationDelay)
-	results, pollErr := pollCommandInvocations(ctx, ssmSvc, commandIDs, len(onlineIDs), pollInterval, pollDeadline)
+	a.sleep(ctx, registrationDelay)
+	results, pollErr := pollCommandInvocations(ctx, orWallClock(a.clock), ssmSvc, commandIDs, len(onlineIDs), pollInterval, pollDeadline)
 	if pollErr != nil {
-		log.Printf("[Elastic CI Mode] ListCommandInvocations failed for commands %v: %v", commandIDs, pollErr)
+		logger.Warn("[Elastic CI Mode] ListCommandInvocations failed", "commands", commandIDs, "error", pollErr)
 		firstError = fmt.Errorf("ListCommandInvocations failed: %w", pollErr)
 	}
 
 	// Healthy and already-marked instances are the common, non-actionable
 	// cases; collect them and log one summary line each instead of one line
 	// per instance.
-	var healthy, alreadyMarked []string
+	var healthy, alreadyMarked, dangling []string
 
 	for _, instanceID := range onlineIDs {
 		inv, ok := results[instanceID]
 		if !ok {
-			log.Printf("[Elastic CI Mode] No invocation result for %s within deadline; skipping", instanceID)
+			logger.Warn("[Elastic CI Mode] No invocation result within deadline; skipping", "instance", instanceID)
 			if firstError == nil {
 				firstError = fmt.Errorf("no invocation result for %s", instanceID)
 			}
@@ -326,7 +369,7 @@ func (a *ASGDriver) checkAndMarkUnhealthy(
 			ssmTypes.CommandInvocationStatusInProgress,
 			ssmTypes.CommandInvocationStatusDelayed,
 			ssmTypes.CommandInvocationStatusCancelling:
-			log.Printf("[Elastic CI Mode] Invocation for %s did not terminate (status: %s); skipping", instanceID, inv.Status)
+			logger.Warn("[Elastic CI Mode] Invocation did not terminate; skipping", "instance", instanceID, "status", inv.Status)
 			if firstError == nil {
 				firstError = fmt.Errorf("invocation for %s did not terminate (status: %s)", instanceID, inv.Status)
 			}
@@ -353,35 +396,57 @@ func (a *ASGDriver) checkAndMarkUnhealthy(
 			continue
 		}
 
-		log.Printf("[Elastic CI Mode] 🧟 Found dangling instance %s; output: %s", instanceID, output)
+		logger.Info("[Elastic CI Mode] 🧟 Found dangling instance", "instance", instanceID, "output", output)
+		dangling = append(dangling, instanceID)
+	}
+	a.danglingFound += len(dangling)
+
+	if len(dangling) > 0 && a.Forensics.enabled() {
+		if err := a.captureForensics(ctx, ssmSvc, dangling, platform); err != nil {
+			// Losing the evidence is better than keeping a broken instance
+			logger.Warn("[Elastic CI Mode] ⚠️  Failed to collect forensics", "error", err)
+		}
+	}
+
+	if len(dangling) > 0 && a.Quarantine.MaxInstances > 0 {
+		quarantined, err := a.quarantine(ctx, a.ec2Client(), a.autoscalingClient(), dangling, "dangling: buildkite-agent not running", a.now())
+		if err != nil {
+			logger.Warn("[Elastic CI Mode] ⚠️  Failed to quarantine instances", "error", err)
+		}
+		markedUnhealthyCount += len(quarantined)
+		dangling = slices.DeleteFunc(slices.Clone(dangling), func(id string) bool { return slices.Contains(quarantined, id) })
+	}
+
+	for _, instanceID := range dangling {
 		if _, err := asgSvc.SetInstanceHealth(ctx, &autoscaling.SetInstanceHealthInput{
 			InstanceId:   aws.String(instanceID),
 			HealthStatus: aws.String("Unhealthy"),
 		}); err != nil {
-			log.Printf("[Elastic CI Mode] Failed to mark instance %s as unhealthy: %v", instanceID, err)
+			logger.Warn("[Elastic CI Mode] Failed to mark instance as unhealthy", "instance", instanceID, "error", err)
 			if firstError == nil {
 				firstError = fmt.Errorf("SetInstanceHealth failed for %s: %w", instanceID, err)
 			}
 		} else {
-			log.Printf("[Elastic CI Mode] Marked instance %s as unhealthy", instanceID)
+			logger.Info("[Elastic CI Mode] Marked instance as unhealthy", "instance", instanceID)
 			markedUnhealthyCount++
 		}
 	}
 
 	if len(healthy) > 0 {
-		log.Printf("[Elastic CI Mode] %d instance(s) healthy: %v", len(healthy), healthy)
+		logger.Debug("[Elastic CI Mode] Instances healthy", "count", len(healthy), "instances", healthy)
 	}
 	if len(alreadyMarked) > 0 {
-		log.Printf("[Elastic CI Mode] ℹ️ %d instance(s) already marked for termination, skipping: %v", len(alreadyMarked), alreadyMarked)
+		logger.Debug("[Elastic CI Mode] ℹ️ Instances already marked for termination, skipping", "count", len(alreadyMarked), "instances", alreadyMarked)
 	}
 
+	a.danglingMarked += markedUnhealthyCount
 	return markedUnhealthyCount, checkedCount, firstError
 }
 
 func (a *ASGDriver) Describe(ctx context.Context) (AutoscaleGroupDetails, error) {
-	log.Printf("Collecting AutoScaling details for ASG %q", a.Name)
+	logging.FromContext(ctx).Debug("Collecting AutoScaling details")
 
-	svc := autoscaling.NewFromConfig(a.Cfg)
+	svc := a.autoscalingClient()
 	input := &autoscaling.DescribeAutoScalingGroupsInput{
 		AutoScalingGroupNames: []string{
 			a.Name,
@@ -413,13 +478,35 @@ func (a *ASGDriver) Describe(ctx context.Context) (AutoscaleGroupDetails, error)
 	}
 
 	instanceIDs := make([]string, 0, len(asg.Instances))
+	instances := make([]InstanceDetails, 0, len(asg.Instances))
 	for _, instance := range asg.Instances {
 		if instance.InstanceId != nil {
 			instanceIDs = append(instanceIDs, *instance.InstanceId)
+			details := InstanceDetails{
+				ID:               *instance.InstanceId,
+				LifecycleState:   string(instance.LifecycleState),
+				AvailabilityZone: aws.ToString(instance.AvailabilityZone),
+			}
+			if lt := instance.LaunchTemplate; lt != nil {
+				details.LaunchTemplate = cmp.Or(aws.ToString(lt.LaunchTemplateName), aws.ToString(lt.LaunchTemplateId))
+				details.LaunchTemplateVersion = aws.ToString(lt.Version)
+			} else {
+				details.LaunchTemplate = aws.ToString(instance.LaunchConfigurationName)
+			}
+			instances = append(instances, details)
+		}
+	}
+
+	tags := make(map[string]string, len(asg.Tags))
+	for _, tag := range asg.Tags {
+		if tag.Key != nil && tag.Value != nil {
+			tags[*tag.Key] = *tag.Value
 		}
 	}
 
 	details := AutoscaleGroupDetails{
+		Tags:         tags,
+		Instances:    instances,
 		Pending:      pending,
 		DesiredCount: int64(*result.AutoScalingGroups[0].DesiredCapacity),
 		MinSize:      int64(*result.AutoScalingGroups[0].MinSize),
@@ -428,14 +515,15 @@ func (a *ASGDriver) Describe(ctx context.Context) (AutoscaleGroupDetails, error)
 		ActualCount:  running,
 	}
 
-	log.Printf("↳ Got pending=%d, desired=%d, actual=%d, min=%d, max=%d (took %v)",
-		details.Pending, details.DesiredCount, details.ActualCount, details.MinSize, details.MaxSize, queryDuration)
+	logging.FromContext(ctx).Info("↳ Got AutoScaling details",
+		"pending", details.Pending, "desired", details.DesiredCount, "actual", details.ActualCount,
+		"min", details.MinSize, "max", details.MaxSize, slog.Duration("took", queryDuration))
 
 	return details, nil
 }
 
 func (a *ASGDriver) SetDesiredCapacity(ctx context.Context, count int64) error {
-	svc := autoscaling.NewFromConfig(a.Cfg)
+	svc := a.autoscalingClient()
 	input := &autoscaling.SetDesiredCapacityInput{
 		AutoScalingGroupName: aws.String(a.Name),
 		DesiredCapacity:      aws.Int32(int32(count)),
@@ -451,7 +539,7 @@ func (a *ASGDriver) SetDesiredCapacity(ctx context.Context, count int64) error {
 }
 
 func (a *ASGDriver) GetAutoscalingActivities(ctx context.Context, nextToken *string) (*autoscaling.DescribeScalingActivitiesOutput, error) {
-	svc := autoscaling.NewFromConfig(a.Cfg)
+	svc := a.autoscalingClient()
 	input := &autoscaling.DescribeScalingActivitiesInput{
 		AutoScalingGroupName: aws.String(a.Name),
 		NextToken:            nextToken,
@@ -459,6 +547,39 @@ func (a *ASGDriver) GetAutoscalingActivities(ctx context.Context, nextToken *str
 	return svc.DescribeScalingActivities(ctx, input)
 }
 
+// ActivityCausesSince returns the causes of the scaling activities that
+// started after since, newest first, reading at most maxActivityCausePages
+// pages of activities.
+func (a *ASGDriver) ActivityCausesSince(ctx context.Context, since time.Time) ([]string, error) {
+	var causes []string
+	var nextToken *string
+	for range maxActivityCausePages {
+		output, err := a.GetAutoscalingActivities(ctx, nextToken)
+		if err != nil {
+			return causes, err
+		}
+		for _, activity := range output.Activities {
+			// Activities are listed newest first
+			if activity.StartTime == nil || !activity.StartTime.After(since) {
+				return causes, nil
+			}
+			if activity.Cause != nil {
+				causes = append(causes, *activity.Cause)
+			}
+		}
+		if output.NextToken == nil {
+			break
+		}
+		nextToken = output.NextToken
+	}
+	return causes, nil
+}
+
+// GetLastScalingInAndOutActivity finds the most recent scale-out and scale-in
+// from the ASG's activities. The scaler's own SetDesiredCapacity calls can't be
+// told apart from anyone else's here, so a manual change counts as a scaling
+// event for cooldowns. Prefer GetLastScalingInAndOutEvents, which only falls
+// back to this when the scaler has no record of its own.
 func (a *ASGDriver) GetLastScalingInAndOutActivity(ctx context.Context, findScaleOut, findScaleIn bool) (*types.Activity, *types.Activity, error) {
 	const scalingOutKey = "increasing the capacity"
 	const shrinkingKey = "shrinking the capacity"
@@ -510,51 +631,13 @@ func (a *ASGDriver) GetLastScalingInAndOutActivity(ctx context.Context, findScal
 type dryRunASG struct {
 }
 
+// SendSIGTERMToAgents asks the agents on one instance to finish their current
+// job and stop. See SignalAgents for stopping several at once.
 func (a *ASGDriver) SendSIGTERMToAgents(ctx context.Context, instanceID string) error {
-	ec2Client := ec2.NewFromConfig(a.Cfg)
-	ssmClient := ssm.NewFromConfig(a.Cfg)
-
-	// Detect platform - graceful SIGTERM is only supported on Linux
-	descResp, err := ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
-		InstanceIds: []string{instanceID},
-	})
-	if err == nil && len(descResp.Reservations) > 0 && len(descResp.Reservations[0].Instances) > 0 {
-		instance := descResp.Reservations[0].Instances[0]
-		if strings.EqualFold(string(instance.Platform), "windows") {
-			return ErrWindowsGracefulScaleInNotSupported
-		}
-	}
-
-	// Wait for SSM agent to be ready before sending command
-	if err := a.waitForSSMReady(ctx, instanceID, 30*time.Second); err != nil {
-		log.Printf("SSM agent not ready on instance %s, cannot send SIGTERM: %v", instanceID, err)
-		return err
+	outcome := a.SignalAgents(ctx, nil, []string{instanceID})[0]
+	if outcome.Outcome != SignalSent {
+		return fmt.Errorf("signalling agents on %s: %s %s", instanceID, outcome.Outcome, outcome.Error)
 	}
-
-	// With consecutive Lambda invocations the same instance selected for scale-in,
-	// only during the first invocation will actually signal the agent to finish current jobs and stop.
-	command := `#!/bin/bash
-if [ -f /tmp/buildkite-agent-termination-marker ]; then
-  echo "Already marked for termination, skipping"
-  exit 0
-fi
-echo "Termination requested at $(date)" > /tmp/buildkite-agent-termination-marker
-sudo systemctl stop buildkite-agent.service || sudo /opt/buildkite-agent/bin/buildkite-agent stop --signal SIGTERM
-`
-	log.Printf("[Elastic CI Mode] Sending SIGTERM to instance %s", instanceID)
-
-	_, err = ssmClient.SendCommand(ctx, &ssm.SendCommandInput{
-		InstanceIds:  []string{instanceID},
-		DocumentName: aws.String("AWS-RunShellScript"),
-		Parameters:   map[string][]string{"commands": {command}},
-		Comment:      aws.String("Gracefully stop Buildkite agent"),
-	})
-
-	if err != nil {
-		log.Printf("[Elastic CI Mode] Error sending SIGTERM to instance %s: %v", instanceID, err)
-		return err
-	}
-	log.Printf("[Elastic CI Mode] Successfully sent SIGTERM command to instance %s", instanceID)
 	return nil
 }
 
@@ -566,49 +649,45 @@ sudo systemctl stop buildkite-agent.service || sudo /opt/buildkite-agent/bin/bui
 // - This function: agent service is stopped, no jobs can be running -> safe to mark as unhealthy
 //
 // Marking instances unhealthy (via autoscaling:SetInstanceHealth) causes the ASG to terminate
-// and replace them according to its configured policies.
-func (a *ASGDriver) CleanupDanglingInstances(ctx context.Context, minimumInstanceUptime time.Duration, maxDanglingInstancesToCheck int) error {
-	ec2Client := ec2.NewFromConfig(a.Cfg)
-	ssmClient := ssm.NewFromConfig(a.Cfg)
-	asgClient := autoscaling.NewFromConfig(a.Cfg)
-
-	asgDetails, err := a.Describe(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to describe ASG %s: %w", a.Name, err)
-	}
-
-	if len(asgDetails.InstanceIDs) == 0 {
+// and replace them according to its configured policies. The candidates come from inv, the
+// run's instance inventory.
+func (a *ASGDriver) CleanupDanglingInstances(ctx context.Context, inv *InstanceInventory, minimumInstanceUptime time.Duration, maxDanglingInstancesToCheck int) (err error) {
+	ctx, span := startSpan(ctx, "scaler.CleanupDanglingInstances", attrASG.String(a.Name), attribute.Int("scaler.instances", len(inv.Instances)))
+	found, marked := a.danglingFound, a.danglingMarked
+	defer func() {
+		span.SetAttributes(
+			attribute.Int("scaler.dangling.found", a.danglingFound-found),
+			attribute.Int("scaler.dangling.marked", a.danglingMarked-marked),
+		)
+		endSpan(span, err)
+	}()
+
+	if len(inv.Instances) == 0 {
 		return nil
 	}
+	logger := logging.FromContext(ctx)
 
-	descInstancesOutput, err := describeInstancesTolerant(ctx, ec2Client, asgDetails.InstanceIDs, a.Name)
-	if err != nil {
-		return fmt.Errorf("failed to describe instances in ASG %s: %w", a.Name, err)
-	}
-
-	var instancesToConsiderChecking []ec2Types.Instance
-	now := time.Now()
-	for _, reservation := range descInstancesOutput.Reservations {
-		for _, instance := range reservation.Instances {
-			if instance.LaunchTime != nil && now.Sub(*instance.LaunchTime) >= minimumInstanceUptime {
-				if instance.State != nil && instance.State.Name == ec2Types.InstanceStateNameRunning {
-					instancesToConsiderChecking = append(instancesToConsiderChecking, instance)
-				}
+	var instancesToConsiderChecking []InventoryInstance
+	now := a.now()
+	for _, instance := range inv.Instances {
+		if !instance.LaunchTime.IsZero() && now.Sub(instance.LaunchTime) >= minimumInstanceUptime {
+			if instance.State == string(ec2Types.InstanceStateNameRunning) {
+				instancesToConsiderChecking = append(instancesToConsiderChecking, instance)
 			}
 		}
 	}
 
 	if len(instancesToConsiderChecking) == 0 {
-		log.Printf("[Elastic CI Mode] None of the %d instance(s) met the dangling check criteria (uptime >= %v and state = running) — skipping", len(asgDetails.InstanceIDs), minimumInstanceUptime)
+		logger.Info("[Elastic CI Mode] No instances met the dangling check criteria (uptime >= minimum and state = running) — skipping", "instances", len(inv.Instances), slog.Duration("minimum_uptime", minimumInstanceUptime))
 		return nil
 	}
 
-	// Detect platform from instances (each ASG is single-platform)
-	platform := a.getASGPlatform(ctx, instancesToConsiderChecking)
+	// Each ASG is single-platform
+	platform := inv.Platform()
 
 	// Sort instances by launch time (oldest first) to prioritize checking older ones
 	sort.SliceStable(instancesToConsiderChecking, func(i, j int) bool {
-		return instancesToConsiderChecking[i].LaunchTime.Before(*instancesToConsiderChecking[j].LaunchTime)
+		return instancesToConsiderChecking[i].LaunchTime.Before(instancesToConsiderChecking[j].LaunchTime)
 	})
 
 	totalMarkedUnhealthy := 0
@@ -616,18 +695,19 @@ func (a *ASGDriver) CleanupDanglingInstances(ctx context.Context, minimumInstanc
 
 	// Pick a sliding slice so oldest-N instances stuck failing SSM checks
 	// don't block the rest of the fleet from ever being examined.
-	instancesToCheck := rotateInstanceWindow(instancesToConsiderChecking, maxDanglingInstancesToCheck, a.DanglingInstancesCheckInterval, time.Now())
+	instancesToCheck := rotateInstanceWindow(instancesToConsiderChecking, maxDanglingInstancesToCheck, a.DanglingInstancesCheckInterval, a.now())
 
 	instancesForSSMCheck := make([]string, 0, len(instancesToCheck))
 	for _, instance := range instancesToCheck {
-		instancesForSSMCheck = append(instancesForSSMCheck, *instance.InstanceId)
+		instancesForSSMCheck = append(instancesForSSMCheck, instance.ID)
 	}
 
 	totalChecked := 0
 
 	if len(instancesForSSMCheck) > 0 {
-		log.Printf("[Elastic CI Mode] Checking %d %s instance(s) for dangling agents: %v", len(instancesForSSMCheck), platform, instancesForSSMCheck)
-		markedInCall, checkedInCall, errInCall := a.checkAndMarkUnhealthy(ctx, instancesForSSMCheck, ssmClient, asgClient, platform)
+		logger.Info("[Elastic CI Mode] Checking instances for dangling agents", "count", len(instancesForSSMCheck), "platform", platform)
+		logger.Debug("[Elastic CI Mode] Instances to check", "instances", instancesForSSMCheck)
+		markedInCall, checkedInCall, errInCall := a.checkAndMarkUnhealthy(ctx, instancesForSSMCheck, a.ssmClient(), a.autoscalingClient(), platform)
 		totalMarkedUnhealthy += markedInCall
 		totalChecked += checkedInCall
 		if errInCall != nil {
@@ -637,11 +717,11 @@ func (a *ASGDriver) CleanupDanglingInstances(ctx context.Context, minimumInstanc
 
 	skipped := len(instancesForSSMCheck) - totalChecked
 	if totalMarkedUnhealthy > 0 {
-		log.Printf("[Elastic CI Mode] Dangling instance check: marked %d of %d checked instance(s) as unhealthy (%d skipped due to errors)", totalMarkedUnhealthy, totalChecked, skipped)
+		logger.Info("[Elastic CI Mode] Dangling instance check marked instances as unhealthy", "marked", totalMarkedUnhealthy, "checked", totalChecked, "skipped", skipped)
 	} else if skipped > 0 {
-		log.Printf("[Elastic CI Mode] Dangling instance check complete: %d of %d instance(s) checked and healthy, %d skipped due to errors", totalChecked, len(instancesForSSMCheck), skipped)
+		logger.Info("[Elastic CI Mode] Dangling instance check complete, some skipped due to errors", "healthy", totalChecked, "instances", len(instancesForSSMCheck), "skipped", skipped)
 	} else {
-		log.Printf("[Elastic CI Mode] Dangling instance check complete: all %d instance(s) healthy", totalChecked)
+		logger.Info("[Elastic CI Mode] Dangling instance check complete: all instances healthy", "healthy", totalChecked)
 	}
 
 	return firstErrorEncountered
@@ -681,10 +761,10 @@ func describeInstancesTolerant(ctx context.Context, client describeInstancesAPI,
 		_, ok := staleSet[id]
 		return ok
 	})
-	log.Printf("[Elastic CI Mode] Skipping %d stale instance ID(s) in ASG %s (no longer present in EC2): %v", len(stale), asgName, stale)
+	logging.FromContext(ctx).Info("[Elastic CI Mode] Skipping stale instance IDs (no longer present in EC2)", "asg", asgName, "instances", stale)
 
 	if len(remaining) == 0 {
-		log.Printf("[Elastic CI Mode] All %d instance ID(s) in ASG %s are stale; nothing to check", len(instanceIDs), asgName)
+		logging.FromContext(ctx).Info("[Elastic CI Mode] All instance IDs are stale; nothing to check", "asg", asgName, "count", len(instanceIDs))
 		return &ec2.DescribeInstancesOutput{}, nil
 	}
 
@@ -695,7 +775,7 @@ func describeInstancesTolerant(ctx context.Context, client describeInstancesAPI,
 // time-seeded offset that advances by windowSize every checkInterval.
 // Returns sorted unchanged when it's already <= windowSize. checkInterval
 // defaults to 60s when <= 0.
-func rotateInstanceWindow(sorted []ec2Types.Instance, windowSize int, checkInterval time.Duration, now time.Time) []ec2Types.Instance {
+func rotateInstanceWindow[T any](sorted []T, windowSize int, checkInterval time.Duration, now time.Time) []T {
 	total := len(sorted)
 	if windowSize <= 0 || total <= windowSize {
 		return sorted
@@ -706,7 +786,7 @@ func rotateInstanceWindow(sorted []ec2Types.Instance, windowSize int, checkInter
 
 	offset := int(now.UnixNano() / int64(checkInterval) * int64(windowSize) % int64(total))
 
-	window := make([]ec2Types.Instance, windowSize)
+	window := make([]T, windowSize)
 	for i := range window {
 		window[i] = sorted[(offset+i)%total]
 	}
@@ -732,12 +812,16 @@ func (a *dryRunASG) SetDesiredCapacity(ctx context.Context, count int64) error {
 	return nil
 }
 
-func (a *dryRunASG) SendSIGTERMToAgents(ctx context.Context, instanceID string) error {
-	log.Printf("[DryRun] Would send SIGTERM to instance %s", instanceID)
-	return nil
+func (a *dryRunASG) SignalAgents(ctx context.Context, inv *InstanceInventory, instanceIDs []string) []SignalOutcome {
+	var outcomes []SignalOutcome
+	for _, id := range instanceIDs {
+		logging.FromContext(ctx).Info("[DryRun] Would send SIGTERM to instance", "instance", id)
+		outcomes = append(outcomes, SignalOutcome{InstanceID: id, Outcome: SignalSent})
+	}
+	return outcomes
 }
 
-func (a *dryRunASG) CleanupDanglingInstances(ctx context.Context, minimumInstanceUptime time.Duration, maxDanglingInstancesToCheck int) error {
-	log.Printf("[DryRun] Would cleanup dangling instances (min uptime: %s, max check: %d)", minimumInstanceUptime, maxDanglingInstancesToCheck)
+func (a *dryRunASG) CleanupDanglingInstances(ctx context.Context, inv *InstanceInventory, minimumInstanceUptime time.Duration, maxDanglingInstancesToCheck int) error {
+	logging.FromContext(ctx).Info("[DryRun] Would cleanup dangling instances", slog.Duration("minimum_uptime", minimumInstanceUptime), "max_check", maxDanglingInstancesToCheck)
 	return nil
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -286,6 +287,7 @@ func TestGetCheckCommand(t *testing.T) {
 				"SERVICE_RUNNING",
 				"RUNNING",
 				"NOT_RUNNING",
+				"MARKER_EXISTS",
 			},
 			expectedNotContains: []string{
 				"#!/bin/bash",
@@ -399,10 +401,12 @@ func makeInstancesForRotation(n int) []ec2Types.Instance {
 // the last one if exhausted (so deadline-driven tests don't have to enumerate
 // every poll).
 type stubSSMClient struct {
-	describeOut   *ssm.DescribeInstanceInformationOutput
-	describeErr   error
-	listResponses []stubListResponse
-	listCalls     int
+	describeOut      *ssm.DescribeInstanceInformationOutput
+	describeErr      error
+	describePageSize int // If set, DescribeInstanceInformation pages its results
+	describeCalls    int
+	listResponses    []stubListResponse
+	listCalls        int
 
 	sendErr     error
 	sendBatches [][]string // InstanceIds passed to each SendCommand call
@@ -414,7 +418,28 @@ type stubListResponse struct {
 }
 
 func (s *stubSSMClient) DescribeInstanceInformation(ctx context.Context, params *ssm.DescribeInstanceInformationInput, _ ...func(*ssm.Options)) (*ssm.DescribeInstanceInformationOutput, error) {
-	return s.describeOut, s.describeErr
+	if s.describeErr != nil {
+		return nil, s.describeErr
+	}
+	s.describeCalls++
+	// Apply the InstanceIds filter, like the real API
+	out := &ssm.DescribeInstanceInformationOutput{}
+	for _, info := range s.describeOut.InstanceInformationList {
+		for _, f := range params.Filters {
+			if aws.ToString(f.Key) == "InstanceIds" && slices.Contains(f.Values, aws.ToString(info.InstanceId)) {
+				out.InstanceInformationList = append(out.InstanceInformationList, info)
+			}
+		}
+	}
+	if s.describePageSize > 0 {
+		start, _ := strconv.Atoi(aws.ToString(params.NextToken))
+		end := min(start+s.describePageSize, len(out.InstanceInformationList))
+		if end < len(out.InstanceInformationList) {
+			out.NextToken = aws.String(strconv.Itoa(end))
+		}
+		out.InstanceInformationList = out.InstanceInformationList[start:end]
+	}
+	return out, nil
 }
 
 func (s *stubSSMClient) SendCommand(ctx context.Context, params *ssm.SendCommandInput, _ ...func(*ssm.Options)) (*ssm.SendCommandOutput, error) {
@@ -474,6 +499,23 @@ func TestFilterOnlineSSMInstances(t *testing.T) {
 	}
 }
 
+func TestFilterOnlineSSMInstancesFollowsPages(t *testing.T) {
+	ids := []string{"i-a", "i-b", "i-c", "i-d", "i-e"}
+	stub := onlineSSMStub(ids...)
+	stub.describePageSize = 2
+
+	got, err := filterOnlineSSMInstances(context.Background(), stub, ids)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !slices.Equal(got, ids) {
+		t.Errorf("got %v, want %v", got, ids)
+	}
+	if stub.describeCalls != 3 {
+		t.Errorf("DescribeInstanceInformation called %d times, want 3", stub.describeCalls)
+	}
+}
+
 func TestPollCommandInvocations(t *testing.T) {
 	ctx := context.Background()
 	inv := func(id string, status ssmTypes.CommandInvocationStatus) ssmTypes.CommandInvocation {
@@ -490,7 +532,7 @@ func TestPollCommandInvocations(t *testing.T) {
 				inv("i-b", ssmTypes.CommandInvocationStatusSuccess),
 			}}},
 		}}
-		results, err := pollCommandInvocations(ctx, stub, []string{"cmd-1"}, 2, time.Millisecond, time.Second)
+		results, err := pollCommandInvocations(ctx, wallClock{}, stub, []string{"cmd-1"}, 2, time.Millisecond, time.Second)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -513,7 +555,7 @@ func TestPollCommandInvocations(t *testing.T) {
 				CommandInvocations: []ssmTypes.CommandInvocation{inv("i-b", ssmTypes.CommandInvocationStatusSuccess)},
 			}},
 		}}
-		results, err := pollCommandInvocations(ctx, stub, []string{"cmd-1"}, 2, time.Millisecond, time.Second)
+		results, err := pollCommandInvocations(ctx, wallClock{}, stub, []string{"cmd-1"}, 2, time.Millisecond, time.Second)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -533,7 +575,7 @@ func TestPollCommandInvocations(t *testing.T) {
 			}}},
 		}}
 		// expected=2 with only InProgress for i-a; never terminal, deadline elapses.
-		results, err := pollCommandInvocations(ctx, stub, []string{"cmd-1"}, 2, time.Millisecond, 5*time.Millisecond)
+		results, err := pollCommandInvocations(ctx, wallClock{}, stub, []string{"cmd-1"}, 2, time.Millisecond, 5*time.Millisecond)
 		if err != nil {
 			t.Fatalf("unexpected error: %v", err)
 		}
@@ -544,7 +586,7 @@ func TestPollCommandInvocations(t *testing.T) {
 
 	t.Run("API error propagates", func(t *testing.T) {
 		stub := &stubSSMClient{listResponses: []stubListResponse{{err: errors.New("throttled")}}}
-		_, err := pollCommandInvocations(ctx, stub, []string{"cmd-1"}, 1, time.Millisecond, time.Second)
+		_, err := pollCommandInvocations(ctx, wallClock{}, stub, []string{"cmd-1"}, 1, time.Millisecond, time.Second)
 		if err == nil || !strings.Contains(err.Error(), "throttled") {
 			t.Errorf("expected throttled error, got %v", err)
 		}
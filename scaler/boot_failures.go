@@ -0,0 +1,170 @@
+package scaler
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+	"github.com/buildkite/buildkite-agent-scaler/logging"
+)
+
+const (
+	defaultBootFailureAlertThreshold = 3
+	defaultBootFailureAlertWindow    = time.Hour
+)
+
+// BootFailureParams configures detection of instances that never register an
+// agent after boot, e.g. because of a broken AMI or user data. It needs a
+// Buildkite API token, see Params.BuildkiteAPIToken.
+type BootFailureParams struct {
+	RegistrationDeadline time.Duration // How long an InService instance has to connect its first agent (0 disables)
+	AlertThreshold       int           // Boot failures on one launch template version within AlertWindow that raise an alert (default 3)
+	AlertWindow          time.Duration // Defaults to 1h
+}
+
+// BootFailure is an instance that never connected an agent.
+type BootFailure struct {
+	Time                  time.Time
+	InstanceID            string
+	LaunchTemplate        string
+	LaunchTemplateVersion string
+	AvailabilityZone      string
+}
+
+// BootFailureState is the boot failure detector's state, carried between runs.
+type BootFailureState struct {
+	// When the detector started watching for agents. Instances launched
+	// before then may have had an agent the detector never saw, so they are
+	// left to the dangling agent check.
+	Since      time.Time
+	Registered []string      // InService instances that have had a connected agent
+	Failures   []BootFailure // Boot failures within the alert window
+}
+
+type bootFailureDetector struct {
+	params BootFailureParams
+	state  BootFailureState
+}
+
+type launchTemplateVersion struct {
+	name, version string
+}
+
+// observe records which instances have connected agents and returns the
+// instances newly found to have missed the registration deadline, oldest
+// first.
+func (d *bootFailureDetector) observe(asg AutoscaleGroupDetails, agents []buildkite.Agent, launchTimes map[string]time.Time, now time.Time) []BootFailure {
+	if d.state.Since.IsZero() {
+		d.state.Since = now
+	}
+
+	connected := make(map[string]bool, len(agents))
+	for _, agent := range agents {
+		if id := agent.MetaDataValue(buildkite.InstanceIDMetaDataKey); id != "" {
+			connected[id] = true
+		}
+	}
+
+	// Forget instances that have left the ASG
+	var registered []string
+	for _, instance := range asg.Instances {
+		if connected[instance.ID] || slices.Contains(d.state.Registered, instance.ID) {
+			registered = append(registered, instance.ID)
+		}
+	}
+	d.state.Registered = registered
+
+	d.state.Failures = slices.DeleteFunc(d.state.Failures, func(f BootFailure) bool {
+		return now.Sub(f.Time) > d.alertWindow()
+	})
+
+	var failures []BootFailure
+	for _, instance := range asg.Instances {
+		if instance.LifecycleState != string(types.LifecycleStateInService) || slices.Contains(registered, instance.ID) {
+			continue
+		}
+		launched, ok := launchTimes[instance.ID]
+		if !ok || launched.Before(d.state.Since) || now.Sub(launched) < d.params.RegistrationDeadline {
+			continue
+		}
+		if slices.ContainsFunc(d.state.Failures, func(f BootFailure) bool { return f.InstanceID == instance.ID }) {
+			continue
+		}
+		failures = append(failures, BootFailure{
+			Time:                  now,
+			InstanceID:            instance.ID,
+			LaunchTemplate:        instance.LaunchTemplate,
+			LaunchTemplateVersion: instance.LaunchTemplateVersion,
+			AvailabilityZone:      instance.AvailabilityZone,
+		})
+	}
+
+	slices.SortStableFunc(failures, func(a, b BootFailure) int {
+		return launchTimes[a.InstanceID].Compare(launchTimes[b.InstanceID])
+	})
+	d.state.Failures = append(d.state.Failures, failures...)
+	return failures
+}
+
+// alerting returns the number of boot failures within the alert window for
+// each launch template version at or over the alert threshold.
+func (d *bootFailureDetector) alerting() map[launchTemplateVersion]int {
+	counts := make(map[launchTemplateVersion]int)
+	for _, f := range d.state.Failures {
+		counts[launchTemplateVersion{f.LaunchTemplate, f.LaunchTemplateVersion}]++
+	}
+	threshold := d.params.AlertThreshold
+	if threshold <= 0 {
+		threshold = defaultBootFailureAlertThreshold
+	}
+	for ltv, n := range counts {
+		if n < threshold {
+			delete(counts, ltv)
+		}
+	}
+	return counts
+}
+
+func (d *bootFailureDetector) alertWindow() time.Duration {
+	if d.params.AlertWindow <= 0 {
+		return defaultBootFailureAlertWindow
+	}
+	return d.params.AlertWindow
+}
+
+// reportBootFailures logs new boot failures and raises an alert for each
+// launch template version failing repeatedly.
+func (s *Scaler) reportBootFailures(ctx context.Context, orgSlug, queue string, failures []BootFailure) {
+	for _, f := range failures {
+		logging.FromContext(ctx).Warn("🥾 Instance never connected an agent after launch",
+			"instance", f.InstanceID, slog.Duration("deadline", s.boot.params.RegistrationDeadline),
+			"launch_template", f.LaunchTemplate, "launch_template_version", f.LaunchTemplateVersion,
+			"availability_zone", f.AvailabilityZone)
+		if s.metrics != nil {
+			if err := s.metrics.PublishWithDimensions(ctx, orgSlug, queue, map[string]string{
+				"LaunchTemplate":        f.LaunchTemplate,
+				"LaunchTemplateVersion": f.LaunchTemplateVersion,
+				"AvailabilityZone":      f.AvailabilityZone,
+			}, map[string]int64{"BootFailures": 1}); err != nil {
+				logging.FromContext(ctx).Warn("⚠️  Failed to publish boot failure metric", "error", err)
+			}
+		}
+	}
+
+	for ltv, n := range s.boot.alerting() {
+		logging.FromContext(ctx).Error("🚨 Launch template version is repeatedly failing to boot instances",
+			"launch_template", ltv.name, "launch_template_version", ltv.version,
+			"failures", n, slog.Duration("window", s.boot.alertWindow()))
+		if s.metrics != nil {
+			if err := s.metrics.PublishWithDimensions(ctx, orgSlug, queue, map[string]string{
+				"LaunchTemplate":        ltv.name,
+				"LaunchTemplateVersion": ltv.version,
+			}, map[string]int64{"BootFailureAlert": 1}); err != nil {
+				logging.FromContext(ctx).Warn("⚠️  Failed to publish boot failure alert metric", "error", err)
+			}
+		}
+	}
+}
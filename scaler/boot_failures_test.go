@@ -0,0 +1,113 @@
+package scaler
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+func TestBootFailureDetectorObserve(t *testing.T) {
+	now := time.Unix(100000, 0)
+	instance := func(id, version string) InstanceDetails {
+		return InstanceDetails{ID: id, LifecycleState: "InService", LaunchTemplate: "agents", LaunchTemplateVersion: version, AvailabilityZone: "us-east-1a"}
+	}
+	asg := AutoscaleGroupDetails{Instances: []InstanceDetails{
+		instance("i-connected", "2"),
+		instance("i-was-connected", "2"),
+		instance("i-young", "2"),
+		instance("i-newer", "2"),
+		instance("i-older", "2"),
+		instance("i-before-watching", "1"),
+		{ID: "i-pending", LifecycleState: "Pending"},
+	}}
+	agents := []buildkite.Agent{{MetaData: []string{"aws:instance-id=i-connected"}}}
+	launchTimes := map[string]time.Time{
+		"i-connected":       now.Add(-time.Hour),
+		"i-was-connected":   now.Add(-time.Hour),
+		"i-young":           now.Add(-time.Minute),
+		"i-newer":           now.Add(-15 * time.Minute),
+		"i-older":           now.Add(-20 * time.Minute),
+		"i-before-watching": now.Add(-3 * time.Hour),
+		"i-pending":         now.Add(-time.Hour),
+	}
+
+	d := &bootFailureDetector{
+		params: BootFailureParams{RegistrationDeadline: 10 * time.Minute, AlertThreshold: 2},
+		state: BootFailureState{
+			Since:      now.Add(-2 * time.Hour),
+			Registered: []string{"i-was-connected", "i-terminated"},
+		},
+	}
+
+	var got []string
+	for _, f := range d.observe(asg, agents, launchTimes, now) {
+		got = append(got, f.InstanceID)
+	}
+	if want := []string{"i-older", "i-newer"}; !slices.Equal(got, want) {
+		t.Errorf("observe() = %v, want %v", got, want)
+	}
+	if want := []string{"i-connected", "i-was-connected"}; !slices.Equal(d.state.Registered, want) {
+		t.Errorf("Registered = %v, want %v", d.state.Registered, want)
+	}
+	if got, want := d.alerting(), map[launchTemplateVersion]int{{"agents", "2"}: 2}; !maps.Equal(got, want) {
+		t.Errorf("alerting() = %v, want %v", got, want)
+	}
+
+	// The same instances aren't reported twice
+	if failures := d.observe(asg, agents, launchTimes, now.Add(time.Minute)); len(failures) != 0 {
+		t.Errorf("second observe() = %v, want none", failures)
+	}
+
+	// Failures age out of the alert window once the instances are replaced
+	d.observe(AutoscaleGroupDetails{}, nil, nil, now.Add(2*time.Hour))
+	if len(d.alerting()) != 0 {
+		t.Errorf("alerting() after the window = %v, want none", d.alerting())
+	}
+}
+
+func TestBootFailureDetectorStartsWatchingOnFirstRun(t *testing.T) {
+	now := time.Unix(100000, 0)
+	asg := AutoscaleGroupDetails{Instances: []InstanceDetails{{ID: "i-old", LifecycleState: "InService"}}}
+	launchTimes := map[string]time.Time{"i-old": now.Add(-time.Hour)}
+
+	d := &bootFailureDetector{params: BootFailureParams{RegistrationDeadline: 10 * time.Minute}}
+	if failures := d.observe(asg, nil, launchTimes, now); len(failures) != 0 {
+		t.Errorf("observe() = %v, want none for an instance launched before watching began", failures)
+	}
+	if !d.state.Since.Equal(now) {
+		t.Errorf("Since = %v, want %v", d.state.Since, now)
+	}
+}
+
+func TestRunMarksBootFailuresUnhealthy(t *testing.T) {
+	asg := &heartbeatTestDriver{
+		asgTestDriver: asgTestDriver{desiredCapacity: 2},
+		launched:      time.Now().Add(-20 * time.Minute),
+	}
+	s := Scaler{
+		autoscaling:    asg,
+		bk:             &buildkiteTestDriver{metrics: buildkite.AgentMetrics{OrgSlug: "llamacorp", RunningJobs: 2}},
+		scaling:        ScalingCalculator{agentsPerInstance: 1},
+		agents:         &fakeAgentLister{agents: []buildkite.Agent{{MetaData: []string{"aws:instance-id=i-000000000000"}}}},
+		danglingAgents: DanglingAgentParams{GracePeriod: 15 * time.Minute},
+		boot: &bootFailureDetector{
+			params: BootFailureParams{RegistrationDeadline: 10 * time.Minute},
+			state:  BootFailureState{Since: time.Now().Add(-time.Hour)},
+		},
+	}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Marked once as a boot failure, not again as a dangling instance
+	if want := []string{"i-000000000001"}; !slices.Equal(asg.markedDirectly, want) {
+		t.Errorf("marked unhealthy = %v, want %v", asg.markedDirectly, want)
+	}
+	if got := s.State().BootFailures.Failures; len(got) != 1 || got[0].InstanceID != "i-000000000001" {
+		t.Errorf("State().BootFailures.Failures = %v, want i-000000000001", got)
+	}
+}
@@ -0,0 +1,208 @@
+package scaler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+	"github.com/buildkite/buildkite-agent-scaler/logging"
+)
+
+// CandidateState is the state of a candidate config's Scaler, carried over
+// like the live Scaler's so its cooldowns follow its own decisions.
+type CandidateState struct {
+	LastScaleIn  time.Time
+	LastScaleOut time.Time
+	State        State
+}
+
+// ParseCandidateParams returns live with the overrides in config applied, for
+// use as Params.Candidate. config has the format of the runtime config SSM
+// parameter, key=value pairs separated by newlines or commas, with keys named
+// after the CLI's scaling flags, e.g. "scale-in-cooldown=30m,
+// availability-threshold=0.7".
+func ParseCandidateParams(live Params, config string) (Params, error) {
+	p := live
+	p.Candidate = nil
+	for key, value := range parseRuntimeConfig(slog.Default(), config) {
+		var err error
+		switch key {
+		case "scale-in-factor":
+			p.ScaleInParams.Factor, err = strconv.ParseFloat(value, 64)
+		case "scale-out-factor":
+			p.ScaleOutParams.Factor, err = strconv.ParseFloat(value, 64)
+		case "scale-in-cooldown":
+			p.ScaleInParams.CooldownPeriod, err = time.ParseDuration(value)
+		case "scale-out-cooldown":
+			p.ScaleOutParams.CooldownPeriod, err = time.ParseDuration(value)
+		case "scale-in-policies":
+			p.ScaleInParams.Policies, err = ParseScalingPolicies(value)
+		case "scale-out-policies":
+			p.ScaleOutParams.Policies, err = ParseScalingPolicies(value)
+		case "scale-in-select-policy":
+			p.ScaleInParams.SelectPolicy, err = ParseSelectPolicy(value)
+		case "scale-out-select-policy":
+			p.ScaleOutParams.SelectPolicy, err = ParseSelectPolicy(value)
+		case "disable-scale-in":
+			p.ScaleInParams.Disable, err = strconv.ParseBool(value)
+		case "disable-scale-out":
+			p.ScaleOutParams.Disable, err = strconv.ParseBool(value)
+		case "scale-only-after-all-event":
+			p.ScaleOnlyAfterAllEvent, err = strconv.ParseBool(value)
+		case "instance-buffer":
+			p.InstanceBuffer, err = strconv.Atoi(value)
+		case "availability-threshold":
+			p.AvailabilityThreshold, err = strconv.ParseFloat(value, 64)
+		case "include-waiting":
+			p.IncludeWaiting, err = strconv.ParseBool(value)
+		case "max-instance-cap":
+			p.MaxInstanceCap, err = strconv.Atoi(value)
+		case runtimeKeyMinSize:
+			p.MinSize, err = strconv.ParseInt(value, 10, 64)
+		case runtimeKeyMaxSize:
+			p.MaxSize, err = strconv.ParseInt(value, 10, 64)
+		case "controller-mode":
+			p.Controller.Mode = value
+		case "controller-signal":
+			p.Controller.Signal = value
+		case "controller-kp":
+			p.Controller.Kp, err = strconv.ParseFloat(value, 64)
+		case "controller-ki":
+			p.Controller.Ki, err = strconv.ParseFloat(value, 64)
+		case "controller-kd":
+			p.Controller.Kd, err = strconv.ParseFloat(value, 64)
+		case "controller-integral-limit":
+			p.Controller.IntegralLimit, err = strconv.ParseFloat(value, 64)
+		default:
+			return Params{}, fmt.Errorf("unknown candidate config key %q", key)
+		}
+		if err != nil {
+			return Params{}, fmt.Errorf("invalid candidate config %s=%q: %w", key, value, err)
+		}
+	}
+	return p, nil
+}
+
+// liveSnapshot is what the live Scaler read during a Run: the ASG, the
+// Buildkite metrics and the runtime config parameter. The candidate Scaler
+// reads it in their place, and acts on a copy of the ASG that goes nowhere.
+type liveSnapshot struct {
+	asg       AutoscaleGroupDetails
+	parameter map[string]string
+	metrics   buildkite.AgentMetrics
+	taken     bool // Whether the live Run got as far as reading metrics
+}
+
+func (l *liveSnapshot) Describe(ctx context.Context) (AutoscaleGroupDetails, error) {
+	return l.asg, nil
+}
+
+func (l *liveSnapshot) SetDesiredCapacity(ctx context.Context, count int64) error {
+	return nil
+}
+
+func (l *liveSnapshot) SignalAgents(ctx context.Context, inv *InstanceInventory, instanceIDs []string) []SignalOutcome {
+	outcomes := make([]SignalOutcome, len(instanceIDs))
+	for i, id := range instanceIDs {
+		outcomes[i] = SignalOutcome{InstanceID: id, Outcome: SignalSent}
+	}
+	return outcomes
+}
+
+func (l *liveSnapshot) CleanupDanglingInstances(ctx context.Context, inv *InstanceInventory, minimumInstanceUptime time.Duration, maxDanglingInstancesToCheck int) error {
+	return nil
+}
+
+func (l *liveSnapshot) GetAgentMetrics(ctx context.Context) (buildkite.AgentMetrics, error) {
+	return l.metrics, nil
+}
+
+func (l *liveSnapshot) GetRuntimeConfig(ctx context.Context) (map[string]string, error) {
+	return l.parameter, nil
+}
+
+// newCandidate creates the Scaler that evaluates params.Candidate against
+// the live Scaler's snapshot. Checks that act on instances rather than
+// desired capacity, e.g. dangling instances and EC2 status checks, are left
+// to the live Scaler.
+func newCandidate(params Params, snapshot *liveSnapshot, clock Clock) (*Scaler, error) {
+	p := *params.Candidate
+	p.Candidate = nil
+	p.DryRun, p.Shadow = false, false
+	p.PublishCloudWatchMetrics = false
+	p.RuntimeConfigParameter = ""
+	p.ExternalChangeGracePeriod = 0
+	p.BuildkiteAPIToken = ""
+	p.InstanceStatus = InstanceStatusParams{}
+	p.State = params.State
+	p.State.Candidate = nil
+	if state := params.State.Candidate; state != nil {
+		p.ScaleInParams.LastEvent = state.LastScaleIn
+		p.ScaleOutParams.LastEvent = state.LastScaleOut
+		p.State = state.State
+	}
+
+	c, err := NewScaler(nil, aws.Config{}, p, WithClock(clock))
+	if err != nil {
+		return nil, fmt.Errorf("candidate config: %w", err)
+	}
+	c.autoscaling = snapshot
+	c.bk = snapshot
+	c.runtimeConfig = snapshot
+	c.label = "Candidate"
+	return c, nil
+}
+
+// evaluateCandidate runs the candidate Scaler on what the live Run read, and
+// logs and publishes where its decision differs from the live one.
+func (s *Scaler) evaluateCandidate(ctx context.Context) {
+	logger := logging.FromContext(ctx)
+	logger.Debug("🅱️ Evaluating candidate config on the same metrics and ASG")
+	if _, err := s.candidate.Run(ctx); err != nil {
+		logger.Warn("⚠️  Candidate config run failed", "error", err)
+		return
+	}
+	live, candidate := s.decision, s.candidate.LastDecision()
+	s.decision.Candidate = &candidate
+
+	var differs int64
+	if candidate.Action != live.Action || candidate.Desired != live.Desired || candidate.Reason != live.Reason {
+		differs = 1
+		logger.Info("🅱️ Candidate differs from live", "candidate", candidate.summary(), "live", live.summary())
+	} else {
+		logger.Info("🅱️ Candidate agrees with live", "live", live.summary())
+	}
+
+	if s.metrics == nil {
+		return
+	}
+	metrics := s.candidateSnapshot.metrics
+	for _, m := range []struct {
+		config  string
+		metrics map[string]int64
+	}{
+		{"live", map[string]int64{"DecisionDesiredCount": live.Desired}},
+		{"candidate", map[string]int64{"DecisionDesiredCount": candidate.Desired, "DecisionDiffers": differs}},
+	} {
+		if err := s.metrics.PublishWithDimensions(ctx, metrics.OrgSlug, metrics.Queue, map[string]string{"Config": m.config}, m.metrics); err != nil {
+			logger.Warn("⚠️  Could not publish candidate comparison metrics", "error", err)
+			return
+		}
+	}
+}
+
+// candidateState returns the candidate Scaler's state for State.Candidate.
+func (s *Scaler) candidateState() *CandidateState {
+	if s.candidate == nil {
+		return nil
+	}
+	return &CandidateState{
+		LastScaleIn:  s.candidate.LastScaleIn(),
+		LastScaleOut: s.candidate.LastScaleOut(),
+		State:        s.candidate.State(),
+	}
+}
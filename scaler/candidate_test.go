@@ -0,0 +1,89 @@
+package scaler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+func TestParseCandidateParams(t *testing.T) {
+	live := Params{
+		AgentsPerInstance:     2,
+		AvailabilityThreshold: 0.5,
+		ScaleInParams:         ScaleParams{CooldownPeriod: time.Hour, Factor: 1},
+	}
+	got, err := ParseCandidateParams(live, "scale-in-cooldown=30m\navailability-threshold=0.7, instance-buffer=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ScaleInParams.CooldownPeriod != 30*time.Minute || got.AvailabilityThreshold != 0.7 || got.InstanceBuffer != 2 {
+		t.Errorf("overrides not applied: %+v", got)
+	}
+	if got.AgentsPerInstance != 2 || got.ScaleInParams.Factor != 1 {
+		t.Errorf("live params not kept: %+v", got)
+	}
+
+	for _, config := range []string{"scale-in-cooldown=soon", "agents-per-instance=4"} {
+		if _, err := ParseCandidateParams(live, config); err == nil {
+			t.Errorf("ParseCandidateParams(%q) succeeded, want an error", config)
+		}
+	}
+}
+
+func TestCandidateDecidesWithoutActing(t *testing.T) {
+	now := time.Now()
+	fake := &fakeAWS{desired: 3, launched: map[string]time.Time{
+		"i-a": now.Add(-10 * time.Minute),
+		"i-b": now.Add(-30 * time.Minute),
+		"i-c": now.Add(-20 * time.Minute),
+	}}
+
+	live := Params{
+		AutoScalingGroupName: "agents",
+		AgentsPerInstance:    1,
+		ScaleInParams:        ScaleParams{CooldownPeriod: time.Hour, LastEvent: now.Add(-10 * time.Minute)},
+	}
+	candidate, err := ParseCandidateParams(live, "scale-in-cooldown=5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	live.Candidate = &candidate
+	s, err := NewScaler(nil, aws.Config{}, live, WithAutoScalingClient(fake), WithEC2Client(fake), WithSSMClient(fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.bk = &buildkiteTestDriver{metrics: buildkite.AgentMetrics{
+		OrgSlug:     "llamacorp",
+		RunningJobs: 2,
+		BusyAgents:  2,
+		IdleAgents:  1,
+		TotalAgents: 3,
+	}}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.desiredSets) > 0 || len(fake.tags) > 0 {
+		t.Errorf("changed the ASG: desired sets %v, tags %v", fake.desiredSets, fake.tags)
+	}
+	d := s.LastDecision()
+	if d.Reason != "scale-in-cooldown" {
+		t.Errorf("live decision reason = %q, want scale-in-cooldown", d.Reason)
+	}
+	if d.Candidate == nil || d.Candidate.Action != ActionScaleIn || d.Candidate.Desired != 2 {
+		t.Fatalf("candidate decision = %+v, want scale-in to 2", d.Candidate)
+	}
+
+	// The candidate's cooldown follows its own decisions, not the live one's
+	state := s.State()
+	if state.Candidate == nil || state.Candidate.LastScaleIn.IsZero() {
+		t.Errorf("candidate state = %+v, want its scale-in recorded", state.Candidate)
+	}
+	if !s.LastScaleIn().Equal(live.ScaleInParams.LastEvent) {
+		t.Errorf("live last scale-in moved to %v", s.LastScaleIn())
+	}
+}
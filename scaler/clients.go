@@ -0,0 +1,130 @@
+package scaler
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AutoScalingAPI is the part of autoscaling.Client the scaler uses.
+type AutoScalingAPI interface {
+	DescribeAutoScalingGroups(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error)
+	DescribeScalingActivities(ctx context.Context, params *autoscaling.DescribeScalingActivitiesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DescribeScalingActivitiesOutput, error)
+	SetDesiredCapacity(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error)
+	SetInstanceHealth(ctx context.Context, params *autoscaling.SetInstanceHealthInput, optFns ...func(*autoscaling.Options)) (*autoscaling.SetInstanceHealthOutput, error)
+	CreateOrUpdateTags(ctx context.Context, params *autoscaling.CreateOrUpdateTagsInput, optFns ...func(*autoscaling.Options)) (*autoscaling.CreateOrUpdateTagsOutput, error)
+	DetachInstances(ctx context.Context, params *autoscaling.DetachInstancesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DetachInstancesOutput, error)
+}
+
+// EC2API is the part of ec2.Client the scaler uses.
+type EC2API interface {
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	DescribeInstanceStatus(ctx context.Context, params *ec2.DescribeInstanceStatusInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error)
+	CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error)
+	DeleteTags(ctx context.Context, params *ec2.DeleteTagsInput, optFns ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error)
+	TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error)
+}
+
+// SSMAPI is the part of ssm.Client the scaler uses.
+type SSMAPI interface {
+	DescribeInstanceInformation(ctx context.Context, params *ssm.DescribeInstanceInformationInput, optFns ...func(*ssm.Options)) (*ssm.DescribeInstanceInformationOutput, error)
+	SendCommand(ctx context.Context, params *ssm.SendCommandInput, optFns ...func(*ssm.Options)) (*ssm.SendCommandOutput, error)
+	ListCommandInvocations(ctx context.Context, params *ssm.ListCommandInvocationsInput, optFns ...func(*ssm.Options)) (*ssm.ListCommandInvocationsOutput, error)
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+// CloudWatchAPI is the part of cloudwatch.Client the scaler uses.
+type CloudWatchAPI interface {
+	PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, optFns ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error)
+}
+
+// AgentMetricsSource reports the queue's agent and job counts, see
+// buildkite.Client.GetAgentMetrics.
+type AgentMetricsSource interface {
+	GetAgentMetrics(ctx context.Context) (buildkite.AgentMetrics, error)
+}
+
+// AgentLister lists the organization's connected agents, see
+// buildkite.APIClient.
+type AgentLister interface {
+	ListConnectedAgents(ctx context.Context, orgSlug string) ([]buildkite.Agent, error)
+}
+
+// Option configures a Scaler, see NewScaler. Clients that aren't set are
+// created from the aws.Config and Buildkite client passed to NewScaler.
+type Option func(*options)
+
+type options struct {
+	autoscaling AutoScalingAPI
+	ec2         EC2API
+	ssm         SSMAPI
+	cloudwatch  CloudWatchAPI
+
+	agentMetrics AgentMetricsSource
+	agents       AgentLister
+	clock        Clock
+
+	tracerProvider trace.TracerProvider
+}
+
+// WithAutoScalingClient sets the client used for the ASG.
+func WithAutoScalingClient(client AutoScalingAPI) Option {
+	return func(o *options) { o.autoscaling = client }
+}
+
+// WithEC2Client sets the client used to describe, tag and terminate instances.
+func WithEC2Client(client EC2API) Option {
+	return func(o *options) { o.ec2 = client }
+}
+
+// WithSSMClient sets the client used to run commands on instances and read
+// the runtime config parameter.
+func WithSSMClient(client SSMAPI) Option {
+	return func(o *options) { o.ssm = client }
+}
+
+// WithCloudWatchClient sets the client used to publish metrics.
+func WithCloudWatchClient(client CloudWatchAPI) Option {
+	return func(o *options) { o.cloudwatch = client }
+}
+
+// WithAgentMetrics sets where the queue's metrics come from, in place of the
+// Buildkite client passed to NewScaler.
+func WithAgentMetrics(source AgentMetricsSource) Option {
+	return func(o *options) { o.agentMetrics = source }
+}
+
+// WithAgentLister sets the lister used by the dangling agent and boot failure
+// checks, in place of a REST API client for Params.BuildkiteAPIToken.
+func WithAgentLister(lister AgentLister) Option {
+	return func(o *options) { o.agents = lister }
+}
+
+// The ASGDriver's clients are created from Cfg on first use, unless
+// NewScaler was given them, and reused after that.
+
+func (a *ASGDriver) autoscalingClient() AutoScalingAPI {
+	if a.autoscalingSvc == nil {
+		a.autoscalingSvc = autoscaling.NewFromConfig(a.Cfg)
+	}
+	return a.autoscalingSvc
+}
+
+func (a *ASGDriver) ec2Client() EC2API {
+	if a.ec2Svc == nil {
+		a.ec2Svc = ec2.NewFromConfig(a.Cfg)
+	}
+	return a.ec2Svc
+}
+
+func (a *ASGDriver) ssmClient() SSMAPI {
+	if a.ssmSvc == nil {
+		a.ssmSvc = ssm.NewFromConfig(a.Cfg)
+	}
+	return a.ssmSvc
+}
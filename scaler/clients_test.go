@@ -0,0 +1,140 @@
+package scaler
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	asgTypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+// fakeAWS is an ASG of running Linux instances, all online in SSM, behind the
+// AutoScaling, EC2 and SSM client interfaces. Calls the scaler shouldn't make
+// panic.
+type fakeAWS struct {
+	AutoScalingAPI
+	EC2API
+	SSMAPI
+
+	desired  int32
+	launched map[string]time.Time
+
+	tags        map[string]string
+	signalled   [][]string // InstanceIds of each SendCommand
+	desiredSets []int32
+}
+
+func (f *fakeAWS) DescribeAutoScalingGroups(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, _ ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	group := asgTypes.AutoScalingGroup{
+		AutoScalingGroupName: aws.String("agents"),
+		DesiredCapacity:      aws.Int32(f.desired),
+		MinSize:              aws.Int32(0),
+		MaxSize:              aws.Int32(10),
+	}
+	for _, id := range slices.Sorted(maps.Keys(f.launched)) {
+		group.Instances = append(group.Instances, asgTypes.Instance{InstanceId: aws.String(id), LifecycleState: asgTypes.LifecycleStateInService})
+	}
+	for k, v := range f.tags {
+		group.Tags = append(group.Tags, asgTypes.TagDescription{Key: aws.String(k), Value: aws.String(v)})
+	}
+	return &autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: []asgTypes.AutoScalingGroup{group}}, nil
+}
+
+func (f *fakeAWS) DescribeScalingActivities(ctx context.Context, params *autoscaling.DescribeScalingActivitiesInput, _ ...func(*autoscaling.Options)) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+	return &autoscaling.DescribeScalingActivitiesOutput{}, nil
+}
+
+func (f *fakeAWS) SetDesiredCapacity(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, _ ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error) {
+	f.desired = aws.ToInt32(params.DesiredCapacity)
+	f.desiredSets = append(f.desiredSets, f.desired)
+	return &autoscaling.SetDesiredCapacityOutput{}, nil
+}
+
+func (f *fakeAWS) CreateOrUpdateTags(ctx context.Context, params *autoscaling.CreateOrUpdateTagsInput, _ ...func(*autoscaling.Options)) (*autoscaling.CreateOrUpdateTagsOutput, error) {
+	if f.tags == nil {
+		f.tags = make(map[string]string)
+	}
+	for _, tag := range params.Tags {
+		f.tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return &autoscaling.CreateOrUpdateTagsOutput{}, nil
+}
+
+func (f *fakeAWS) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	var instances []ec2Types.Instance
+	for _, id := range params.InstanceIds {
+		instances = append(instances, ec2Types.Instance{
+			InstanceId: aws.String(id),
+			LaunchTime: aws.Time(f.launched[id]),
+			State:      &ec2Types.InstanceState{Name: ec2Types.InstanceStateNameRunning},
+		})
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []ec2Types.Reservation{{Instances: instances}}}, nil
+}
+
+func (f *fakeAWS) DescribeInstanceInformation(ctx context.Context, params *ssm.DescribeInstanceInformationInput, _ ...func(*ssm.Options)) (*ssm.DescribeInstanceInformationOutput, error) {
+	out := &ssm.DescribeInstanceInformationOutput{}
+	for _, id := range params.Filters[0].Values {
+		out.InstanceInformationList = append(out.InstanceInformationList,
+			ssmTypes.InstanceInformation{InstanceId: aws.String(id), PingStatus: ssmTypes.PingStatusOnline})
+	}
+	return out, nil
+}
+
+func (f *fakeAWS) SendCommand(ctx context.Context, params *ssm.SendCommandInput, _ ...func(*ssm.Options)) (*ssm.SendCommandOutput, error) {
+	f.signalled = append(f.signalled, params.InstanceIds)
+	return &ssm.SendCommandOutput{Command: &ssmTypes.Command{CommandId: aws.String(fmt.Sprintf("cmd-%d", len(f.signalled)))}}, nil
+}
+
+func TestElasticCIScaleInWithInjectedClients(t *testing.T) {
+	now := time.Now()
+	fake := &fakeAWS{desired: 3, launched: map[string]time.Time{
+		"i-a": now.Add(-10 * time.Minute),
+		"i-b": now.Add(-30 * time.Minute), // Oldest
+		"i-c": now.Add(-20 * time.Minute),
+	}}
+
+	s, err := NewScaler(nil, aws.Config{}, Params{
+		AutoScalingGroupName:  "agents",
+		AgentsPerInstance:     1,
+		ElasticCIMode:         true,
+		MinimumInstanceUptime: time.Hour, // Too young for the dangling check
+	}, WithAutoScalingClient(fake), WithEC2Client(fake), WithSSMClient(fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.bk = &buildkiteTestDriver{metrics: buildkite.AgentMetrics{
+		OrgSlug:     "llamacorp",
+		RunningJobs: 2,
+		BusyAgents:  2,
+		IdleAgents:  1,
+		TotalAgents: 3,
+	}}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []int32{2}; !slices.Equal(fake.desiredSets, want) {
+		t.Errorf("desired capacity set to %v, want %v", fake.desiredSets, want)
+	}
+	if len(fake.signalled) != 1 || !slices.Equal(fake.signalled[0], []string{"i-b"}) {
+		t.Errorf("signalled %v, want the oldest instance i-b", fake.signalled)
+	}
+	if _, ok := fake.tags[TagLastScaleIn]; !ok {
+		t.Errorf("scale-in wasn't recorded in the %s tag", TagLastScaleIn)
+	}
+	if got := s.LastDecision().Signals; len(got) != 1 || got[0].Outcome != SignalSent {
+		t.Errorf("decision signals = %+v, want i-b signalled", got)
+	}
+}
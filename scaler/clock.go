@@ -0,0 +1,60 @@
+package scaler
+
+import (
+	"context"
+	"time"
+)
+
+// Clock is the scaler's source of time: cooldowns, scaling policies, instance
+// uptimes and SSM command polling all read it. Durations measured only for
+// logging use the wall clock regardless.
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d, or until ctx is done.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// wallClock is the real time, used unless NewScaler is given WithClock.
+type wallClock struct{}
+
+func (wallClock) Now() time.Time { return time.Now() }
+
+func (wallClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// orWallClock returns c, or the wall clock if c is nil, so Scalers and
+// drivers built without NewScaler still tell the time.
+func orWallClock(c Clock) Clock {
+	if c == nil {
+		return wallClock{}
+	}
+	return c
+}
+
+// WithClock sets the clock the scaler reads, e.g. a virtual clock that lets
+// tests run hours of Run cycles without waiting.
+func WithClock(clock Clock) Option {
+	return func(o *options) { o.clock = clock }
+}
+
+func (s *Scaler) now() time.Time {
+	return orWallClock(s.clock).Now()
+}
+
+func (a *ASGDriver) now() time.Time {
+	return orWallClock(a.clock).Now()
+}
+
+// sleep waits for d on the driver's clock. A cancelled ctx cuts it short; the
+// SSM calls that follow then fail with ctx's error.
+func (a *ASGDriver) sleep(ctx context.Context, d time.Duration) {
+	_ = orWallClock(a.clock).Sleep(ctx, d)
+}
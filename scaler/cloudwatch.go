@@ -2,63 +2,277 @@ package scaler
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	"github.com/buildkite/buildkite-agent-scaler/logging"
 )
 
 const (
 	cloudWatchMetricsNamespace = "Buildkite"
 )
 
+// Formats metrics can be published in.
+const (
+	MetricsFormatAPI = "api" // PutMetricData calls
+	MetricsFormatEMF = "emf" // CloudWatch Embedded Metric Format log lines
+)
+
+// CloudWatchMetricsParams configures how metrics are published when
+// Params.PublishCloudWatchMetrics is set. The zero value publishes the queue's
+// job counts with PutMetricData under the Buildkite namespace.
+type CloudWatchMetricsParams struct {
+	Format         string            // MetricsFormatAPI (default) or MetricsFormatEMF
+	Namespace      string            // Default "Buildkite"
+	Dimensions     map[string]string // Added to every metric after Org and Queue, e.g. {"Stack": "ci"}
+	ASGDimension   bool              // Adds an AutoScalingGroup dimension with the ASG's name
+	HighResolution bool              // Store metrics at 1-second rather than 1-minute resolution
+	Extended       bool              // Also publish agents, instances, availability, dangling instances and agent stop signals
+}
+
+// ParseMetricDimensions parses extra dimensions for
+// CloudWatchMetricsParams.Dimensions, as Name=value pairs separated by
+// commas or newlines, e.g. "Stack=ci,Team=platform".
+func ParseMetricDimensions(s string) (map[string]string, error) {
+	dimensions := make(map[string]string)
+	for _, pair := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(pair, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !ok || name == "" || value == "" {
+			return nil, fmt.Errorf("invalid metric dimension %q: expected Name=value", pair)
+		}
+		dimensions[name] = value
+	}
+	return dimensions, nil
+}
+
+// metricsConfig is what the publishers share: where metrics go and the
+// dimensions added to all of them.
+type metricsConfig struct {
+	namespace      string
+	dimensions     map[string]string
+	highResolution bool
+}
+
+// newMetricsConfig validates params, adding the ASG dimension if asked for.
+func newMetricsConfig(params CloudWatchMetricsParams, asgName string) (metricsConfig, error) {
+	switch params.Format {
+	case "", MetricsFormatAPI, MetricsFormatEMF:
+	default:
+		return metricsConfig{}, fmt.Errorf("unknown CloudWatch metrics format %q, expected %q or %q", params.Format, MetricsFormatAPI, MetricsFormatEMF)
+	}
+
+	c := metricsConfig{
+		namespace:      params.Namespace,
+		dimensions:     maps.Clone(params.Dimensions),
+		highResolution: params.HighResolution,
+	}
+	if c.namespace == "" {
+		c.namespace = cloudWatchMetricsNamespace
+	}
+	if params.ASGDimension {
+		if c.dimensions == nil {
+			c.dimensions = make(map[string]string)
+		}
+		c.dimensions["AutoScalingGroup"] = asgName
+	}
+	for name := range c.dimensions {
+		if name == "Org" || name == "Queue" {
+			return metricsConfig{}, fmt.Errorf("metric dimension %s is always set by the scaler", name)
+		}
+	}
+	return c, nil
+}
+
+// metricDimensions returns the names and values of a metric's dimensions:
+// Org and Queue, then the configured dimensions and extra, each sorted by
+// name.
+func (c metricsConfig) metricDimensions(orgSlug, queue string, extra map[string]string) (names []string, values map[string]string) {
+	names = []string{"Org", "Queue"}
+	values = map[string]string{"Org": orgSlug, "Queue": queue}
+	for _, set := range []map[string]string{c.dimensions, extra} {
+		for _, name := range slices.Sorted(maps.Keys(set)) {
+			if _, ok := values[name]; !ok {
+				names = append(names, name)
+			}
+			values[name] = dimensionValue(set[name])
+		}
+	}
+	return names, values
+}
+
+func (c metricsConfig) storageResolution() int32 {
+	if c.highResolution {
+		return 1
+	}
+	return 60
+}
+
+// metricUnit is the unit a metric is published with. Everything the scaler
+// publishes is a count, except where the name says otherwise.
+func metricUnit(name string) types.StandardUnit {
+	if strings.HasSuffix(name, "Percent") {
+		return types.StandardUnitPercent
+	}
+	return types.StandardUnitCount
+}
+
 // cloudWatchMetricsPublisher sends queue metrics to AWS CloudWatch
 type cloudWatchMetricsPublisher struct {
-	cfg aws.Config
+	client CloudWatchAPI
+	metricsConfig
 }
 
 // Publish queue metrics to CloudWatch Metrics
 // The context allows for request cancellation and timeouts.
 func (cp *cloudWatchMetricsPublisher) Publish(ctx context.Context, orgSlug, queue string, metrics map[string]int64) error {
-	svc := cloudwatch.NewFromConfig(cp.cfg)
+	return cp.PublishWithDimensions(ctx, orgSlug, queue, nil, metrics)
+}
 
-	datum := make([]types.MetricDatum, 0, len(metrics))
+// PublishWithDimensions publishes metrics with extra dimensions on top of Org
+// and Queue, e.g. who set a runtime control or which launch template version
+// is failing to boot.
+func (cp *cloudWatchMetricsPublisher) PublishWithDimensions(ctx context.Context, orgSlug, queue string, extra map[string]string, metrics map[string]int64) error {
+	names, values := cp.metricDimensions(orgSlug, queue, extra)
+	dimensions := make([]types.Dimension, 0, len(names))
+	for _, name := range names {
+		dimensions = append(dimensions, types.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(values[name]),
+		})
+	}
 
-	for k, v := range metrics {
-		log.Printf("Publishing metric %s=%d [org=%s,queue=%s]",
-			k, v, orgSlug, queue)
+	datum := make([]types.MetricDatum, 0, len(metrics))
+	for _, k := range slices.Sorted(maps.Keys(metrics)) {
+		v := metrics[k]
+		logging.FromContext(ctx).Debug("Publishing metric", "metric", k, "value", v, "dimensions", extraLabel(extra))
 
 		datum = append(datum, types.MetricDatum{
-			MetricName: aws.String(k),
-			Unit:       types.StandardUnitCount,
-			Value:      aws.Float64(float64(v)),
-			Dimensions: []types.Dimension{
-				{
-					Name:  aws.String("Org"),
-					Value: aws.String(orgSlug),
-				},
-				{
-					Name:  aws.String("Queue"),
-					Value: aws.String(queue),
-				},
-			},
+			MetricName:        aws.String(k),
+			Unit:              metricUnit(k),
+			Value:             aws.Float64(float64(v)),
+			Dimensions:        dimensions,
+			StorageResolution: aws.Int32(cp.storageResolution()),
 		})
 	}
 
-	_, err := svc.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
-		Namespace:  aws.String(cloudWatchMetricsNamespace),
+	_, err := cp.client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+		Namespace:  aws.String(cp.namespace),
 		MetricData: datum,
 	})
 
 	return err
 }
 
+// emfMetricsPublisher writes metrics as CloudWatch Embedded Metric Format log
+// lines, which CloudWatch Logs turns into metrics. From Lambda this costs no
+// API calls; elsewhere the lines need to reach CloudWatch Logs, e.g. through
+// the CloudWatch agent.
+type emfMetricsPublisher struct {
+	out   io.Writer
+	clock Clock
+	metricsConfig
+}
+
+// emfMetadata is the _aws member of an EMF log line.
+type emfMetadata struct {
+	Timestamp         int64                `json:"Timestamp"`
+	CloudWatchMetrics []emfMetricDirective `json:"CloudWatchMetrics"`
+}
+
+type emfMetricDirective struct {
+	Namespace  string      `json:"Namespace"`
+	Dimensions [][]string  `json:"Dimensions"`
+	Metrics    []emfMetric `json:"Metrics"`
+}
+
+type emfMetric struct {
+	Name              string `json:"Name"`
+	Unit              string `json:"Unit"`
+	StorageResolution int32  `json:"StorageResolution,omitempty"`
+}
+
+func (ep *emfMetricsPublisher) Publish(ctx context.Context, orgSlug, queue string, metrics map[string]int64) error {
+	return ep.PublishWithDimensions(ctx, orgSlug, queue, nil, metrics)
+}
+
+// PublishWithDimensions writes one log line for metrics, with extra
+// dimensions on top of Org and Queue.
+func (ep *emfMetricsPublisher) PublishWithDimensions(ctx context.Context, orgSlug, queue string, extra map[string]string, metrics map[string]int64) error {
+	names, values := ep.metricDimensions(orgSlug, queue, extra)
+
+	directive := emfMetricDirective{
+		Namespace:  ep.namespace,
+		Dimensions: [][]string{names},
+	}
+	line := make(map[string]any, len(values)+len(metrics)+1)
+	for name, value := range values {
+		line[name] = value
+	}
+	for _, k := range slices.Sorted(maps.Keys(metrics)) {
+		m := emfMetric{Name: k, Unit: string(metricUnit(k))}
+		if ep.highResolution {
+			m.StorageResolution = 1
+		}
+		directive.Metrics = append(directive.Metrics, m)
+		line[k] = metrics[k]
+	}
+	line["_aws"] = emfMetadata{
+		Timestamp:         orWallClock(ep.clock).Now().UnixMilli(),
+		CloudWatchMetrics: []emfMetricDirective{directive},
+	}
+
+	b, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+	// One write per line, so lines aren't interleaved with the log
+	_, err = ep.out.Write(append(b, '\n'))
+	return err
+}
+
+// extraLabel formats extra dimensions for a log attribute, e.g.
+// "Mode=pause,SetBy=alice".
+func extraLabel(extra map[string]string) string {
+	parts := make([]string, 0, len(extra))
+	for _, name := range slices.Sorted(maps.Keys(extra)) {
+		parts = append(parts, name+"="+extra[name])
+	}
+	return strings.Join(parts, ",")
+}
+
+// dimensionValue returns v, or "unknown" since CloudWatch rejects empty
+// dimension values.
+func dimensionValue(v string) string {
+	if v == "" {
+		return "unknown"
+	}
+	return v
+}
+
 type dryRunMetricsPublisher struct{}
 
 func (p *dryRunMetricsPublisher) Publish(ctx context.Context, orgSlug, queue string, metrics map[string]int64) error {
 	for k, v := range metrics {
-		log.Printf("[DRY RUN] Would publish metric %s=%d [org=%s,queue=%s]", k, v, orgSlug, queue)
+		logging.FromContext(ctx).Info("[DRY RUN] Would publish metric", "metric", k, "value", v)
+	}
+	return nil
+}
+
+func (p *dryRunMetricsPublisher) PublishWithDimensions(ctx context.Context, orgSlug, queue string, extra map[string]string, metrics map[string]int64) error {
+	for k, v := range metrics {
+		logging.FromContext(ctx).Info("[DRY RUN] Would publish metric", "metric", k, "value", v, "dimensions", extraLabel(extra))
 	}
 	return nil
 }
@@ -0,0 +1,211 @@
+package scaler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+// fakeCloudWatch records PutMetricData calls.
+type fakeCloudWatch struct {
+	inputs []*cloudwatch.PutMetricDataInput
+}
+
+func (f *fakeCloudWatch) PutMetricData(ctx context.Context, params *cloudwatch.PutMetricDataInput, _ ...func(*cloudwatch.Options)) (*cloudwatch.PutMetricDataOutput, error) {
+	f.inputs = append(f.inputs, params)
+	return &cloudwatch.PutMetricDataOutput{}, nil
+}
+
+// published returns each metric published, by name, with its dimensions as
+// "Name=value" in order.
+func (f *fakeCloudWatch) published() map[string][]string {
+	metrics := make(map[string][]string)
+	for _, in := range f.inputs {
+		for _, d := range in.MetricData {
+			var dimensions []string
+			for _, dim := range d.Dimensions {
+				dimensions = append(dimensions, aws.ToString(dim.Name)+"="+aws.ToString(dim.Value))
+			}
+			metrics[aws.ToString(d.MetricName)] = dimensions
+		}
+	}
+	return metrics
+}
+
+func TestParseMetricDimensions(t *testing.T) {
+	got, err := ParseMetricDimensions("Stack=ci, Team = platform\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"Stack": "ci", "Team": "platform"}; !maps.Equal(got, want) {
+		t.Errorf("ParseMetricDimensions() = %v, want %v", got, want)
+	}
+
+	for _, s := range []string{"Stack", "Stack=", "=ci"} {
+		if _, err := ParseMetricDimensions(s); err == nil {
+			t.Errorf("ParseMetricDimensions(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func TestNewMetricsConfig(t *testing.T) {
+	c, err := newMetricsConfig(CloudWatchMetricsParams{Dimensions: map[string]string{"Stack": "ci"}, ASGDimension: true}, "agents")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.namespace != "Buildkite" {
+		t.Errorf("namespace = %q, want the Buildkite default", c.namespace)
+	}
+	names, values := c.metricDimensions("llamacorp", "default", map[string]string{"Mode": ""})
+	if want := []string{"Org", "Queue", "AutoScalingGroup", "Stack", "Mode"}; !slices.Equal(names, want) {
+		t.Errorf("dimension names = %v, want %v", names, want)
+	}
+	if values["AutoScalingGroup"] != "agents" || values["Mode"] != "unknown" {
+		t.Errorf("dimension values = %v", values)
+	}
+
+	for _, params := range []CloudWatchMetricsParams{
+		{Format: "statsd"},
+		{Dimensions: map[string]string{"Queue": "other"}},
+	} {
+		if _, err := newMetricsConfig(params, "agents"); err == nil {
+			t.Errorf("newMetricsConfig(%+v) succeeded, want an error", params)
+		}
+	}
+}
+
+func TestEMFPublisher(t *testing.T) {
+	var out bytes.Buffer
+	p := &emfMetricsPublisher{
+		out: &out,
+		metricsConfig: metricsConfig{
+			namespace:      "CI",
+			dimensions:     map[string]string{"AutoScalingGroup": "agents"},
+			highResolution: true,
+		},
+	}
+	err := p.PublishWithDimensions(context.Background(), "llamacorp", "default",
+		map[string]string{"Outcome": "failed"},
+		map[string]int64{"AgentStopSignals": 2, "AgentAvailabilityPercent": 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := bytes.Split(bytes.TrimSuffix(out.Bytes(), []byte("\n")), []byte("\n"))
+	if len(lines) != 1 {
+		t.Fatalf("wrote %d lines, want 1: %s", len(lines), out.String())
+	}
+	var line struct {
+		AWS struct {
+			Timestamp         int64
+			CloudWatchMetrics []struct {
+				Namespace  string
+				Dimensions [][]string
+				Metrics    []emfMetric
+			}
+		} `json:"_aws"`
+		Org              string
+		Queue            string
+		AutoScalingGroup string
+		Outcome          string
+		AgentStopSignals int64
+	}
+	if err := json.Unmarshal(lines[0], &line); err != nil {
+		t.Fatalf("line isn't JSON: %v: %s", err, lines[0])
+	}
+
+	if line.AWS.Timestamp == 0 || len(line.AWS.CloudWatchMetrics) != 1 {
+		t.Fatalf("_aws = %+v", line.AWS)
+	}
+	directive := line.AWS.CloudWatchMetrics[0]
+	if directive.Namespace != "CI" {
+		t.Errorf("namespace = %q, want CI", directive.Namespace)
+	}
+	if want := [][]string{{"Org", "Queue", "AutoScalingGroup", "Outcome"}}; len(directive.Dimensions) != 1 || !slices.Equal(directive.Dimensions[0], want[0]) {
+		t.Errorf("dimensions = %v, want %v", directive.Dimensions, want)
+	}
+	wantMetrics := []emfMetric{
+		{Name: "AgentAvailabilityPercent", Unit: "Percent", StorageResolution: 1},
+		{Name: "AgentStopSignals", Unit: "Count", StorageResolution: 1},
+	}
+	if !slices.Equal(directive.Metrics, wantMetrics) {
+		t.Errorf("metrics = %+v, want %+v", directive.Metrics, wantMetrics)
+	}
+	if line.Org != "llamacorp" || line.Queue != "default" || line.AutoScalingGroup != "agents" || line.Outcome != "failed" || line.AgentStopSignals != 2 {
+		t.Errorf("values = %+v", line)
+	}
+}
+
+func TestExtendedMetrics(t *testing.T) {
+	now := time.Now()
+	fake := &fakeAWS{desired: 2, launched: map[string]time.Time{
+		"i-a": now.Add(-30 * time.Minute),
+		"i-b": now.Add(-30 * time.Minute),
+	}}
+	cw := &fakeCloudWatch{}
+
+	s, err := NewScaler(nil, aws.Config{}, Params{
+		AutoScalingGroupName:     "agents",
+		AgentsPerInstance:        2,
+		PublishCloudWatchMetrics: true,
+		CloudWatchMetrics: CloudWatchMetricsParams{
+			Namespace:      "CI",
+			ASGDimension:   true,
+			HighResolution: true,
+			Extended:       true,
+		},
+		ScaleInParams: ScaleParams{CooldownPeriod: time.Hour, LastEvent: now},
+	}, WithAutoScalingClient(fake), WithEC2Client(fake), WithSSMClient(fake), WithCloudWatchClient(cw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.bk = &buildkiteTestDriver{metrics: buildkite.AgentMetrics{
+		OrgSlug:     "llamacorp",
+		Queue:       "default",
+		RunningJobs: 3,
+		BusyAgents:  3,
+		TotalAgents: 3,
+	}}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	published := cw.published()
+	for _, name := range []string{
+		"ScheduledJobsCount", "IdleAgentsCount", "BusyAgentsCount", "TotalAgentsCount",
+		"DesiredInstancesCount", "ActualInstancesCount", "PendingInstancesCount",
+		"AgentAvailabilityPercent", "DanglingInstancesFound", "DanglingInstancesMarked",
+	} {
+		dimensions, ok := published[name]
+		if !ok {
+			t.Errorf("%s wasn't published", name)
+			continue
+		}
+		if want := []string{"Org=llamacorp", "Queue=default", "AutoScalingGroup=agents"}; !slices.Equal(dimensions, want) {
+			t.Errorf("%s dimensions = %v, want %v", name, dimensions, want)
+		}
+	}
+
+	for _, in := range cw.inputs {
+		if aws.ToString(in.Namespace) != "CI" {
+			t.Errorf("namespace = %q, want CI", aws.ToString(in.Namespace))
+		}
+		for _, d := range in.MetricData {
+			if aws.ToInt32(d.StorageResolution) != 1 {
+				t.Errorf("%s storage resolution = %d, want 1", aws.ToString(d.MetricName), aws.ToInt32(d.StorageResolution))
+			}
+			if aws.ToString(d.MetricName) == "AgentAvailabilityPercent" && aws.ToFloat64(d.Value) != 75 {
+				t.Errorf("AgentAvailabilityPercent = %v, want 75 (3 of 4 agents)", aws.ToFloat64(d.Value))
+			}
+		}
+	}
+}
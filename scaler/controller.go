@@ -0,0 +1,169 @@
+package scaler
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+const (
+	// ControllerModeStep sets desired capacity straight from the job-based
+	// calculation, with ScaleParams.Factor applied to each change. This is the
+	// default.
+	ControllerModeStep = "step"
+	// ControllerModePID drives desired capacity with a closed-loop PID
+	// controller instead of the step function.
+	ControllerModePID = "pid"
+
+	// ControllerSignalBacklog uses the gap between the job-based desired count
+	// (including any instance buffer) and the ASG desired count as the error.
+	ControllerSignalBacklog = "backlog"
+	// ControllerSignalWait uses scheduled jobs that have no idle agent to run
+	// them, in instances, as the error. Idle agents drive it negative.
+	ControllerSignalWait = "wait"
+
+	// controllerStateMaxAge is how old controller state can be before it is
+	// discarded. Integrating or differentiating across a long gap (e.g. a cold
+	// Lambda start) would produce a large, meaningless jump.
+	controllerStateMaxAge = 5 * time.Minute
+)
+
+// ControllerParams configures the optional closed-loop controller. Gains are
+// in instances per instance of error; Ki is per second of accumulated error
+// and Kd per instance of error change per second.
+type ControllerParams struct {
+	Mode   string
+	Signal string
+	Kp     float64
+	Ki     float64
+	Kd     float64
+	// IntegralLimit bounds the integral term, in instances, for anti-windup.
+	// When 0 it defaults to the size of the ASG's Min/Max range.
+	IntegralLimit float64
+}
+
+// ControllerState is the PID controller state carried between Run cycles.
+type ControllerState struct {
+	Integral   float64
+	LastError  float64
+	LastUpdate time.Time
+}
+
+// ParseControllerParams validates the controller mode and signal, filling in
+// defaults for empty values.
+func ParseControllerParams(p ControllerParams) (ControllerParams, error) {
+	switch p.Mode {
+	case "":
+		p.Mode = ControllerModeStep
+	case ControllerModeStep, ControllerModePID:
+	default:
+		return p, fmt.Errorf("unknown controller mode %q (expected %q or %q)", p.Mode, ControllerModeStep, ControllerModePID)
+	}
+
+	switch p.Signal {
+	case "":
+		p.Signal = ControllerSignalBacklog
+	case ControllerSignalBacklog, ControllerSignalWait:
+	default:
+		return p, fmt.Errorf("unknown controller signal %q (expected %q or %q)", p.Signal, ControllerSignalBacklog, ControllerSignalWait)
+	}
+
+	if p.IntegralLimit < 0 {
+		return p, fmt.Errorf("controller integral limit must not be negative, got %v", p.IntegralLimit)
+	}
+
+	return p, nil
+}
+
+type pidController struct {
+	params ControllerParams
+	state  ControllerState
+
+	lastUnclamped int64   // Output of the last call to next before clamping, for reporting clamps
+	nextIntegral  float64 // The integral after the last call to next, see commitIntegral
+}
+
+// errorSignal returns the controller error, in instances, for the configured
+// signal. target is the job-based desired count, including any buffer.
+func (c *pidController) errorSignal(metrics *buildkite.AgentMetrics, target, current int64, agentsPerInstance int) float64 {
+	if c.params.Signal == ControllerSignalWait {
+		if agentsPerInstance <= 0 {
+			agentsPerInstance = 1
+		}
+		return float64(metrics.ScheduledJobs-metrics.IdleAgents) / float64(agentsPerInstance)
+	}
+	return float64(target - current)
+}
+
+// next returns the desired count for error e, relative to base, clamped to
+// [lower, upper]. The integral is only accumulated while the output is not
+// saturated in the direction of the error (conditional integration), and the
+// integral term is bounded by IntegralLimit, so a long backlog against
+// MaxSize doesn't wind the controller up. The integral isn't updated until
+// commitIntegral, so error the scaler couldn't act on doesn't wind it up
+// either.
+func (c *pidController) next(logger *slog.Logger, e float64, base, lower, upper int64, now time.Time) int64 {
+	var dt float64
+	if !c.state.LastUpdate.IsZero() {
+		elapsed := now.Sub(c.state.LastUpdate)
+		if elapsed > controllerStateMaxAge || elapsed < 0 {
+			logger.Info("↳ 🎛️ Controller state is stale, resetting", slog.Duration("age", elapsed.Round(time.Second)))
+			c.state = ControllerState{}
+		} else {
+			dt = elapsed.Seconds()
+		}
+	}
+
+	proportional := c.params.Kp * e
+
+	var derivative float64
+	if dt > 0 {
+		derivative = c.params.Kd * (e - c.state.LastError) / dt
+	}
+
+	integral := c.state.Integral + e*dt
+	integralTerm := c.params.Ki * integral
+	limit := c.params.IntegralLimit
+	if limit == 0 {
+		limit = float64(upper - lower)
+	}
+	if c.params.Ki != 0 && math.Abs(integralTerm) > limit {
+		integralTerm = math.Copysign(limit, integralTerm)
+		integral = integralTerm / c.params.Ki
+	}
+
+	out := base + int64(math.Round(proportional+integralTerm+derivative))
+	c.lastUnclamped = out
+
+	saturated := false
+	if out > upper {
+		out = upper
+		saturated = e > 0
+	}
+	if out < lower {
+		out = lower
+		saturated = e < 0
+	}
+	c.nextIntegral = c.state.Integral
+	if !saturated {
+		c.nextIntegral = integral
+	}
+	c.state.LastError = e
+	c.state.LastUpdate = now
+
+	logger.Info("↳ 🎛️ Controller output", "signal", c.params.Signal,
+		"error", e, "p", proportional, "i", integralTerm, "d", derivative,
+		"desired", out, "base", base, "lower", lower, "upper", upper)
+
+	return out
+}
+
+// commitIntegral keeps the integral from the last call to next. The scaler
+// calls it once the output has been acted on, and not while a cooldown,
+// scaling policy or disabled direction holds desired capacity.
+func (c *pidController) commitIntegral() {
+	c.state.Integral = c.nextIntegral
+}
@@ -0,0 +1,199 @@
+package scaler
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+func TestPIDControllerProportionalOnlyMatchesStep(t *testing.T) {
+	c := &pidController{params: ControllerParams{Kp: 1}}
+	// Backlog of 8 instances on top of 2 gives 10, same as the step function.
+	if got := c.next(slog.Default(), 8, 2, 0, 100, time.Unix(0, 0)); got != 10 {
+		t.Errorf("next() = %d, want 10", got)
+	}
+}
+
+func TestPIDControllerClampsToBounds(t *testing.T) {
+	c := &pidController{params: ControllerParams{Kp: 2}}
+	if got := c.next(slog.Default(), 50, 10, 1, 20, time.Unix(0, 0)); got != 20 {
+		t.Errorf("next() = %d, want upper bound 20", got)
+	}
+	if got := c.next(slog.Default(), -50, 10, 1, 20, time.Unix(10, 0)); got != 1 {
+		t.Errorf("next() = %d, want lower bound 1", got)
+	}
+}
+
+func TestPIDControllerAntiWindup(t *testing.T) {
+	c := &pidController{params: ControllerParams{Kp: 0, Ki: 0.1}}
+	start := time.Unix(0, 0)
+	c.next(slog.Default(), 0, 10, 0, 10, start)
+
+	// A sustained backlog against MaxSize saturates the output, so the
+	// integral must not keep growing.
+	for i := 1; i <= 20; i++ {
+		if got := c.next(slog.Default(), 5, 10, 0, 10, start.Add(time.Duration(i)*10*time.Second)); got != 10 {
+			t.Fatalf("cycle %d: next() = %d, want 10", i, got)
+		}
+	}
+	if c.state.Integral != 0 {
+		t.Errorf("integral wound up to %v while saturated, want 0", c.state.Integral)
+	}
+
+	// Once the backlog clears, the output responds immediately rather than
+	// waiting for a wound-up integral to unwind.
+	if got := c.next(slog.Default(), -2, 10, 0, 10, start.Add(210*time.Second)); got != 8 {
+		t.Errorf("next() after backlog cleared = %d, want 8", got)
+	}
+}
+
+func TestPIDControllerIntegralLimit(t *testing.T) {
+	c := &pidController{params: ControllerParams{Ki: 1, IntegralLimit: 3}}
+	start := time.Unix(0, 0)
+	c.next(slog.Default(), 0, 0, 0, 100, start)
+	if got := c.next(slog.Default(), 10, 0, 0, 100, start.Add(10*time.Second)); got != 3 {
+		t.Errorf("next() = %d, want integral term capped at 3", got)
+	}
+}
+
+func TestPIDControllerDerivative(t *testing.T) {
+	c := &pidController{params: ControllerParams{Kd: 10}}
+	start := time.Unix(0, 0)
+	c.next(slog.Default(), 0, 5, 0, 100, start)
+	// Error rising by 2 over 10s is 0.2/s, times Kd of 10.
+	if got := c.next(slog.Default(), 2, 5, 0, 100, start.Add(10*time.Second)); got != 7 {
+		t.Errorf("next() = %d, want 7", got)
+	}
+}
+
+func TestPIDControllerResetsStaleState(t *testing.T) {
+	c := &pidController{
+		params: ControllerParams{Ki: 1, Kd: 1},
+		state:  ControllerState{Integral: 100, LastError: 50, LastUpdate: time.Unix(0, 0)},
+	}
+	if got := c.next(slog.Default(), 1, 5, 0, 100, time.Unix(0, 0).Add(time.Hour)); got != 5 {
+		t.Errorf("next() = %d, want 5 from fresh state", got)
+	}
+	if c.state.Integral != 0 {
+		t.Errorf("integral = %v, want 0 after reset", c.state.Integral)
+	}
+}
+
+func TestPIDControllerWaitSignal(t *testing.T) {
+	c := &pidController{params: ControllerParams{Signal: ControllerSignalWait}}
+	metrics := &buildkite.AgentMetrics{ScheduledJobs: 10, IdleAgents: 2}
+	if got := c.errorSignal(metrics, 0, 0, 4); got != 2 {
+		t.Errorf("errorSignal() = %v, want 2", got)
+	}
+}
+
+func TestParseControllerParams(t *testing.T) {
+	p, err := ParseControllerParams(ControllerParams{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.Mode != ControllerModeStep || p.Signal != ControllerSignalBacklog {
+		t.Errorf("defaults = %q/%q, want step/backlog", p.Mode, p.Signal)
+	}
+
+	for _, bad := range []ControllerParams{
+		{Mode: "bang-bang"},
+		{Mode: ControllerModePID, Signal: "latency"},
+		{Mode: ControllerModePID, IntegralLimit: -1},
+	} {
+		if _, err := ParseControllerParams(bad); err == nil {
+			t.Errorf("ParseControllerParams(%+v) = nil error, want error", bad)
+		}
+	}
+}
+
+func TestScalingWithPIDControllerIgnoresFactor(t *testing.T) {
+	asg := &asgTestDriver{desiredCapacity: 2}
+	s := Scaler{
+		autoscaling: asg,
+		bk: &buildkiteTestDriver{metrics: buildkite.AgentMetrics{
+			ScheduledJobs: 10,
+			TotalAgents:   2,
+		}},
+		scaling: ScalingCalculator{
+			agentsPerInstance: 1,
+		},
+		scaleOutParams: ScaleParams{Factor: 0.1},
+		controller: &pidController{params: ControllerParams{
+			Mode:   ControllerModePID,
+			Signal: ControllerSignalBacklog,
+			Kp:     0.5,
+		}},
+	}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Backlog of 8 (10 needed, 2 desired) at Kp 0.5 adds 4; the 0.1 factor
+	// would have added 1.
+	if asg.desiredCapacity != 6 {
+		t.Errorf("desired capacity = %d, want 6", asg.desiredCapacity)
+	}
+	if s.State().Controller.LastUpdate.IsZero() {
+		t.Error("expected controller state to be carried in State()")
+	}
+}
+
+// steppedClock only moves when the test moves it.
+type steppedClock struct{ now time.Time }
+
+func (c *steppedClock) Now() time.Time { return c.now }
+
+func (c *steppedClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.now = c.now.Add(d)
+	return nil
+}
+
+func TestPIDControllerIntegralFrozenThroughCooldown(t *testing.T) {
+	clock := &steppedClock{now: time.Unix(1000, 0)}
+	asg := &asgTestDriver{desiredCapacity: 10}
+	s := Scaler{
+		autoscaling: asg,
+		bk:          &buildkiteTestDriver{metrics: buildkite.AgentMetrics{ScheduledJobs: 2, TotalAgents: 10, IdleAgents: 8}},
+		scaling:     ScalingCalculator{agentsPerInstance: 1},
+		scaleInParams: ScaleParams{
+			CooldownPeriod: time.Hour,
+			LastEvent:      clock.now,
+		},
+		controller: &pidController{params: ControllerParams{
+			Mode:   ControllerModePID,
+			Signal: ControllerSignalBacklog,
+			Kp:     0.5,
+			Ki:     0.001,
+		}},
+		clock: clock,
+	}
+
+	// The backlog wants a scale-in throughout a cooldown
+	for range 30 {
+		clock.now = clock.now.Add(10 * time.Second)
+		if _, err := s.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if got := s.LastDecision().Reason; got != "scale-in-cooldown" {
+			t.Fatalf("LastDecision().Reason = %q, want scale-in-cooldown", got)
+		}
+	}
+	if got := s.State().Controller.Integral; got != 0 {
+		t.Errorf("integral wound up to %v during the cooldown, want 0", got)
+	}
+
+	// Once the cooldown is over, the error integrates from there
+	clock.now = clock.now.Add(10 * time.Second)
+	s.scaleInParams.LastEvent = clock.now.Add(-time.Hour)
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.State().Controller.Integral; got >= 0 {
+		t.Errorf("integral after the cooldown = %v, want it to follow the negative error", got)
+	}
+}
@@ -0,0 +1,222 @@
+package scaler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+	"github.com/buildkite/buildkite-agent-scaler/logging"
+)
+
+// DanglingAgentParams configures detection of instances with no connected
+// agent from Buildkite's own view of connected agents, rather than by asking
+// each instance over SSM.
+type DanglingAgentParams struct {
+	GracePeriod    time.Duration // How long an InService instance may run without a connected agent (0 disables)
+	ConfirmWithSSM bool          // Confirm each instance over SSM before marking it unhealthy
+}
+
+// danglingAgentAPI is implemented by ASG drivers that can act on instances
+// flagged by the heartbeat check.
+type danglingAgentAPI interface {
+	MarkInstancesUnhealthy(ctx context.Context, instanceIDs []string) (int, error)
+	ConfirmDanglingWithSSM(ctx context.Context, instanceIDs []string, platform string) (int, error)
+}
+
+// findAgentlessInstances returns the InService instances older than the
+// grace period that no connected agent reports as its aws:instance-id, oldest
+// first.
+func findAgentlessInstances(asg AutoscaleGroupDetails, agents []buildkite.Agent, launchTimes map[string]time.Time, gracePeriod time.Duration, now time.Time) []string {
+	connected := make(map[string]bool, len(agents))
+	for _, agent := range agents {
+		if id := agent.MetaDataValue(buildkite.InstanceIDMetaDataKey); id != "" {
+			connected[id] = true
+		}
+	}
+
+	var agentless []string
+	for _, instance := range asg.Instances {
+		if instance.LifecycleState != string(types.LifecycleStateInService) || connected[instance.ID] {
+			continue
+		}
+		launched, ok := launchTimes[instance.ID]
+		if !ok || now.Sub(launched) < gracePeriod {
+			continue
+		}
+		agentless = append(agentless, instance.ID)
+	}
+
+	slices.SortStableFunc(agentless, func(a, b string) int {
+		return launchTimes[a].Compare(launchTimes[b])
+	})
+	return agentless
+}
+
+// minHeartbeatCheckInterval is the least time between heartbeat checks.
+// Listing agents pages through the whole organization, as the REST API can't
+// filter agents by queue or meta-data, so checking every poll would run into
+// its rate limits on a large organization.
+const minHeartbeatCheckInterval = time.Minute
+
+// checkAgentHeartbeats flags InService instances that never connected an agent
+// by the registration deadline, or have had no connected agent for longer than
+// the grace period, and marks them unhealthy so the ASG replaces them. It runs
+// at most once per heartbeat interval.
+func (s *Scaler) checkAgentHeartbeats(ctx context.Context, orgSlug, queue string, asg AutoscaleGroupDetails) (err error) {
+	if s.heartbeatChecked {
+		return nil
+	}
+	s.heartbeatChecked = true
+
+	now := s.now()
+	if now.Sub(s.lastHeartbeatCheck) < s.heartbeatInterval {
+		logging.FromContext(ctx).Debug("💓 Skipping agent heartbeat check until the next interval",
+			"last_checked", s.lastHeartbeatCheck.Format(time.RFC3339), slog.Duration("interval", s.heartbeatInterval))
+		return nil
+	}
+	s.lastHeartbeatCheck = now
+
+	ctx, span := startSpan(ctx, "scaler.CheckAgentHeartbeats", attrASG.String(s.asgName), attrQueue.String(queue))
+	defer func() { endSpan(span, err) }()
+
+	api, ok := s.autoscaling.(danglingAgentAPI)
+	if !ok {
+		return nil
+	}
+
+	agents, err := s.agents.ListConnectedAgents(ctx, orgSlug)
+	if err != nil {
+		return fmt.Errorf("listing connected agents: %w", err)
+	}
+
+	var inService []string
+	for _, instance := range asg.Instances {
+		if instance.LifecycleState == string(types.LifecycleStateInService) {
+			inService = append(inService, instance.ID)
+		}
+	}
+	if len(inService) == 0 {
+		return nil
+	}
+
+	inv, err := s.instanceInventory(ctx, asg)
+	if err != nil {
+		return err
+	}
+	if inv == nil {
+		return nil
+	}
+	launchTimes := inv.LaunchTimes()
+
+	var bootFailed []string
+	if s.boot != nil {
+		failures := s.boot.observe(asg, agents, launchTimes, now)
+		s.reportBootFailures(ctx, orgSlug, queue, failures)
+		for _, f := range failures {
+			bootFailed = append(bootFailed, f.InstanceID)
+		}
+	}
+
+	logger := logging.FromContext(ctx)
+	var agentless []string
+	if s.danglingAgents.GracePeriod > 0 {
+		agentless = slices.DeleteFunc(findAgentlessInstances(asg, agents, launchTimes, s.danglingAgents.GracePeriod, now),
+			func(id string) bool { return slices.Contains(bootFailed, id) })
+		if len(agentless) == 0 {
+			logger.Debug("💓 All InService instances older than the grace period have a connected agent", slog.Duration("grace_period", s.danglingAgents.GracePeriod))
+		}
+		for _, id := range agentless {
+			logger.Warn("💔 Instance has had no connected agent for over the grace period",
+				"instance", id, slog.Duration("grace_period", s.danglingAgents.GracePeriod), "launched", launchTimes[id].Format(time.RFC3339))
+		}
+	}
+
+	// Boot failures go first, so a broken launch template is caught before it
+	// replaces much of the fleet
+	agentless = append(bootFailed, agentless...)
+	if len(agentless) == 0 {
+		return nil
+	}
+
+	if s.maxDanglingInstancesToCheck > 0 && len(agentless) > s.maxDanglingInstancesToCheck {
+		logger.Info("↳ Acting on some of the instances this run", "acting_on", s.maxDanglingInstancesToCheck, "instances", len(agentless))
+		agentless = agentless[:s.maxDanglingInstancesToCheck]
+	}
+
+	// If no instance has an agent, Buildkite is as likely to be having a bad
+	// day as the whole fleet is, so confirm on the instances themselves.
+	confirm := s.danglingAgents.ConfirmWithSSM
+	if !confirm && len(agents) == 0 {
+		logger.Info("↳ No connected agents at all, confirming over SSM before marking instances unhealthy")
+		confirm = true
+	}
+
+	var marked int
+	if confirm {
+		marked, err = api.ConfirmDanglingWithSSM(ctx, agentless, inv.Platform())
+	} else {
+		s.decision.DanglingInstances += len(agentless)
+		marked, err = api.MarkInstancesUnhealthy(ctx, agentless)
+		s.decision.DanglingMarked += marked
+	}
+	logger.Info("↳ Marked agentless instances unhealthy", "marked", marked, "instances", len(agentless))
+	return err
+}
+
+func (s *Scaler) heartbeatsEnabled() bool {
+	return s.agents != nil && s.danglingAgents.GracePeriod > 0
+}
+
+// cleanupDanglingInstances replaces instances whose agent has stopped, using
+// agent heartbeats when a Buildkite API token is configured, and otherwise
+// checking the instances over SSM.
+func (s *Scaler) cleanupDanglingInstances(ctx context.Context, orgSlug, queue string, asg AutoscaleGroupDetails, minimumInstanceUptime time.Duration) error {
+	if s.heartbeatsEnabled() {
+		return s.checkAgentHeartbeats(ctx, orgSlug, queue, asg)
+	}
+	inv, err := s.instanceInventory(ctx, asg)
+	if err != nil {
+		return err
+	}
+	if inv == nil {
+		// The driver can't take an inventory, so there's nothing to check
+		inv = &InstanceInventory{}
+	}
+	return s.autoscaling.CleanupDanglingInstances(ctx, inv, minimumInstanceUptime, s.maxDanglingInstancesToCheck)
+}
+
+// MarkInstancesUnhealthy marks each instance unhealthy so the ASG replaces it.
+func (a *ASGDriver) MarkInstancesUnhealthy(ctx context.Context, instanceIDs []string) (int, error) {
+	svc := a.autoscalingClient()
+	marked := 0
+	var firstErr error
+	for _, id := range instanceIDs {
+		if _, err := svc.SetInstanceHealth(ctx, &autoscaling.SetInstanceHealthInput{
+			InstanceId:   aws.String(id),
+			HealthStatus: aws.String("Unhealthy"),
+		}); err != nil {
+			logging.FromContext(ctx).Warn("Failed to mark instance as unhealthy", "instance", id, "error", err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("SetInstanceHealth failed for %s: %w", id, err)
+			}
+			continue
+		}
+		logging.FromContext(ctx).Info("Marked instance as unhealthy", "instance", id)
+		marked++
+	}
+	return marked, firstErr
+}
+
+// ConfirmDanglingWithSSM checks each instance over SSM, as
+// CleanupDanglingInstances does, and marks those whose agent isn't running
+// unhealthy.
+func (a *ASGDriver) ConfirmDanglingWithSSM(ctx context.Context, instanceIDs []string, platform string) (int, error) {
+	marked, _, err := a.checkAndMarkUnhealthy(ctx, instanceIDs, a.ssmClient(), a.autoscalingClient(), platform)
+	return marked, err
+}
@@ -0,0 +1,147 @@
+package scaler
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+func TestFindAgentlessInstances(t *testing.T) {
+	now := time.Unix(100000, 0)
+	asg := AutoscaleGroupDetails{Instances: []InstanceDetails{
+		{ID: "i-connected", LifecycleState: "InService"},
+		{ID: "i-young", LifecycleState: "InService"},
+		{ID: "i-newer", LifecycleState: "InService"},
+		{ID: "i-older", LifecycleState: "InService"},
+		{ID: "i-pending", LifecycleState: "Pending"},
+	}}
+	agents := []buildkite.Agent{{MetaData: []string{"aws:instance-id=i-connected"}}}
+	launchTimes := map[string]time.Time{
+		"i-connected": now.Add(-time.Hour),
+		"i-young":     now.Add(-time.Minute),
+		"i-newer":     now.Add(-20 * time.Minute),
+		"i-older":     now.Add(-40 * time.Minute),
+		"i-pending":   now.Add(-time.Hour),
+	}
+
+	got := findAgentlessInstances(asg, agents, launchTimes, 15*time.Minute, now)
+	if want := []string{"i-older", "i-newer"}; !slices.Equal(got, want) {
+		t.Errorf("findAgentlessInstances() = %v, want %v", got, want)
+	}
+}
+
+type fakeAgentLister struct {
+	agents []buildkite.Agent
+	calls  int
+}
+
+func (f *fakeAgentLister) ListConnectedAgents(ctx context.Context, orgSlug string) ([]buildkite.Agent, error) {
+	f.calls++
+	return f.agents, nil
+}
+
+// heartbeatTestDriver adds the heartbeat check's instance APIs to
+// asgTestDriver, recording what it was asked to do.
+type heartbeatTestDriver struct {
+	asgTestDriver
+	launched       time.Time
+	markedDirectly []string
+	confirmedOver  []string
+}
+
+func (d *heartbeatTestDriver) Inventory(ctx context.Context, asg AutoscaleGroupDetails) (*InstanceInventory, error) {
+	inv := &InstanceInventory{}
+	for _, instance := range asg.Instances {
+		inv.Instances = append(inv.Instances, InventoryInstance{InstanceDetails: instance, LaunchTime: d.launched, Platform: "linux"})
+	}
+	return inv, nil
+}
+
+func (d *heartbeatTestDriver) MarkInstancesUnhealthy(ctx context.Context, instanceIDs []string) (int, error) {
+	d.markedDirectly = append(d.markedDirectly, instanceIDs...)
+	return len(instanceIDs), nil
+}
+
+func (d *heartbeatTestDriver) ConfirmDanglingWithSSM(ctx context.Context, instanceIDs []string, platform string) (int, error) {
+	d.confirmedOver = append(d.confirmedOver, instanceIDs...)
+	return len(instanceIDs), nil
+}
+
+func TestRunChecksAgentHeartbeats(t *testing.T) {
+	for _, tc := range []struct {
+		name          string
+		agents        []buildkite.Agent
+		wantMarked    []string
+		wantConfirmed []string
+	}{
+		{
+			name:       "agentless instance is marked unhealthy",
+			agents:     []buildkite.Agent{{MetaData: []string{"aws:instance-id=i-000000000000"}}},
+			wantMarked: []string{"i-000000000001"},
+		},
+		{
+			name:          "no connected agents at all confirms over SSM",
+			wantConfirmed: []string{"i-000000000000", "i-000000000001"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			asg := &heartbeatTestDriver{
+				asgTestDriver: asgTestDriver{desiredCapacity: 2},
+				launched:      time.Now().Add(-time.Hour),
+			}
+			s := Scaler{
+				autoscaling:    asg,
+				bk:             &buildkiteTestDriver{metrics: buildkite.AgentMetrics{OrgSlug: "llamacorp", RunningJobs: 2}},
+				scaling:        ScalingCalculator{agentsPerInstance: 1},
+				agents:         &fakeAgentLister{agents: tc.agents},
+				danglingAgents: DanglingAgentParams{GracePeriod: 15 * time.Minute},
+			}
+
+			if _, err := s.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(asg.markedDirectly, tc.wantMarked) {
+				t.Errorf("marked unhealthy = %v, want %v", asg.markedDirectly, tc.wantMarked)
+			}
+			if !slices.Equal(asg.confirmedOver, tc.wantConfirmed) {
+				t.Errorf("confirmed over SSM = %v, want %v", asg.confirmedOver, tc.wantConfirmed)
+			}
+		})
+	}
+}
+
+func TestRunChecksAgentHeartbeatsOncePerInterval(t *testing.T) {
+	lister := &fakeAgentLister{agents: []buildkite.Agent{{MetaData: []string{"aws:instance-id=i-000000000000"}}}}
+	s := Scaler{
+		autoscaling: &heartbeatTestDriver{
+			asgTestDriver: asgTestDriver{desiredCapacity: 1},
+			launched:      time.Now().Add(-time.Hour),
+		},
+		bk:                &buildkiteTestDriver{metrics: buildkite.AgentMetrics{OrgSlug: "llamacorp", RunningJobs: 1}},
+		scaling:           ScalingCalculator{agentsPerInstance: 1},
+		agents:            lister,
+		danglingAgents:    DanglingAgentParams{GracePeriod: 15 * time.Minute},
+		heartbeatInterval: time.Minute,
+	}
+
+	for range 3 {
+		if _, err := s.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if lister.calls != 1 {
+		t.Errorf("listed agents %d times within the interval, want once", lister.calls)
+	}
+
+	// Once the interval has passed, agents are listed again
+	s.lastHeartbeatCheck = s.lastHeartbeatCheck.Add(-time.Minute)
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if lister.calls != 2 {
+		t.Errorf("listed agents %d times, want a second listing after the interval", lister.calls)
+	}
+}
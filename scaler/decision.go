@@ -0,0 +1,140 @@
+package scaler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+// Actions a Decision can record.
+const (
+	ActionNone     = "none"
+	ActionScaleOut = "scale-out"
+	ActionScaleIn  = "scale-in"
+)
+
+// Decision records what one Run decided and why, for logging and reporting.
+type Decision struct {
+	Time    time.Time
+	Action  string
+	Current int64   // ASG desired capacity when the run started
+	Desired int64   // Desired capacity the run settled on
+	Reason  string  // Why the run took no action, if it didn't
+	Clamps  []Clamp // Every bound that changed the desired count, in order
+
+	// What the run read, for reporting
+	Actual  int64                   // Instances in the ASG
+	Pending int64                   // Instances launching
+	Metrics *buildkite.AgentMetrics // The queue, nil if the run didn't get that far
+
+	Availability *float64 // Connected agents over those expected of the ASG's instances, nil if not calculated
+
+	DanglingInstances int // Instances found with their agent stopped, replaced or quarantined
+	DanglingMarked    int // Of those, instances marked unhealthy or quarantined
+
+	Signals []SignalOutcome // Agents asked to stop on instances being scaled in or drained
+
+	Shadow []ShadowAction // Changes not made because the scaler is in shadow mode
+
+	Candidate *Decision // The candidate config's decision on the same inputs, see Params.Candidate
+}
+
+// Clamp records a bound that changed the desired count during a decision.
+type Clamp struct {
+	Bound string // Which bound applied, e.g. "asg-max", "tag-min", "scale-out-policy"
+	From  int64
+	To    int64
+}
+
+// clamp records that bound moved the desired count from from to to.
+func (d *Decision) clamp(bound string, from, to int64) {
+	d.Clamps = append(d.Clamps, Clamp{Bound: bound, From: from, To: to})
+}
+
+// summary describes the action and desired count, e.g. "none
+// (scale-in-cooldown), desired 3 -> 3".
+func (d *Decision) summary() string {
+	msg := d.Action
+	if d.Reason != "" {
+		msg += " (" + d.Reason + ")"
+	}
+	return fmt.Sprintf("%s, desired %d -> %d", msg, d.Current, d.Desired)
+}
+
+// log writes a one-line summary of the decision, labelled e.g. "Candidate"
+// for a candidate config's.
+func (d *Decision) log(logger *slog.Logger, label string) {
+	msg := "📋 Decision"
+	if label != "" {
+		msg = "📋 " + label + " decision"
+	}
+	attrs := []any{
+		"action", d.Action,
+		"current", d.Current,
+		"desired", d.Desired,
+	}
+	if d.Reason != "" {
+		attrs = append(attrs, "reason", d.Reason)
+	}
+	if len(d.Clamps) > 0 {
+		attrs = append(attrs, "clamps", fmt.Sprint(d.Clamps))
+	}
+	if len(d.Signals) > 0 {
+		attrs = append(attrs, "signals", signalSummary(d.Signals))
+	}
+	if len(d.Shadow) > 0 {
+		attrs = append(attrs, "shadow", shadowSummary(d.Shadow))
+	}
+	logger.Info(msg, attrs...)
+}
+
+// publishDecisionMetrics publishes what the run read and did, for
+// CloudWatchMetricsParams.Extended. Runs that didn't get as far as the
+// queue's metrics publish nothing, as the Org and Queue dimensions aren't
+// known.
+func (s *Scaler) publishDecisionMetrics(ctx context.Context) {
+	d := s.decision
+	if s.metrics == nil || d.Metrics == nil {
+		return
+	}
+	q := d.Metrics
+
+	metrics := map[string]int64{
+		"IdleAgentsCount":         q.IdleAgents,
+		"BusyAgentsCount":         q.BusyAgents,
+		"TotalAgentsCount":        q.TotalAgents,
+		"DesiredInstancesCount":   d.Desired,
+		"ActualInstancesCount":    d.Actual,
+		"PendingInstancesCount":   d.Pending,
+		"DanglingInstancesFound":  int64(d.DanglingInstances),
+		"DanglingInstancesMarked": int64(d.DanglingMarked),
+	}
+	if d.Availability != nil {
+		metrics["AgentAvailabilityPercent"] = int64(math.Round(*d.Availability * 100))
+	}
+	if err := s.metrics.Publish(ctx, q.OrgSlug, q.Queue, metrics); err != nil {
+		s.log.Warn("⚠️  Could not publish decision metrics", "error", err)
+		return
+	}
+
+	// One series per outcome, so failures can be alarmed on separately
+	outcomes := make(map[string]int64)
+	for _, o := range d.Signals {
+		outcomes[o.Outcome]++
+	}
+	for _, outcome := range slices.Sorted(maps.Keys(outcomes)) {
+		if err := s.metrics.PublishWithDimensions(ctx, q.OrgSlug, q.Queue,
+			map[string]string{"Outcome": outcome},
+			map[string]int64{"AgentStopSignals": outcomes[outcome]},
+		); err != nil {
+			s.log.Warn("⚠️  Could not publish agent stop signal metrics", "error", err)
+			return
+		}
+	}
+}
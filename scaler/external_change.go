@@ -0,0 +1,124 @@
+package scaler
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/logging"
+)
+
+// selfTerminationCause is in the cause of an activity where an instance left
+// the ASG with TerminateInstanceInAutoScalingGroup and
+// ShouldDecrementDesiredCapacity, as Elastic CI Stack agents do when they
+// terminate themselves. That lowers desired capacity, but it isn't an
+// operator overriding the scaler.
+const selfTerminationCause = "taken out of service in response to a user request, shrinking the capacity"
+
+// ManualOverride is a change to desired capacity the scaler didn't make. The
+// scaler holds desired capacity at To until Expires.
+type ManualOverride struct {
+	Detected time.Time
+	From     int64
+	To       int64
+	Expires  time.Time
+	Cause    string // Cause of the ASG activity behind the change, if known
+}
+
+func (o ManualOverride) holding(desired int64, now time.Time) bool {
+	return !o.Detected.IsZero() && o.To == desired && now.Before(o.Expires)
+}
+
+// activityCauser is implemented by ASG drivers that can explain changes to
+// desired capacity.
+type activityCauser interface {
+	ActivityCausesSince(ctx context.Context, since time.Time) ([]string, error)
+}
+
+var selfTerminationShrink = regexp.MustCompile(`shrinking the capacity from (\d+) to (\d+)`)
+
+// selfTerminated returns how far the activities with causes reduced desired
+// capacity by instances terminating themselves.
+func selfTerminated(causes []string) int64 {
+	var n int64
+	for _, cause := range causes {
+		if !strings.Contains(cause, selfTerminationCause) {
+			continue
+		}
+		m := selfTerminationShrink.FindStringSubmatch(cause)
+		if m == nil {
+			n++
+			continue
+		}
+		from, _ := strconv.ParseInt(m[1], 10, 64)
+		to, _ := strconv.ParseInt(m[2], 10, 64)
+		n += from - to
+	}
+	return n
+}
+
+// checkExternalChange compares the ASG's desired capacity with the last value
+// the scaler set, and records a manual override if someone else changed it.
+// After a cold start, the last value the scaler set comes from its scaling
+// records in the ASG's tags. It reports whether desired capacity should be
+// held for an override.
+func (s *Scaler) checkExternalChange(ctx context.Context, asg AutoscaleGroupDetails, now time.Time) bool {
+	if s.externalChangeGracePeriod <= 0 {
+		return false
+	}
+	if s.lastDesired.Time.IsZero() {
+		s.lastDesired = lastRecordedChange(asg.Tags)
+		if s.lastDesired.Time.IsZero() {
+			return false
+		}
+	}
+
+	if asg.DesiredCount != s.lastDesired.To && asg.DesiredCount != s.override.To {
+		// Several agents may have terminated themselves since the scaler
+		// last set desired capacity, so look at every activity since then
+		var causes []string
+		if causer, ok := s.autoscaling.(activityCauser); ok {
+			var err error
+			if causes, err = causer.ActivityCausesSince(ctx, s.lastDesired.Time); err != nil {
+				logging.FromContext(ctx).Warn("⚠️  Could not describe scaling activities to explain a desired capacity change", "error", err)
+			}
+		}
+
+		if n := selfTerminated(causes); n > 0 && s.lastDesired.To-n == asg.DesiredCount {
+			logging.FromContext(ctx).Info("↳ Desired capacity dropped as instances terminated themselves", "from", s.lastDesired.To, "to", asg.DesiredCount)
+			s.lastDesired = CapacityChange{Time: now, From: s.lastDesired.To, To: asg.DesiredCount}
+			return false
+		}
+
+		// The newest activity that wasn't a self-termination
+		var cause string
+		for _, c := range causes {
+			if !strings.Contains(c, selfTerminationCause) {
+				cause = c
+				break
+			}
+		}
+
+		s.override = ManualOverride{
+			Detected: now,
+			From:     s.lastDesired.To,
+			To:       asg.DesiredCount,
+			Expires:  now.Add(s.externalChangeGracePeriod),
+			Cause:    cause,
+		}
+		logging.FromContext(ctx).Warn("✋ Desired capacity changed outside the scaler, treating it as a manual override",
+			"from", s.override.From, "to", s.override.To, "expires", s.override.Expires.Format(time.RFC3339), "cause", cause)
+	}
+
+	if !s.override.holding(asg.DesiredCount, now) {
+		return false
+	}
+
+	logging.FromContext(ctx).Info("✋ Manual override in effect, holding desired capacity",
+		"desired", s.override.To, slog.Duration("remaining", s.override.Expires.Sub(now).Round(time.Second)))
+	s.decision.Reason = "manual-override"
+	return true
+}
@@ -0,0 +1,128 @@
+package scaler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+func TestRunHoldsManualOverride(t *testing.T) {
+	asg := &asgTestDriver{desiredCapacity: 2}
+	bk := &buildkiteTestDriver{metrics: buildkite.AgentMetrics{ScheduledJobs: 5}}
+	s := Scaler{
+		autoscaling:               asg,
+		bk:                        bk,
+		scaling:                   ScalingCalculator{agentsPerInstance: 1},
+		externalChangeGracePeriod: 30 * time.Minute,
+	}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if asg.desiredCapacity != 5 {
+		t.Fatalf("desired capacity after first run = %d, want 5", asg.desiredCapacity)
+	}
+
+	// An operator bumps desired capacity by hand
+	asg.desiredCapacity = 12
+	asg.activityCauses = []string{"At 2026-01-01T12:00:00Z a user request explicitly set group desired capacity changing the desired capacity from 5 to 12."}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if asg.desiredCapacity != 12 {
+		t.Fatalf("desired capacity during override = %d, want 12", asg.desiredCapacity)
+	}
+	if got := s.State().Override; got.From != 5 || got.To != 12 {
+		t.Errorf("State().Override = %+v, want 5 -> 12", got)
+	}
+	if got := s.LastDecision().Reason; got != "manual-override" {
+		t.Errorf("LastDecision().Reason = %q, want manual-override", got)
+	}
+
+	// Once the grace period is over the scaler takes over again
+	s.override.Expires = time.Now().Add(-time.Second)
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if asg.desiredCapacity != 5 {
+		t.Errorf("desired capacity after override expired = %d, want 5", asg.desiredCapacity)
+	}
+}
+
+func TestRunIgnoresSelfTerminationAsOverride(t *testing.T) {
+	asg := &asgTestDriver{desiredCapacity: 5}
+	s := Scaler{
+		autoscaling:               asg,
+		bk:                        &buildkiteTestDriver{metrics: buildkite.AgentMetrics{ScheduledJobs: 5}},
+		scaling:                   ScalingCalculator{agentsPerInstance: 1},
+		externalChangeGracePeriod: 30 * time.Minute,
+		lastDesired:               CapacityChange{Time: time.Now(), From: 2, To: 5},
+	}
+
+	// Two agents terminate themselves, and an instance launched in between
+	asg.desiredCapacity = 3
+	asg.activityCauses = []string{
+		"At 2026-01-01T12:02:00Z an instance was taken out of service in response to a user request, shrinking the capacity from 4 to 3.",
+		"At 2026-01-01T12:01:00Z an instance was started in response to a difference between desired and actual capacity, increasing the capacity from 4 to 5.",
+		"At 2026-01-01T12:00:00Z an instance was taken out of service in response to a user request, shrinking the capacity from 5 to 4.",
+	}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if asg.desiredCapacity != 5 {
+		t.Errorf("desired capacity = %d, want the scaler to restore 5", asg.desiredCapacity)
+	}
+	if got := s.State().Override; !got.Detected.IsZero() {
+		t.Errorf("State().Override = %+v, want none", got)
+	}
+}
+
+func TestRunRevertsExternalChangesWhenDisabled(t *testing.T) {
+	asg := &asgTestDriver{desiredCapacity: 12}
+	s := Scaler{
+		autoscaling: asg,
+		bk:          &buildkiteTestDriver{metrics: buildkite.AgentMetrics{ScheduledJobs: 5}},
+		scaling:     ScalingCalculator{agentsPerInstance: 1},
+		lastDesired: CapacityChange{Time: time.Now(), From: 2, To: 5},
+	}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if asg.desiredCapacity != 5 {
+		t.Errorf("desired capacity = %d, want 5", asg.desiredCapacity)
+	}
+}
+
+func TestRunSeedsOverrideDetectionFromRecords(t *testing.T) {
+	// After a cold start, the scaler's last change is only in the ASG tags
+	recorded := ScalingRecord{Time: time.Now().Add(-10 * time.Minute), From: 2, To: 5, Reason: "metrics"}
+	asg := &asgTestDriver{
+		desiredCapacity: 12,
+		tags: map[string]string{
+			TagLastScaleOut: recorded.String(),
+			TagLastScaleIn:  ScalingRecord{Time: recorded.Time.Add(-time.Hour), From: 8, To: 2}.String(),
+		},
+		activityCauses: []string{"At 2026-01-01T12:00:00Z a user request explicitly set group desired capacity changing the desired capacity from 5 to 12."},
+	}
+	s := Scaler{
+		autoscaling:               asg,
+		bk:                        &buildkiteTestDriver{metrics: buildkite.AgentMetrics{ScheduledJobs: 5}},
+		scaling:                   ScalingCalculator{agentsPerInstance: 1},
+		externalChangeGracePeriod: 30 * time.Minute,
+	}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if asg.desiredCapacity != 12 {
+		t.Errorf("desired capacity = %d, want the override of 12 held", asg.desiredCapacity)
+	}
+	if got := s.State().Override; got.From != 5 || got.To != 12 {
+		t.Errorf("State().Override = %+v, want 5 -> 12", got)
+	}
+}
@@ -0,0 +1,212 @@
+package scaler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/buildkite/buildkite-agent-scaler/logging"
+)
+
+const defaultScheduledEventDrainTimeout = time.Hour
+
+// InstanceStatusParams configures replacing instances that EC2 status checks
+// report as impaired, or that have scheduled EC2 maintenance events.
+type InstanceStatusParams struct {
+	Enabled bool
+	// How long agents on an impaired instance, or one with a scheduled
+	// event, get to finish their jobs before the instance is replaced anyway
+	// (default 1h)
+	DrainTimeout time.Duration
+}
+
+// drainImpaired is the DrainingInstance.Event of an instance draining because
+// its status checks are impaired.
+const drainImpaired = "status-check-impaired"
+
+// InstanceStatus is an instance's EC2 status checks and scheduled events.
+type InstanceStatus struct {
+	ID             string
+	SystemStatus   string // "ok", "impaired", "initializing", "insufficient-data" or "not-applicable"
+	InstanceStatus string
+	Events         []ScheduledEvent
+}
+
+// ScheduledEvent is a scheduled EC2 maintenance event, e.g. a retirement.
+type ScheduledEvent struct {
+	Code      string
+	NotBefore time.Time
+}
+
+func (st InstanceStatus) impaired() bool {
+	return st.SystemStatus == string(ec2Types.SummaryStatusImpaired) || st.InstanceStatus == string(ec2Types.SummaryStatusImpaired)
+}
+
+// DrainingInstance is an instance the scaler has asked to stop its agents
+// before it is replaced.
+type DrainingInstance struct {
+	InstanceID string
+	Since      time.Time
+	Event      string // The scheduled event's code, or drainImpaired
+}
+
+// instanceStatusAPI is implemented by ASG drivers that can read EC2 status
+// checks.
+type instanceStatusAPI interface {
+	InstanceStatuses(ctx context.Context, instanceIDs []string) ([]InstanceStatus, error)
+	MarkInstancesUnhealthy(ctx context.Context, instanceIDs []string) (int, error)
+}
+
+// checkInstanceStatus drains then replaces InService instances with impaired
+// status checks or scheduled events. Agents that stop leave their instance to
+// terminate itself, as in an Elastic CI Mode scale-in; an instance still
+// InService after the drain timeout is marked unhealthy so the ASG replaces
+// it. An impaired instance whose agents can't be signalled, e.g. because SSM
+// can't reach it either, is replaced straight away.
+func (s *Scaler) checkInstanceStatus(ctx context.Context, asg AutoscaleGroupDetails, now time.Time) error {
+	api, ok := s.autoscaling.(instanceStatusAPI)
+	if !ok {
+		return nil
+	}
+
+	var inService []string
+	for _, instance := range asg.Instances {
+		if instance.LifecycleState == string(types.LifecycleStateInService) {
+			inService = append(inService, instance.ID)
+		}
+	}
+
+	// Forget drains for instances that have left service
+	s.draining = slices.DeleteFunc(s.draining, func(d DrainingInstance) bool {
+		return !slices.Contains(inService, d.InstanceID)
+	})
+	if len(inService) == 0 {
+		return nil
+	}
+
+	statuses, err := api.InstanceStatuses(ctx, inService)
+	if err != nil {
+		return fmt.Errorf("describing instance status: %w", err)
+	}
+
+	logger := logging.FromContext(ctx)
+	var replace, drain []string
+	for _, st := range statuses {
+		if !st.impaired() && len(st.Events) == 0 {
+			// Forget drains for instances that have recovered, so a later
+			// impairment drains them again instead of replacing them at once
+			s.draining = slices.DeleteFunc(s.draining, func(d DrainingInstance) bool { return d.InstanceID == st.ID })
+			continue
+		}
+
+		i := slices.IndexFunc(s.draining, func(d DrainingInstance) bool { return d.InstanceID == st.ID })
+		if i < 0 {
+			reason := drainImpaired
+			if st.impaired() {
+				logger.Warn("🩺 Instance failed EC2 status checks, draining its agents",
+					"instance", st.ID, "system_status", st.SystemStatus, "instance_status", st.InstanceStatus)
+			} else {
+				event := st.Events[0]
+				reason = event.Code
+				logger.Info("🗓️ Instance has a scheduled event, draining its agents",
+					"instance", st.ID, "event", event.Code, "not_before", event.NotBefore.Format(time.RFC3339))
+			}
+			drain = append(drain, st.ID)
+			s.draining = append(s.draining, DrainingInstance{InstanceID: st.ID, Since: now, Event: reason})
+			continue
+		}
+
+		if now.Sub(s.draining[i].Since) >= s.drainTimeout() {
+			logger.Info("⏳ Instance has been draining long enough, replacing it",
+				"instance", st.ID, "event", s.draining[i].Event, "since", s.draining[i].Since.Format(time.RFC3339))
+			replace = append(replace, st.ID)
+		}
+	}
+
+	if len(drain) > 0 {
+		// Without the run's inventory, the driver takes one of just these instances
+		inv, _ := s.instanceInventory(ctx, asg)
+		outcomes := s.autoscaling.SignalAgents(ctx, inv, drain)
+		s.decision.Signals = append(s.decision.Signals, outcomes...)
+		for _, o := range outcomes {
+			if o.Outcome == SignalSent {
+				continue
+			}
+			i := slices.IndexFunc(s.draining, func(d DrainingInstance) bool { return d.InstanceID == o.InstanceID })
+			if i >= 0 && s.draining[i].Event == drainImpaired {
+				logger.Warn("⚠️  Failed to drain impaired instance, replacing it now",
+					"instance", o.InstanceID, "outcome", o.Outcome, "error", o.Error)
+				replace = append(replace, o.InstanceID)
+				continue
+			}
+			logger.Warn("⚠️  Failed to drain instance, it will be replaced after the drain timeout",
+				"instance", o.InstanceID, slog.Duration("drain_timeout", s.drainTimeout()), "outcome", o.Outcome, "error", o.Error)
+		}
+	}
+
+	if len(replace) == 0 {
+		return nil
+	}
+	if s.maxDanglingInstancesToCheck > 0 && len(replace) > s.maxDanglingInstancesToCheck {
+		logger.Info("↳ Acting on some of the instances this run", "acting_on", s.maxDanglingInstancesToCheck, "instances", len(replace))
+		replace = replace[:s.maxDanglingInstancesToCheck]
+	}
+	marked, err := api.MarkInstancesUnhealthy(ctx, replace)
+	logger.Info("↳ Marked instances unhealthy after EC2 status checks", "marked", marked, "instances", len(replace))
+	return err
+}
+
+func (s *Scaler) drainTimeout() time.Duration {
+	if s.instanceStatus.DrainTimeout <= 0 {
+		return defaultScheduledEventDrainTimeout
+	}
+	return s.instanceStatus.DrainTimeout
+}
+
+// InstanceStatuses returns the EC2 status checks and scheduled events of each
+// running instance.
+func (a *ASGDriver) InstanceStatuses(ctx context.Context, instanceIDs []string) ([]InstanceStatus, error) {
+	svc := a.ec2Client()
+	var statuses []InstanceStatus
+	// DescribeInstanceStatus takes at most 100 instance IDs
+	for batch := range slices.Chunk(instanceIDs, 100) {
+		paginator := ec2.NewDescribeInstanceStatusPaginator(svc, &ec2.DescribeInstanceStatusInput{
+			InstanceIds: batch,
+		})
+		for paginator.HasMorePages() {
+			output, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, err
+			}
+			for _, st := range output.InstanceStatuses {
+				status := InstanceStatus{ID: aws.ToString(st.InstanceId)}
+				if st.SystemStatus != nil {
+					status.SystemStatus = string(st.SystemStatus.Status)
+				}
+				if st.InstanceStatus != nil {
+					status.InstanceStatus = string(st.InstanceStatus.Status)
+				}
+				for _, event := range st.Events {
+					// Completed and canceled events stay listed, with a
+					// description starting "[Completed]" or "[Canceled]"
+					if strings.HasPrefix(aws.ToString(event.Description), "[") {
+						continue
+					}
+					status.Events = append(status.Events, ScheduledEvent{
+						Code:      string(event.Code),
+						NotBefore: aws.ToTime(event.NotBefore),
+					})
+				}
+				statuses = append(statuses, status)
+			}
+		}
+	}
+	return statuses, nil
+}
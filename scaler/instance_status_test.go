@@ -0,0 +1,166 @@
+package scaler
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+)
+
+// instanceStatusTestDriver adds EC2 status checks to asgTestDriver.
+type instanceStatusTestDriver struct {
+	asgTestDriver
+	statuses []InstanceStatus
+	marked   []string
+	offline  []string // Instances whose agents can't be signalled
+}
+
+func (d *instanceStatusTestDriver) SignalAgents(ctx context.Context, inv *InstanceInventory, instanceIDs []string) []SignalOutcome {
+	outcomes := d.asgTestDriver.SignalAgents(ctx, inv, instanceIDs)
+	for i, o := range outcomes {
+		if slices.Contains(d.offline, o.InstanceID) {
+			outcomes[i].Outcome = SignalSSMOffline
+		}
+	}
+	return outcomes
+}
+
+func (d *instanceStatusTestDriver) InstanceStatuses(ctx context.Context, instanceIDs []string) ([]InstanceStatus, error) {
+	return d.statuses, nil
+}
+
+func (d *instanceStatusTestDriver) MarkInstancesUnhealthy(ctx context.Context, instanceIDs []string) (int, error) {
+	d.marked = append(d.marked, instanceIDs...)
+	return len(instanceIDs), nil
+}
+
+func TestCheckInstanceStatus(t *testing.T) {
+	now := time.Unix(100000, 0)
+	asg := AutoscaleGroupDetails{Instances: []InstanceDetails{
+		{ID: "i-ok", LifecycleState: "InService"},
+		{ID: "i-impaired", LifecycleState: "InService"},
+		{ID: "i-retiring", LifecycleState: "InService"},
+		{ID: "i-drained", LifecycleState: "InService"},
+	}}
+	driver := &instanceStatusTestDriver{statuses: []InstanceStatus{
+		{ID: "i-ok", SystemStatus: "ok", InstanceStatus: "ok"},
+		{ID: "i-impaired", SystemStatus: "impaired", InstanceStatus: "ok"},
+		{ID: "i-retiring", SystemStatus: "ok", InstanceStatus: "ok", Events: []ScheduledEvent{{Code: "instance-retirement", NotBefore: now.Add(48 * time.Hour)}}},
+		{ID: "i-drained", SystemStatus: "ok", InstanceStatus: "ok", Events: []ScheduledEvent{{Code: "system-reboot", NotBefore: now.Add(time.Hour)}}},
+	}}
+	s := Scaler{
+		autoscaling:    driver,
+		instanceStatus: InstanceStatusParams{Enabled: true, DrainTimeout: 30 * time.Minute},
+		draining: []DrainingInstance{
+			{InstanceID: "i-drained", Since: now.Add(-time.Hour), Event: "system-reboot"},
+			{InstanceID: "i-gone", Since: now.Add(-time.Hour), Event: "instance-stop"},
+		},
+	}
+
+	if err := s.checkInstanceStatus(context.Background(), asg, now); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"i-drained"}; !slices.Equal(driver.marked, want) {
+		t.Errorf("marked unhealthy = %v, want %v", driver.marked, want)
+	}
+	if want := []string{"i-impaired", "i-retiring"}; !slices.Equal(driver.sigTermsSent, want) {
+		t.Errorf("SIGTERMs sent = %v, want %v", driver.sigTermsSent, want)
+	}
+	var draining []string
+	for _, d := range s.draining {
+		draining = append(draining, d.InstanceID)
+	}
+	if want := []string{"i-drained", "i-impaired", "i-retiring"}; !slices.Equal(draining, want) {
+		t.Errorf("draining = %v, want %v", draining, want)
+	}
+
+	// A draining instance isn't signalled again
+	driver.marked, driver.sigTermsSent = nil, nil
+	if err := s.checkInstanceStatus(context.Background(), asg, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(driver.sigTermsSent) != 0 {
+		t.Errorf("SIGTERMs sent on the second check = %v, want none", driver.sigTermsSent)
+	}
+}
+
+func TestCheckInstanceStatusDrainsImpairedInstances(t *testing.T) {
+	now := time.Unix(100000, 0)
+	asg := AutoscaleGroupDetails{Instances: []InstanceDetails{
+		{ID: "i-impaired", LifecycleState: "InService"},
+		{ID: "i-unreachable", LifecycleState: "InService"},
+	}}
+	driver := &instanceStatusTestDriver{
+		statuses: []InstanceStatus{
+			{ID: "i-impaired", SystemStatus: "ok", InstanceStatus: "impaired"},
+			{ID: "i-unreachable", SystemStatus: "impaired", InstanceStatus: "impaired"},
+		},
+		offline: []string{"i-unreachable"},
+	}
+	s := Scaler{
+		autoscaling:    driver,
+		instanceStatus: InstanceStatusParams{Enabled: true, DrainTimeout: 30 * time.Minute},
+	}
+
+	// An impaired instance that can't be drained is replaced straight away
+	if err := s.checkInstanceStatus(context.Background(), asg, now); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"i-unreachable"}; !slices.Equal(driver.marked, want) {
+		t.Errorf("marked unhealthy = %v, want %v", driver.marked, want)
+	}
+
+	// The other gets until the drain timeout to stop its agents
+	driver.marked = nil
+	asg.Instances, driver.statuses = asg.Instances[:1], driver.statuses[:1]
+	if err := s.checkInstanceStatus(context.Background(), asg, now.Add(10*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(driver.marked) != 0 {
+		t.Errorf("marked unhealthy during the drain = %v, want none", driver.marked)
+	}
+	if err := s.checkInstanceStatus(context.Background(), asg, now.Add(30*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"i-impaired"}; !slices.Equal(driver.marked, want) {
+		t.Errorf("marked unhealthy after the drain timeout = %v, want %v", driver.marked, want)
+	}
+}
+
+func TestCheckInstanceStatusForgetsRecoveredInstances(t *testing.T) {
+	now := time.Unix(100000, 0)
+	asg := AutoscaleGroupDetails{Instances: []InstanceDetails{{ID: "i-flaky", LifecycleState: "InService"}}}
+	driver := &instanceStatusTestDriver{statuses: []InstanceStatus{
+		{ID: "i-flaky", SystemStatus: "ok", InstanceStatus: "impaired"},
+	}}
+	s := Scaler{
+		autoscaling:    driver,
+		instanceStatus: InstanceStatusParams{Enabled: true, DrainTimeout: 30 * time.Minute},
+	}
+
+	if err := s.checkInstanceStatus(context.Background(), asg, now); err != nil {
+		t.Fatal(err)
+	}
+
+	// It recovers, so it's no longer draining
+	driver.statuses[0].InstanceStatus = "ok"
+	if err := s.checkInstanceStatus(context.Background(), asg, now.Add(10*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.draining) != 0 {
+		t.Errorf("draining after recovery = %+v, want none", s.draining)
+	}
+
+	// Impaired again long after, it's drained again rather than replaced
+	driver.statuses[0].InstanceStatus = "impaired"
+	driver.sigTermsSent = nil
+	if err := s.checkInstanceStatus(context.Background(), asg, now.Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if len(driver.marked) != 0 {
+		t.Errorf("marked unhealthy = %v, want none", driver.marked)
+	}
+	if want := []string{"i-flaky"}; !slices.Equal(driver.sigTermsSent, want) {
+		t.Errorf("SIGTERMs sent = %v, want %v", driver.sigTermsSent, want)
+	}
+}
@@ -0,0 +1,195 @@
+package scaler
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/buildkite/buildkite-agent-scaler/logging"
+)
+
+// InstanceInventory is a snapshot of the ASG's instances, merging what the
+// ASG, EC2 and SSM know about each. The scaler takes one per Run, the first
+// time something needs it, so the dangling checks, scale-in and signalling
+// don't each describe the instances again.
+type InstanceInventory struct {
+	Time      time.Time
+	Instances []InventoryInstance // In the ASG's order
+}
+
+// Tags EC2 adds to instances launched from a launch template.
+const (
+	launchTemplateIDTag      = "aws:ec2launchtemplate:id"
+	launchTemplateVersionTag = "aws:ec2launchtemplate:version"
+)
+
+// InventoryInstance is one instance in an InstanceInventory. Instances EC2
+// no longer knows about have a zero LaunchTime and an empty State.
+type InventoryInstance struct {
+	// From the ASG, with the AZ and launch template filled in from EC2 when
+	// the ASG doesn't report them
+	InstanceDetails
+
+	LaunchTime    time.Time
+	State         string // EC2 instance state, e.g. "running"
+	Platform      string // "linux" or "windows"
+	MarketType    string // "spot" or "on-demand"
+	SSMPingStatus string // e.g. "Online" or "ConnectionLost", empty if SSM doesn't know the instance
+}
+
+// ssmPingStatusUnknown is the SSMPingStatus of instances in an inventory
+// taken while SSM couldn't be described.
+const ssmPingStatusUnknown = "Unknown"
+
+// SSMOnline reports whether the instance's SSM agent was reachable.
+func (i InventoryInstance) SSMOnline() bool {
+	return i.SSMPingStatus == string(ssmTypes.PingStatusOnline)
+}
+
+// Get returns the instance with the given ID.
+func (inv *InstanceInventory) Get(id string) (InventoryInstance, bool) {
+	i := slices.IndexFunc(inv.Instances, func(instance InventoryInstance) bool { return instance.ID == id })
+	if i < 0 {
+		return InventoryInstance{}, false
+	}
+	return inv.Instances[i], true
+}
+
+// LaunchTimes returns the launch time of each instance EC2 described.
+func (inv *InstanceInventory) LaunchTimes() map[string]time.Time {
+	launchTimes := make(map[string]time.Time, len(inv.Instances))
+	for _, instance := range inv.Instances {
+		if !instance.LaunchTime.IsZero() {
+			launchTimes[instance.ID] = instance.LaunchTime
+		}
+	}
+	return launchTimes
+}
+
+// Platform returns the ASG's platform. Each ASG is single-platform, so one
+// Windows instance makes it a Windows ASG.
+func (inv *InstanceInventory) Platform() string {
+	for _, instance := range inv.Instances {
+		if instance.Platform == "windows" {
+			return "windows"
+		}
+	}
+	return "linux"
+}
+
+// inventoryAPI is implemented by ASG drivers that can take an inventory.
+type inventoryAPI interface {
+	Inventory(ctx context.Context, asg AutoscaleGroupDetails) (*InstanceInventory, error)
+}
+
+// Inventory describes the ASG's instances in EC2 and SSM.
+func (a *ASGDriver) Inventory(ctx context.Context, asg AutoscaleGroupDetails) (*InstanceInventory, error) {
+	return a.inventory(ctx, a.ec2Client(), a.ssmClient(), asg)
+}
+
+func (a *ASGDriver) inventory(ctx context.Context, ec2Svc describeInstancesAPI, ssmSvc ssmCheckAPI, asg AutoscaleGroupDetails) (*InstanceInventory, error) {
+	t := time.Now()
+	inv := &InstanceInventory{Time: a.now(), Instances: make([]InventoryInstance, 0, len(asg.Instances))}
+	if len(asg.Instances) == 0 {
+		return inv, nil
+	}
+
+	ids := make([]string, 0, len(asg.Instances))
+	for _, instance := range asg.Instances {
+		ids = append(ids, instance.ID)
+	}
+
+	output, err := describeInstancesTolerant(ctx, ec2Svc, ids, a.Name)
+	if err != nil {
+		return nil, fmt.Errorf("DescribeInstances failed: %w", err)
+	}
+	described := make(map[string]InventoryInstance, len(ids))
+	for _, reservation := range output.Reservations {
+		for _, instance := range reservation.Instances {
+			i := InventoryInstance{
+				LaunchTime: aws.ToTime(instance.LaunchTime),
+				Platform:   "linux",
+				MarketType: "on-demand",
+			}
+			if instance.State != nil {
+				i.State = string(instance.State.Name)
+			}
+			if instance.Placement != nil {
+				i.AvailabilityZone = aws.ToString(instance.Placement.AvailabilityZone)
+			}
+			for _, tag := range instance.Tags {
+				switch aws.ToString(tag.Key) {
+				case launchTemplateIDTag:
+					i.LaunchTemplate = aws.ToString(tag.Value)
+				case launchTemplateVersionTag:
+					i.LaunchTemplateVersion = aws.ToString(tag.Value)
+				}
+			}
+			// The Platform field is only set for Windows instances, as "windows"
+			if strings.EqualFold(string(instance.Platform), "windows") {
+				i.Platform = "windows"
+			}
+			if instance.InstanceLifecycle != "" {
+				i.MarketType = string(instance.InstanceLifecycle)
+			}
+			described[aws.ToString(instance.InstanceId)] = i
+		}
+	}
+
+	// Without SSM, the rest of the inventory still orders scale-in
+	pingStatus, err := ssmPingStatuses(ctx, ssmSvc, ids)
+	if err != nil {
+		logging.FromContext(ctx).Warn("⚠️  Failed to describe SSM instance information, ping statuses unknown", "error", err)
+		pingStatus = make(map[string]string, len(ids))
+		for _, id := range ids {
+			pingStatus[id] = ssmPingStatusUnknown
+		}
+	}
+
+	online := 0
+	for _, details := range asg.Instances {
+		instance := described[details.ID]
+		// Instances attached to the ASG have no launch template there, and
+		// SignalAgents takes inventories of bare instance IDs, so fall back
+		// to what EC2 knows
+		fromEC2 := instance.InstanceDetails
+		instance.InstanceDetails = details
+		instance.AvailabilityZone = cmp.Or(details.AvailabilityZone, fromEC2.AvailabilityZone)
+		instance.LaunchTemplate = cmp.Or(details.LaunchTemplate, fromEC2.LaunchTemplate)
+		instance.LaunchTemplateVersion = cmp.Or(details.LaunchTemplateVersion, fromEC2.LaunchTemplateVersion)
+		instance.SSMPingStatus = pingStatus[details.ID]
+		if instance.SSMOnline() {
+			online++
+		}
+		inv.Instances = append(inv.Instances, instance)
+	}
+
+	logging.FromContext(ctx).Info("↳ 🗂️  Took instance inventory",
+		"instances", len(inv.Instances), "described", len(described), "ssm_online", online, slog.Duration("took", time.Since(t)))
+	return inv, nil
+}
+
+// instanceInventory returns this run's inventory, taking it the first time
+// it's needed. It returns nil without an error if the driver can't take one.
+func (s *Scaler) instanceInventory(ctx context.Context, asg AutoscaleGroupDetails) (*InstanceInventory, error) {
+	if s.inventoryTaken {
+		return s.inventory, s.inventoryErr
+	}
+	s.inventoryTaken = true
+
+	api, ok := s.autoscaling.(inventoryAPI)
+	if !ok {
+		return nil, nil
+	}
+	s.inventory, s.inventoryErr = api.Inventory(ctx, asg)
+	if s.inventoryErr != nil {
+		s.inventoryErr = fmt.Errorf("taking instance inventory: %w", s.inventoryErr)
+	}
+	return s.inventory, s.inventoryErr
+}
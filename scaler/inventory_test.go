@@ -0,0 +1,147 @@
+package scaler
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+func TestInventoryMergesEC2AndSSM(t *testing.T) {
+	launched := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ec2Stub := &stubDescribeInstancesClient{responses: []stubDescribeResponse{{out: &ec2.DescribeInstancesOutput{
+		Reservations: []ec2Types.Reservation{{Instances: []ec2Types.Instance{
+			{
+				InstanceId:        aws.String("i-spot"),
+				LaunchTime:        aws.Time(launched),
+				State:             &ec2Types.InstanceState{Name: ec2Types.InstanceStateNameRunning},
+				Platform:          "windows",
+				InstanceLifecycle: ec2Types.InstanceLifecycleTypeSpot,
+			},
+			{
+				InstanceId: aws.String("i-ondemand"),
+				LaunchTime: aws.Time(launched.Add(time.Hour)),
+				State:      &ec2Types.InstanceState{Name: ec2Types.InstanceStateNamePending},
+				Placement:  &ec2Types.Placement{AvailabilityZone: aws.String("us-east-1b")},
+				Tags: []ec2Types.Tag{
+					{Key: aws.String("aws:ec2launchtemplate:id"), Value: aws.String("lt-0123")},
+					{Key: aws.String("aws:ec2launchtemplate:version"), Value: aws.String("4")},
+				},
+			},
+		}}},
+	}}}}
+	ssmStub := onlineSSMStub("i-spot")
+	ssmStub.describeOut.InstanceInformationList = append(ssmStub.describeOut.InstanceInformationList,
+		ssmTypes.InstanceInformation{InstanceId: aws.String("i-ondemand"), PingStatus: ssmTypes.PingStatusConnectionLost})
+	asg := AutoscaleGroupDetails{Instances: []InstanceDetails{
+		{ID: "i-spot", LifecycleState: "InService", LaunchTemplateVersion: "3"},
+		{ID: "i-ondemand", LifecycleState: "Pending"},
+		{ID: "i-gone", LifecycleState: "Terminating"},
+	}}
+
+	inv, err := (&ASGDriver{Name: "agents"}).inventory(context.Background(), ec2Stub, ssmStub, asg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ec2Stub.calls) != 1 {
+		t.Errorf("DescribeInstances called %d times, want 1", len(ec2Stub.calls))
+	}
+	if len(inv.Instances) != 3 {
+		t.Fatalf("got %d instances, want 3", len(inv.Instances))
+	}
+	spot, _ := inv.Get("i-spot")
+	if spot.LaunchTemplateVersion != "3" || spot.Platform != "windows" || spot.MarketType != "spot" || !spot.SSMOnline() || !spot.LaunchTime.Equal(launched) {
+		t.Errorf("i-spot = %+v", spot)
+	}
+	onDemand, _ := inv.Get("i-ondemand")
+	// The ASG didn't report its AZ or launch template, so they come from EC2
+	if onDemand.State != "pending" || onDemand.MarketType != "on-demand" || onDemand.SSMOnline() ||
+		onDemand.AvailabilityZone != "us-east-1b" || onDemand.LaunchTemplate != "lt-0123" || onDemand.LaunchTemplateVersion != "4" {
+		t.Errorf("i-ondemand = %+v", onDemand)
+	}
+	gone, _ := inv.Get("i-gone")
+	if gone.LifecycleState != "Terminating" || !gone.LaunchTime.IsZero() || gone.SSMPingStatus != "" {
+		t.Errorf("i-gone = %+v, want only its ASG details", gone)
+	}
+	if _, ok := inv.LaunchTimes()["i-gone"]; ok {
+		t.Error("LaunchTimes() includes an instance EC2 didn't describe")
+	}
+	if got := inv.Platform(); got != "windows" {
+		t.Errorf("Platform() = %q, want windows", got)
+	}
+}
+
+func TestInventoryFollowsSSMPages(t *testing.T) {
+	ids := []string{"i-a", "i-b", "i-c"}
+	ssmStub := onlineSSMStub(ids...)
+	ssmStub.describePageSize = 2
+	asg := AutoscaleGroupDetails{}
+	for _, id := range ids {
+		asg.Instances = append(asg.Instances, InstanceDetails{ID: id, LifecycleState: "InService"})
+	}
+
+	inv, err := (&ASGDriver{Name: "agents"}).inventory(context.Background(), &stubDescribeInstancesClient{}, ssmStub, asg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ssmStub.describeCalls != 2 {
+		t.Errorf("DescribeInstanceInformation called %d times, want 2", ssmStub.describeCalls)
+	}
+	for _, id := range ids {
+		if instance, _ := inv.Get(id); !instance.SSMOnline() {
+			t.Errorf("%s SSMPingStatus = %q, want Online", id, instance.SSMPingStatus)
+		}
+	}
+}
+
+func TestInventoryWithoutSSM(t *testing.T) {
+	launched := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ec2Stub := &stubDescribeInstancesClient{responses: []stubDescribeResponse{{out: &ec2.DescribeInstancesOutput{
+		Reservations: []ec2Types.Reservation{{Instances: []ec2Types.Instance{
+			{InstanceId: aws.String("i-a"), LaunchTime: aws.Time(launched)},
+		}}},
+	}}}}
+	ssmStub := &stubSSMClient{describeErr: errors.New("throttled")}
+	asg := AutoscaleGroupDetails{Instances: []InstanceDetails{{ID: "i-a", LifecycleState: "InService"}}}
+
+	inv, err := (&ASGDriver{Name: "agents"}).inventory(context.Background(), ec2Stub, ssmStub, asg)
+	if err != nil {
+		t.Fatalf("inventory() error = %v, want the inventory without SSM", err)
+	}
+	instance, _ := inv.Get("i-a")
+	if !instance.LaunchTime.Equal(launched) || instance.SSMPingStatus != ssmPingStatusUnknown {
+		t.Errorf("i-a = %+v, want its launch time and an unknown ping status", instance)
+	}
+}
+
+// inventoryTestDriver counts the inventories taken.
+type inventoryTestDriver struct {
+	asgTestDriver
+	taken int
+}
+
+func (d *inventoryTestDriver) Inventory(ctx context.Context, asg AutoscaleGroupDetails) (*InstanceInventory, error) {
+	d.taken++
+	return &InstanceInventory{}, nil
+}
+
+func TestInstanceInventoryTakenOncePerRun(t *testing.T) {
+	asg := &inventoryTestDriver{}
+	s := Scaler{autoscaling: asg}
+
+	for range 3 {
+		if _, err := s.instanceInventory(context.Background(), AutoscaleGroupDetails{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if asg.taken != 1 {
+		t.Errorf("took %d inventories, want 1", asg.taken)
+	}
+}
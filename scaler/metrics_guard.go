@@ -0,0 +1,121 @@
+package scaler
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+// MetricsGuardParams configures anomaly detection on the Buildkite metrics
+// feed and the circuit breaker behind it. Each check is disabled by its zero
+// value; the guard is off entirely when all of them are.
+type MetricsGuardParams struct {
+	MaxMetricsAge        time.Duration // Treat responses whose server Date is older than this as anomalous
+	MaxJobSwing          int64         // Treat a change in scheduled+running jobs larger than this between polls as anomalous
+	MaxRepeatedResponses int           // Treat more than this many identical responses (same Date and counts) in a row as anomalous
+	DetectAgentsVanished bool          // Treat TotalAgents dropping to 0 while instances are InService as anomalous
+	BreakerThreshold     int           // Open the circuit breaker after this many consecutive failures or anomalies
+	SafeFloor            int64         // While the breaker is open, keep at least this many instances (0 just holds capacity)
+}
+
+func (p MetricsGuardParams) enabled() bool {
+	return p.MaxMetricsAge > 0 || p.MaxJobSwing > 0 || p.MaxRepeatedResponses > 0 ||
+		p.DetectAgentsVanished || p.BreakerThreshold > 0
+}
+
+// MetricsGuardState is the metrics guard state carried between Run cycles.
+type MetricsGuardState struct {
+	HasLast       bool
+	LastTimestamp time.Time
+	LastJobs      int64
+	LastAgents    int64
+	Repeats       int
+	Consecutive   int  // Consecutive failures or anomalies
+	Open          bool // Whether the circuit breaker is open
+}
+
+// Reasons the metrics guard rejects a response.
+const (
+	anomalyStale          = "stale"
+	anomalyRepeated       = "repeated"
+	anomalyJobSwing       = "job-swing"
+	anomalyAgentsVanished = "agents-vanished"
+)
+
+type metricsGuard struct {
+	params MetricsGuardParams
+	state  MetricsGuardState
+}
+
+// check inspects a metrics response against the previous one and the ASG. It
+// returns the anomaly kind and a description, or "" if the response looks
+// plausible. The response always becomes the new baseline, so a genuine step
+// change (e.g. a large pipeline upload) is only held for one poll.
+func (g *metricsGuard) check(logger *slog.Logger, metrics *buildkite.AgentMetrics, asg *AutoscaleGroupDetails, now time.Time) (kind, detail string) {
+	jobs := metrics.ScheduledJobs + metrics.RunningJobs
+	last := g.state
+	defer func() {
+		g.state.HasLast = true
+		g.state.LastTimestamp = metrics.Timestamp
+		g.state.LastJobs = jobs
+		g.state.LastAgents = metrics.TotalAgents
+	}()
+
+	if g.params.MaxMetricsAge > 0 && !metrics.Timestamp.IsZero() {
+		if age := now.Sub(metrics.Timestamp); age > g.params.MaxMetricsAge {
+			return g.anomaly(logger, anomalyStale, fmt.Sprintf("response is %s old (server time %s)", age.Round(time.Second), metrics.Timestamp.Format(time.RFC3339)))
+		}
+	}
+
+	if last.HasLast && metrics.Timestamp.Equal(last.LastTimestamp) && jobs == last.LastJobs && metrics.TotalAgents == last.LastAgents {
+		g.state.Repeats++
+	} else {
+		g.state.Repeats = 0
+	}
+	if g.params.MaxRepeatedResponses > 0 && g.state.Repeats > g.params.MaxRepeatedResponses {
+		return g.anomaly(logger, anomalyRepeated, fmt.Sprintf("identical response (server time %s) repeated %d times", metrics.Timestamp.Format(time.RFC3339), g.state.Repeats))
+	}
+
+	if g.params.MaxJobSwing > 0 && last.HasLast {
+		swing := jobs - last.LastJobs
+		if swing < 0 {
+			swing = -swing
+		}
+		if swing > g.params.MaxJobSwing {
+			return g.anomaly(logger, anomalyJobSwing, fmt.Sprintf("scheduled+running jobs moved from %d to %d (limit %d)", last.LastJobs, jobs, g.params.MaxJobSwing))
+		}
+	}
+
+	if g.params.DetectAgentsVanished && last.HasLast && last.LastAgents > 0 && metrics.TotalAgents == 0 && asg.ActualCount > 0 {
+		return g.anomaly(logger, anomalyAgentsVanished, fmt.Sprintf("total agents dropped from %d to 0 with %d instance(s) InService", last.LastAgents, asg.ActualCount))
+	}
+
+	g.healthy(logger)
+	return "", ""
+}
+
+func (g *metricsGuard) anomaly(logger *slog.Logger, kind, detail string) (string, string) {
+	g.recordFailure(logger)
+	return kind, detail
+}
+
+// recordFailure counts a failed or anomalous poll towards the circuit
+// breaker, and reports whether the breaker is open.
+func (g *metricsGuard) recordFailure(logger *slog.Logger) bool {
+	g.state.Consecutive++
+	if g.params.BreakerThreshold > 0 && g.state.Consecutive >= g.params.BreakerThreshold && !g.state.Open {
+		g.state.Open = true
+		logger.Error("🔌 Metrics circuit breaker OPEN after consecutive failed or anomalous polls", "consecutive", g.state.Consecutive)
+	}
+	return g.state.Open
+}
+
+func (g *metricsGuard) healthy(logger *slog.Logger) {
+	if g.state.Open {
+		logger.Info("🔌 Metrics circuit breaker closed after a healthy response")
+	}
+	g.state.Consecutive = 0
+	g.state.Open = false
+}
@@ -0,0 +1,157 @@
+package scaler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+func TestMetricsGuardCheck(t *testing.T) {
+	now := time.Unix(10000, 0)
+	asg := &AutoscaleGroupDetails{DesiredCount: 3, ActualCount: 3}
+
+	for _, tc := range []struct {
+		name     string
+		params   MetricsGuardParams
+		previous []buildkite.AgentMetrics
+		metrics  buildkite.AgentMetrics
+		want     string
+	}{
+		{
+			name:    "fresh response passes",
+			params:  MetricsGuardParams{MaxMetricsAge: time.Minute},
+			metrics: buildkite.AgentMetrics{Timestamp: now.Add(-10 * time.Second)},
+			want:    "",
+		},
+		{
+			name:    "old server time is stale",
+			params:  MetricsGuardParams{MaxMetricsAge: time.Minute},
+			metrics: buildkite.AgentMetrics{Timestamp: now.Add(-5 * time.Minute)},
+			want:    anomalyStale,
+		},
+		{
+			name:   "repeated response",
+			params: MetricsGuardParams{MaxRepeatedResponses: 1},
+			previous: []buildkite.AgentMetrics{
+				{Timestamp: now, ScheduledJobs: 4, TotalAgents: 2},
+				{Timestamp: now, ScheduledJobs: 4, TotalAgents: 2},
+			},
+			metrics: buildkite.AgentMetrics{Timestamp: now, ScheduledJobs: 4, TotalAgents: 2},
+			want:    anomalyRepeated,
+		},
+		{
+			name:     "same counts with a new server time is not a repeat",
+			params:   MetricsGuardParams{MaxRepeatedResponses: 1},
+			previous: []buildkite.AgentMetrics{{Timestamp: now.Add(-20 * time.Second)}, {Timestamp: now.Add(-10 * time.Second)}},
+			metrics:  buildkite.AgentMetrics{Timestamp: now},
+			want:     "",
+		},
+		{
+			name:     "implausible job swing",
+			params:   MetricsGuardParams{MaxJobSwing: 100},
+			previous: []buildkite.AgentMetrics{{ScheduledJobs: 2}},
+			metrics:  buildkite.AgentMetrics{ScheduledJobs: 500},
+			want:     anomalyJobSwing,
+		},
+		{
+			name:     "agents vanish while instances are InService",
+			params:   MetricsGuardParams{DetectAgentsVanished: true},
+			previous: []buildkite.AgentMetrics{{TotalAgents: 3}},
+			metrics:  buildkite.AgentMetrics{TotalAgents: 0},
+			want:     anomalyAgentsVanished,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			g := &metricsGuard{params: tc.params}
+			for _, m := range tc.previous {
+				g.check(slog.Default(), &m, asg, now)
+			}
+			if got, _ := g.check(slog.Default(), &tc.metrics, asg, now); got != tc.want {
+				t.Errorf("check() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMetricsGuardJobSwingAcceptsSecondPollAtNewLevel(t *testing.T) {
+	g := &metricsGuard{params: MetricsGuardParams{MaxJobSwing: 100}}
+	asg := &AutoscaleGroupDetails{}
+	g.check(slog.Default(), &buildkite.AgentMetrics{ScheduledJobs: 2}, asg, time.Now())
+	if kind, _ := g.check(slog.Default(), &buildkite.AgentMetrics{ScheduledJobs: 500}, asg, time.Now()); kind != anomalyJobSwing {
+		t.Fatalf("first poll at new level = %q, want %q", kind, anomalyJobSwing)
+	}
+	if kind, _ := g.check(slog.Default(), &buildkite.AgentMetrics{ScheduledJobs: 510}, asg, time.Now()); kind != "" {
+		t.Errorf("second poll at new level = %q, want accepted", kind)
+	}
+}
+
+func TestMetricsGuardBreaker(t *testing.T) {
+	g := &metricsGuard{params: MetricsGuardParams{BreakerThreshold: 3}}
+	for i := 1; i <= 2; i++ {
+		if g.recordFailure(slog.Default()) {
+			t.Fatalf("breaker open after %d failure(s), want closed until 3", i)
+		}
+	}
+	if !g.recordFailure(slog.Default()) {
+		t.Fatal("breaker closed after 3 failures, want open")
+	}
+	g.check(slog.Default(), &buildkite.AgentMetrics{}, &AutoscaleGroupDetails{}, time.Now())
+	if g.state.Open || g.state.Consecutive != 0 {
+		t.Errorf("breaker state after healthy response = %+v, want closed and reset", g.state)
+	}
+}
+
+func TestRunIgnoresAnomalousMetrics(t *testing.T) {
+	asg := &asgTestDriver{desiredCapacity: 2}
+	bk := &buildkiteTestDriver{metrics: buildkite.AgentMetrics{ScheduledJobs: 2, TotalAgents: 2}}
+	s := Scaler{
+		autoscaling: asg,
+		bk:          bk,
+		scaling:     ScalingCalculator{agentsPerInstance: 1},
+		guard:       &metricsGuard{params: MetricsGuardParams{MaxJobSwing: 50}},
+	}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	bk.metrics.ScheduledJobs = 200
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if asg.desiredCapacity != 2 {
+		t.Errorf("desired capacity after anomalous metrics = %d, want 2", asg.desiredCapacity)
+	}
+}
+
+func TestRunAppliesSafeFloorWhenBreakerOpens(t *testing.T) {
+	asg := &asgTestDriver{desiredCapacity: 1}
+	bk := &buildkiteTestDriver{err: errors.New("503 Service Unavailable")}
+	s := Scaler{
+		autoscaling: asg,
+		bk:          bk,
+		scaling:     ScalingCalculator{agentsPerInstance: 1},
+		guard:       &metricsGuard{params: MetricsGuardParams{BreakerThreshold: 2, SafeFloor: 4}},
+	}
+
+	if _, err := s.Run(context.Background()); err == nil {
+		t.Fatal("expected metrics error")
+	}
+	if asg.desiredCapacity != 1 {
+		t.Fatalf("desired capacity before breaker opened = %d, want 1", asg.desiredCapacity)
+	}
+
+	if _, err := s.Run(context.Background()); err == nil {
+		t.Fatal("expected metrics error")
+	}
+	if asg.desiredCapacity != 4 {
+		t.Errorf("desired capacity with breaker open = %d, want safe floor 4", asg.desiredCapacity)
+	}
+	if !s.State().MetricsGuard.Open {
+		t.Error("expected breaker state to be carried in State()")
+	}
+}
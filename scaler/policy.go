@@ -0,0 +1,208 @@
+package scaler
+
+import (
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// PolicyTypeInstances limits a change to a number of instances per period.
+	PolicyTypeInstances = "instances"
+	// PolicyTypePercent limits a change to a percentage of the capacity at the
+	// start of the period.
+	PolicyTypePercent = "percent"
+
+	// SelectPolicyMax picks the policy that allows the largest change. This
+	// is the default, matching the Kubernetes HPA.
+	SelectPolicyMax = "max"
+	// SelectPolicyMin picks the policy that allows the smallest change.
+	SelectPolicyMin = "min"
+)
+
+// ScalingPolicy bounds how far desired capacity may move in one direction
+// within Period, in the style of Kubernetes HPA scaling policies.
+type ScalingPolicy struct {
+	Type   string
+	Value  int
+	Period time.Duration
+}
+
+func (p ScalingPolicy) String() string {
+	if p.Type == PolicyTypePercent {
+		return fmt.Sprintf("%d%%/%s", p.Value, p.Period)
+	}
+	return fmt.Sprintf("%d/%s", p.Value, p.Period)
+}
+
+// CapacityChange records one change the scaler made to desired capacity.
+type CapacityChange struct {
+	Time time.Time
+	From int64
+	To   int64
+}
+
+// ParseScalingPolicies parses a comma-separated list of policies, each a
+// value, an optional % for percent policies, a slash and a period. For
+// example "20/1m,100%/1m" allows 20 instances or 100% per minute.
+func ParseScalingPolicies(s string) ([]ScalingPolicy, error) {
+	var policies []ScalingPolicy
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		value, period, ok := strings.Cut(field, "/")
+		if !ok {
+			return nil, fmt.Errorf("scaling policy %q must be <value>/<period> or <value>%%/<period>", field)
+		}
+
+		policy := ScalingPolicy{Type: PolicyTypeInstances}
+		if v, isPercent := strings.CutSuffix(value, "%"); isPercent {
+			policy.Type = PolicyTypePercent
+			value = v
+		}
+
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("scaling policy %q must have a positive integer value", field)
+		}
+		policy.Value = n
+
+		d, err := time.ParseDuration(strings.TrimSpace(period))
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("scaling policy %q must have a positive period", field)
+		}
+		policy.Period = d
+
+		policies = append(policies, policy)
+	}
+	return policies, nil
+}
+
+// ParseSelectPolicy validates a select policy, defaulting to SelectPolicyMax.
+func ParseSelectPolicy(s string) (string, error) {
+	switch strings.ToLower(s) {
+	case "", SelectPolicyMax:
+		return SelectPolicyMax, nil
+	case SelectPolicyMin:
+		return SelectPolicyMin, nil
+	default:
+		return "", fmt.Errorf("unknown select policy %q (expected %q or %q)", s, SelectPolicyMax, SelectPolicyMin)
+	}
+}
+
+// changedInPeriod returns how many instances were added and removed by
+// changes in history since start.
+func changedInPeriod(history []CapacityChange, start time.Time) (added, removed int64) {
+	for _, c := range history {
+		if c.Time.Before(start) {
+			continue
+		}
+		if diff := c.To - c.From; diff > 0 {
+			added += diff
+		} else {
+			removed -= diff
+		}
+	}
+	return added, removed
+}
+
+// limitScaleOut returns desired bounded by the scale-out policies, given
+// current desired capacity and the history of recent changes. As in the HPA,
+// each policy limits growth relative to the capacity at the start of its
+// period, and selectPolicy picks between the policies' limits.
+func limitScaleOut(logger *slog.Logger, desired, current int64, policies []ScalingPolicy, selectPolicy string, history []CapacityChange, now time.Time) int64 {
+	if len(policies) == 0 || desired <= current {
+		return desired
+	}
+
+	var limit int64
+	var chosen ScalingPolicy
+	for i, p := range policies {
+		added, _ := changedInPeriod(history, now.Add(-p.Period))
+		periodStart := current - added
+
+		var l int64
+		if p.Type == PolicyTypePercent {
+			// Any percentage of nothing is nothing, so a percent policy
+			// allows at least one instance, or an empty ASG would never
+			// scale out
+			l = max(int64(math.Ceil(float64(periodStart)*(1+float64(p.Value)/100))), periodStart+1)
+		} else {
+			l = periodStart + int64(p.Value)
+		}
+
+		if i == 0 || (selectPolicy == SelectPolicyMin && l < limit) || (selectPolicy != SelectPolicyMin && l > limit) {
+			limit = l
+			chosen = p
+		}
+	}
+
+	if limit < current {
+		limit = current
+	}
+	if desired > limit {
+		logger.Info("🚦 Scale-out limited by policy", "desired", desired, "limit", limit, "policy", chosen.String(), "select", selectPolicy)
+		return limit
+	}
+	return desired
+}
+
+// limitScaleIn is the scale-in counterpart of limitScaleOut. Selecting max
+// picks the policy that allows the most instances to be removed.
+func limitScaleIn(logger *slog.Logger, desired, current int64, policies []ScalingPolicy, selectPolicy string, history []CapacityChange, now time.Time) int64 {
+	if len(policies) == 0 || desired >= current {
+		return desired
+	}
+
+	var limit int64
+	var chosen ScalingPolicy
+	for i, p := range policies {
+		_, removed := changedInPeriod(history, now.Add(-p.Period))
+		periodStart := current + removed
+
+		var l int64
+		if p.Type == PolicyTypePercent {
+			l = int64(math.Floor(float64(periodStart) * (1 - float64(p.Value)/100)))
+		} else {
+			l = periodStart - int64(p.Value)
+		}
+
+		if i == 0 || (selectPolicy == SelectPolicyMin && l > limit) || (selectPolicy != SelectPolicyMin && l < limit) {
+			limit = l
+			chosen = p
+		}
+	}
+
+	if limit > current {
+		limit = current
+	}
+	if desired < limit {
+		logger.Info("🚦 Scale-in limited by policy", "desired", desired, "limit", limit, "policy", chosen.String(), "select", selectPolicy)
+		return limit
+	}
+	return desired
+}
+
+// pruneHistory drops changes older than the longest policy period, which are
+// no longer needed to enforce any policy.
+func pruneHistory(history []CapacityChange, policies []ScalingPolicy, now time.Time) []CapacityChange {
+	var longest time.Duration
+	for _, p := range policies {
+		longest = max(longest, p.Period)
+	}
+
+	start := now.Add(-longest)
+	kept := history[:0]
+	for _, c := range history {
+		if !c.Time.Before(start) {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,214 @@
+package scaler
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+func TestParseScalingPolicies(t *testing.T) {
+	got, err := ParseScalingPolicies("20/1m, 100%/60s")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []ScalingPolicy{
+		{Type: PolicyTypeInstances, Value: 20, Period: time.Minute},
+		{Type: PolicyTypePercent, Value: 100, Period: time.Minute},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ParseScalingPolicies() = %v, want %v", got, want)
+	}
+
+	if got, err := ParseScalingPolicies(""); err != nil || got != nil {
+		t.Errorf("ParseScalingPolicies(\"\") = %v, %v, want nil, nil", got, err)
+	}
+
+	for _, bad := range []string{"20", "0/1m", "-5/1m", "x%/1m", "5/soon", "5/0s"} {
+		if _, err := ParseScalingPolicies(bad); err == nil {
+			t.Errorf("ParseScalingPolicies(%q) = nil error, want error", bad)
+		}
+	}
+}
+
+func TestLimitScaleOut(t *testing.T) {
+	now := time.Unix(1000, 0)
+	policies := []ScalingPolicy{
+		{Type: PolicyTypeInstances, Value: 20, Period: time.Minute},
+		{Type: PolicyTypePercent, Value: 100, Period: time.Minute},
+	}
+
+	for _, tc := range []struct {
+		name         string
+		desired      int64
+		current      int64
+		selectPolicy string
+		history      []CapacityChange
+		want         int64
+	}{
+		{
+			name:    "metrics glitch from 2 is held to +20",
+			desired: 200, current: 2, selectPolicy: SelectPolicyMax,
+			want: 22,
+		},
+		{
+			name:    "max picks percent when it allows more",
+			desired: 200, current: 50, selectPolicy: SelectPolicyMax,
+			want: 100,
+		},
+		{
+			name:    "min picks the tighter policy",
+			desired: 200, current: 50, selectPolicy: SelectPolicyMin,
+			want: 70,
+		},
+		{
+			name:    "additions within the period count against the limit",
+			desired: 200, current: 12, selectPolicy: SelectPolicyMax,
+			history: []CapacityChange{{Time: now.Add(-30 * time.Second), From: 2, To: 12}},
+			want:    22,
+		},
+		{
+			name:    "additions outside the period are ignored",
+			desired: 200, current: 12, selectPolicy: SelectPolicyMax,
+			history: []CapacityChange{{Time: now.Add(-2 * time.Minute), From: 2, To: 12}},
+			want:    32,
+		},
+		{
+			name:    "within limits is unchanged",
+			desired: 10, current: 5, selectPolicy: SelectPolicyMax,
+			want: 10,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := limitScaleOut(slog.Default(), tc.desired, tc.current, policies, tc.selectPolicy, tc.history, now)
+			if got != tc.want {
+				t.Errorf("limitScaleOut() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLimitScaleOutFromZero(t *testing.T) {
+	now := time.Unix(1000, 0)
+	percent := ScalingPolicy{Type: PolicyTypePercent, Value: 100, Period: time.Minute}
+	instances := ScalingPolicy{Type: PolicyTypeInstances, Value: 20, Period: time.Minute}
+
+	for _, tc := range []struct {
+		name         string
+		policies     []ScalingPolicy
+		selectPolicy string
+		want         int64
+	}{
+		{
+			name:     "percent only allows one instance",
+			policies: []ScalingPolicy{percent}, selectPolicy: SelectPolicyMax,
+			want: 1,
+		},
+		{
+			name:     "min with a percent policy allows one instance",
+			policies: []ScalingPolicy{instances, percent}, selectPolicy: SelectPolicyMin,
+			want: 1,
+		},
+		{
+			name:     "max picks the instances policy",
+			policies: []ScalingPolicy{instances, percent}, selectPolicy: SelectPolicyMax,
+			want: 20,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := limitScaleOut(slog.Default(), 200, 0, tc.policies, tc.selectPolicy, nil, now)
+			if got != tc.want {
+				t.Errorf("limitScaleOut() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLimitScaleIn(t *testing.T) {
+	now := time.Unix(1000, 0)
+	policies := []ScalingPolicy{
+		{Type: PolicyTypeInstances, Value: 5, Period: 5 * time.Minute},
+		{Type: PolicyTypePercent, Value: 10, Period: 5 * time.Minute},
+	}
+
+	for _, tc := range []struct {
+		name         string
+		desired      int64
+		current      int64
+		selectPolicy string
+		history      []CapacityChange
+		want         int64
+	}{
+		{
+			name:    "max allows the larger drop",
+			desired: 0, current: 100, selectPolicy: SelectPolicyMax,
+			want: 90,
+		},
+		{
+			name:    "min allows the smaller drop",
+			desired: 0, current: 100, selectPolicy: SelectPolicyMin,
+			want: 95,
+		},
+		{
+			name:    "removals within the period exhaust the budget",
+			desired: 0, current: 20, selectPolicy: SelectPolicyMin,
+			history: []CapacityChange{{Time: now.Add(-time.Minute), From: 25, To: 20}},
+			want:    20,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := limitScaleIn(slog.Default(), tc.desired, tc.current, policies, tc.selectPolicy, tc.history, now)
+			if got != tc.want {
+				t.Errorf("limitScaleIn() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPruneHistory(t *testing.T) {
+	now := time.Unix(1000, 0)
+	history := []CapacityChange{
+		{Time: now.Add(-10 * time.Minute), From: 1, To: 2},
+		{Time: now.Add(-time.Minute), From: 2, To: 3},
+	}
+	got := pruneHistory(history, []ScalingPolicy{{Period: 5 * time.Minute}}, now)
+	if len(got) != 1 || got[0].To != 3 {
+		t.Errorf("pruneHistory() = %v, want only the change within 5m", got)
+	}
+}
+
+func TestScaleOutPoliciesAcrossRuns(t *testing.T) {
+	asg := &asgTestDriver{desiredCapacity: 2, maxSize: 500}
+	s := Scaler{
+		autoscaling: asg,
+		bk: &buildkiteTestDriver{metrics: buildkite.AgentMetrics{
+			ScheduledJobs: 200,
+			TotalAgents:   2,
+		}},
+		scaling: ScalingCalculator{agentsPerInstance: 1},
+		scaleOutParams: ScaleParams{
+			Policies: []ScalingPolicy{{Type: PolicyTypeInstances, Value: 20, Period: time.Minute}},
+		},
+	}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if asg.desiredCapacity != 22 {
+		t.Fatalf("desired capacity after first run = %d, want 22", asg.desiredCapacity)
+	}
+
+	// The policy budget for this minute is spent, so the second run holds.
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if asg.desiredCapacity != 22 {
+		t.Errorf("desired capacity after second run = %d, want 22", asg.desiredCapacity)
+	}
+	if got := s.State().History; len(got) != 1 || got[0].From != 2 || got[0].To != 22 {
+		t.Errorf("State().History = %v, want one 2->22 change", got)
+	}
+}
@@ -0,0 +1,265 @@
+package scaler
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/buildkite/buildkite-agent-scaler/logging"
+)
+
+// EC2 tags on a quarantined instance.
+const (
+	TagQuarantinedFrom   = RuntimeTagPrefix + "quarantined-from" // The ASG the instance was detached from
+	TagQuarantineExpires = RuntimeTagPrefix + "quarantine-expires"
+	TagQuarantineReason  = RuntimeTagPrefix + "quarantine-reason"
+)
+
+const defaultQuarantineExpiry = 24 * time.Hour
+
+// ForensicsParams configures collecting logs from a dangling instance over
+// SSM before it is replaced. The instance's SSM agent writes the command
+// output, so the instance profile needs access to the bucket or log group.
+type ForensicsParams struct {
+	S3Bucket    string
+	S3KeyPrefix string
+	LogGroup    string // CloudWatch Logs group
+}
+
+func (p ForensicsParams) enabled() bool {
+	return p.S3Bucket != "" || p.LogGroup != ""
+}
+
+// QuarantineParams configures detaching dangling instances from the ASG for
+// inspection, rather than having the ASG terminate them.
+type QuarantineParams struct {
+	MaxInstances int           // How many instances may be quarantined at once (0 disables)
+	Expiry       time.Duration // How long a quarantined instance is kept before it is terminated (default 24h)
+}
+
+// quarantineEC2API is the subset of ec2.Client used for quarantine,
+// extracted so tests can stub it.
+type quarantineEC2API interface {
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	CreateTags(ctx context.Context, params *ec2.CreateTagsInput, optFns ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error)
+	DeleteTags(ctx context.Context, params *ec2.DeleteTagsInput, optFns ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error)
+	TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error)
+}
+
+// quarantineASGAPI is the subset of autoscaling.Client used for quarantine.
+type quarantineASGAPI interface {
+	DetachInstances(ctx context.Context, params *autoscaling.DetachInstancesInput, optFns ...func(*autoscaling.Options)) (*autoscaling.DetachInstancesOutput, error)
+}
+
+func (a *ASGDriver) getForensicsCommand(platform string) string {
+	if platform == "windows" {
+		return `
+Write-Output "=== buildkite-agent logs ==="
+Get-ChildItem C:\buildkite-agent\*.log -ErrorAction SilentlyContinue | ForEach-Object {
+    Write-Output "--- $($_.FullName)"
+    Get-Content $_.FullName -Tail 1000
+}
+Write-Output "=== System event log ==="
+Get-WinEvent -LogName System -MaxEvents 200 -ErrorAction SilentlyContinue | Format-List TimeCreated,Id,LevelDisplayName,Message
+`
+	}
+
+	return `#!/bin/bash
+echo "=== journalctl -u buildkite-agent ==="
+journalctl -u buildkite-agent --no-pager -n 2000 2>&1
+echo "=== dmesg ==="
+dmesg -T 2>&1 | tail -n 500
+echo "=== agent logs ==="
+for f in /var/log/buildkite-agent*.log /var/log/elastic-stack.log; do
+  [ -f "$f" ] && { echo "--- $f"; tail -n 1000 "$f"; }
+done
+exit 0
+`
+}
+
+// captureForensics collects the agent's logs, the journal and dmesg from each
+// instance to S3 or CloudWatch Logs, waiting for the commands to finish so the
+// evidence is saved before the instance goes.
+func (a *ASGDriver) captureForensics(ctx context.Context, ssmSvc ssmCheckAPI, instanceIDs []string, platform string) error {
+	documentName := "AWS-RunShellScript"
+	if platform == "windows" {
+		documentName = "AWS-RunPowerShellScript"
+	}
+
+	input := &ssm.SendCommandInput{
+		InstanceIds:  instanceIDs,
+		DocumentName: aws.String(documentName),
+		Parameters:   map[string][]string{"commands": {a.getForensicsCommand(platform)}},
+		Comment:      aws.String("Collect buildkite-agent forensics before replacement"),
+	}
+	if a.Forensics.S3Bucket != "" {
+		input.OutputS3BucketName = aws.String(a.Forensics.S3Bucket)
+		input.OutputS3KeyPrefix = aws.String(a.Forensics.S3KeyPrefix)
+	}
+	if a.Forensics.LogGroup != "" {
+		input.CloudWatchOutputConfig = &ssmTypes.CloudWatchOutputConfig{
+			CloudWatchLogGroupName:  aws.String(a.Forensics.LogGroup),
+			CloudWatchOutputEnabled: true,
+		}
+	}
+
+	// Dangling instances come in small numbers, well under SendCommand's
+	// 50 instance limit
+	sendOut, err := ssmSvc.SendCommand(ctx, input)
+	if err != nil {
+		return fmt.Errorf("SendCommand failed: %w", err)
+	}
+	commandID := aws.ToString(sendOut.Command.CommandId)
+	logging.FromContext(ctx).Info("[Elastic CI Mode] 🔬 Collecting forensics", "instances", instanceIDs, "command", commandID)
+
+	a.sleep(ctx, cmp.Or(a.ssmRegistrationDelay, 3*time.Second))
+	results, err := pollCommandInvocations(ctx, orWallClock(a.clock), ssmSvc, []string{commandID}, len(instanceIDs),
+		cmp.Or(a.ssmPollInterval, 3*time.Second), cmp.Or(a.ssmPollDeadline, 60*time.Second))
+	if err != nil {
+		return fmt.Errorf("ListCommandInvocations failed: %w", err)
+	}
+	for _, id := range instanceIDs {
+		if inv, ok := results[id]; !ok || inv.Status != ssmTypes.CommandInvocationStatusSuccess {
+			logging.FromContext(ctx).Warn("[Elastic CI Mode] ⚠️  Forensics collection did not succeed", "instance", id, "status", inv.Status)
+		}
+	}
+	return nil
+}
+
+// quarantinedInstance is an instance detached from the ASG for inspection.
+type quarantinedInstance struct {
+	ID      string
+	Expires time.Time // Zero if the expires tag is missing or invalid
+}
+
+func (a *ASGDriver) listQuarantined(ctx context.Context, ec2Svc quarantineEC2API) ([]quarantinedInstance, error) {
+	var quarantined []quarantinedInstance
+	paginator := ec2.NewDescribeInstancesPaginator(ec2Svc, &ec2.DescribeInstancesInput{
+		Filters: []ec2Types.Filter{
+			{Name: aws.String("tag:" + TagQuarantinedFrom), Values: []string{a.Name}},
+			{Name: aws.String("instance-state-name"), Values: []string{"pending", "running", "stopping", "stopped"}},
+		},
+	})
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, reservation := range output.Reservations {
+			for _, instance := range reservation.Instances {
+				q := quarantinedInstance{ID: aws.ToString(instance.InstanceId)}
+				for _, tag := range instance.Tags {
+					if aws.ToString(tag.Key) == TagQuarantineExpires {
+						q.Expires, _ = time.Parse(time.RFC3339, aws.ToString(tag.Value))
+					}
+				}
+				quarantined = append(quarantined, q)
+			}
+		}
+	}
+	return quarantined, nil
+}
+
+// quarantine tags instances for inspection and detaches them from the ASG,
+// which launches replacements. It returns the instances it detached, no more
+// than the free quarantine slots. Instances it fails to detach are untagged,
+// so they aren't swept as quarantined while still in the ASG.
+func (a *ASGDriver) quarantine(ctx context.Context, ec2Svc quarantineEC2API, asgSvc quarantineASGAPI, instanceIDs []string, reason string, now time.Time) ([]string, error) {
+	existing, err := a.listQuarantined(ctx, ec2Svc)
+	if err != nil {
+		return nil, fmt.Errorf("listing quarantined instances: %w", err)
+	}
+	slots := a.Quarantine.MaxInstances - len(existing)
+	if slots <= 0 {
+		logging.FromContext(ctx).Warn("[Elastic CI Mode] Quarantine is full, replacing dangling instances as usual", "quarantined", len(existing))
+		return nil, nil
+	}
+	instanceIDs = instanceIDs[:min(slots, len(instanceIDs))]
+
+	expires := now.Add(cmp.Or(a.Quarantine.Expiry, defaultQuarantineExpiry))
+	// Tag before detaching, while the instance still has the ASG's tags that
+	// the IAM policy conditions on
+	if _, err := ec2Svc.CreateTags(ctx, &ec2.CreateTagsInput{
+		Resources: instanceIDs,
+		Tags: []ec2Types.Tag{
+			{Key: aws.String(TagQuarantinedFrom), Value: aws.String(a.Name)},
+			{Key: aws.String(TagQuarantineExpires), Value: aws.String(expires.UTC().Format(time.RFC3339))},
+			{Key: aws.String(TagQuarantineReason), Value: aws.String(reason)},
+		},
+	}); err != nil {
+		return nil, fmt.Errorf("CreateTags failed: %w", err)
+	}
+
+	var detached []string
+	// DetachInstances takes at most 20 instance IDs
+	for batch := range slices.Chunk(instanceIDs, 20) {
+		if _, err := asgSvc.DetachInstances(ctx, &autoscaling.DetachInstancesInput{
+			AutoScalingGroupName:           aws.String(a.Name),
+			InstanceIds:                    batch,
+			ShouldDecrementDesiredCapacity: aws.Bool(false),
+		}); err != nil {
+			err = fmt.Errorf("DetachInstances failed: %w", err)
+			if _, untagErr := ec2Svc.DeleteTags(ctx, &ec2.DeleteTagsInput{
+				Resources: instanceIDs[len(detached):],
+				Tags: []ec2Types.Tag{
+					{Key: aws.String(TagQuarantinedFrom)},
+					{Key: aws.String(TagQuarantineExpires)},
+					{Key: aws.String(TagQuarantineReason)},
+				},
+			}); untagErr != nil {
+				err = errors.Join(err, fmt.Errorf("DeleteTags failed: %w", untagErr))
+			}
+			return detached, err
+		}
+		detached = append(detached, batch...)
+	}
+	for _, id := range detached {
+		logging.FromContext(ctx).Info("[Elastic CI Mode] 🔒 Quarantined instance", "instance", id, "expires", expires.Format(time.RFC3339))
+	}
+	return detached, nil
+}
+
+// SweepQuarantine terminates quarantined instances whose quarantine has
+// expired. Extending an instance's expires tag keeps it for longer.
+func (a *ASGDriver) SweepQuarantine(ctx context.Context, now time.Time) error {
+	if a.Quarantine.MaxInstances <= 0 {
+		return nil
+	}
+	quarantined, err := a.listQuarantined(ctx, a.ec2Client())
+	if err != nil {
+		return fmt.Errorf("listing quarantined instances: %w", err)
+	}
+
+	var expired []string
+	for _, q := range quarantined {
+		switch {
+		case q.Expires.IsZero():
+			logging.FromContext(ctx).Warn("⚠️  Quarantined instance has no valid expires tag, leaving it", "instance", q.ID, "tag", TagQuarantineExpires)
+		case !now.Before(q.Expires):
+			expired = append(expired, q.ID)
+		}
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+
+	if _, err := a.ec2Client().TerminateInstances(ctx, &ec2.TerminateInstancesInput{InstanceIds: expired}); err != nil {
+		return fmt.Errorf("TerminateInstances failed: %w", err)
+	}
+	logging.FromContext(ctx).Info("🔓 Terminated quarantined instances past their expiry", "instances", expired)
+	return nil
+}
+
+// quarantineSweeper is implemented by ASG drivers that quarantine instances.
+type quarantineSweeper interface {
+	SweepQuarantine(ctx context.Context, now time.Time) error
+}
@@ -0,0 +1,166 @@
+package scaler
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// stubQuarantineClient implements the EC2 and ASG calls quarantine makes,
+// with a fixed set of already quarantined instances. Other calls panic.
+type stubQuarantineClient struct {
+	EC2API
+	AutoScalingAPI
+
+	quarantined map[string]string // Instance ID to expires tag
+	tagged      []string
+	untagged    []string
+	detached    []string
+	terminated  []string
+	detachErr   error
+}
+
+func (s *stubQuarantineClient) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	var instances []ec2Types.Instance
+	for id, expires := range s.quarantined {
+		instances = append(instances, ec2Types.Instance{
+			InstanceId: aws.String(id),
+			Tags:       []ec2Types.Tag{{Key: aws.String(TagQuarantineExpires), Value: aws.String(expires)}},
+		})
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []ec2Types.Reservation{{Instances: instances}}}, nil
+}
+
+func (s *stubQuarantineClient) CreateTags(ctx context.Context, params *ec2.CreateTagsInput, _ ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	s.tagged = append(s.tagged, params.Resources...)
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (s *stubQuarantineClient) DeleteTags(ctx context.Context, params *ec2.DeleteTagsInput, _ ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error) {
+	s.untagged = append(s.untagged, params.Resources...)
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+func (s *stubQuarantineClient) TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, _ ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error) {
+	s.terminated = append(s.terminated, params.InstanceIds...)
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
+func (s *stubQuarantineClient) DetachInstances(ctx context.Context, params *autoscaling.DetachInstancesInput, _ ...func(*autoscaling.Options)) (*autoscaling.DetachInstancesOutput, error) {
+	if aws.ToBool(params.ShouldDecrementDesiredCapacity) {
+		panic("quarantine must not decrement desired capacity")
+	}
+	if s.detachErr != nil {
+		return nil, s.detachErr
+	}
+	s.detached = append(s.detached, params.InstanceIds...)
+	return &autoscaling.DetachInstancesOutput{}, nil
+}
+
+func TestQuarantineFillsFreeSlots(t *testing.T) {
+	stub := &stubQuarantineClient{quarantined: map[string]string{"i-earlier": "2030-01-01T00:00:00Z"}}
+	driver := &ASGDriver{Name: "agents", Quarantine: QuarantineParams{MaxInstances: 2}}
+
+	got, err := driver.quarantine(context.Background(), stub, stub, []string{"i-a", "i-b"}, "dangling", time.Unix(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"i-a"}; !slices.Equal(got, want) {
+		t.Errorf("quarantine() = %v, want %v", got, want)
+	}
+	if !slices.Equal(stub.tagged, got) || !slices.Equal(stub.detached, got) {
+		t.Errorf("tagged %v and detached %v, want both %v", stub.tagged, stub.detached, got)
+	}
+}
+
+func TestQuarantineUntagsInstancesItFailsToDetach(t *testing.T) {
+	stub := &stubQuarantineClient{detachErr: errors.New("throttled")}
+	driver := &ASGDriver{Name: "agents", Quarantine: QuarantineParams{MaxInstances: 2}}
+
+	got, err := driver.quarantine(context.Background(), stub, stub, []string{"i-a", "i-b"}, "dangling", time.Unix(0, 0))
+	if err == nil {
+		t.Fatal("quarantine() error = nil, want the DetachInstances error")
+	}
+	if len(got) != 0 {
+		t.Errorf("quarantine() = %v, want none detached", got)
+	}
+	if want := []string{"i-a", "i-b"}; !slices.Equal(stub.untagged, want) {
+		t.Errorf("untagged %v, want %v", stub.untagged, want)
+	}
+}
+
+func TestSweepQuarantine(t *testing.T) {
+	now := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	stub := &stubQuarantineClient{quarantined: map[string]string{
+		"i-expired": "2026-01-01T00:00:00Z",
+		"i-kept":    "2026-01-03T00:00:00Z",
+		"i-invalid": "next tuesday",
+	}}
+	driver := &ASGDriver{
+		Name:           "agents",
+		Quarantine:     QuarantineParams{MaxInstances: 5},
+		ec2Svc:         stub,
+		autoscalingSvc: stub,
+	}
+
+	if err := driver.SweepQuarantine(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"i-expired"}; !slices.Equal(stub.terminated, want) {
+		t.Errorf("terminated = %v, want %v", stub.terminated, want)
+	}
+}
+
+func TestCheckAndMarkUnhealthyQuarantinesAfterForensics(t *testing.T) {
+	stub := &stubQuarantineClient{}
+	driver := &ASGDriver{
+		Name:                 "agents",
+		Forensics:            ForensicsParams{S3Bucket: "evidence"},
+		Quarantine:           QuarantineParams{MaxInstances: 1},
+		ec2Svc:               stub,
+		autoscalingSvc:       stub,
+		ssmRegistrationDelay: time.Millisecond,
+		ssmPollInterval:      time.Millisecond,
+		ssmPollDeadline:      time.Second,
+	}
+	ssmStub := &stubSSMClient{
+		describeOut: &ssm.DescribeInstanceInformationOutput{InstanceInformationList: []ssmTypes.InstanceInformation{
+			{InstanceId: aws.String("i-a"), PingStatus: ssmTypes.PingStatusOnline},
+			{InstanceId: aws.String("i-b"), PingStatus: ssmTypes.PingStatusOnline},
+		}},
+		listResponses: []stubListResponse{{out: &ssm.ListCommandInvocationsOutput{
+			CommandInvocations: []ssmTypes.CommandInvocation{
+				{InstanceId: aws.String("i-a"), Status: ssmTypes.CommandInvocationStatusSuccess, CommandPlugins: []ssmTypes.CommandPlugin{{Output: aws.String("NOT_RUNNING: failed")}}},
+				{InstanceId: aws.String("i-b"), Status: ssmTypes.CommandInvocationStatusSuccess, CommandPlugins: []ssmTypes.CommandPlugin{{Output: aws.String("NOT_RUNNING: failed")}}},
+			},
+		}}},
+	}
+	asgStub := &stubASGClient{}
+
+	marked, _, err := driver.checkAndMarkUnhealthy(context.Background(), []string{"i-a", "i-b"}, ssmStub, asgStub, "linux")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if marked != 2 {
+		t.Errorf("markedUnhealthyCount = %d, want 2", marked)
+	}
+	// One check command, then one forensics command for both instances
+	if len(ssmStub.sendBatches) != 2 || !slices.Equal(ssmStub.sendBatches[1], []string{"i-a", "i-b"}) {
+		t.Errorf("SendCommand batches = %v, want the check then forensics for [i-a i-b]", ssmStub.sendBatches)
+	}
+	if want := []string{"i-a"}; !slices.Equal(stub.detached, want) {
+		t.Errorf("detached = %v, want %v", stub.detached, want)
+	}
+	if want := []string{"i-b"}; !slices.Equal(asgStub.markedUnhealthy, want) {
+		t.Errorf("marked unhealthy = %v, want %v", asgStub.markedUnhealthy, want)
+	}
+}
@@ -0,0 +1,180 @@
+// Package replay replays a recorded timeline of queue metrics through the
+// scaler against a simulated fleet, to see what a set of scaler.Params would
+// have cost and how long jobs would have waited for agents.
+//
+// The jobs behind the timeline are inferred from it (see Timeline.Jobs) and
+// queued on a scalertest.Sim, which boots instances and runs jobs as the
+// Scaler drives it. Everything the Scaler does on a real fleet happens in the
+// replay: the step function or controller, scale factors, cooldowns, scaling
+// policies, the instance buffer and agent availability checks.
+package replay
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/buildkite/buildkite-agent-scaler/scaler"
+	"github.com/buildkite/buildkite-agent-scaler/scaler/scalertest"
+)
+
+// Config describes the fleet to replay against. Zero values take the
+// defaults noted.
+type Config struct {
+	Interval time.Duration // How often the scaler runs, default 10s as in the CLI
+
+	MinSize        int64 // The ASG's own bounds; scaler.Params.MinSize and MaxSize apply within them
+	MaxSize        int64 // Default 100
+	InitialDesired int64 // Instances running when the timeline starts, default MinSize
+
+	BootDelay            time.Duration // From launch until InService, default 90s
+	RegistrationDelay    time.Duration // From InService until the agents connect, default 30s
+	LifecycleHookTimeout time.Duration // See scalertest.Config
+	IdleTimeout          time.Duration // See scalertest.Config
+
+	InstanceHourlyCost float64 // For the estimated cost
+}
+
+func (c *Config) setDefaults() {
+	c.Interval = cmp.Or(c.Interval, 10*time.Second)
+	c.MaxSize = cmp.Or(c.MaxSize, 100)
+	c.InitialDesired = max(c.InitialDesired, c.MinSize)
+}
+
+// Report is the outcome of a replay.
+type Report struct {
+	Start, End time.Time
+	Jobs       int // Jobs inferred from the timeline
+	JobsLost   int // Jobs lost to instances terminated while running them
+
+	InstanceHours float64
+	Cost          float64 // InstanceHours at Config.InstanceHourlyCost
+
+	// How long jobs waited for an agent, including how long the jobs still
+	// waiting at the end had waited
+	Wait WaitTimes
+
+	ScaleOuts   int // Runs that raised desired capacity
+	ScaleIns    int // Runs that lowered desired capacity
+	PeakDesired int64
+}
+
+// ScalingActions is how many times the scaler changed desired capacity.
+func (r Report) ScalingActions() int {
+	return r.ScaleOuts + r.ScaleIns
+}
+
+// WaitTimes are percentiles of job wait times.
+type WaitTimes struct {
+	P50, P90, P95, P99, Max time.Duration
+}
+
+// Run replays timeline through a Scaler with params. The ASG name, queue and
+// anything that would reach outside the simulation, e.g. DryRun, are
+// overridden.
+func Run(ctx context.Context, timeline Timeline, params scaler.Params, cfg Config) (Report, error) {
+	if len(timeline) == 0 {
+		return Report{}, errors.New("timeline has no samples")
+	}
+	cfg.setDefaults()
+	start, end := timeline[0].Time, timeline[len(timeline)-1].Time
+
+	sim := scalertest.New(scalertest.Config{
+		ASGName:              "replay",
+		MinSize:              cfg.MinSize,
+		MaxSize:              cfg.MaxSize,
+		Desired:              cfg.InitialDesired,
+		AgentsPerInstance:    params.AgentsPerInstance,
+		BootDelay:            cfg.BootDelay,
+		RegistrationDelay:    cfg.RegistrationDelay,
+		LifecycleHookTimeout: cfg.LifecycleHookTimeout,
+		IdleTimeout:          cfg.IdleTimeout,
+		Start:                start,
+	})
+	params.AutoScalingGroupName = "replay"
+	params.BuildkiteQueue = "default"
+	params.DryRun = false
+	params.PublishCloudWatchMetrics = false
+	params.RuntimeConfigParameter = ""
+	sc, err := scaler.NewScaler(nil, aws.Config{}, params, sim.Options()...)
+	if err != nil {
+		return Report{}, err
+	}
+
+	jobs := timeline.Jobs()
+	report := Report{Start: start, End: end, Jobs: len(jobs), PeakDesired: cfg.InitialDesired}
+	var nextJob, sample int
+	for now := start; !now.After(end); now = now.Add(cfg.Interval) {
+		sim.Clock.Advance(now.Sub(sim.Clock.Now()))
+		for ; nextJob < len(jobs) && !jobs[nextJob].Queued.After(now); nextJob++ {
+			sim.AddJobs(1, jobs[nextJob].Duration)
+		}
+		for sample+1 < len(timeline) && !timeline[sample+1].Time.After(now) {
+			sample++
+		}
+		sim.SetBlockedJobs(timeline[sample].WaitingJobs)
+
+		if _, err := sc.Run(ctx); err != nil {
+			return report, fmt.Errorf("run at %s: %w", now.Sub(start), err)
+		}
+		switch d := sc.LastDecision(); {
+		case d.Desired > d.Current:
+			report.ScaleOuts++
+			report.PeakDesired = max(report.PeakDesired, d.Desired)
+		case d.Desired < d.Current:
+			report.ScaleIns++
+		}
+	}
+	sim.Clock.Advance(end.Sub(sim.Clock.Now()))
+
+	stats := sim.Stats()
+	report.JobsLost = stats.JobsLost
+	report.InstanceHours = stats.InstanceTime.Hours()
+	report.Cost = report.InstanceHours * cfg.InstanceHourlyCost
+	report.Wait = percentiles(sim.JobWaits())
+	return report, nil
+}
+
+// percentiles returns the nearest-rank percentiles of waits.
+func percentiles(waits []time.Duration) WaitTimes {
+	if len(waits) == 0 {
+		return WaitTimes{}
+	}
+	slices.Sort(waits)
+	rank := func(p float64) time.Duration {
+		return waits[max(int(math.Ceil(p*float64(len(waits))))-1, 0)]
+	}
+	return WaitTimes{
+		P50: rank(0.50),
+		P90: rank(0.90),
+		P95: rank(0.95),
+		P99: rank(0.99),
+		Max: waits[len(waits)-1],
+	}
+}
+
+// Write writes the report for people to read.
+func (r Report) Write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, `Replayed %s to %s (%s)
+Jobs:            %d (%d lost to busy terminations)
+Instance hours:  %.1f
+Estimated cost:  %.2f
+Job wait:        p50 %s, p90 %s, p95 %s, p99 %s, max %s
+Scaling actions: %d (%d out, %d in)
+Peak desired:    %d
+`,
+		r.Start.Format(time.RFC3339), r.End.Format(time.RFC3339), r.End.Sub(r.Start),
+		r.Jobs, r.JobsLost,
+		r.InstanceHours,
+		r.Cost,
+		r.Wait.P50, r.Wait.P90, r.Wait.P95, r.Wait.P99, r.Wait.Max,
+		r.ScalingActions(), r.ScaleOuts, r.ScaleIns,
+		r.PeakDesired)
+	return err
+}
@@ -0,0 +1,81 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/scaler"
+)
+
+// workday records bursts of 8 ten-minute jobs every two hours, run by a fleet
+// that had capacity for them all.
+func workday() Timeline {
+	var timeline Timeline
+	for m := 0; m <= 8*60; m++ {
+		s := Sample{Time: t0.Add(time.Duration(m) * time.Minute)}
+		if m%120 < 10 {
+			s.RunningJobs = 8
+		}
+		timeline = append(timeline, s)
+	}
+	return timeline
+}
+
+func TestRun(t *testing.T) {
+	timeline := workday()
+	cfg := Config{MaxSize: 20, InstanceHourlyCost: 0.5}
+
+	base, err := Run(context.Background(), timeline, scaler.Params{AgentsPerInstance: 2}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base.Jobs != 40 || base.JobsLost != 0 {
+		t.Errorf("jobs=%d lost=%d, want 40 jobs and none lost", base.Jobs, base.JobsLost)
+	}
+	// Every burst waits for instances to boot, then they're scaled back in,
+	// apart from the last, which the timeline ends during
+	if base.ScaleOuts < 5 || base.ScaleIns < 4 || base.PeakDesired != 4 {
+		t.Errorf("scale outs=%d ins=%d peak=%d, want at least one each per burst and a peak of 4", base.ScaleOuts, base.ScaleIns, base.PeakDesired)
+	}
+	if base.Wait.P50 < time.Minute || base.Wait.Max > 5*time.Minute {
+		t.Errorf("wait = %+v, want jobs to wait for instances to boot", base.Wait)
+	}
+	if base.Cost != base.InstanceHours*0.5 {
+		t.Errorf("cost = %v, want %v instance hours at 0.5", base.Cost, base.InstanceHours)
+	}
+
+	// Keeping enough instances warm cuts waits after the first burst, at the
+	// cost of idle instances
+	warm, err := Run(context.Background(), timeline, scaler.Params{AgentsPerInstance: 2, MinSize: 4}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warm.Wait.P50 != 0 || warm.InstanceHours <= base.InstanceHours {
+		t.Errorf("kept warm, wait = %+v and %.1f instance hours, want most jobs not to wait, for more than %.1f instance hours",
+			warm.Wait, warm.InstanceHours, base.InstanceHours)
+	}
+
+	// A long scale-in cooldown keeps instances between bursts
+	cooldown, err := Run(context.Background(), timeline, scaler.Params{
+		AgentsPerInstance: 2,
+		ScaleInParams:     scaler.ScaleParams{CooldownPeriod: 3 * time.Hour},
+	}, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cooldown.InstanceHours <= base.InstanceHours || cooldown.ScaleIns >= base.ScaleIns {
+		t.Errorf("with a cooldown, %.1f instance hours and %d scale ins, want more than %.1f and fewer than %d",
+			cooldown.InstanceHours, cooldown.ScaleIns, base.InstanceHours, base.ScaleIns)
+	}
+
+	var out bytes.Buffer
+	if err := base.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Jobs:            40") {
+		t.Errorf("report:\n%s", out.String())
+	}
+}
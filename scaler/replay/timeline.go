@@ -0,0 +1,290 @@
+package replay
+
+import (
+	"bufio"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats ReadTimeline reads.
+const (
+	FormatCSV        = "csv"        // A header row naming the columns, then one sample per row
+	FormatJSONL      = "jsonl"      // One JSON object per line
+	FormatCloudWatch = "cloudwatch" // The output of aws cloudwatch get-metric-data
+)
+
+// Sample is a recorded reading of a queue's metrics.
+type Sample struct {
+	Time          time.Time
+	ScheduledJobs int64
+	RunningJobs   int64
+	WaitingJobs   int64 // Jobs behind wait steps
+}
+
+// Timeline is a queue's recorded metrics, oldest first.
+type Timeline []Sample
+
+// FormatFromPath returns the format of a timeline file from its extension:
+// .csv, .jsonl (or .ndjson), or .json for a CloudWatch export.
+func FormatFromPath(path string) (string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return FormatCSV, nil
+	case ".jsonl", ".ndjson":
+		return FormatJSONL, nil
+	case ".json":
+		return FormatCloudWatch, nil
+	}
+	return "", fmt.Errorf("can't tell the format of %s from its extension, expected .csv, .jsonl or .json", path)
+}
+
+// ReadTimeline reads a timeline in the given format.
+//
+// CSV and JSONL samples have a time, as RFC 3339 or Unix seconds, and the
+// scheduled, running and (optionally) waiting job counts. The counts may also
+// be named after the CloudWatch metrics the scaler publishes, e.g.
+// ScheduledJobsCount. CloudWatch exports are matched to those metrics by each
+// result's Label or Id, e.g. "scheduled".
+func ReadTimeline(r io.Reader, format string) (Timeline, error) {
+	var samples map[time.Time]*Sample
+	var err error
+	switch format {
+	case FormatCSV:
+		samples, err = readCSV(r)
+	case FormatJSONL:
+		samples, err = readJSONL(r)
+	case FormatCloudWatch:
+		samples, err = readCloudWatch(r)
+	default:
+		return nil, fmt.Errorf("unknown timeline format %q", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(samples) == 0 {
+		return nil, errors.New("timeline has no samples")
+	}
+
+	var t Timeline
+	for _, s := range samples {
+		t = append(t, *s)
+	}
+	slices.SortFunc(t, func(a, b Sample) int { return a.Time.Compare(b.Time) })
+	return t, nil
+}
+
+// column returns the field a CSV column or JSON key holds, or "" if it's not
+// one ReadTimeline uses.
+func column(name string) string {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "time", "timestamp":
+		return "time"
+	case "scheduled", "scheduledjobscount":
+		return "scheduled"
+	case "running", "runningjobscount":
+		return "running"
+	case "waiting", "waitingjobscount":
+		return "waiting"
+	}
+	return ""
+}
+
+// set stores a value read for field in the sample.
+func (s *Sample) set(field string, value float64) {
+	n := int64(math.Round(value)) // CloudWatch statistics can be fractional
+	switch field {
+	case "scheduled":
+		s.ScheduledJobs = n
+	case "running":
+		s.RunningJobs = n
+	case "waiting":
+		s.WaitingJobs = n
+	}
+}
+
+func parseTime(v string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func readCSV(r io.Reader) (map[time.Time]*Sample, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	header := make([]string, len(records[0]))
+	for i, name := range records[0] {
+		header[i] = column(name)
+	}
+	if !slices.Contains(header, "time") {
+		return nil, errors.New("CSV timeline has no time column")
+	}
+
+	samples := make(map[time.Time]*Sample)
+	for line, record := range records[1:] {
+		s := &Sample{}
+		for i, v := range record {
+			var err error
+			switch header[i] {
+			case "":
+			case "time":
+				s.Time, err = parseTime(v)
+			default:
+				var f float64
+				f, err = strconv.ParseFloat(v, 64)
+				s.set(header[i], f)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line+2, err)
+			}
+		}
+		samples[s.Time] = s
+	}
+	return samples, nil
+}
+
+func readJSONL(r io.Reader) (map[time.Time]*Sample, error) {
+	samples := make(map[time.Time]*Sample)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var fields map[string]any
+		if err := json.Unmarshal(scanner.Bytes(), &fields); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		s := &Sample{}
+		for k, v := range fields {
+			var err error
+			switch field := column(k); {
+			case field == "":
+			case field == "time":
+				switch v := v.(type) {
+				case float64:
+					s.Time = time.Unix(int64(v), 0).UTC()
+				case string:
+					s.Time, err = parseTime(v)
+				default:
+					err = fmt.Errorf("%s is %v, not a time", k, v)
+				}
+			default:
+				f, ok := v.(float64)
+				if !ok {
+					err = fmt.Errorf("%s is %v, not a number", k, v)
+				}
+				s.set(field, f)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+		}
+		if s.Time.IsZero() {
+			return nil, fmt.Errorf("line %d: no time", line)
+		}
+		samples[s.Time] = s
+	}
+	return samples, scanner.Err()
+}
+
+func readCloudWatch(r io.Reader) (map[time.Time]*Sample, error) {
+	var export struct {
+		MetricDataResults []struct {
+			Id         string
+			Label      string
+			Timestamps []time.Time
+			Values     []float64
+		}
+	}
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, err
+	}
+
+	samples := make(map[time.Time]*Sample)
+	for _, result := range export.MetricDataResults {
+		field := cmp.Or(column(result.Label), column(result.Id))
+		if field == "" || field == "time" {
+			continue
+		}
+		if len(result.Timestamps) != len(result.Values) {
+			return nil, fmt.Errorf("%s has %d timestamps but %d values", result.Id, len(result.Timestamps), len(result.Values))
+		}
+		for i, t := range result.Timestamps {
+			s, ok := samples[t]
+			if !ok {
+				s = &Sample{Time: t}
+				samples[t] = s
+			}
+			s.set(field, result.Values[i])
+		}
+	}
+	return samples, nil
+}
+
+// Job is a job inferred from a timeline.
+type Job struct {
+	Queued   time.Time
+	Duration time.Duration
+}
+
+// Jobs infers the jobs behind a timeline. Jobs arrive when the number of
+// scheduled and running jobs rises, and finish when it falls, oldest first.
+// The oldest jobs are taken to be the running ones, so a job's duration runs
+// from the first sample it's seen running in to the first it's gone from.
+// Jobs that are never seen running are taken to run for half the gap between
+// samples, and jobs still there at the end are cut short.
+//
+// Jobs that arrive and finish between two samples, or while others finish,
+// aren't seen at all, so sample as often as the metrics allow.
+func (t Timeline) Jobs() []Job {
+	var jobs []Job
+	var started []time.Time // When each job was first seen running
+	var present []int       // Indexes of the jobs in the queue, oldest first
+	var gap time.Duration
+
+	duration := func(i int, end time.Time) time.Duration {
+		if !started[i].IsZero() && end.After(started[i]) {
+			return end.Sub(started[i])
+		}
+		return gap / 2
+	}
+
+	for k, sample := range t {
+		if k > 0 {
+			gap = sample.Time.Sub(t[k-1].Time)
+		}
+		n := int(max(sample.ScheduledJobs+sample.RunningJobs, 0))
+		for ; len(present) > n; present = present[1:] {
+			jobs[present[0]].Duration = duration(present[0], sample.Time)
+		}
+		for len(present) < n {
+			present = append(present, len(jobs))
+			jobs = append(jobs, Job{Queued: sample.Time})
+			started = append(started, time.Time{})
+		}
+		for _, i := range present[:min(int(max(sample.RunningJobs, 0)), n)] {
+			if started[i].IsZero() {
+				started[i] = sample.Time
+			}
+		}
+	}
+	for _, i := range present {
+		jobs[i].Duration = duration(i, t[len(t)-1].Time)
+	}
+	return jobs
+}
@@ -0,0 +1,94 @@
+package replay
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func TestReadTimeline(t *testing.T) {
+	want := Timeline{
+		{Time: t0, ScheduledJobs: 3, RunningJobs: 1},
+		{Time: t0.Add(time.Minute), ScheduledJobs: 1, RunningJobs: 4, WaitingJobs: 2},
+	}
+	for _, tc := range []struct {
+		format, input string
+	}{
+		{FormatCSV, "time,scheduled,running,waiting\n" +
+			"2026-05-01T12:01:00Z,1,4,2\n" +
+			"2026-05-01T12:00:00Z,3,1,0\n"},
+		{FormatCSV, "Timestamp,ScheduledJobsCount,RunningJobsCount,WaitingJobsCount,IdleAgentCount\n" +
+			"1777636800,3,1,0,5\n" +
+			"1777636860,1,4,2,0\n"},
+		{FormatJSONL, `{"time":"2026-05-01T12:00:00Z","scheduled":3,"running":1}` + "\n\n" +
+			`{"time":1777636860,"scheduled":1,"running":4,"waiting":2}` + "\n"},
+		{FormatCloudWatch, `{"MetricDataResults":[
+			{"Id":"scheduled","Label":"ScheduledJobsCount","Timestamps":["2026-05-01T12:01:00+00:00","2026-05-01T12:00:00+00:00"],"Values":[1,3]},
+			{"Id":"running","Label":"running","Timestamps":["2026-05-01T12:01:00+00:00","2026-05-01T12:00:00+00:00"],"Values":[4.2,0.8]},
+			{"Id":"waiting","Label":"WaitingJobsCount","Timestamps":["2026-05-01T12:01:00+00:00"],"Values":[2]}
+		]}`},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			got, err := ReadTimeline(strings.NewReader(tc.input), tc.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("ReadTimeline() = %+v, want %+v", got, want)
+			}
+			for i := range want {
+				if !got[i].Time.Equal(want[i].Time) || got[i].ScheduledJobs != want[i].ScheduledJobs ||
+					got[i].RunningJobs != want[i].RunningJobs || got[i].WaitingJobs != want[i].WaitingJobs {
+					t.Errorf("sample %d = %+v, want %+v", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestReadTimelineErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, format, input string
+	}{
+		{"no time column", FormatCSV, "scheduled,running\n1,2\n"},
+		{"bad count", FormatCSV, "time,scheduled\n2026-05-01T12:00:00Z,lots\n"},
+		{"no samples", FormatCSV, "time,scheduled\n"},
+		{"no time", FormatJSONL, `{"scheduled":1}`},
+		{"unknown format", "xml", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ReadTimeline(strings.NewReader(tc.input), tc.format); err == nil {
+				t.Error("ReadTimeline() succeeded")
+			}
+		})
+	}
+}
+
+func TestJobs(t *testing.T) {
+	at := func(m int) time.Time { return t0.Add(time.Duration(m) * time.Minute) }
+	timeline := Timeline{
+		{Time: at(0), ScheduledJobs: 2},                 // Two jobs queue
+		{Time: at(1), ScheduledJobs: 1, RunningJobs: 1}, // One starts
+		{Time: at(2), RunningJobs: 2},                   // The other starts
+		{Time: at(5), RunningJobs: 1},                   // The first finishes
+		{Time: at(6), ScheduledJobs: 1, RunningJobs: 1}, // A third queues
+		{Time: at(8)}, // Both finish, the third unseen running
+	}
+
+	want := []Job{
+		{Queued: at(0), Duration: 4 * time.Minute},
+		{Queued: at(0), Duration: 6 * time.Minute},
+		{Queued: at(6), Duration: time.Minute},
+	}
+	got := timeline.Jobs()
+	if len(got) != len(want) {
+		t.Fatalf("Jobs() = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if !got[i].Queued.Equal(want[i].Queued) || got[i].Duration != want[i].Duration {
+			t.Errorf("job %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
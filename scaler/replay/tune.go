@@ -0,0 +1,198 @@
+package replay
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/scaler"
+)
+
+// Grid is the values Tune tries for each parameter it sweeps. A parameter
+// without values keeps the base scaler.Params' value.
+type Grid struct {
+	ScaleInFactors         []float64
+	ScaleOutFactors        []float64
+	ScaleInCooldowns       []time.Duration
+	ScaleOutCooldowns      []time.Duration
+	InstanceBuffers        []int
+	AvailabilityThresholds []float64
+	IncludeWaiting         []bool
+}
+
+// Candidate is one combination of the parameters Tune sweeps.
+type Candidate struct {
+	ScaleInFactor         float64
+	ScaleOutFactor        float64
+	ScaleInCooldown       time.Duration
+	ScaleOutCooldown      time.Duration
+	InstanceBuffer        int
+	AvailabilityThreshold float64
+	IncludeWaiting        bool
+}
+
+func candidateOf(p scaler.Params) Candidate {
+	return Candidate{
+		ScaleInFactor:         p.ScaleInParams.Factor,
+		ScaleOutFactor:        p.ScaleOutParams.Factor,
+		ScaleInCooldown:       p.ScaleInParams.CooldownPeriod,
+		ScaleOutCooldown:      p.ScaleOutParams.CooldownPeriod,
+		InstanceBuffer:        p.InstanceBuffer,
+		AvailabilityThreshold: p.AvailabilityThreshold,
+		IncludeWaiting:        p.IncludeWaiting,
+	}
+}
+
+// Apply returns p with the candidate's parameters.
+func (c Candidate) Apply(p scaler.Params) scaler.Params {
+	p.ScaleInParams.Factor = c.ScaleInFactor
+	p.ScaleOutParams.Factor = c.ScaleOutFactor
+	p.ScaleInParams.CooldownPeriod = c.ScaleInCooldown
+	p.ScaleOutParams.CooldownPeriod = c.ScaleOutCooldown
+	p.InstanceBuffer = c.InstanceBuffer
+	p.AvailabilityThreshold = c.AvailabilityThreshold
+	p.IncludeWaiting = c.IncludeWaiting
+	return p
+}
+
+// TemplateParameter is a parameter of the Serverless Application template,
+// template.yaml.
+type TemplateParameter struct {
+	Name  string
+	Value string
+}
+
+// TemplateParameters returns the template.yaml parameters that deploy the
+// candidate.
+func (c Candidate) TemplateParameters() []TemplateParameter {
+	float := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+	seconds := func(d time.Duration) string { return strconv.FormatInt(int64(d/time.Second), 10) }
+	return []TemplateParameter{
+		{"ScaleInFactor", float(c.ScaleInFactor)},
+		{"ScaleOutFactor", float(c.ScaleOutFactor)},
+		{"ScaleInCooldownPeriod", seconds(c.ScaleInCooldown)},
+		{"ScaleOutCooldownPeriod", seconds(c.ScaleOutCooldown)},
+		{"InstanceBuffer", strconv.Itoa(c.InstanceBuffer)},
+		{"AvailabilityThreshold", float(c.AvailabilityThreshold)},
+		{"ScaleOutForWaitingJobs", strconv.FormatBool(c.IncludeWaiting)},
+	}
+}
+
+// Candidates returns every combination of the grid's values, with base's
+// value for parameters the grid doesn't sweep.
+func (g Grid) Candidates(base scaler.Params) []Candidate {
+	candidates := []Candidate{candidateOf(base)}
+	sweep := func(n int, set func(c *Candidate, i int)) {
+		if n == 0 {
+			return
+		}
+		var next []Candidate
+		for _, c := range candidates {
+			for i := range n {
+				set(&c, i)
+				next = append(next, c)
+			}
+		}
+		candidates = next
+	}
+	sweep(len(g.ScaleInFactors), func(c *Candidate, i int) { c.ScaleInFactor = g.ScaleInFactors[i] })
+	sweep(len(g.ScaleOutFactors), func(c *Candidate, i int) { c.ScaleOutFactor = g.ScaleOutFactors[i] })
+	sweep(len(g.ScaleInCooldowns), func(c *Candidate, i int) { c.ScaleInCooldown = g.ScaleInCooldowns[i] })
+	sweep(len(g.ScaleOutCooldowns), func(c *Candidate, i int) { c.ScaleOutCooldown = g.ScaleOutCooldowns[i] })
+	sweep(len(g.InstanceBuffers), func(c *Candidate, i int) { c.InstanceBuffer = g.InstanceBuffers[i] })
+	sweep(len(g.AvailabilityThresholds), func(c *Candidate, i int) { c.AvailabilityThreshold = g.AvailabilityThresholds[i] })
+	sweep(len(g.IncludeWaiting), func(c *Candidate, i int) { c.IncludeWaiting = g.IncludeWaiting[i] })
+	return candidates
+}
+
+// Objective scores replays; lower is better. The score is the weighted sum of
+// the cost, the p95 job wait in minutes and the jobs lost.
+type Objective struct {
+	CostWeight    float64 // Per unit of estimated cost, or per instance hour without an instance cost
+	WaitWeight    float64 // Per minute of p95 job wait
+	LostJobWeight float64 // Per job lost to a busy termination
+}
+
+// Score scores a replay's report.
+func (o Objective) Score(r Report) float64 {
+	return o.CostWeight*r.cost() + o.WaitWeight*r.Wait.P95.Minutes() + o.LostJobWeight*float64(r.JobsLost)
+}
+
+// cost is the estimated cost, or instance hours without an instance cost.
+func (r Report) cost() float64 {
+	if r.Cost == 0 {
+		return r.InstanceHours
+	}
+	return r.Cost
+}
+
+// Result is a candidate's replay.
+type Result struct {
+	Candidate Candidate
+	Report    Report
+	Score     float64
+}
+
+// dominates reports whether r is at least as good as other on cost, p95 wait
+// and lost jobs, and better on at least one.
+func (r Result) dominates(other Result) bool {
+	a, b := r.Report, other.Report
+	if a.cost() > b.cost() || a.Wait.P95 > b.Wait.P95 || a.JobsLost > b.JobsLost {
+		return false
+	}
+	return a.cost() < b.cost() || a.Wait.P95 < b.Wait.P95 || a.JobsLost < b.JobsLost
+}
+
+// Tune replays timeline with each of the grid's candidates applied to base,
+// up to parallelism at a time, and returns the results best score first.
+func Tune(ctx context.Context, timeline Timeline, base scaler.Params, cfg Config, grid Grid, objective Objective, parallelism int) ([]Result, error) {
+	candidates := grid.Candidates(base)
+	results := make([]Result, len(candidates))
+	errs := make([]error, len(candidates))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(parallelism, 1))
+	for i, c := range candidates {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			errs[i] = ctx.Err()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			report, err := Run(ctx, timeline, c.Apply(base), cfg)
+			results[i] = Result{Candidate: c, Report: report, Score: objective.Score(report)}
+			errs[i] = err
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	slices.SortStableFunc(results, func(a, b Result) int { return cmp.Compare(a.Score, b.Score) })
+	return results, nil
+}
+
+// ParetoFrontier returns the results that no other result beats on cost, p95
+// job wait and lost jobs together, cheapest first. Each is the best trade-off
+// for its cost; the rest can be discarded whatever the objective's weights.
+func ParetoFrontier(results []Result) []Result {
+	var frontier []Result
+	for _, r := range results {
+		if !slices.ContainsFunc(results, func(other Result) bool { return other.dominates(r) }) {
+			frontier = append(frontier, r)
+		}
+	}
+	slices.SortStableFunc(frontier, func(a, b Result) int {
+		return cmp.Or(cmp.Compare(a.Report.cost(), b.Report.cost()), cmp.Compare(a.Report.Wait.P95, b.Report.Wait.P95))
+	})
+	return frontier
+}
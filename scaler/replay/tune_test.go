@@ -0,0 +1,130 @@
+package replay
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/scaler"
+)
+
+func TestCandidates(t *testing.T) {
+	base := scaler.Params{
+		ScaleOutParams: scaler.ScaleParams{Factor: 1},
+		InstanceBuffer: 2,
+	}
+	grid := Grid{
+		ScaleInFactors:   []float64{0.5, 1},
+		ScaleInCooldowns: []time.Duration{0, time.Hour, 2 * time.Hour},
+		IncludeWaiting:   []bool{false, true},
+	}
+
+	candidates := grid.Candidates(base)
+	if len(candidates) != 12 {
+		t.Fatalf("got %d candidates, want 2x3x2", len(candidates))
+	}
+	seen := make(map[Candidate]bool)
+	for _, c := range candidates {
+		if c.ScaleOutFactor != 1 || c.InstanceBuffer != 2 {
+			t.Errorf("candidate %+v doesn't keep the base's unswept parameters", c)
+		}
+		seen[c] = true
+	}
+	if len(seen) != 12 {
+		t.Errorf("got %d distinct candidates, want 12", len(seen))
+	}
+
+	if got := (Grid{}).Candidates(base); len(got) != 1 || got[0] != candidateOf(base) {
+		t.Errorf("empty grid candidates = %+v, want just the base", got)
+	}
+}
+
+func TestTemplateParameters(t *testing.T) {
+	c := Candidate{ScaleInFactor: 0.5, ScaleOutFactor: 1, ScaleInCooldown: 10 * time.Minute, AvailabilityThreshold: 0.5, IncludeWaiting: true}
+	want := map[string]string{
+		"ScaleInFactor":          "0.5",
+		"ScaleOutFactor":         "1",
+		"ScaleInCooldownPeriod":  "600",
+		"ScaleOutCooldownPeriod": "0",
+		"InstanceBuffer":         "0",
+		"AvailabilityThreshold":  "0.5",
+		"ScaleOutForWaitingJobs": "true",
+	}
+	got := c.TemplateParameters()
+	if len(got) != len(want) {
+		t.Errorf("TemplateParameters() = %v", got)
+	}
+	for _, p := range got {
+		if want[p.Name] != p.Value {
+			t.Errorf("%s = %q, want %q", p.Name, p.Value, want[p.Name])
+		}
+	}
+}
+
+func TestParetoFrontier(t *testing.T) {
+	result := func(cost float64, p95 time.Duration, lost int) Result {
+		return Result{Report: Report{Cost: cost, Wait: WaitTimes{P95: p95}, JobsLost: lost}}
+	}
+	cheap := result(10, 10*time.Minute, 0)
+	fast := result(30, 0, 0)
+	middle := result(20, 2*time.Minute, 0)
+	dominated := result(25, 5*time.Minute, 0)
+	lossy := result(5, 0, 3)
+
+	frontier := ParetoFrontier([]Result{fast, dominated, cheap, lossy, middle})
+	want := []Result{lossy, cheap, middle, fast}
+	if len(frontier) != len(want) {
+		t.Fatalf("frontier = %+v, want %+v", frontier, want)
+	}
+	for i := range want {
+		if frontier[i].Report != want[i].Report {
+			t.Errorf("frontier[%d] = %+v, want %+v", i, frontier[i].Report, want[i].Report)
+		}
+	}
+}
+
+// trickle records a five minute job every quarter of an hour for a day.
+func trickle() Timeline {
+	var timeline Timeline
+	for m := 0; m <= 24*60; m++ {
+		s := Sample{Time: t0.Add(time.Duration(m) * time.Minute)}
+		if m%15 < 5 {
+			s.RunningJobs = 1
+		}
+		timeline = append(timeline, s)
+	}
+	return timeline
+}
+
+func TestTune(t *testing.T) {
+	timeline := trickle()
+	base := scaler.Params{AgentsPerInstance: 1}
+	grid := Grid{ScaleInCooldowns: []time.Duration{0, 12 * time.Hour}}
+
+	for _, tc := range []struct {
+		name      string
+		objective Objective
+		want      time.Duration
+	}{
+		// Keeping the instance between jobs means they don't wait for one
+		// to boot, for more instance hours
+		{"cost", Objective{CostWeight: 1}, 0},
+		{"wait", Objective{WaitWeight: 1}, 12 * time.Hour},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			results, err := Tune(context.Background(), timeline, base, Config{}, grid, tc.objective, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 2 {
+				t.Fatalf("got %d results, want one per candidate", len(results))
+			}
+			if got := results[0].Candidate.ScaleInCooldown; got != tc.want {
+				t.Errorf("best scale-in cooldown = %s, want %s; results: %+v", got, tc.want, results)
+			}
+			if frontier := ParetoFrontier(results); len(frontier) != 2 {
+				t.Errorf("frontier = %+v, want both, trading cost for wait", frontier)
+			}
+		})
+	}
+}
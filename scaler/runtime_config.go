@@ -0,0 +1,150 @@
+package scaler
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/buildkite-agent-scaler/logging"
+)
+
+// RuntimeTagPrefix prefixes the ASG tags that override scaler settings at
+// runtime, e.g. "buildkite:scaler:max-size".
+const RuntimeTagPrefix = "buildkite:scaler:"
+
+// Runtime setting keys, shared by ASG tags (after RuntimeTagPrefix) and the
+// runtime config SSM parameter.
+const (
+	runtimeKeyMinSize = "min-size"
+	runtimeKeyMaxSize = "max-size"
+)
+
+// Sources of the bounds applied to desired capacity, as reported in
+// Decision.Clamps.
+const (
+	boundASGMin       = "asg-min"
+	boundASGMax       = "asg-max"
+	boundScalerMin    = "scaler-min"
+	boundScalerMax    = "scaler-max"
+	boundTagMin       = "tag-min"
+	boundTagMax       = "tag-max"
+	boundParameterMin = "parameter-min"
+	boundParameterMax = "parameter-max"
+)
+
+// parseRuntimeConfig parses "key=value" pairs separated by newlines or
+// commas, the format of the runtime config SSM parameter. Blank lines and
+// lines starting with # are ignored.
+func parseRuntimeConfig(logger *slog.Logger, s string) map[string]string {
+	config := make(map[string]string)
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok {
+			logger.Warn("⚠️  Ignoring runtime config entry: expected key=value", "entry", line)
+			continue
+		}
+		config[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return config
+}
+
+// runtimeTags returns the ASG tags under RuntimeTagPrefix, keyed without it.
+func runtimeTags(tags map[string]string) map[string]string {
+	config := make(map[string]string)
+	for k, v := range tags {
+		if key, ok := strings.CutPrefix(k, RuntimeTagPrefix); ok {
+			config[key] = v
+		}
+	}
+	return config
+}
+
+// ssmRuntimeConfig reads runtime settings from an SSM parameter.
+type ssmRuntimeConfig struct {
+	client SSMAPI
+	name   string
+}
+
+func (r *ssmRuntimeConfig) GetRuntimeConfig(ctx context.Context) (map[string]string, error) {
+	value, err := RetrieveFromParameterStore(ctx, r.client, r.name)
+	if err != nil {
+		return nil, err
+	}
+	return parseRuntimeConfig(logging.FromContext(ctx), value), nil
+}
+
+// sizeBounds are the effective bounds on desired capacity for one run, with
+// the source of each for reporting clamps.
+type sizeBounds struct {
+	min, max             int64
+	minSource, maxSource string
+}
+
+// tighten narrows the bounds to [min, max] where that is tighter. A value <= 0
+// for max means no bound.
+func (b *sizeBounds) tighten(min, max int64, minSource, maxSource string) {
+	if min > b.min {
+		b.min, b.minSource = min, minSource
+	}
+	if max > 0 && max < b.max {
+		b.max, b.maxSource = max, maxSource
+	}
+}
+
+// runtimeInt parses an integer runtime setting, reporting whether it was
+// set. It logs and ignores anything that doesn't parse.
+func runtimeInt(logger *slog.Logger, config map[string]string, key, source string) (int64, bool) {
+	v, ok := config[key]
+	if !ok || v == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		logger.Warn("⚠️  Ignoring runtime setting: must be a non-negative integer", "source", source, "key", key, "value", v)
+		return 0, false
+	}
+	return n, true
+}
+
+// computeSizeBounds combines the ASG's own MinSize/MaxSize with the scaler's
+// configured bounds, then any tag and SSM parameter overrides. Scaler bounds
+// can only narrow the ASG's range, never widen it. A tag or parameter value
+// replaces the configured scaler bound, with the parameter taking precedence.
+// A min-size of 0 lowers a configured min, so a queue can scale to zero; a
+// max-size of 0 is ignored, like an unset MAX_SIZE.
+func computeSizeBounds(logger *slog.Logger, asg AutoscaleGroupDetails, minSize, maxSize int64, tags, parameter map[string]string) sizeBounds {
+	scalerMin, scalerMax := minSize, maxSize
+	minSource, maxSource := boundScalerMin, boundScalerMax
+
+	if v, ok := runtimeInt(logger, tags, runtimeKeyMinSize, "ASG tag "+RuntimeTagPrefix); ok {
+		scalerMin, minSource = v, boundTagMin
+	}
+	if v, ok := runtimeInt(logger, tags, runtimeKeyMaxSize, "ASG tag "+RuntimeTagPrefix); ok && v > 0 {
+		scalerMax, maxSource = v, boundTagMax
+	}
+	if v, ok := runtimeInt(logger, parameter, runtimeKeyMinSize, "runtime parameter"); ok {
+		scalerMin, minSource = v, boundParameterMin
+	}
+	if v, ok := runtimeInt(logger, parameter, runtimeKeyMaxSize, "runtime parameter"); ok && v > 0 {
+		scalerMax, maxSource = v, boundParameterMax
+	}
+
+	bounds := sizeBounds{
+		min:       asg.MinSize,
+		max:       asg.MaxSize,
+		minSource: boundASGMin,
+		maxSource: boundASGMax,
+	}
+	bounds.tighten(min(scalerMin, asg.MaxSize), scalerMax, minSource, maxSource)
+
+	if bounds.min > bounds.max {
+		logger.Warn("⚠️  Scaler min size is above max size, using the max", "min", bounds.min, "min_source", bounds.minSource, "max", bounds.max, "max_source", bounds.maxSource)
+		bounds.min = bounds.max
+	}
+	return bounds
+}
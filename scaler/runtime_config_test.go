@@ -0,0 +1,132 @@
+package scaler
+
+import (
+	"context"
+	"log/slog"
+	"maps"
+	"testing"
+
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+func TestParseRuntimeConfig(t *testing.T) {
+	got := parseRuntimeConfig(slog.Default(), "# queue overrides\nmin-size = 2, max-size=10\n\nbogus\n")
+	want := map[string]string{"min-size": "2", "max-size": "10"}
+	if !maps.Equal(got, want) {
+		t.Errorf("parseRuntimeConfig() = %v, want %v", got, want)
+	}
+}
+
+func TestComputeSizeBounds(t *testing.T) {
+	asg := AutoscaleGroupDetails{MinSize: 0, MaxSize: 100}
+
+	for _, tc := range []struct {
+		name             string
+		minSize, maxSize int64
+		tags, parameter  map[string]string
+		want             sizeBounds
+	}{
+		{
+			name: "unset uses the ASG range",
+			want: sizeBounds{min: 0, max: 100, minSource: boundASGMin, maxSource: boundASGMax},
+		},
+		{
+			name:    "scaler bounds narrow the ASG range",
+			minSize: 2, maxSize: 20,
+			want: sizeBounds{min: 2, max: 20, minSource: boundScalerMin, maxSource: boundScalerMax},
+		},
+		{
+			name:    "scaler bounds never widen the ASG range",
+			maxSize: 500,
+			want:    sizeBounds{min: 0, max: 100, minSource: boundASGMin, maxSource: boundASGMax},
+		},
+		{
+			name:    "tags override the configured bounds",
+			minSize: 2, maxSize: 20,
+			tags: map[string]string{"max-size": "50"},
+			want: sizeBounds{min: 2, max: 50, minSource: boundScalerMin, maxSource: boundTagMax},
+		},
+		{
+			name:      "parameter takes precedence over tags",
+			tags:      map[string]string{"max-size": "50"},
+			parameter: map[string]string{"max-size": "10"},
+			want:      sizeBounds{min: 0, max: 10, minSource: boundASGMin, maxSource: boundParameterMax},
+		},
+		{
+			name:    "a zero min overrides the configured min",
+			minSize: 2, maxSize: 20,
+			tags: map[string]string{"min-size": "0"},
+			want: sizeBounds{min: 0, max: 20, minSource: boundASGMin, maxSource: boundScalerMax},
+		},
+		{
+			name:      "a zero min in the parameter overrides a tag",
+			tags:      map[string]string{"min-size": "3"},
+			parameter: map[string]string{"min-size": "0"},
+			want:      sizeBounds{min: 0, max: 100, minSource: boundASGMin, maxSource: boundASGMax},
+		},
+		{
+			name: "invalid values are ignored",
+			tags: map[string]string{"max-size": "lots", "min-size": "-1"},
+			want: sizeBounds{min: 0, max: 100, minSource: boundASGMin, maxSource: boundASGMax},
+		},
+		{
+			name:    "min above max is capped",
+			minSize: 30, maxSize: 20,
+			want: sizeBounds{min: 20, max: 20, minSource: boundScalerMin, maxSource: boundScalerMax},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := computeSizeBounds(slog.Default(), asg, tc.minSize, tc.maxSize, tc.tags, tc.parameter)
+			if got != tc.want {
+				t.Errorf("computeSizeBounds() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunClampsToTagBounds(t *testing.T) {
+	asg := &asgTestDriver{
+		desiredCapacity: 2,
+		tags:            map[string]string{RuntimeTagPrefix + "max-size": "8"},
+	}
+	s := Scaler{
+		autoscaling: asg,
+		bk: &buildkiteTestDriver{metrics: buildkite.AgentMetrics{
+			ScheduledJobs: 40,
+		}},
+		scaling: ScalingCalculator{agentsPerInstance: 1},
+		maxSize: 20,
+	}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if asg.desiredCapacity != 8 {
+		t.Fatalf("desired capacity = %d, want tag max 8", asg.desiredCapacity)
+	}
+
+	d := s.LastDecision()
+	if d.Action != ActionScaleOut || d.Current != 2 || d.Desired != 8 {
+		t.Errorf("LastDecision() = %+v, want scale-out 2 -> 8", d)
+	}
+	if len(d.Clamps) != 1 || d.Clamps[0] != (Clamp{Bound: boundTagMax, From: 40, To: 8}) {
+		t.Errorf("LastDecision().Clamps = %v, want one tag-max 40 -> 8 clamp", d.Clamps)
+	}
+}
+
+func TestRunHonoursScalerMinSize(t *testing.T) {
+	asg := &asgTestDriver{desiredCapacity: 5}
+	s := Scaler{
+		autoscaling: asg,
+		bk:          &buildkiteTestDriver{},
+		scaling:     ScalingCalculator{agentsPerInstance: 1},
+		minSize:     3,
+	}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if asg.desiredCapacity != 3 {
+		t.Errorf("desired capacity = %d, want scaler min 3", asg.desiredCapacity)
+	}
+}
@@ -0,0 +1,127 @@
+package scaler
+
+import (
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// Runtime control modes, set with the "mode" key as an ASG tag (after
+// RuntimeTagPrefix) or in the runtime config SSM parameter.
+const (
+	// ControlModeNormal scales as configured. It is the same as no mode.
+	ControlModeNormal = "normal"
+	// ControlModePaused makes no changes to the ASG at all, including the
+	// Elastic CI Mode dangling instance cleanup. Metrics are still published.
+	ControlModePaused = "paused"
+	// ControlModeScaleOutOnly scales out as usual but never scales in.
+	ControlModeScaleOutOnly = "scale-out-only"
+	// ControlModeFreeze holds desired capacity where it is, but keeps
+	// cleaning up dangling instances in Elastic CI Mode.
+	ControlModeFreeze = "freeze"
+)
+
+const (
+	runtimeKeyMode    = "mode"
+	runtimeKeyExpires = "expires"
+	runtimeKeyDesired = "desired"
+	runtimeKeySetBy   = "set-by"
+	runtimeKeyReason  = "reason"
+)
+
+// RuntimeControl is an operator override of the scaler, read at the start of
+// each Run from ASG tags or the runtime config SSM parameter.
+type RuntimeControl struct {
+	Mode    string    // One of the ControlMode constants; empty means normal
+	Pinned  bool      // Whether desired capacity is pinned to Desired
+	Desired int64     // Pinned desired capacity
+	Expires time.Time // When the control stops applying; zero means never
+	SetBy   string    // Who set the control, for logs and metrics
+	Reason  string    // Why the control was set, for logs
+	Source  string    // "tag" or "parameter"
+}
+
+// active reports whether the control changes the scaler's behaviour.
+func (c RuntimeControl) active() bool {
+	return (c.Mode != "" && c.Mode != ControlModeNormal) || c.Pinned
+}
+
+func (c RuntimeControl) String() string {
+	s := "mode=" + c.Mode
+	if c.Mode == "" {
+		s = "mode=" + ControlModeNormal
+	}
+	if c.Pinned {
+		s += " desired=" + strconv.FormatInt(c.Desired, 10)
+	}
+	if !c.Expires.IsZero() {
+		s += " expires=" + c.Expires.Format(time.RFC3339)
+	}
+	if c.SetBy != "" {
+		s += " set-by=" + strconv.Quote(c.SetBy)
+	}
+	if c.Reason != "" {
+		s += " reason=" + strconv.Quote(c.Reason)
+	}
+	return s + " (from " + c.Source + ")"
+}
+
+// parseRuntimeControl reads a control from one source's runtime settings. ok
+// is false if the source doesn't set a mode or pinned desired count, or sets
+// an invalid one.
+func parseRuntimeControl(logger *slog.Logger, config map[string]string, source string) (control RuntimeControl, ok bool) {
+	control = RuntimeControl{
+		Mode:   config[runtimeKeyMode],
+		SetBy:  config[runtimeKeySetBy],
+		Reason: config[runtimeKeyReason],
+		Source: source,
+	}
+
+	switch control.Mode {
+	case "", ControlModeNormal, ControlModePaused, ControlModeScaleOutOnly, ControlModeFreeze:
+	default:
+		logger.Warn("⚠️  Ignoring runtime control: unknown mode", "source", source, "mode", control.Mode)
+		return RuntimeControl{}, false
+	}
+
+	if v := config[runtimeKeyDesired]; v != "" {
+		desired, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || desired < 0 {
+			logger.Warn("⚠️  Ignoring runtime control: desired must be a non-negative integer", "source", source, "desired", v)
+			return RuntimeControl{}, false
+		}
+		control.Pinned, control.Desired = true, desired
+	}
+
+	if v := config[runtimeKeyExpires]; v != "" {
+		expires, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			// A typo shouldn't lift a pause during an incident, so the control
+			// still applies, just without an expiry.
+			logger.Warn("⚠️  Runtime control has an invalid expires (want RFC3339), applying it without expiry", "source", source, "expires", v)
+		} else {
+			control.Expires = expires
+		}
+	}
+
+	return control, control.Mode != "" || control.Pinned
+}
+
+// resolveRuntimeControl picks the control to apply from the ASG tags and the
+// runtime config parameter. A control in the parameter replaces one in the
+// tags entirely, rather than merging key by key. Expired controls are ignored.
+func resolveRuntimeControl(logger *slog.Logger, tags, parameter map[string]string, now time.Time) RuntimeControl {
+	control, ok := parseRuntimeControl(logger, parameter, "parameter")
+	if !ok {
+		control, ok = parseRuntimeControl(logger, tags, "tag")
+	}
+	if !ok {
+		return RuntimeControl{}
+	}
+
+	if !control.Expires.IsZero() && !now.Before(control.Expires) {
+		logger.Info("↳ Runtime control expired, ignoring it", "expired", control.Expires.Format(time.RFC3339), "control", control.String())
+		return RuntimeControl{}
+	}
+	return control
+}
@@ -0,0 +1,136 @@
+package scaler
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+func TestResolveRuntimeControl(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name            string
+		tags, parameter map[string]string
+		want            RuntimeControl
+	}{
+		{
+			name: "nothing set",
+			want: RuntimeControl{},
+		},
+		{
+			name: "paused by tag",
+			tags: map[string]string{"mode": "paused", "set-by": "alice", "reason": "INC-42"},
+			want: RuntimeControl{Mode: ControlModePaused, SetBy: "alice", Reason: "INC-42", Source: "tag"},
+		},
+		{
+			name:      "parameter replaces the tag control",
+			tags:      map[string]string{"mode": "paused", "set-by": "alice"},
+			parameter: map[string]string{"desired": "0"},
+			want:      RuntimeControl{Pinned: true, Desired: 0, Source: "parameter"},
+		},
+		{
+			name: "expired control is ignored",
+			tags: map[string]string{"mode": "freeze", "expires": "2026-01-01T11:00:00Z"},
+			want: RuntimeControl{},
+		},
+		{
+			name: "unexpired control applies",
+			tags: map[string]string{"mode": "freeze", "expires": "2026-01-01T13:00:00Z"},
+			want: RuntimeControl{Mode: ControlModeFreeze, Expires: now.Add(time.Hour), Source: "tag"},
+		},
+		{
+			name: "invalid expiry still applies the control",
+			tags: map[string]string{"mode": "paused", "expires": "tomorrow"},
+			want: RuntimeControl{Mode: ControlModePaused, Source: "tag"},
+		},
+		{
+			name: "unknown mode is ignored",
+			tags: map[string]string{"mode": "off"},
+			want: RuntimeControl{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := resolveRuntimeControl(slog.Default(), tc.tags, tc.parameter, now)
+			if got != tc.want {
+				t.Errorf("resolveRuntimeControl() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunRuntimeControls(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		tags            map[string]string
+		currentDesired  int64
+		scheduledJobs   int64
+		expectedDesired int64
+	}{
+		{
+			name:            "paused holds despite a backlog",
+			tags:            map[string]string{"mode": "paused"},
+			currentDesired:  2,
+			scheduledJobs:   10,
+			expectedDesired: 2,
+		},
+		{
+			name:            "freeze holds with no jobs",
+			tags:            map[string]string{"mode": "freeze"},
+			currentDesired:  5,
+			expectedDesired: 5,
+		},
+		{
+			name:            "scale-out-only still scales out",
+			tags:            map[string]string{"mode": "scale-out-only"},
+			currentDesired:  2,
+			scheduledJobs:   10,
+			expectedDesired: 10,
+		},
+		{
+			name:            "scale-out-only never scales in",
+			tags:            map[string]string{"mode": "scale-out-only"},
+			currentDesired:  5,
+			expectedDesired: 5,
+		},
+		{
+			name:            "pinned desired ignores metrics",
+			tags:            map[string]string{"desired": "7"},
+			currentDesired:  2,
+			scheduledJobs:   30,
+			expectedDesired: 7,
+		},
+		{
+			name:            "expired pause scales normally",
+			tags:            map[string]string{"mode": "paused", "expires": "2000-01-01T00:00:00Z"},
+			currentDesired:  2,
+			scheduledJobs:   10,
+			expectedDesired: 10,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tags := make(map[string]string)
+			for k, v := range tc.tags {
+				tags[RuntimeTagPrefix+k] = v
+			}
+			asg := &asgTestDriver{desiredCapacity: tc.currentDesired, tags: tags}
+			s := Scaler{
+				autoscaling: asg,
+				bk: &buildkiteTestDriver{metrics: buildkite.AgentMetrics{
+					ScheduledJobs: tc.scheduledJobs,
+				}},
+				scaling: ScalingCalculator{agentsPerInstance: 1},
+			}
+
+			if _, err := s.Run(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if asg.desiredCapacity != tc.expectedDesired {
+				t.Errorf("desired capacity = %d, want %d", asg.desiredCapacity, tc.expectedDesired)
+			}
+		})
+	}
+}
@@ -2,17 +2,25 @@ package scaler
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"log"
+	"log/slog"
 	"math"
+	"os"
+	"slices"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+	"github.com/buildkite/buildkite-agent-scaler/logging"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ScaleParams struct {
@@ -20,6 +28,8 @@ type ScaleParams struct {
 	CooldownPeriod time.Duration
 	Factor         float64
 	LastEvent      time.Time
+	Policies       []ScalingPolicy // Optional limits on how far capacity can move per period
+	SelectPolicy   string          // Which policy limit applies when there are several: "max" (default) or "min"
 }
 
 type Params struct {
@@ -29,6 +39,7 @@ type Params struct {
 	BuildkiteQueue                 string
 	UserAgent                      string
 	PublishCloudWatchMetrics       bool
+	CloudWatchMetrics              CloudWatchMetricsParams // How metrics are published, see PublishCloudWatchMetrics
 	DryRun                         bool
 	IncludeWaiting                 bool
 	ScaleInParams                  ScaleParams
@@ -42,21 +53,87 @@ type Params struct {
 	MaxDanglingInstancesToCheck    int           // Maximum number of instances to check for dangling instances (only used for dangling instance scanning, not for normal scale-in)
 	MaxInstanceCap                 int           // Maximum instance count cap (0 means no cap)
 	DanglingInstancesCheckInterval time.Duration // Interval between dangling-instance checks; used to rotate the check window. Defaults to 60s when 0.
+
+	Controller             ControllerParams   // Optional closed-loop controller; the step function is used when Mode is empty or "step"
+	MetricsGuard           MetricsGuardParams // Optional anomaly detection and circuit breaker for the Buildkite metrics feed
+	MinSize                int64              // Scaler-enforced minimum desired capacity, within the ASG's own MinSize/MaxSize (0 means no extra bound)
+	MaxSize                int64              // Scaler-enforced maximum desired capacity, within the ASG's own MinSize/MaxSize (0 means no extra bound)
+	RuntimeConfigParameter string             // Optional SSM parameter with key=value runtime overrides, e.g. "max-size=10"
+
+	// Optional Buildkite REST API token (read_agents scope) for checking
+	// connected agents against instances, see DanglingAgents
+	BuildkiteAPIToken    string
+	BuildkiteAPIEndpoint string
+	DanglingAgents       DanglingAgentParams
+	BootFailures         BootFailureParams
+
+	// Optional replacement of instances that fail EC2 status checks or have
+	// scheduled maintenance events
+	InstanceStatus InstanceStatusParams
+
+	// How agents are stopped on instances being scaled in; the zero value
+	// uses the built-in commands
+	StopProcedure StopProcedure
+	Signal        SignalParams
+
+	// Optional log collection and quarantine for dangling instances found by
+	// the Elastic CI Mode SSM check
+	Forensics  ForensicsParams
+	Quarantine QuarantineParams
+
+	// How long to hold a desired capacity set outside the scaler (e.g. by
+	// hand in the console) before scaling again. 0 disables detection.
+	ExternalChangeGracePeriod time.Duration
+
+	// Read-only mode against the real ASG: every read is made, and every
+	// change is recorded in the Decision instead of being made. The checks
+	// of whether agents are running are still sent, as decisions depend on
+	// them.
+	Shadow bool
+
+	// Optional second config evaluated alongside this one, see
+	// ParseCandidateParams. Each Run the candidate decides from the same
+	// metrics and ASG without acting, and where it differs is logged and
+	// published.
+	Candidate *Params
+
+	State State // State carried over from a previous Scaler, see Scaler.State
+
+	// Where the scaler logs; nil means slog.Default. Every record carries
+	// the ASG and queue, and those made during a Run its ID and the org.
+	Logger *slog.Logger
+}
+
+// State is the scaler state carried between Run cycles that isn't captured by
+// ScaleParams.LastEvent. The Lambda keeps it in global state so warm
+// invocations pick up where the previous one stopped.
+type State struct {
+	Controller         ControllerState
+	History            []CapacityChange // Recent changes to desired capacity, used to enforce scaling policies
+	MetricsGuard       MetricsGuardState
+	LastDesired        CapacityChange // The last desired capacity the scaler set or accepted
+	Override           ManualOverride // The most recent change to desired capacity made outside the scaler
+	BootFailures       BootFailureState
+	Draining           []DrainingInstance // Instances draining ahead of a scheduled EC2 event
+	LastHeartbeatCheck time.Time          // When agent heartbeats were last checked
+	Candidate          *CandidateState    // The candidate config's state, see Params.Candidate
 }
 
 type Scaler struct {
 	autoscaling interface {
 		Describe(ctx context.Context) (AutoscaleGroupDetails, error)
 		SetDesiredCapacity(ctx context.Context, count int64) error
-		SendSIGTERMToAgents(ctx context.Context, instanceID string) error
-		CleanupDanglingInstances(ctx context.Context, minimumInstanceUptime time.Duration, maxDanglingInstancesToCheck int) error
+		SignalAgents(ctx context.Context, inv *InstanceInventory, instanceIDs []string) []SignalOutcome
+		CleanupDanglingInstances(ctx context.Context, inv *InstanceInventory, minimumInstanceUptime time.Duration, maxDanglingInstancesToCheck int) error
 	}
 	bk interface {
 		GetAgentMetrics(ctx context.Context) (buildkite.AgentMetrics, error)
 	}
 	metrics interface {
 		Publish(ctx context.Context, orgSlug, queue string, metrics map[string]int64) error
+		PublishWithDimensions(ctx context.Context, orgSlug, queue string, extra map[string]string, metrics map[string]int64) error
 	}
+	extendedMetrics             bool // Publish the decision metrics, see CloudWatchMetricsParams.Extended
 	scaling                     ScalingCalculator
 	scaleInParams               ScaleParams
 	scaleOutParams              ScaleParams
@@ -64,26 +141,162 @@ type Scaler struct {
 	scaleOnlyAfterAllEvent      bool
 	asgActivityCooldown         time.Duration
 	elasticCIMode               bool // Special mode for Elastic CI Stack
-	cfg                         aws.Config
 	minimumInstanceUptime       time.Duration
 	maxDanglingInstancesToCheck int
+	controller                  *pidController // nil unless Controller.Mode is "pid"
+	history                     []CapacityChange
+	guard                       *metricsGuard // nil unless MetricsGuard has a check enabled
+	minSize                     int64
+	maxSize                     int64
+	runtimeConfig               interface {
+		GetRuntimeConfig(ctx context.Context) (map[string]string, error)
+	}
+	externalChangeGracePeriod time.Duration
+	lastDesired               CapacityChange
+	override                  ManualOverride
+	agents                    interface {
+		ListConnectedAgents(ctx context.Context, orgSlug string) ([]buildkite.Agent, error)
+	}
+	danglingAgents DanglingAgentParams
+	// Agent heartbeats are checked at most once per interval
+	heartbeatInterval  time.Duration
+	lastHeartbeatCheck time.Time
+	boot               *bootFailureDetector // nil unless BootFailures.RegistrationDeadline is set and there is an agent lister
+	instanceStatus     InstanceStatusParams
+	draining           []DrainingInstance
+
+	clock Clock // nil means the wall clock, see now
+
+	logger *slog.Logger // With the ASG and queue, see Params.Logger
+	log    *slog.Logger // logger with the current Run's attributes, see startRunLog
+	org    string       // The org, once metrics have told us
+
+	tracerProvider trace.TracerProvider // nil means the provider of the span Run is called in, see WithTracerProvider
+	queue, asgName string               // For span attributes
+
+	shadow *shadowLog // nil unless Params.Shadow is set
+
+	candidate         *Scaler // nil unless Params.Candidate is set
+	candidateSnapshot *liveSnapshot
+	label             string // Labels the decision log line, e.g. "Candidate"
+
+	// Per-run state, reset at the start of each Run
+	bounds           sizeBounds
+	control          RuntimeControl
+	decision         Decision
+	heartbeatChecked bool
+	inventory        *InstanceInventory // Taken on first use, see instanceInventory
+	inventoryErr     error
+	inventoryTaken   bool
 }
 
-func NewScaler(client *buildkite.Client, cfg aws.Config, params Params) (*Scaler, error) {
+// NewScaler creates a Scaler. The AWS clients it uses are created from cfg,
+// unless set by opts.
+func NewScaler(client *buildkite.Client, cfg aws.Config, params Params, opts ...Option) (*Scaler, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if params.Shadow && params.DryRun {
+		return nil, errors.New("shadow mode and dry run are mutually exclusive")
+	}
+	logger := params.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger = logger.With(logging.KeyASG, params.AutoScalingGroupName, logging.KeyQueue, params.BuildkiteQueue)
+
+	// Trace the AWS calls made during a traced Run, clipping so the caller's
+	// config isn't changed under it
+	cfg.APIOptions = append(slices.Clip(cfg.APIOptions), tracingAPIOption)
+
+	metricsConfig, err := newMetricsConfig(params.CloudWatchMetrics, params.AutoScalingGroupName)
+	if err != nil {
+		return nil, err
+	}
+
 	scaler := &Scaler{
 		bk: &buildkiteDriver{
 			client: client,
 			queue:  params.BuildkiteQueue,
 		},
+		clock:                  orWallClock(o.clock),
+		logger:                 logger,
+		log:                    logger,
+		tracerProvider:         o.tracerProvider,
+		queue:                  params.BuildkiteQueue,
+		asgName:                params.AutoScalingGroupName,
 		scaleInParams:          params.ScaleInParams,
 		scaleOutParams:         params.ScaleOutParams,
 		instanceBuffer:         params.InstanceBuffer,
 		scaleOnlyAfterAllEvent: params.ScaleOnlyAfterAllEvent,
 		asgActivityCooldown:    params.ASGActivityCooldown,
 		elasticCIMode:          params.ElasticCIMode,
+		history:                slices.Clone(params.State.History),
+		minSize:                params.MinSize,
+		maxSize:                params.MaxSize,
+
+		externalChangeGracePeriod: params.ExternalChangeGracePeriod,
+		lastDesired:               params.State.LastDesired,
+		override:                  params.State.Override,
+
+		instanceStatus: params.InstanceStatus,
+		draining:       slices.Clone(params.State.Draining),
+
+		extendedMetrics: params.PublishCloudWatchMetrics && params.CloudWatchMetrics.Extended,
+	}
+
+	if o.agentMetrics != nil {
+		scaler.bk = o.agentMetrics
+	}
+
+	if params.Candidate != nil {
+		snapshot := &liveSnapshot{}
+		candidate, err := newCandidate(params, snapshot, scaler.clock)
+		if err != nil {
+			return nil, err
+		}
+		scaler.candidate, scaler.candidateSnapshot = candidate, snapshot
+	}
+
+	if params.Shadow {
+		scaler.shadow = &shadowLog{}
+		scaler.shadow.wrap(&o, cfg)
+		logger.Info("👻 [Shadow] Running read-only against the ASG; changes will be logged but not made")
+		if scaler.externalChangeGracePeriod > 0 {
+			// The ASG's desired capacity never follows the shadow's, so
+			// every run would look like a change made outside the scaler
+			logger.Info("ℹ️ [Shadow] External change detection is disabled in shadow mode")
+			scaler.externalChangeGracePeriod = 0
+		}
+	}
+
+	if o.agents == nil && params.BuildkiteAPIToken != "" {
+		o.agents = buildkite.NewAPIClient(params.BuildkiteAPIToken, params.BuildkiteAPIEndpoint)
+	}
+	if o.agents != nil {
+		scaler.agents = o.agents
+		scaler.danglingAgents = params.DanglingAgents
+		scaler.heartbeatInterval = max(params.DanglingInstancesCheckInterval, minHeartbeatCheckInterval)
+		scaler.lastHeartbeatCheck = params.State.LastHeartbeatCheck
+		if params.BootFailures.RegistrationDeadline > 0 {
+			scaler.boot = &bootFailureDetector{
+				params: params.BootFailures,
+				state:  params.State.BootFailures,
+			}
+		}
+	}
+
+	if params.RuntimeConfigParameter != "" {
+		if o.ssm == nil {
+			o.ssm = ssm.NewFromConfig(cfg)
+		}
+		scaler.runtimeConfig = &ssmRuntimeConfig{
+			client: o.ssm,
+			name:   params.RuntimeConfigParameter,
+		}
 	}
 
-	scaler.cfg = cfg
 	scaler.minimumInstanceUptime = params.MinimumInstanceUptime
 	scaler.maxDanglingInstancesToCheck = params.MaxDanglingInstancesToCheck
 
@@ -93,6 +306,27 @@ func NewScaler(client *buildkite.Client, cfg aws.Config, params Params) (*Scaler
 		availabilityThreshold: params.AvailabilityThreshold,
 		elasticCIMode:         params.ElasticCIMode,
 		maxInstanceCap:        params.MaxInstanceCap,
+		clock:                 scaler.clock,
+	}
+
+	controllerParams, err := ParseControllerParams(params.Controller)
+	if err != nil {
+		return nil, err
+	}
+	if controllerParams.Mode == ControllerModePID {
+		scaler.controller = &pidController{
+			params: controllerParams,
+			state:  params.State.Controller,
+		}
+		logger.Info("🎛️ Using PID controller; scale factors are ignored",
+			"signal", controllerParams.Signal, "kp", controllerParams.Kp, "ki", controllerParams.Ki, "kd", controllerParams.Kd)
+	}
+
+	if params.MetricsGuard.enabled() {
+		scaler.guard = &metricsGuard{
+			params: params.MetricsGuard,
+			state:  params.State.MetricsGuard,
+		}
 	}
 
 	if params.DryRun {
@@ -115,23 +349,44 @@ func NewScaler(client *buildkite.Client, cfg aws.Config, params Params) (*Scaler
 		MinimumInstanceUptime:          params.MinimumInstanceUptime,
 		MaxDanglingInstancesToCheck:    params.MaxDanglingInstancesToCheck,
 		DanglingInstancesCheckInterval: danglingInstancesCheckInterval,
+		Forensics:                      params.Forensics,
+		Quarantine:                     params.Quarantine,
+		StopProcedure:                  params.StopProcedure,
+		Signal:                         params.Signal,
+
+		autoscalingSvc: o.autoscaling,
+		ec2Svc:         o.ec2,
+		ssmSvc:         o.ssm,
+		clock:          scaler.clock,
 	}
 
-	if params.PublishCloudWatchMetrics {
+	if params.PublishCloudWatchMetrics && params.Shadow {
+		scaler.metrics = &dryRunMetricsPublisher{}
+	} else if params.PublishCloudWatchMetrics && params.CloudWatchMetrics.Format == MetricsFormatEMF {
+		scaler.metrics = &emfMetricsPublisher{
+			out:           os.Stdout,
+			clock:         scaler.clock,
+			metricsConfig: metricsConfig,
+		}
+	} else if params.PublishCloudWatchMetrics {
+		if o.cloudwatch == nil {
+			o.cloudwatch = cloudwatch.NewFromConfig(cfg)
+		}
 		scaler.metrics = &cloudWatchMetricsPublisher{
-			cfg: cfg,
+			client:        o.cloudwatch,
+			metricsConfig: metricsConfig,
 		}
 	}
 
 	if params.ElasticCIMode {
-		log.Printf("🛡️ [Elastic CI Mode] Running with enhanced safety features (stale metrics detection, dangling instance protection)")
+		logger.Info("🛡️ [Elastic CI Mode] Running with enhanced safety features (stale metrics detection, dangling instance protection)")
 		if params.ScaleInParams.Disable {
-			log.Printf("ℹ️ [Elastic CI Mode] DISABLE_SCALE_IN=true is set but will be ignored to allow proper bidirectional scaling")
+			logger.Info("ℹ️ [Elastic CI Mode] DISABLE_SCALE_IN=true is set but will be ignored to allow proper bidirectional scaling")
 		}
 	}
 
 	if params.IncludeWaiting {
-		log.Printf("ℹ️ ScaleOutForWaitingJobs is enabled. Agents will be created for jobs behind a wait step which can cause Agent bloat if the jobs being waited on are long running.")
+		logger.Info("ℹ️ ScaleOutForWaitingJobs is enabled. Agents will be created for jobs behind a wait step which can cause Agent bloat if the jobs being waited on are long running.")
 	}
 
 	return scaler, nil
@@ -145,94 +400,280 @@ func (s *Scaler) LastScaleOut() time.Time {
 	return s.scaleOutParams.LastEvent
 }
 
+// CooldownRemaining returns how long until the scaler may next scale in and
+// out, 0 if it may now. Elastic CI Mode's check of the ASG's own scale-in
+// activity isn't included.
+func (s *Scaler) CooldownRemaining() (scaleIn, scaleOut time.Duration) {
+	remaining := func(params, other ScaleParams) time.Duration {
+		if params.LastEvent.IsZero() {
+			return 0
+		}
+		lastEvent := params.LastEvent
+		if s.scaleOnlyAfterAllEvent && lastEvent.Before(other.LastEvent) {
+			lastEvent = other.LastEvent
+		}
+		return max(params.CooldownPeriod-s.now().Sub(lastEvent), 0)
+	}
+	return remaining(s.scaleInParams, s.scaleOutParams), remaining(s.scaleOutParams, s.scaleInParams)
+}
+
+// LastDecision returns the decision made by the most recent Run.
+func (s *Scaler) LastDecision() Decision {
+	return s.decision
+}
+
+// State returns the state to pass as Params.State to the next Scaler so it
+// continues where this one stopped.
+func (s *Scaler) State() State {
+	state := State{
+		History:     slices.Clone(s.history),
+		LastDesired: s.lastDesired,
+		Override:    s.override,
+		Draining:    slices.Clone(s.draining),
+		Candidate:   s.candidateState(),
+
+		LastHeartbeatCheck: s.lastHeartbeatCheck,
+	}
+	if s.controller != nil {
+		state.Controller = s.controller.state
+	}
+	if s.guard != nil {
+		state.MetricsGuard = s.guard.state
+	}
+	if s.boot != nil {
+		state.BootFailures = s.boot.state
+	}
+	return state
+}
+
+// startRunLog sets s.log to a logger with a new run ID, and returns ctx
+// carrying it for the drivers. A labelled Scaler, e.g. a candidate config's,
+// runs inside another Scaler's Run, so logs under that run instead.
+func (s *Scaler) startRunLog(ctx context.Context) context.Context {
+	if s.label != "" {
+		s.log = logging.FromContext(ctx).With("config", strings.ToLower(s.label))
+		return logging.WithLogger(ctx, s.log)
+	}
+	if s.logger == nil {
+		s.logger = slog.Default()
+	}
+	s.log = s.logger.With(logging.KeyRunID, newRunID())
+	if s.org != "" {
+		s.log = s.log.With(logging.KeyOrg, s.org)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		s.log = s.log.With(logging.KeyTraceID, sc.TraceID().String())
+	}
+	return logging.WithLogger(ctx, s.log)
+}
+
+// newRunID returns a random ID to tell one Run's records from another's.
+func newRunID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Run makes one scaling decision and acts on it, and returns the shortest
+// time the Buildkite API allows before the next. Each Run is traced as a
+// "scaler.Run" span, see WithTracerProvider.
 func (s *Scaler) Run(ctx context.Context) (time.Duration, error) {
+	tp := s.tracerProvider
+	if tp == nil {
+		tp = trace.SpanFromContext(ctx).TracerProvider()
+	}
+	attrs := []attribute.KeyValue{attrQueue.String(s.queue), attrASG.String(s.asgName)}
+	if s.label != "" {
+		attrs = append(attrs, attrConfig.String(strings.ToLower(s.label)))
+	}
+	ctx, span := tp.Tracer(tracerName).Start(ctx, "scaler.Run", trace.WithAttributes(attrs...))
 
-	// In Elastic CI mode, check for any dangling instances (where buildkite-agent is not running)
-	// This runs first, before getting metrics or scaling
-	if driver, ok := s.autoscaling.(*ASGDriver); ok && s.elasticCIMode {
-		if err := driver.CleanupDanglingInstances(ctx, s.minimumInstanceUptime, s.maxDanglingInstancesToCheck); err != nil {
-			log.Printf("[Elastic CI Mode] Warning: Failed to cleanup dangling instances: %v", err)
-			// Continue with normal scaling operations even if dangling instance cleanup fails
-		}
+	pollDuration, err := s.run(ctx)
+
+	d := s.decision
+	span.SetAttributes(attrDesired.Int64(d.Desired), attrCurrent.Int64(d.Current), attrActual.Int64(d.Actual), attrPending.Int64(d.Pending))
+	if d.Action != "" {
+		span.SetAttributes(attrAction.String(d.Action))
+	}
+	if d.Reason != "" {
+		span.SetAttributes(attrReason.String(d.Reason))
+	}
+	if d.Metrics != nil {
+		span.SetAttributes(attrOrg.String(d.Metrics.OrgSlug))
 	}
+	endSpan(span, err)
+	return pollDuration, err
+}
 
-	metrics, err := s.bk.GetAgentMetrics(ctx)
-	if err != nil {
-		return metrics.PollDuration, err
+func (s *Scaler) run(ctx context.Context) (pollDuration time.Duration, err error) {
+	ctx = s.startRunLog(ctx)
+	s.decision = Decision{}
+	s.heartbeatChecked = false
+	s.inventory, s.inventoryErr, s.inventoryTaken = nil, nil, false
+	if s.candidateSnapshot != nil {
+		*s.candidateSnapshot = liveSnapshot{}
 	}
+	defer func() {
+		if driver, ok := s.autoscaling.(*ASGDriver); ok {
+			s.decision.DanglingInstances += driver.danglingFound
+			s.decision.DanglingMarked += driver.danglingMarked
+			driver.danglingFound, driver.danglingMarked = 0, 0
+		}
+		if s.shadow != nil {
+			s.decision.Shadow = s.shadow.take()
+		}
+		if !s.decision.Time.IsZero() {
+			s.decision.log(s.log, s.label)
+			if s.extendedMetrics {
+				s.publishDecisionMetrics(ctx)
+			}
+		}
+		if s.candidateSnapshot != nil && s.candidateSnapshot.taken {
+			s.evaluateCandidate(ctx)
+		}
+	}()
 
-	// Check if metrics are stale (older than 60 seconds)
-	metricAge := time.Since(metrics.Timestamp)
-	if !metrics.Timestamp.IsZero() && metricAge > 60*time.Second {
-		log.Printf("⚠️ [Elastic CI Mode] Warning: Using metrics that are %.1f seconds old", metricAge.Seconds())
+	// Runtime controls come from the ASG tags, so describe it before doing
+	// anything else
+	asg, err := s.describe(ctx)
+	if err != nil {
+		return 0, err
 	}
 
-	if s.metrics != nil {
-		err = s.metrics.Publish(ctx, metrics.OrgSlug, metrics.Queue, map[string]int64{
-			"ScheduledJobsCount": metrics.ScheduledJobs,
-			"RunningJobsCount":   metrics.RunningJobs,
-			"WaitingJobsCount":   metrics.WaitingJobs,
-		})
+	// In Elastic CI mode, check for any dangling instances (where buildkite-agent is not running)
+	// This runs first, before getting metrics or scaling. The heartbeat check
+	// replaces it when configured, once metrics tell us the org.
+	if driver, ok := s.autoscaling.(*ASGDriver); ok && s.elasticCIMode && s.control.Mode != ControlModePaused && !s.heartbeatsEnabled() {
+		inv, err := s.instanceInventory(ctx, asg)
+		if err == nil {
+			err = driver.CleanupDanglingInstances(ctx, inv, s.minimumInstanceUptime, s.maxDanglingInstancesToCheck)
+		}
 		if err != nil {
-			return metrics.PollDuration, err
+			s.log.Warn("[Elastic CI Mode] Failed to cleanup dangling instances", "error", err)
+			// Continue with normal scaling operations even if dangling instance cleanup fails
+		}
+	}
+
+	// EC2's view of instance health doesn't depend on Buildkite, so check it
+	// even if metrics are unavailable
+	if s.instanceStatus.Enabled && s.control.Mode != ControlModePaused {
+		if err := s.checkInstanceStatus(ctx, asg, s.now()); err != nil {
+			s.log.Warn("⚠️  Instance status check failed", "error", err)
 		}
 	}
 
-	asg, err := s.autoscaling.Describe(ctx)
+	if sweeper, ok := s.autoscaling.(quarantineSweeper); ok && s.control.Mode != ControlModePaused {
+		if err := sweeper.SweepQuarantine(ctx, s.now()); err != nil {
+			s.log.Warn("⚠️  Quarantine sweep failed", "error", err)
+		}
+	}
+
+	metrics, err := s.getAgentMetrics(ctx)
+	if err == nil {
+		s.decision.Metrics = &metrics
+	}
+	if err == nil && s.candidateSnapshot != nil {
+		s.candidateSnapshot.metrics = metrics
+		s.candidateSnapshot.taken = true
+	}
 	if err != nil {
+		// A runtime control overrides the breaker's safe floor
+		if s.guard != nil && s.guard.recordFailure(s.log) && s.guard.params.SafeFloor > 0 && !s.control.active() {
+			if floorErr := s.holdAtSafeFloor(ctx, asg); floorErr != nil {
+				s.log.Warn("⚠️  Could not apply the metrics safe floor", "error", floorErr)
+			}
+		}
 		return metrics.PollDuration, err
 	}
 
-	log.Printf("Scaling calculation based on metrics collected at %s", metrics.Timestamp.Format(time.RFC3339))
-
-	desired := s.scaling.DesiredCount(&metrics, &asg)
+	if s.org == "" && s.label == "" && metrics.OrgSlug != "" {
+		s.org = metrics.OrgSlug
+		s.log = s.log.With(logging.KeyOrg, s.org)
+		ctx = logging.WithLogger(ctx, s.log)
+	}
 
-	// Only add instance buffer if there are agents required (any jobs that need processing)
-	if metrics.ScheduledJobs > 0 || metrics.RunningJobs > 0 || metrics.WaitingJobs > 0 {
-		// Calculate a proportional buffer based on the number of jobs
-		totalJobs := metrics.ScheduledJobs + metrics.RunningJobs
-		if s.scaling.includeWaiting {
-			totalJobs += metrics.WaitingJobs
+	if (s.heartbeatsEnabled() || s.boot != nil) && s.control.Mode != ControlModePaused {
+		if err := s.checkAgentHeartbeats(ctx, metrics.OrgSlug, metrics.Queue, asg); err != nil {
+			s.log.Warn("⚠️  Agent heartbeat check failed", "error", err)
 		}
+	}
 
-		// Apply a proportional buffer, but ensure we don't add more than the configured buffer
-		// For a single job add just 1 instance buffer, scaling up to the full buffer for larger workloads
-		var proportionalBuffer int64
+	// Check if metrics are stale (older than 60 seconds)
+	metricAge := s.now().Sub(metrics.Timestamp)
+	if !metrics.Timestamp.IsZero() && metricAge > 60*time.Second {
+		s.log.Warn("⚠️ [Elastic CI Mode] Using stale metrics", slog.Duration("age", metricAge))
+	}
 
-		if s.scaling.agentsPerInstance <= 0 {
-			log.Printf("⚠️  Invalid agentsPerInstance value %d, defaulting to 1", s.scaling.agentsPerInstance)
-			proportionalBuffer = totalJobs // Default to 1:1 mapping
-		} else {
-			proportionalBuffer = int64(math.Ceil(float64(totalJobs) / float64(s.scaling.agentsPerInstance)))
+	if s.metrics != nil {
+		var controlActive int64
+		if s.control.active() {
+			controlActive = 1
 		}
-
-		if proportionalBuffer < 0 {
-			log.Printf("⚠️  Calculated negative proportional buffer %d, capping at 0", proportionalBuffer)
-			proportionalBuffer = 0
+		err = s.metrics.Publish(ctx, metrics.OrgSlug, metrics.Queue, map[string]int64{
+			"ScheduledJobsCount":   metrics.ScheduledJobs,
+			"RunningJobsCount":     metrics.RunningJobs,
+			"WaitingJobsCount":     metrics.WaitingJobs,
+			"RuntimeControlActive": controlActive,
+		})
+		if err != nil {
+			return metrics.PollDuration, err
 		}
-
-		if s.scaling.maxInstanceCap > 0 && proportionalBuffer > int64(s.scaling.maxInstanceCap) {
-			log.Printf("⚠️  Calculated proportional buffer %d exceeds max cap, capping at %d", proportionalBuffer, s.scaling.maxInstanceCap)
-			proportionalBuffer = int64(s.scaling.maxInstanceCap)
+		if s.control.active() {
+			// Who set the control and its mode as dimensions, so it can be found on a dashboard
+			if err := s.metrics.PublishWithDimensions(ctx, metrics.OrgSlug, metrics.Queue,
+				map[string]string{"Mode": s.control.Mode, "SetBy": s.control.SetBy},
+				map[string]int64{"RuntimeControlActive": 1},
+			); err != nil {
+				return metrics.PollDuration, err
+			}
 		}
+	}
 
-		if proportionalBuffer > int64(s.instanceBuffer) {
-			proportionalBuffer = int64(s.instanceBuffer)
+	if s.control.active() {
+		// Runtime controls are set deliberately, so they win over a manual
+		// override detected from the ASG
+		switch {
+		case s.control.Mode == ControlModePaused, s.control.Mode == ControlModeFreeze:
+			s.log.Info("↳ Holding desired capacity for runtime control", "desired", asg.DesiredCount, "mode", s.control.Mode)
+			s.decision.Reason = "runtime-control: " + s.control.Mode
+			return metrics.PollDuration, nil
+		case s.control.Pinned:
+			return metrics.PollDuration, s.applyPinnedDesired(ctx, asg)
 		}
+	}
 
-		if proportionalBuffer > 0 {
-			log.Printf("↳ 🧮 Adding proportional instance buffer: %d (based on %d total jobs)", proportionalBuffer, totalJobs)
-		}
-		desired += proportionalBuffer
+	if s.checkExternalChange(ctx, asg, s.now()) {
+		return metrics.PollDuration, nil
 	}
 
-	if desired > asg.MaxSize {
-		log.Printf("⚠️  Desired count exceed MaxSize, capping at %d", asg.MaxSize)
-		desired = asg.MaxSize
+	if s.guard != nil {
+		if kind, detail := s.guard.check(s.log, &metrics, &asg, s.now()); kind != "" {
+			s.log.Warn("⚠️  Ignoring anomalous Buildkite metrics", "anomaly", kind, "detail", detail)
+			s.decision.Reason = "metrics-anomaly: " + kind
+			if s.guard.state.Open {
+				return metrics.PollDuration, s.holdAtSafeFloor(ctx, asg)
+			}
+			// Agents genuinely dying looks the same as a bad response. The
+			// dangling check confirms on the instances themselves before
+			// acting, so it is still safe to run.
+			if kind == anomalyAgentsVanished && s.elasticCIMode {
+				if err := s.cleanupDanglingInstances(ctx, metrics.OrgSlug, metrics.Queue, asg, 10*time.Minute); err != nil {
+					s.log.Warn("⚠️  [Elastic CI Mode] Failed to cleanup dangling instances", "error", err)
+				}
+			}
+			return metrics.PollDuration, nil
+		}
 	}
-	if desired < asg.MinSize {
-		log.Printf("⚠️  Desired count is less than MinSize, capping at %d", asg.MinSize)
-		desired = asg.MinSize
+
+	desired := s.decide(ctx, &metrics, asg)
+	if s.controller != nil {
+		// Only integrate error the scaler acted on. A Reason means a
+		// cooldown, policy or disabled direction held desired capacity.
+		defer func() {
+			if err == nil && s.decision.Reason == "" {
+				s.controller.commitIntegral()
+			}
+		}()
 	}
 
 	// Use actual count for comparison if available, otherwise fall back to desired count
@@ -242,17 +683,18 @@ func (s *Scaler) Run(ctx context.Context) (time.Duration, error) {
 	}
 
 	if desired > instanceCount {
-		log.Printf("Scaling decision: calculated desired %d instances. ASG current desired: %d, ASG actual running: %d (approx %d agents), Buildkite scheduled: %d, running: %d, waiting: %d",
-			desired, asg.DesiredCount, instanceCount, instanceCount*int64(s.scaling.agentsPerInstance), metrics.ScheduledJobs, metrics.RunningJobs, metrics.WaitingJobs)
+		s.log.Info("Scaling decision: more instances wanted than running",
+			"desired", desired, "asg_desired", asg.DesiredCount, "actual", instanceCount,
+			"approx_agents", instanceCount*int64(s.scaling.agentsPerInstance))
 
 		if desired > asg.DesiredCount {
-			log.Printf(" Action: Scale out from %d to %d", asg.DesiredCount, desired)
+			s.log.Info("↳ Action: scale out", "from", asg.DesiredCount, "to", desired)
 			return metrics.PollDuration, s.scaleOut(ctx, desired, asg)
 		} else if desired < asg.DesiredCount {
-			log.Printf(" Action: Scale in from %d to %d", asg.DesiredCount, desired)
+			s.log.Info("↳ Action: scale in", "from", asg.DesiredCount, "to", desired)
 			return metrics.PollDuration, s.scaleIn(ctx, desired, asg)
 		} else {
-			log.Printf(" Action: No change needed. Desired capacity %d matches ASG desired %d.", desired, asg.DesiredCount)
+			s.log.Info("↳ Action: no change needed, desired capacity matches the ASG's", "desired", desired)
 		}
 
 		// The following block handles a scenario where desired == asg.DesiredCount, but instanceCount might be different
@@ -261,9 +703,9 @@ func (s *Scaler) Run(ctx context.Context) (time.Duration, error) {
 		// If instanceCount < desired (and desired == asg.DesiredCount), it implies instances might be launching slowly.
 		// In these cases, no direct scaling action is taken here as the ASG is already set to the correct desired count.
 		if instanceCount > desired && asg.DesiredCount == desired {
-			log.Printf("INFO: Instance count (%d) > desired (%d), but ASG desired count (%d) already matches. ASG may be converging.", instanceCount, desired, asg.DesiredCount)
+			s.log.Info("Instance count is above desired, but the ASG's desired count already matches. ASG may be converging.", "actual", instanceCount, "desired", desired)
 		} else if instanceCount < desired && asg.DesiredCount == desired {
-			log.Printf("INFO: Instance count (%d) < desired (%d), but ASG desired count (%d) already matches. ASG may be converging.", instanceCount, desired, asg.DesiredCount)
+			s.log.Info("Instance count is below desired, but the ASG's desired count already matches. ASG may be converging.", "actual", instanceCount, "desired", desired)
 		}
 		return metrics.PollDuration, nil
 	}
@@ -276,12 +718,12 @@ func (s *Scaler) Run(ctx context.Context) (time.Duration, error) {
 		// In Elastic CI mode, check for pending instances before scaling down
 		// If there are pending instances, it means ASG is already scaling, so we should wait
 		if s.elasticCIMode && asg.Pending > 0 {
-			log.Printf("⏳ [Elastic CI Mode] ASG has %d pending instances, waiting before scaling in", asg.Pending)
+			s.log.Info("⏳ [Elastic CI Mode] ASG has pending instances, waiting before scaling in", "pending", asg.Pending)
 			return metrics.PollDuration, nil
 		}
 
-		log.Printf("Scaling decision: need %d instances, have %d actual running instances (desired set to %d)",
-			desired, instanceCount, asg.DesiredCount)
+		s.log.Info("Scaling decision: fewer instances wanted than running",
+			"desired", desired, "actual", instanceCount, "asg_desired", asg.DesiredCount)
 		return metrics.PollDuration, s.scaleIn(ctx, desired, asg)
 	}
 
@@ -295,44 +737,41 @@ func (s *Scaler) Run(ctx context.Context) (time.Duration, error) {
 	// This is shorter than the default 1-hour minimumInstanceUptime but long enough to avoid
 	// prematurely killing instances that haven't finished starting up.
 	if s.elasticCIMode && instanceCount > 0 && metrics.TotalAgents == 0 {
-		log.Printf("🔍 [Elastic CI Mode] Detected %d running instance(s) but 0 agents reporting — checking for dangling instances", instanceCount)
+		s.log.Info("🔍 [Elastic CI Mode] Running instances but no agents reporting, checking for dangling instances", "actual", instanceCount)
 		danglingCheckUptime := 10 * time.Minute
-		if err := s.autoscaling.CleanupDanglingInstances(ctx, danglingCheckUptime, s.maxDanglingInstancesToCheck); err != nil {
-			log.Printf("⚠️  [Elastic CI Mode] Failed to cleanup dangling instances: %v", err)
+		if err := s.cleanupDanglingInstances(ctx, metrics.OrgSlug, metrics.Queue, asg, danglingCheckUptime); err != nil {
+			s.log.Warn("⚠️  [Elastic CI Mode] Failed to cleanup dangling instances", "error", err)
 		}
 		return metrics.PollDuration, nil
 	}
 
-	log.Printf("No scaling required, currently %d actual instances (desired set to %d)",
-		instanceCount, asg.DesiredCount)
+	s.log.Info("No scaling required", "actual", instanceCount, "asg_desired", asg.DesiredCount)
 	return metrics.PollDuration, nil
 }
 
 func (s *Scaler) scaleIn(ctx context.Context, desired int64, current AutoscaleGroupDetails) error {
 	// In ElasticCIMode, DISABLE_SCALE_IN is ignored (handled by s.elasticCIMode check below)
 	if s.scaleInParams.Disable && !s.elasticCIMode {
+		s.decision.Reason = "scale-in-disabled"
+		return nil
+	}
+
+	if s.control.Mode == ControlModeScaleOutOnly {
+		s.log.Info("🎚️ Want to scale IN but runtime control is "+ControlModeScaleOutOnly, "desired", desired)
+		s.decision.Reason = "runtime-control: " + ControlModeScaleOutOnly
 		return nil
 	}
 
 	// If we're in ElasticCIMode and DISABLE_SCALE_IN is true, log that we're ignoring it
 	if s.scaleInParams.Disable && s.elasticCIMode {
-		log.Printf("ℹ️ [Elastic CI Mode] Ignoring DISABLE_SCALE_IN=true since ElasticCIMode has safer scaling mechanisms")
+		s.log.Info("ℹ️ [Elastic CI Mode] Ignoring DISABLE_SCALE_IN=true since ElasticCIMode has safer scaling mechanisms")
 	}
 
 	// If we've scaled down before, check if a cooldown should be enforced
-	if !s.scaleInParams.LastEvent.IsZero() {
-		lastScaleInEvent := s.scaleInParams.LastEvent
-		lastScaleOutEvent := s.scaleOutParams.LastEvent
-		lastEvent := lastScaleInEvent
-		if s.scaleOnlyAfterAllEvent && lastScaleInEvent.Before(lastScaleOutEvent) {
-			lastEvent = lastScaleOutEvent
-		}
-		cooldownRemaining := s.scaleInParams.CooldownPeriod - time.Since(lastEvent)
-
-		if cooldownRemaining > 0 {
-			log.Printf("⏲ Want to scale IN but in cooldown for %d seconds", cooldownRemaining/time.Second)
-			return nil
-		}
+	if cooldownRemaining, _ := s.CooldownRemaining(); cooldownRemaining > 0 {
+		s.log.Info("⏲ Want to scale IN but in cooldown", "desired", desired, slog.Duration("remaining", cooldownRemaining.Round(time.Second)))
+		s.decision.Reason = "scale-in-cooldown"
+		return nil
 	}
 
 	// Special Elastic CI Stack mode with additional safety checks
@@ -343,33 +782,32 @@ func (s *Scaler) scaleIn(ctx context.Context, desired int64, current AutoscaleGr
 			// In ElasticCIMode, override the page limit to allow unlimited pages
 			if driver.MaxDescribeScalingActivitiesPages >= 0 {
 				// Override to allow unlimited pages (-1) for full activity history in ElasticCIMode
-				log.Printf("ℹ️ [Elastic CI Mode] Setting MAX_DESCRIBE_SCALING_ACTIVITIES_PAGES from %d to -1 (unlimited) for better safety checks",
-					driver.MaxDescribeScalingActivitiesPages)
+				s.log.Info("ℹ️ [Elastic CI Mode] Setting MAX_DESCRIBE_SCALING_ACTIVITIES_PAGES to -1 (unlimited) for better safety checks",
+					"was", driver.MaxDescribeScalingActivitiesPages)
 				driver.MaxDescribeScalingActivitiesPages = -1
 			}
 
-			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-			defer cancel()
-
-			// Get the last scale-in activity from ASG history
-			_, lastScaleInActivity, err := driver.GetLastScalingInAndOutActivity(ctx, false, true)
+			// Get the last scale-in from the scaler's records, or ASG history
+			activityCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			_, lastScaleInTime, err := driver.GetLastScalingInAndOutEvents(activityCtx, false, true)
+			cancel()
 			if err != nil {
-				log.Printf("⚠️ [Elastic CI Mode] Could not check last ASG scale-in activity: %v", err)
-			} else if lastScaleInActivity != nil && lastScaleInActivity.StartTime != nil {
+				s.log.Warn("⚠️ [Elastic CI Mode] Could not check last ASG scale-in activity", "error", err)
+			} else if !lastScaleInTime.IsZero() {
 				// Check how recently the ASG scaled down
-				lastScaleInTime := *lastScaleInActivity.StartTime
-				timeSinceLastScaleIn := time.Since(lastScaleInTime)
+				timeSinceLastScaleIn := s.now().Sub(lastScaleInTime)
 
 				// Check if we're in cooldown period based on the last ASG scale-in activity
 				if s.scaleInParams.CooldownPeriod > 0 && timeSinceLastScaleIn < s.scaleInParams.CooldownPeriod {
-					log.Printf("⏲ [Elastic CI Mode] Last ASG scale-in was %s ago, in cooldown period for %s more (cooldown: %s)",
-						timeSinceLastScaleIn.Round(time.Second),
-						(s.scaleInParams.CooldownPeriod - timeSinceLastScaleIn).Round(time.Second),
-						s.scaleInParams.CooldownPeriod)
+					s.log.Info("⏲ [Elastic CI Mode] In cooldown after the last ASG scale-in",
+						slog.Duration("since", timeSinceLastScaleIn.Round(time.Second)),
+						slog.Duration("remaining", (s.scaleInParams.CooldownPeriod-timeSinceLastScaleIn).Round(time.Second)),
+						slog.Duration("cooldown", s.scaleInParams.CooldownPeriod))
+					s.decision.Reason = "scale-in-cooldown"
 					return nil
 				}
 
-				log.Printf("[Elastic CI Mode] Last ASG scale-in was %s ago", timeSinceLastScaleIn.Round(time.Second))
+				s.log.Debug("[Elastic CI Mode] Last ASG scale-in", slog.Duration("since", timeSinceLastScaleIn.Round(time.Second)))
 			}
 		}
 	}
@@ -377,31 +815,40 @@ func (s *Scaler) scaleIn(ctx context.Context, desired int64, current AutoscaleGr
 	// Calculate the change in the desired count, will be negative
 	change := desired - current.DesiredCount
 
-	// Apply scaling factor if one is given
-	if factor := s.scaleInParams.Factor; factor != 0 {
+	// Apply scaling factor if one is given. The PID controller already
+	// shapes the size of each step, so the factor only applies in step mode.
+	if factor := s.scaleInParams.Factor; factor != 0 && s.controller == nil {
 		// Use Floor to avoid never reaching upper bound
 		factoredChange := int64(math.Floor(float64(change) * factor))
 
 		switch {
 		case factoredChange < change:
-			log.Printf("👮‍️ Increasing scale-in of %d by factor of %0.2f",
-				change, factor)
+			s.log.Info("👮‍️ Increasing scale-in by factor", "change", change, "factor", factor)
 
 		case factoredChange > change:
-			log.Printf("👮‍️ Decreasing scale-in of %d by factor of %0.2f",
-				change, factor)
+			s.log.Info("👮‍️ Decreasing scale-in by factor", "change", change, "factor", factor)
 
 		default:
-			log.Printf("👮‍️ Scale-in factor of %0.2f was ignored",
-				factor)
+			s.log.Info("👮‍️ Scale-in factor was ignored", "factor", factor)
 		}
 
 		desired = current.DesiredCount + factoredChange
 
-		if desired < current.MinSize {
-			log.Printf("⚠️  Post scalein-factor desired count lower than MinSize, capping at %d", current.MinSize)
-			desired = current.MinSize
+		if desired < s.bounds.min {
+			s.log.Warn("⚠️  Post scalein-factor desired count lower than MinSize, capping", "desired", desired, "min", s.bounds.min, "source", s.bounds.minSource)
+			s.decision.clamp(s.bounds.minSource, desired, s.bounds.min)
+			desired = s.bounds.min
+		}
+	}
+
+	if limited := limitScaleIn(s.log, desired, current.DesiredCount, s.scaleInParams.Policies, s.scaleInParams.SelectPolicy, s.history, s.now()); limited != desired {
+		s.decision.clamp("scale-in-policy", desired, limited)
+		if limited == current.DesiredCount {
+			s.log.Info("🚦 Want to scale IN but scale-in policies allow no further change yet", "desired", desired)
+			s.decision.Reason = "scale-in-policy"
+			return nil
 		}
+		desired = limited
 	}
 
 	// Correct negative values if we get them
@@ -409,138 +856,90 @@ func (s *Scaler) scaleIn(ctx context.Context, desired int64, current AutoscaleGr
 		desired = 0
 	}
 
-	log.Printf("Scaling IN 📉 to %d instances (currently %d)", desired, current.DesiredCount)
+	s.log.Info("Scaling IN 📉", "from", current.DesiredCount, "to", desired)
 
 	instancesToTerminate := current.DesiredCount - desired
 
 	// In Elastic CI Mode, use graceful termination if we have instance IDs
-	if _, ok := s.autoscaling.(*ASGDriver); ok && s.elasticCIMode && len(current.InstanceIDs) > 0 && instancesToTerminate > 0 {
-		log.Printf("[Elastic CI Mode] Using graceful termination for %d instances", instancesToTerminate)
+	if driver, ok := s.autoscaling.(*ASGDriver); ok && s.elasticCIMode && len(current.InstanceIDs) > 0 && instancesToTerminate > 0 {
+		s.log.Info("[Elastic CI Mode] Using graceful termination", "instances", instancesToTerminate)
 
 		// Determine instances to terminate by sorting by launch time (oldest first)
 		maxToTerminate := instancesToTerminate
 
 		instancesForTermination := make([]string, 0, maxToTerminate)
 
-		if len(current.InstanceIDs) > 0 {
-			// Define a struct to hold instance info for sorting
-			type instanceInfo struct {
-				ID         string
-				LaunchTime time.Time
+		inv, err := s.instanceInventory(ctx, current)
+		if err != nil || inv == nil {
+			if err != nil {
+				s.log.Warn("[Elastic CI Mode] Could not get instance launch times", "error", err)
 			}
-
-			ec2Svc := ec2.NewFromConfig(s.cfg)
-
-			instances := make([]instanceInfo, 0, len(current.InstanceIDs))
-			describeResult, err := ec2Svc.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
-				InstanceIds: current.InstanceIDs,
+			// Fall back to unsorted if we can't get launch times
+			instancesForTermination = current.InstanceIDs
+			if int64(len(instancesForTermination)) > maxToTerminate {
+				instancesForTermination = instancesForTermination[:maxToTerminate]
+			}
+		} else {
+			instances := slices.DeleteFunc(slices.Clone(inv.Instances), func(instance InventoryInstance) bool {
+				return instance.LaunchTime.IsZero()
 			})
 
-			if err != nil {
-				log.Printf("[Elastic CI Mode] Warning: Could not get instance launch times: %v", err)
-				// Fall back to unsorted if we can't get launch times
-				instancesForTermination = current.InstanceIDs
-				if int64(len(instancesForTermination)) > maxToTerminate {
-					instancesForTermination = instancesForTermination[:maxToTerminate]
-				}
-			} else {
-				// Process results and build list of instances with launch times
-				// We need to iterate through reservations as that's how AWS groups the instances
-				for _, reservation := range describeResult.Reservations {
-					for _, instance := range reservation.Instances {
-						if instance.InstanceId != nil && instance.LaunchTime != nil {
-							instances = append(instances, instanceInfo{
-								ID:         *instance.InstanceId,
-								LaunchTime: *instance.LaunchTime,
-							})
-						}
-					}
-				}
-
-				// Sort instances by launch time (oldest first)
-				sort.Slice(instances, func(i, j int) bool {
-					return instances[i].LaunchTime.Before(instances[j].LaunchTime)
-				})
+			// Sort instances by launch time (oldest first)
+			sort.Slice(instances, func(i, j int) bool {
+				return instances[i].LaunchTime.Before(instances[j].LaunchTime)
+			})
 
-				limit := int(maxToTerminate)
-				if len(instances) < limit {
-					limit = len(instances)
-				}
+			limit := int(maxToTerminate)
+			if len(instances) < limit {
+				limit = len(instances)
+			}
 
-				instancesForTermination = make([]string, limit)
-				for i := 0; i < limit; i++ {
-					instancesForTermination[i] = instances[i].ID
-				}
+			instancesForTermination = make([]string, limit)
+			for i := 0; i < limit; i++ {
+				instancesForTermination[i] = instances[i].ID
+			}
 
-				if len(instances) > 0 {
-					oldestTime := instances[0].LaunchTime.Format(time.RFC3339)
-					log.Printf("[Elastic CI Mode] Selecting %d oldest instances by launch time for termination (oldest from %s)",
-						len(instancesForTermination), oldestTime)
-				}
+			if len(instances) > 0 {
+				oldestTime := instances[0].LaunchTime.Format(time.RFC3339)
+				s.log.Debug("[Elastic CI Mode] Selecting the oldest instances by launch time for termination",
+					"instances", len(instancesForTermination), "oldest_launched", oldestTime)
 			}
 		}
 
-		log.Printf("[Elastic CI Mode] Attempting graceful termination for %d instance(s): %v", len(instancesForTermination), instancesForTermination)
+		s.log.Info("[Elastic CI Mode] Attempting graceful termination", "instance_ids", instancesForTermination)
 
-		sigTermErrors := 0
-		sigTermSkipped := 0
-		sigTermSuccess := 0
-		for _, instanceID := range instancesForTermination {
-			if err := s.autoscaling.SendSIGTERMToAgents(ctx, instanceID); err != nil {
-				if errors.Is(err, ErrWindowsGracefulScaleInNotSupported) {
-					sigTermSkipped++
-				} else {
-					log.Printf("⚠️  Failed to send SIGTERM to instance %s: %v", instanceID, err)
-					sigTermErrors++
-				}
-			} else {
-				log.Printf("✅ Successfully sent SIGTERM to instance %s", instanceID)
-				sigTermSuccess++
+		outcomes := s.autoscaling.SignalAgents(ctx, inv, instancesForTermination)
+		s.decision.Signals = append(s.decision.Signals, outcomes...)
+		for _, o := range outcomes {
+			if o.Outcome != SignalSent {
+				s.log.Warn("⚠️  Failed to stop agents on instance", "instance_id", o.InstanceID, "outcome", o.Outcome, "error", o.Error)
 			}
 		}
+		s.log.Info("↳ Stop outcomes", "instances", len(outcomes), "outcomes", signalSummary(outcomes))
 
-		if sigTermErrors > 0 {
-			log.Printf("⚠️  Failed to send SIGTERM to %d/%d instances",
-				sigTermErrors, len(instancesForTermination))
-		}
-		if sigTermSkipped > 0 {
-			log.Printf("ℹ️  Skipped %d Windows instance(s) - graceful scale-in not supported, will be terminated directly by ASG",
-				sigTermSkipped)
-		}
-		if sigTermSuccess > 0 {
-			log.Printf("✅ Successfully sent SIGTERM to %d instance(s)", sigTermSuccess)
-		}
-
-		log.Printf("[Elastic CI Mode] Updating ASG desired capacity to %d", desired)
-		if err := s.setDesiredCapacity(ctx, desired); err != nil {
-			log.Printf("CRITICAL: [Elastic CI Mode] Failed to set desired capacity to %d after sending SIGTERMs: %v. ASG might replace terminated instances.", desired, err)
+		s.log.Info("[Elastic CI Mode] Updating ASG desired capacity", "desired", desired)
+		if err := s.setDesiredCapacity(ctx, current.DesiredCount, desired, "metrics"); err != nil {
+			s.log.Error("CRITICAL: [Elastic CI Mode] Failed to set desired capacity after stopping agents. ASG might replace terminated instances.", "desired", desired, "error", err)
 
 		}
 
 		if current.DesiredCount <= 1 && len(current.InstanceIDs) == 1 {
 			instanceID := current.InstanceIDs[0]
-			log.Printf("[Elastic CI Mode] Single-instance ASG detected - checking if instance %s is a dangling instance", instanceID)
+			s.log.Info("[Elastic CI Mode] Single-instance ASG detected, checking if the instance is dangling", "instance_id", instanceID)
 
 			// Only consider direct termination for dangling instances
-			ssmClient := ssm.NewFromConfig(s.cfg)
-			ec2Client := ec2.NewFromConfig(s.cfg)
+			ssmClient := driver.ssmClient()
+			ec2Client := driver.ec2Client()
 
 			// Detect platform for this instance
-			descResp, descErr := ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
-				InstanceIds: []string{instanceID},
-			})
-
 			documentName := "AWS-RunShellScript"
 			checkCommand := "systemctl is-active buildkite-agent"
-			if descErr != nil {
-				log.Printf("[Elastic CI Mode] Warning: Failed to detect platform for %s, defaulting to Linux: %v", instanceID, descErr)
-			} else if len(descResp.Reservations) > 0 && len(descResp.Reservations[0].Instances) > 0 {
-				instance := descResp.Reservations[0].Instances[0]
-				if strings.EqualFold(string(instance.Platform), "windows") {
-					documentName = "AWS-RunPowerShellScript"
-					checkCommand = "nssm status buildkite-agent"
-					log.Printf("[Elastic CI Mode] Detected Windows platform for instance %s", instanceID)
-				}
+			if inv == nil {
+				s.log.Warn("[Elastic CI Mode] Failed to detect platform, defaulting to Linux", "instance_id", instanceID)
+			} else if instance, ok := inv.Get(instanceID); ok && instance.Platform == "windows" {
+				documentName = "AWS-RunPowerShellScript"
+				checkCommand = "nssm status buildkite-agent"
+				s.log.Debug("[Elastic CI Mode] Detected Windows platform", "instance_id", instanceID)
 			}
 
 			// Try to check if buildkite-agent is running via SSM
@@ -550,108 +949,340 @@ func (s *Scaler) scaleIn(ctx context.Context, desired int64, current AutoscaleGr
 				Parameters: map[string][]string{
 					"commands": {checkCommand},
 				},
-				Comment: aws.String("Check if buildkite-agent service is running"),
+				Comment: aws.String(checkCommandComment),
 			})
 
 			// Only terminate if we can't check agent status, suggesting it's likely a dangling instance
 			if err != nil {
-				log.Printf("[Elastic CI Mode] Warning: Cannot check agent status, assuming dangling instance: %v", err)
-				log.Printf("[Elastic CI Mode] Directly terminating probable dangling instance")
+				s.log.Warn("[Elastic CI Mode] Cannot check agent status, directly terminating probable dangling instance", "instance_id", instanceID, "error", err)
 
 				if termErr := directlyTerminateInstance(ctx, ec2Client, instanceID); termErr != nil {
-					log.Printf("[Elastic CI Mode] Error: Failed to terminate: %v", termErr)
+					s.log.Error("[Elastic CI Mode] Failed to terminate", "instance_id", instanceID, "error", termErr)
 				}
 			} else {
-				log.Printf("[Elastic CI Mode] Instance appears responsive, not terminating directly")
+				s.log.Info("[Elastic CI Mode] Instance appears responsive, not terminating directly", "instance_id", instanceID)
 			}
 		}
-		s.scaleInParams.LastEvent = time.Now()
+		s.scaleInParams.LastEvent = s.now()
 		return nil
 	} else {
-		log.Printf("Using standard scale-in (Elastic CI Mode disabled or no instances to terminate)")
-		if err := s.setDesiredCapacity(ctx, desired); err != nil {
+		s.log.Debug("Using standard scale-in (Elastic CI Mode disabled or no instances to terminate)")
+		if err := s.setDesiredCapacity(ctx, current.DesiredCount, desired, "metrics"); err != nil {
 			return err
 		}
-		s.scaleInParams.LastEvent = time.Now()
+		s.scaleInParams.LastEvent = s.now()
 		return nil
 	}
 }
 
 func (s *Scaler) scaleOut(ctx context.Context, desired int64, current AutoscaleGroupDetails) error {
 	if s.scaleOutParams.Disable {
+		s.decision.Reason = "scale-out-disabled"
 		return nil
 	}
 
 	// If we've scaled out before, check if a cooldown should be enforced
-	if !s.scaleOutParams.LastEvent.IsZero() {
-		lastScaleInEvent := s.scaleInParams.LastEvent
-		lastScaleOutEvent := s.scaleOutParams.LastEvent
-		lastEvent := lastScaleOutEvent
-		if s.scaleOnlyAfterAllEvent && lastScaleOutEvent.Before(lastScaleInEvent) {
-			lastEvent = lastScaleInEvent
-		}
-		cooldownRemaining := s.scaleOutParams.CooldownPeriod - time.Since(lastEvent)
-
-		if cooldownRemaining > 0 {
-			log.Printf("⏲ Want to scale OUT but in cooldown for %d seconds", cooldownRemaining/time.Second)
-			return nil
-		}
+	if _, cooldownRemaining := s.CooldownRemaining(); cooldownRemaining > 0 {
+		s.log.Info("⏲ Want to scale OUT but in cooldown", "desired", desired, slog.Duration("remaining", cooldownRemaining.Round(time.Second)))
+		s.decision.Reason = "scale-out-cooldown"
+		return nil
 	}
 
 	// Calculate the change in the desired count, will be positive
 	change := desired - current.DesiredCount
 
-	// Apply scaling factor if one is given
-	if s.scaleOutParams.Factor != 0 {
+	// Apply scaling factor if one is given. The PID controller already
+	// shapes the size of each step, so the factor only applies in step mode.
+	if s.scaleOutParams.Factor != 0 && s.controller == nil {
 		// Use Ceil to avoid never reaching upper bound
 		factoredChange := int64(math.Ceil(float64(change) * s.scaleOutParams.Factor))
 
 		switch {
 		case factoredChange > change:
-			log.Printf("👮‍️ Increasing scale-out of %d by factor of %0.2f",
-				change, s.scaleOutParams.Factor)
+			s.log.Info("👮‍️ Increasing scale-out by factor", "change", change, "factor", s.scaleOutParams.Factor)
 
 		case factoredChange < change:
-			log.Printf("👮‍️ Decreasing scale-out of %d by factor of %0.2f",
-				change, s.scaleOutParams.Factor)
+			s.log.Info("👮‍️ Decreasing scale-out by factor", "change", change, "factor", s.scaleOutParams.Factor)
 
 		default:
-			log.Printf("👮‍️ Scale-out factor of %0.2f was ignored",
-				s.scaleOutParams.Factor)
+			s.log.Info("👮‍️ Scale-out factor was ignored", "factor", s.scaleOutParams.Factor)
 		}
 
 		desired = current.DesiredCount + factoredChange
 
-		if desired > current.MaxSize {
-			log.Printf("⚠️  Post scaleout-factor desired count exceed MaxSize, capping at %d", current.MaxSize)
-			desired = current.MaxSize
+		if desired > s.bounds.max {
+			s.log.Warn("⚠️  Post scaleout-factor desired count exceeds MaxSize, capping", "desired", desired, "max", s.bounds.max, "source", s.bounds.maxSource)
+			s.decision.clamp(s.bounds.maxSource, desired, s.bounds.max)
+			desired = s.bounds.max
 		}
 	}
 
-	log.Printf("Scaling OUT 📈 to %d instances (currently %d)", desired, current.DesiredCount)
+	if limited := limitScaleOut(s.log, desired, current.DesiredCount, s.scaleOutParams.Policies, s.scaleOutParams.SelectPolicy, s.history, s.now()); limited != desired {
+		s.decision.clamp("scale-out-policy", desired, limited)
+		if limited == current.DesiredCount {
+			s.log.Info("🚦 Want to scale OUT but scale-out policies allow no further change yet", "desired", desired)
+			s.decision.Reason = "scale-out-policy"
+			return nil
+		}
+		desired = limited
+	}
 
-	if err := s.setDesiredCapacity(ctx, desired); err != nil {
+	s.log.Info("Scaling OUT 📈", "from", current.DesiredCount, "to", desired)
+
+	if err := s.setDesiredCapacity(ctx, current.DesiredCount, desired, "metrics"); err != nil {
 		return err
 	}
 
-	s.scaleOutParams.LastEvent = time.Now()
+	s.scaleOutParams.LastEvent = s.now()
 	return nil
 }
 
-func (s *Scaler) setDesiredCapacity(ctx context.Context, desired int64) error {
+// decide works out the desired count from the queue's metrics, within the
+// run's size bounds, recording the bounds that changed it.
+func (s *Scaler) decide(ctx context.Context, metrics *buildkite.AgentMetrics, asg AutoscaleGroupDetails) int64 {
+	_, span := startSpan(ctx, "scaler.Decide", attrCurrent.Int64(asg.DesiredCount))
+	defer span.End()
+
+	s.log.Debug("Scaling calculation based on metrics", "collected_at", metrics.Timestamp.Format(time.RFC3339))
+
+	desired := s.scaling.DesiredCount(s.log, metrics, &asg)
+	s.decision.Availability = s.scaling.availability
+
+	// Only add instance buffer if there are agents required (any jobs that need processing)
+	if metrics.ScheduledJobs > 0 || metrics.RunningJobs > 0 || metrics.WaitingJobs > 0 {
+		// Calculate a proportional buffer based on the number of jobs
+		totalJobs := metrics.ScheduledJobs + metrics.RunningJobs
+		if s.scaling.includeWaiting {
+			totalJobs += metrics.WaitingJobs
+		}
+
+		// Apply a proportional buffer, but ensure we don't add more than the configured buffer
+		// For a single job add just 1 instance buffer, scaling up to the full buffer for larger workloads
+		var proportionalBuffer int64
+
+		if s.scaling.agentsPerInstance <= 0 {
+			s.log.Warn("⚠️  Invalid agentsPerInstance value, defaulting to 1", "agents_per_instance", s.scaling.agentsPerInstance)
+			proportionalBuffer = totalJobs // Default to 1:1 mapping
+		} else {
+			proportionalBuffer = int64(math.Ceil(float64(totalJobs) / float64(s.scaling.agentsPerInstance)))
+		}
+
+		if proportionalBuffer < 0 {
+			s.log.Warn("⚠️  Calculated negative proportional buffer, capping at 0", "buffer", proportionalBuffer)
+			proportionalBuffer = 0
+		}
+
+		if s.scaling.maxInstanceCap > 0 && proportionalBuffer > int64(s.scaling.maxInstanceCap) {
+			s.log.Warn("⚠️  Calculated proportional buffer exceeds max cap, capping", "buffer", proportionalBuffer, "max_instance_cap", s.scaling.maxInstanceCap)
+			proportionalBuffer = int64(s.scaling.maxInstanceCap)
+		}
+
+		if proportionalBuffer > int64(s.instanceBuffer) {
+			proportionalBuffer = int64(s.instanceBuffer)
+		}
+
+		if proportionalBuffer > 0 {
+			s.log.Info("↳ 🧮 Adding proportional instance buffer", "buffer", proportionalBuffer, "total_jobs", totalJobs)
+		}
+		desired += proportionalBuffer
+	}
+
+	if s.controller != nil {
+		upper, upperSource := s.bounds.max, s.bounds.maxSource
+		if s.scaling.maxInstanceCap > 0 && int64(s.scaling.maxInstanceCap) < upper {
+			upper, upperSource = int64(s.scaling.maxInstanceCap), "max-instance-cap"
+		}
+		e := s.controller.errorSignal(metrics, desired, asg.DesiredCount, s.scaling.agentsPerInstance)
+		desired = s.controller.next(s.log, e, asg.DesiredCount, s.bounds.min, upper, s.now())
+		if raw := s.controller.lastUnclamped; raw > desired {
+			s.decision.clamp(upperSource, raw, desired)
+		} else if raw < desired {
+			s.decision.clamp(s.bounds.minSource, raw, desired)
+		}
+	}
+
+	if desired > s.bounds.max {
+		s.log.Warn("⚠️  Desired count exceeds MaxSize, capping", "desired", desired, "max", s.bounds.max, "source", s.bounds.maxSource)
+		s.decision.clamp(s.bounds.maxSource, desired, s.bounds.max)
+		desired = s.bounds.max
+	}
+	if desired < s.bounds.min {
+		s.log.Warn("⚠️  Desired count is less than MinSize, capping", "desired", desired, "min", s.bounds.min, "source", s.bounds.minSource)
+		s.decision.clamp(s.bounds.minSource, desired, s.bounds.min)
+		desired = s.bounds.min
+	}
+
+	span.SetAttributes(attrDesired.Int64(desired), attribute.Int("scaler.clamps", len(s.decision.Clamps)))
+	return desired
+}
+
+// getAgentMetrics reads the queue's agent and job counts.
+func (s *Scaler) getAgentMetrics(ctx context.Context) (buildkite.AgentMetrics, error) {
+	ctx, span := startSpan(ctx, "buildkite.GetAgentMetrics", attrQueue.String(s.queue))
+	metrics, err := s.bk.GetAgentMetrics(ctx)
+	if err == nil {
+		span.SetAttributes(
+			attrOrg.String(metrics.OrgSlug),
+			attribute.Int64("buildkite.jobs.scheduled", metrics.ScheduledJobs),
+			attribute.Int64("buildkite.jobs.running", metrics.RunningJobs),
+			attribute.Int64("buildkite.jobs.waiting", metrics.WaitingJobs),
+			attribute.Int64("buildkite.agents.idle", metrics.IdleAgents),
+			attribute.Int64("buildkite.agents.busy", metrics.BusyAgents),
+			attribute.Int64("buildkite.agents.total", metrics.TotalAgents),
+		)
+	}
+	endSpan(span, err)
+	return metrics, err
+}
+
+// describe describes the ASG and resolves the effective size bounds for this
+// run from the ASG, the scaler's configuration and any runtime overrides.
+func (s *Scaler) describe(ctx context.Context) (AutoscaleGroupDetails, error) {
+	describeCtx, span := startSpan(ctx, "scaler.Describe", attrASG.String(s.asgName))
+	asg, err := s.autoscaling.Describe(describeCtx)
+	if err == nil {
+		span.SetAttributes(
+			attrCurrent.Int64(asg.DesiredCount),
+			attrActual.Int64(asg.ActualCount),
+			attrPending.Int64(asg.Pending),
+			attribute.Int64("aws.autoscaling.min_size", asg.MinSize),
+			attribute.Int64("aws.autoscaling.max_size", asg.MaxSize),
+		)
+	}
+	endSpan(span, err)
+	if err != nil {
+		return asg, err
+	}
+
+	var parameter map[string]string
+	if s.runtimeConfig != nil {
+		if parameter, err = s.runtimeConfig.GetRuntimeConfig(ctx); err != nil {
+			s.log.Warn("⚠️  Could not read runtime config parameter, ignoring it", "error", err)
+			parameter = nil
+		}
+	}
+
+	if s.candidateSnapshot != nil {
+		s.candidateSnapshot.asg = asg
+		s.candidateSnapshot.parameter = parameter
+	}
+
+	tags := runtimeTags(asg.Tags)
+	s.bounds = computeSizeBounds(s.log, asg, s.minSize, s.maxSize, tags, parameter)
+	s.control = resolveRuntimeControl(s.log, tags, parameter, s.now())
+	if s.control.active() {
+		s.log.Info("🎚️ Runtime control in effect", "control", s.control.String())
+	}
+	if s.bounds.minSource != boundASGMin || s.bounds.maxSource != boundASGMax {
+		s.log.Info("↳ Scaler bounds", "min", s.bounds.min, "min_source", s.bounds.minSource, "max", s.bounds.max, "max_source", s.bounds.maxSource)
+	}
+
+	s.decision = Decision{
+		Time:    s.now(),
+		Action:  ActionNone,
+		Current: asg.DesiredCount,
+		Desired: asg.DesiredCount,
+		Actual:  asg.ActualCount,
+		Pending: asg.Pending,
+	}
+	return asg, nil
+}
+
+// applyPinnedDesired sets desired capacity to the count pinned by a runtime
+// control, within the size bounds. Cooldowns and scaling policies don't apply:
+// the pin is an operator decision, not a reaction to metrics.
+func (s *Scaler) applyPinnedDesired(ctx context.Context, asg AutoscaleGroupDetails) error {
+	desired := s.control.Desired
+	if desired > s.bounds.max {
+		s.log.Warn("⚠️  Pinned desired count exceeds MaxSize, capping", "desired", desired, "max", s.bounds.max, "source", s.bounds.maxSource)
+		s.decision.clamp(s.bounds.maxSource, desired, s.bounds.max)
+		desired = s.bounds.max
+	}
+	if desired < s.bounds.min {
+		s.log.Warn("⚠️  Pinned desired count is less than MinSize, capping", "desired", desired, "min", s.bounds.min, "source", s.bounds.minSource)
+		s.decision.clamp(s.bounds.minSource, desired, s.bounds.min)
+		desired = s.bounds.min
+	}
+
+	s.decision.Reason = "runtime-control: pinned"
+	if desired == asg.DesiredCount {
+		s.log.Info("↳ Desired capacity is already at the pinned count", "desired", desired)
+		return nil
+	}
+	if desired < asg.DesiredCount && s.control.Mode == ControlModeScaleOutOnly {
+		s.log.Info("↳ Pinned desired is below the ASG's but runtime control is "+ControlModeScaleOutOnly+", holding", "desired", desired, "asg_desired", asg.DesiredCount)
+		return nil
+	}
+
+	s.log.Info("↳ Setting desired capacity to the pinned count", "desired", desired)
+	return s.setDesiredCapacity(ctx, asg.DesiredCount, desired, "runtime-control: pinned")
+}
+
+// holdAtSafeFloor is used instead of a scaling decision while the metrics
+// circuit breaker is open. It never scales in, and only scales out if desired
+// capacity is below the configured safe floor.
+func (s *Scaler) holdAtSafeFloor(ctx context.Context, asg AutoscaleGroupDetails) error {
+	floor := min(s.guard.params.SafeFloor, s.bounds.max)
+	if floor <= asg.DesiredCount {
+		s.log.Warn("🔌 Metrics circuit breaker open, holding desired capacity", "desired", asg.DesiredCount)
+		s.decision.Reason = "metrics-breaker-open"
+		return nil
+	}
+
+	s.log.Warn("🔌 Metrics circuit breaker open, raising desired capacity to the safe floor", "from", asg.DesiredCount, "to", floor)
+	return s.setDesiredCapacity(ctx, asg.DesiredCount, floor, "metrics-breaker-safe-floor")
+}
+
+// setDesiredCapacity sets the ASG's desired capacity and records the change,
+// with reason, for scaling policies, manual override detection and cooldowns
+// after a restart.
+func (s *Scaler) setDesiredCapacity(ctx context.Context, current, desired int64, reason string) error {
 	t := time.Now()
+	now := s.now()
 
 	if err := s.autoscaling.SetDesiredCapacity(ctx, desired); err != nil {
 		return err
 	}
 
-	log.Printf("↳ Set desired to %d (took %v)", desired, time.Since(t))
+	if s.label != "" {
+		s.log.Info("↳ "+s.label+" would set desired", "desired", desired)
+	} else {
+		s.log.Info("↳ Set desired", "desired", desired, slog.Duration("took", time.Since(t)))
+	}
+
+	s.lastDesired = CapacityChange{Time: now, From: current, To: desired}
+	s.decision.Desired = desired
+	switch {
+	case desired > current:
+		s.decision.Action = ActionScaleOut
+	case desired < current:
+		s.decision.Action = ActionScaleIn
+	}
+
+	if recorder, ok := s.autoscaling.(scalingRecorder); ok && desired != current {
+		tag := TagLastScaleOut
+		if desired < current {
+			tag = TagLastScaleIn
+		}
+		record := ScalingRecord{Time: now, From: current, To: desired, Reason: reason}
+		if err := recorder.RecordScaling(ctx, tag, record); err != nil {
+			s.log.Warn("⚠️  Could not record scaling event in ASG tag", "tag", tag, "error", err)
+		}
+	}
+
+	// Record the change so scaling policies can account for it. Only the
+	// window covered by the longest policy is kept.
+	if desired != current {
+		s.history = append(s.history, CapacityChange{Time: now, From: current, To: desired})
+		policies := append(slices.Clone(s.scaleInParams.Policies), s.scaleOutParams.Policies...)
+		s.history = pruneHistory(s.history, policies, now)
+	}
 	return nil
 }
 
 // directlyTerminateInstance terminates an EC2 instance directly via EC2 API
 // This is a helper function for dangling instance termination
-func directlyTerminateInstance(ctx context.Context, ec2Client *ec2.Client, instanceID string) error {
+func directlyTerminateInstance(ctx context.Context, ec2Client EC2API, instanceID string) error {
 	_, err := ec2Client.TerminateInstances(ctx, &ec2.TerminateInstancesInput{
 		InstanceIds: []string{instanceID},
 	})
@@ -659,7 +1290,7 @@ func directlyTerminateInstance(ctx context.Context, ec2Client *ec2.Client, insta
 		return err
 	}
 
-	log.Printf("[Elastic CI Mode] Successfully terminated instance %s via EC2 API", instanceID)
+	logging.FromContext(ctx).Info("[Elastic CI Mode] Terminated instance via EC2 API", "instance_id", instanceID)
 	return nil
 }
 
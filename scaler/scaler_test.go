@@ -1,12 +1,16 @@
 package scaler
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+	"github.com/buildkite/buildkite-agent-scaler/logging"
 )
 
 func TestScalingOutWithoutError(t *testing.T) {
@@ -453,6 +457,9 @@ type asgTestDriver struct {
 	desiredCapacity        int64
 	actualCapacity         int64 // If 0, will default to desiredCapacity
 	maxSize                int64 // If 0, defaults to 100
+	tags                   map[string]string
+	activityCauses         []string
+	records                map[string]ScalingRecord
 	sigTermsSent           []string
 	elasticCIMode          bool
 	danglingInstancesFound int
@@ -461,8 +468,10 @@ type asgTestDriver struct {
 func (d *asgTestDriver) Describe(ctx context.Context) (AutoscaleGroupDetails, error) {
 	d.elasticCIMode = false
 	instanceIDs := make([]string, d.desiredCapacity)
+	instances := make([]InstanceDetails, d.desiredCapacity)
 	for i := int64(0); i < d.desiredCapacity; i++ {
 		instanceIDs[i] = fmt.Sprintf("i-%012d", i)
+		instances[i] = InstanceDetails{ID: instanceIDs[i], LifecycleState: "InService"}
 	}
 
 	actualCount := d.actualCapacity
@@ -481,23 +490,45 @@ func (d *asgTestDriver) Describe(ctx context.Context) (AutoscaleGroupDetails, er
 		MinSize:      0,
 		MaxSize:      maxSize,
 		InstanceIDs:  instanceIDs,
+		Tags:         d.tags,
+		Instances:    instances,
 	}, d.err
 }
 
+func (d *asgTestDriver) ActivityCausesSince(ctx context.Context, since time.Time) ([]string, error) {
+	return d.activityCauses, nil
+}
+
+func (d *asgTestDriver) RecordScaling(ctx context.Context, tag string, record ScalingRecord) error {
+	if d.records == nil {
+		d.records = make(map[string]ScalingRecord)
+	}
+	d.records[tag] = record
+	return nil
+}
+
 func (d *asgTestDriver) SetDesiredCapacity(ctx context.Context, count int64) error {
 	d.desiredCapacity = count
 	return d.err
 }
 
-func (d *asgTestDriver) SendSIGTERMToAgents(ctx context.Context, instanceID string) error {
+func (d *asgTestDriver) SignalAgents(ctx context.Context, inv *InstanceInventory, instanceIDs []string) []SignalOutcome {
 	if d.sigTermsSent == nil {
 		d.sigTermsSent = []string{}
 	}
-	d.sigTermsSent = append(d.sigTermsSent, instanceID)
-	return d.err
+	var outcomes []SignalOutcome
+	for _, id := range instanceIDs {
+		d.sigTermsSent = append(d.sigTermsSent, id)
+		outcome := SignalOutcome{InstanceID: id, Outcome: SignalSent}
+		if d.err != nil {
+			outcome = SignalOutcome{InstanceID: id, Outcome: SignalFailed, Error: d.err.Error()}
+		}
+		outcomes = append(outcomes, outcome)
+	}
+	return outcomes
 }
 
-func (d *asgTestDriver) CleanupDanglingInstances(ctx context.Context, minimumInstanceUptime time.Duration, maxDanglingInstancesToCheck int) error {
+func (d *asgTestDriver) CleanupDanglingInstances(ctx context.Context, inv *InstanceInventory, minimumInstanceUptime time.Duration, maxDanglingInstancesToCheck int) error {
 	d.danglingInstancesFound++
 	return d.err
 }
@@ -783,3 +814,54 @@ func TestDanglingInstanceDetection(t *testing.T) {
 		})
 	}
 }
+
+func TestRunLogAttributes(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := logging.NewLogger(&out, logging.FormatJSON, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeAWS{desired: 1}
+	s, err := NewScaler(nil, aws.Config{}, Params{
+		AutoScalingGroupName: "agents",
+		BuildkiteQueue:       "default",
+		AgentsPerInstance:    1,
+		Logger:               logger,
+	}, WithAutoScalingClient(fake), WithEC2Client(fake), WithSSMClient(fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.bk = &buildkiteTestDriver{metrics: buildkite.AgentMetrics{OrgSlug: "llamacorp", Queue: "default", ScheduledJobs: 2}}
+
+	runIDs := make(map[any]bool)
+	for range 2 {
+		out.Reset()
+		if _, err := s.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		var decision map[string]any
+		for _, line := range bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n")) {
+			var record map[string]any
+			if err := json.Unmarshal(line, &record); err != nil {
+				t.Fatalf("record isn't JSON: %v: %s", err, line)
+			}
+			if record[logging.KeyASG] != "agents" || record[logging.KeyQueue] != "default" || record[logging.KeyRunID] == nil {
+				t.Errorf("record %q is missing the run's attributes: %v", record["msg"], record)
+			}
+			if record["msg"] == "📋 Decision" {
+				decision = record
+			}
+		}
+		if decision == nil {
+			t.Fatalf("no decision record in:\n%s", out.String())
+		}
+		if decision[logging.KeyOrg] != "llamacorp" || decision["desired"] != float64(2) {
+			t.Errorf("decision record = %v", decision)
+		}
+		runIDs[decision[logging.KeyRunID]] = true
+	}
+	if len(runIDs) != 2 {
+		t.Errorf("run IDs = %v, want one per run", runIDs)
+	}
+}
@@ -0,0 +1,374 @@
+package scalertest
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	asgTypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	ec2Types "github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/aws/smithy-go"
+	"github.com/buildkite/buildkite-agent-scaler/scaler"
+)
+
+var (
+	_ scaler.AutoScalingAPI = (*Sim)(nil)
+	_ scaler.EC2API         = (*Sim)(nil)
+	_ scaler.SSMAPI         = (*Sim)(nil)
+)
+
+const availabilityZone = "us-east-1a"
+
+// invocation is one instance's part of an SSM command. Its outcome is decided
+// when the command is sent; it's reported once the command's delay passes.
+type invocation struct {
+	instanceID string
+	sent       time.Time
+	done       time.Time
+	status     ssmTypes.CommandInvocationStatus
+	output     string
+}
+
+func (s *Sim) DescribeAutoScalingGroups(ctx context.Context, params *autoscaling.DescribeAutoScalingGroupsInput, _ ...func(*autoscaling.Options)) (*autoscaling.DescribeAutoScalingGroupsOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	if len(params.AutoScalingGroupNames) > 0 && !slices.Contains(params.AutoScalingGroupNames, s.cfg.ASGName) {
+		return &autoscaling.DescribeAutoScalingGroupsOutput{}, nil
+	}
+	group := asgTypes.AutoScalingGroup{
+		AutoScalingGroupName: aws.String(s.cfg.ASGName),
+		DesiredCapacity:      aws.Int32(int32(s.desired)),
+		MinSize:              aws.Int32(int32(s.minSize)),
+		MaxSize:              aws.Int32(int32(s.maxSize)),
+	}
+	for _, i := range s.asgInstances() {
+		group.Instances = append(group.Instances, asgTypes.Instance{
+			InstanceId:       aws.String(i.id),
+			LifecycleState:   asgTypes.LifecycleState(i.lifecycle),
+			AvailabilityZone: aws.String(availabilityZone),
+			HealthStatus:     aws.String("Healthy"),
+			LaunchTemplate: &asgTypes.LaunchTemplateSpecification{
+				LaunchTemplateName: aws.String(s.cfg.ASGName),
+				Version:            aws.String("1"),
+			},
+		})
+	}
+	for _, k := range slices.Sorted(maps.Keys(s.asgTags)) {
+		group.Tags = append(group.Tags, asgTypes.TagDescription{Key: aws.String(k), Value: aws.String(s.asgTags[k])})
+	}
+	return &autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: []asgTypes.AutoScalingGroup{group}}, nil
+}
+
+func (s *Sim) DescribeScalingActivities(ctx context.Context, params *autoscaling.DescribeScalingActivitiesInput, _ ...func(*autoscaling.Options)) (*autoscaling.DescribeScalingActivitiesOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+	return &autoscaling.DescribeScalingActivitiesOutput{Activities: slices.Clone(s.activities)}, nil
+}
+
+func (s *Sim) SetDesiredCapacity(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, _ ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	desired := int64(aws.ToInt32(params.DesiredCapacity))
+	if desired < s.minSize || desired > s.maxSize {
+		return nil, validationError(fmt.Sprintf("New SetDesiredCapacity value %d is outside the bounds of min size %d and max size %d", desired, s.minSize, s.maxSize))
+	}
+	s.setDesired(desired)
+	s.update()
+	return &autoscaling.SetDesiredCapacityOutput{}, nil
+}
+
+func (s *Sim) SetInstanceHealth(ctx context.Context, params *autoscaling.SetInstanceHealthInput, _ ...func(*autoscaling.Options)) (*autoscaling.SetInstanceHealthOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	id := aws.ToString(params.InstanceId)
+	i := s.instance(id)
+	if i == nil || !i.inASG {
+		return nil, validationError(fmt.Sprintf("Instance Id not found - No managed instance found for instance ID %s", id))
+	}
+	if aws.ToString(params.HealthStatus) == "Unhealthy" && (i.lifecycle == lifecyclePending || i.lifecycle == lifecycleInService) {
+		s.recordActivity(fmt.Sprintf("At %s an instance was taken out of service in response to a user health-check.", s.timestamp()),
+			"Terminating EC2 instance: "+id)
+		s.terminate(i)
+		s.update()
+	}
+	return &autoscaling.SetInstanceHealthOutput{}, nil
+}
+
+func (s *Sim) CreateOrUpdateTags(ctx context.Context, params *autoscaling.CreateOrUpdateTagsInput, _ ...func(*autoscaling.Options)) (*autoscaling.CreateOrUpdateTagsOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tag := range params.Tags {
+		s.asgTags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	return &autoscaling.CreateOrUpdateTagsOutput{}, nil
+}
+
+// DetachInstances removes instances from the ASG, leaving them running.
+func (s *Sim) DetachInstances(ctx context.Context, params *autoscaling.DetachInstancesInput, _ ...func(*autoscaling.Options)) (*autoscaling.DetachInstancesOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	for _, id := range params.InstanceIds {
+		if i := s.instance(id); i == nil || !i.inASG {
+			return nil, validationError(fmt.Sprintf("The instance %s is not part of Auto Scaling group %s.", id, s.cfg.ASGName))
+		}
+	}
+	for _, id := range params.InstanceIds {
+		i := s.instance(id)
+		i.inASG = false
+		i.lifecycle = lifecycleDetached
+		cause := fmt.Sprintf("At %s instance %s was detached in response to a user request.", s.timestamp(), id)
+		if aws.ToBool(params.ShouldDecrementDesiredCapacity) {
+			cause = fmt.Sprintf("At %s instance %s was detached in response to a user request, shrinking the capacity from %d to %d.",
+				s.timestamp(), id, s.desired, s.desired-1)
+			s.desired--
+		}
+		s.recordActivity(cause, "Detaching EC2 instance: "+id)
+	}
+	s.update()
+	return &autoscaling.DetachInstancesOutput{}, nil
+}
+
+// DescribeInstances describes instances by ID, or by tag and state filters.
+// Terminated instances are still described.
+func (s *Sim) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	var instances []ec2Types.Instance
+	for _, i := range s.instances {
+		if len(params.InstanceIds) > 0 && !slices.Contains(params.InstanceIds, i.id) {
+			continue
+		}
+		if !i.matches(params.Filters) {
+			continue
+		}
+		instance := ec2Types.Instance{
+			InstanceId: aws.String(i.id),
+			LaunchTime: aws.Time(i.launched),
+			State:      &ec2Types.InstanceState{Name: ec2Types.InstanceStateName(i.ec2State)},
+			Placement:  &ec2Types.Placement{AvailabilityZone: aws.String(availabilityZone)},
+		}
+		if s.cfg.Platform == "windows" {
+			instance.Platform = ec2Types.PlatformValuesWindows
+		}
+		for _, k := range slices.Sorted(maps.Keys(i.tags)) {
+			instance.Tags = append(instance.Tags, ec2Types.Tag{Key: aws.String(k), Value: aws.String(i.tags[k])})
+		}
+		instances = append(instances, instance)
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []ec2Types.Reservation{{Instances: instances}}}, nil
+}
+
+// matches reports whether the instance passes the tag:<key> and
+// instance-state-name filters. Other filters are ignored.
+func (i *instance) matches(filters []ec2Types.Filter) bool {
+	for _, f := range filters {
+		name := aws.ToString(f.Name)
+		switch {
+		case name == "instance-state-name":
+			if !slices.Contains(f.Values, i.ec2State) {
+				return false
+			}
+		case strings.HasPrefix(name, "tag:"):
+			v, ok := i.tags[strings.TrimPrefix(name, "tag:")]
+			if !ok || !slices.Contains(f.Values, v) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// DescribeInstanceStatus reports every running instance as passing its
+// status checks, with no scheduled events.
+func (s *Sim) DescribeInstanceStatus(ctx context.Context, params *ec2.DescribeInstanceStatusInput, _ ...func(*ec2.Options)) (*ec2.DescribeInstanceStatusOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	out := &ec2.DescribeInstanceStatusOutput{}
+	for _, id := range params.InstanceIds {
+		if i := s.instance(id); i != nil && i.ec2State == ec2Running {
+			out.InstanceStatuses = append(out.InstanceStatuses, ec2Types.InstanceStatus{
+				InstanceId:     aws.String(id),
+				InstanceState:  &ec2Types.InstanceState{Name: ec2Types.InstanceStateNameRunning},
+				InstanceStatus: &ec2Types.InstanceStatusSummary{Status: ec2Types.SummaryStatusOk},
+				SystemStatus:   &ec2Types.InstanceStatusSummary{Status: ec2Types.SummaryStatusOk},
+			})
+		}
+	}
+	return out, nil
+}
+
+func (s *Sim) CreateTags(ctx context.Context, params *ec2.CreateTagsInput, _ ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range params.Resources {
+		if i := s.instance(id); i != nil {
+			for _, tag := range params.Tags {
+				i.tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+			}
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (s *Sim) DeleteTags(ctx context.Context, params *ec2.DeleteTagsInput, _ ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range params.Resources {
+		if i := s.instance(id); i != nil {
+			for _, tag := range params.Tags {
+				delete(i.tags, aws.ToString(tag.Key))
+			}
+		}
+	}
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+// TerminateInstances shuts instances down at once, bypassing the ASG's
+// lifecycle hook. The ASG replaces them.
+func (s *Sim) TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, _ ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	for _, id := range params.InstanceIds {
+		if i := s.instance(id); i != nil && i.ec2State == ec2Running {
+			s.shutdown(i)
+		}
+	}
+	s.update()
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
+func (s *Sim) DescribeInstanceInformation(ctx context.Context, params *ssm.DescribeInstanceInformationInput, _ ...func(*ssm.Options)) (*ssm.DescribeInstanceInformationOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	var ids []string
+	for _, f := range params.Filters {
+		if aws.ToString(f.Key) == "InstanceIds" {
+			ids = f.Values
+		}
+	}
+	out := &ssm.DescribeInstanceInformationOutput{}
+	for _, i := range s.instances {
+		if (ids == nil || slices.Contains(ids, i.id)) && i.ssmOnline() {
+			out.InstanceInformationList = append(out.InstanceInformationList, ssmTypes.InstanceInformation{
+				InstanceId: aws.String(i.id),
+				PingStatus: ssmTypes.PingStatusOnline,
+			})
+		}
+	}
+	return out, nil
+}
+
+// SendCommand runs a command on instances that are online in SSM. The agent
+// checks report whether the agent service is running, the scaler's stop
+// command stops the agents once they finish their jobs, and anything else
+// succeeds without doing anything.
+func (s *Sim) SendCommand(ctx context.Context, params *ssm.SendCommandInput, _ ...func(*ssm.Options)) (*ssm.SendCommandOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	if len(params.InstanceIds) == 0 || len(params.InstanceIds) > 50 {
+		return nil, validationError(fmt.Sprintf("SendCommand takes 1 to 50 instance IDs, got %d", len(params.InstanceIds)))
+	}
+	commands := strings.Join(params.Parameters["commands"], "\n")
+	stop := aws.ToString(params.Comment) == "Gracefully stop Buildkite agent"
+	check := strings.Contains(commands, "ActiveState") || strings.Contains(commands, "nssm status") || strings.Contains(commands, "is-active")
+
+	s.seq++
+	commandID := fmt.Sprintf("command-%d", s.seq)
+	for _, id := range params.InstanceIds {
+		inv := &invocation{
+			instanceID: id,
+			sent:       s.at,
+			done:       s.at.Add(s.cfg.CommandDelay),
+			status:     ssmTypes.CommandInvocationStatusSuccess,
+		}
+		i := s.instance(id)
+		switch {
+		case i == nil || !i.ssmOnline():
+			inv.status = ssmTypes.CommandInvocationStatusFailed
+			inv.output = "Undeliverable"
+		case check && i.serviceDown:
+			inv.output = "NOT_RUNNING: inactive"
+		case check:
+			inv.output = "RUNNING"
+		case stop:
+			for _, a := range i.agents {
+				a.stopping = true
+				if a.connected && a.job == nil {
+					s.disconnect(a)
+				}
+			}
+			if !i.agentsStarted {
+				i.serviceDown = true
+			}
+		}
+		s.commands[commandID] = append(s.commands[commandID], inv)
+	}
+	s.update()
+	return &ssm.SendCommandOutput{Command: &ssmTypes.Command{CommandId: aws.String(commandID)}}, nil
+}
+
+func (s *Sim) ListCommandInvocations(ctx context.Context, params *ssm.ListCommandInvocationsInput, _ ...func(*ssm.Options)) (*ssm.ListCommandInvocationsOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	out := &ssm.ListCommandInvocationsOutput{}
+	for _, inv := range s.commands[aws.ToString(params.CommandId)] {
+		ci := ssmTypes.CommandInvocation{
+			CommandId:         params.CommandId,
+			InstanceId:        aws.String(inv.instanceID),
+			RequestedDateTime: aws.Time(inv.sent),
+			Status:            ssmTypes.CommandInvocationStatusInProgress,
+		}
+		if !inv.done.After(s.at) {
+			ci.Status = inv.status
+			if params.Details {
+				ci.CommandPlugins = []ssmTypes.CommandPlugin{{Output: aws.String(inv.output)}}
+			}
+		}
+		out.CommandInvocations = append(out.CommandInvocations, ci)
+	}
+	return out, nil
+}
+
+func (s *Sim) GetParameter(ctx context.Context, params *ssm.GetParameterInput, _ ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name := aws.ToString(params.Name)
+	value, ok := s.parameters[name]
+	if !ok {
+		return nil, &ssmTypes.ParameterNotFound{Message: aws.String("Parameter " + name + " not found.")}
+	}
+	return &ssm.GetParameterOutput{Parameter: &ssmTypes.Parameter{Name: params.Name, Value: aws.String(value)}}, nil
+}
+
+func validationError(message string) error {
+	return &smithy.GenericAPIError{Code: "ValidationError", Message: message}
+}
@@ -0,0 +1,72 @@
+package scalertest
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+	"github.com/buildkite/buildkite-agent-scaler/scaler"
+)
+
+var (
+	_ scaler.AgentMetricsSource = (*Sim)(nil)
+	_ scaler.AgentLister        = (*Sim)(nil)
+)
+
+// GetAgentMetrics reports the queue's jobs and connected agents as of the
+// clock's time.
+func (s *Sim) GetAgentMetrics(ctx context.Context) (buildkite.AgentMetrics, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	metrics := buildkite.AgentMetrics{
+		OrgSlug:       s.cfg.OrgSlug,
+		Queue:         s.cfg.Queue,
+		ScheduledJobs: int64(len(s.waiting)),
+		WaitingJobs:   s.blocked,
+		Timestamp:     s.at,
+	}
+	for _, i := range s.instances {
+		for _, a := range i.agents {
+			if !a.connected {
+				continue
+			}
+			metrics.TotalAgents++
+			if a.job != nil {
+				metrics.BusyAgents++
+				metrics.RunningJobs++
+			} else {
+				metrics.IdleAgents++
+			}
+		}
+	}
+	return metrics, nil
+}
+
+// ListConnectedAgents lists the queue's connected agents, each with the
+// instance it runs on in its meta-data.
+func (s *Sim) ListConnectedAgents(ctx context.Context, orgSlug string) ([]buildkite.Agent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+
+	if orgSlug != s.cfg.OrgSlug {
+		return nil, fmt.Errorf("no organization %q", orgSlug)
+	}
+	var agents []buildkite.Agent
+	for _, i := range s.instances {
+		for _, a := range i.agents {
+			if a.connected {
+				agents = append(agents, buildkite.Agent{
+					ID:              a.id,
+					Name:            a.id,
+					ConnectionState: "connected",
+					MetaData:        []string{"queue=" + s.cfg.Queue, buildkite.InstanceIDMetaDataKey + "=" + i.id},
+					CreatedAt:       a.created,
+				})
+			}
+		}
+	}
+	return agents, nil
+}
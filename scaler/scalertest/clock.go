@@ -0,0 +1,45 @@
+package scalertest
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock is a virtual scaler.Clock. Time only moves when Sleep or Advance is
+// called, so hours of scaler cycles run in milliseconds. Concurrent sleeps
+// each advance it, so time passes faster than it would for real when the
+// scaler signals several batches of agents at once.
+type Clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewClock returns a Clock set to start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Sleep advances the clock by d, unless ctx is already done.
+func (c *Clock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.Advance(d)
+	return nil
+}
+
+// Advance moves the clock forward by d.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d > 0 {
+		c.now = c.now.Add(d)
+	}
+}
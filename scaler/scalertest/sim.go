@@ -0,0 +1,668 @@
+// Package scalertest simulates an Elastic CI Stack style fleet for end-to-end
+// scaler tests: an ASG of EC2 instances reachable through SSM, with Buildkite
+// agents that run jobs from a queue, all driven by a virtual clock.
+//
+// A Sim implements the AWS and Buildkite interfaces the scaler uses, so a
+// Scaler created with Sim.Options runs against it unchanged. The simulation
+// catches up with the clock on every call, one event at a time, so the
+// scaler's sleeps and the gaps between Run cycles cost nothing.
+package scalertest
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	asgTypes "github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/buildkite/buildkite-agent-scaler/scaler"
+)
+
+// Config describes a simulated fleet. Zero values take the defaults noted.
+type Config struct {
+	ASGName           string // Default "agents"
+	OrgSlug           string // Default "sim"
+	Queue             string // Default "default"
+	Platform          string // "linux" (default) or "windows"
+	MinSize           int64
+	MaxSize           int64 // Default 10
+	Desired           int64 // Instances launched at Start
+	AgentsPerInstance int   // Default 1
+
+	BootDelay         time.Duration // From launch until InService and online in SSM, default 90s
+	RegistrationDelay time.Duration // From InService until the agents connect, default 30s
+	TerminationDelay  time.Duration // From shutting down until terminated, default 60s
+	CommandDelay      time.Duration // From SendCommand until the invocations finish, default 2s
+
+	// How long a termination lifecycle hook holds an instance while its
+	// agents finish their jobs, as lifecycled does for Elastic CI Stack. 0
+	// means there is no hook: instances shut down as soon as the ASG
+	// terminates them, whatever they're running.
+	LifecycleHookTimeout time.Duration
+
+	// How long an agent waits for a job before it stops. When the last agent
+	// on an instance stops this way, the instance terminates itself and
+	// decrements desired capacity, as Elastic CI Stack instances do. The last
+	// agents keep waiting once the ASG is down to MinSize. 0 means agents wait
+	// forever.
+	IdleTimeout time.Duration
+
+	Start time.Time // Default 2026-01-01 00:00 UTC
+}
+
+func (c *Config) setDefaults() {
+	c.ASGName = cmp.Or(c.ASGName, "agents")
+	c.OrgSlug = cmp.Or(c.OrgSlug, "sim")
+	c.Queue = cmp.Or(c.Queue, "default")
+	c.Platform = cmp.Or(c.Platform, "linux")
+	c.MaxSize = cmp.Or(c.MaxSize, 10)
+	c.AgentsPerInstance = cmp.Or(c.AgentsPerInstance, 1)
+	c.BootDelay = cmp.Or(c.BootDelay, 90*time.Second)
+	c.RegistrationDelay = cmp.Or(c.RegistrationDelay, 30*time.Second)
+	c.TerminationDelay = cmp.Or(c.TerminationDelay, 60*time.Second)
+	c.CommandDelay = cmp.Or(c.CommandDelay, 2*time.Second)
+	if c.Start.IsZero() {
+		c.Start = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// ASG lifecycle states of simulated instances. Instances that have left the
+// ASG, by terminating or being detached, keep their last state.
+const (
+	lifecyclePending    = string(asgTypes.LifecycleStatePending)
+	lifecycleInService  = string(asgTypes.LifecycleStateInService)
+	lifecycleWait       = string(asgTypes.LifecycleStateTerminatingWait)
+	lifecycleProceed    = string(asgTypes.LifecycleStateTerminatingProceed)
+	lifecycleTerminated = string(asgTypes.LifecycleStateTerminated)
+	lifecycleDetached   = string(asgTypes.LifecycleStateDetached)
+)
+
+// EC2 states of simulated instances, which are running from launch
+const (
+	ec2Running      = "running"
+	ec2ShuttingDown = "shutting-down"
+	ec2Terminated   = "terminated"
+)
+
+const maxActivities = 100 // DescribeScalingActivities keeps the most recent
+
+// How long terminated instances stay visible to DescribeInstances, as in EC2
+const terminatedRetention = time.Hour
+
+type instance struct {
+	id       string
+	launched time.Time
+	inASG    bool
+	tags     map[string]string
+
+	lifecycle   string
+	ec2State    string
+	inService   time.Time // When it went InService
+	hookExpires time.Time // When the termination lifecycle hook gives up, in Terminating:Wait
+	terminateAt time.Time // When it finishes shutting down
+
+	agents        []*agent
+	agentsStarted bool
+	serviceDown   bool // The agent service has exited, stopped or killed
+}
+
+func (i *instance) ssmOnline() bool {
+	return i.ec2State == ec2Running && !i.inService.IsZero()
+}
+
+func (i *instance) connectedAgents() int {
+	n := 0
+	for _, a := range i.agents {
+		if a.connected {
+			n++
+		}
+	}
+	return n
+}
+
+type agent struct {
+	id        string
+	instance  *instance
+	created   time.Time
+	connected bool
+	stopping  bool // Finishes its job, then disconnects
+	idleSince time.Time
+	job       *job
+}
+
+type job struct {
+	id       int
+	duration time.Duration
+	queued   time.Time
+	finishAt time.Time // Zero until an agent picks it up
+}
+
+// Violation is something the scaler must never cause, e.g. an instance
+// terminated while one of its agents was running a job.
+type Violation struct {
+	Time       time.Time
+	InstanceID string
+	JobID      int
+	Reason     string
+}
+
+// Stats summarises the simulation so far.
+type Stats struct {
+	Desired         int64
+	InService       int // Instances InService in the ASG
+	ConnectedAgents int
+	BusyAgents      int
+	WaitingJobs     int
+	RunningJobs     int
+	JobsCompleted   int
+	JobsLost        int // Jobs lost to agents killed with KillAgent, or to busy terminations
+	Launched        int
+	Terminated      int
+
+	// How long instances have been running in total, from launch until
+	// terminated, which is what EC2 bills for
+	InstanceTime time.Duration
+}
+
+// Sim is a simulated ASG, its EC2 instances, SSM and a Buildkite queue.
+// Its methods are safe for concurrent use.
+type Sim struct {
+	Clock *Clock
+
+	cfg Config
+
+	mu  sync.Mutex
+	at  time.Time // The time the simulation has caught up to
+	seq int       // For instance, command and activity IDs
+
+	desired, minSize, maxSize int64
+	asgTags                   map[string]string
+	activities                []asgTypes.Activity // Newest first
+	desiredCause              string              // Prefix for the causes of activities following a SetDesiredCapacity
+	instances                 []*instance         // In launch order, including those no longer in the ASG
+
+	commands   map[string][]*invocation
+	parameters map[string]string
+
+	waiting    []*job // In the order they were queued
+	jobSeq     int
+	waits      []time.Duration // How long each job that started waited for an agent
+	blocked    int64
+	violations []Violation
+	stats      Stats
+}
+
+// New creates a simulation and launches cfg.Desired instances.
+func New(cfg Config) *Sim {
+	cfg.setDefaults()
+	s := &Sim{
+		Clock:      NewClock(cfg.Start),
+		cfg:        cfg,
+		at:         cfg.Start,
+		desired:    cfg.Desired,
+		minSize:    cfg.MinSize,
+		maxSize:    cfg.MaxSize,
+		asgTags:    make(map[string]string),
+		commands:   make(map[string][]*invocation),
+		parameters: make(map[string]string),
+	}
+	s.update()
+	return s
+}
+
+// Options returns the scaler.Options that point a Scaler at the simulation.
+func (s *Sim) Options() []scaler.Option {
+	return []scaler.Option{
+		scaler.WithClock(s.Clock),
+		scaler.WithAutoScalingClient(s),
+		scaler.WithEC2Client(s),
+		scaler.WithSSMClient(s),
+		scaler.WithAgentMetrics(s),
+		scaler.WithAgentLister(s),
+	}
+}
+
+// Run runs sc every interval for d, calling step (if not nil) with each
+// cycle's scheduled time before it runs, to change the workload. Time the
+// scaler spends sleeping counts towards the interval. It stops at the first
+// error from sc.Run.
+func (s *Sim) Run(ctx context.Context, sc *scaler.Scaler, d, interval time.Duration, step func(now time.Time)) error {
+	start := s.Clock.Now()
+	for next := start; next.Before(start.Add(d)); next = next.Add(interval) {
+		s.Clock.Advance(next.Sub(s.Clock.Now()))
+		if step != nil {
+			step(next)
+		}
+		if _, err := sc.Run(ctx); err != nil {
+			return fmt.Errorf("run at %s: %w", s.Clock.Now().Sub(start), err)
+		}
+	}
+	s.Clock.Advance(start.Add(d).Sub(s.Clock.Now()))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+	return nil
+}
+
+// AddJobs queues n jobs that each take d to run.
+func (s *Sim) AddJobs(n int, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+	for range n {
+		s.jobSeq++
+		s.waiting = append(s.waiting, &job{id: s.jobSeq, duration: d, queued: s.at})
+	}
+	s.update()
+}
+
+// SetBlockedJobs sets how many jobs are behind wait steps. The scaler sees
+// them as waiting jobs (see scaler.Params.IncludeWaiting), but agents can't
+// run them.
+func (s *Sim) SetBlockedJobs(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blocked = n
+}
+
+// JobWaits returns how long each job waited for an agent, in the order they
+// started, followed by how long the jobs still waiting have waited so far.
+func (s *Sim) JobWaits() []time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+	waits := slices.Clone(s.waits)
+	for _, j := range s.waiting {
+		waits = append(waits, s.at.Sub(j.queued))
+	}
+	return waits
+}
+
+// KillAgent kills the agent service on an instance, losing any jobs it was
+// running, and leaves the instance running without agents.
+func (s *Sim) KillAgent(instanceID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+	i := s.instance(instanceID)
+	if i == nil || i.ec2State != ec2Running {
+		return fmt.Errorf("no running instance %s", instanceID)
+	}
+	for _, a := range i.agents {
+		if a.job != nil {
+			s.stats.JobsLost++
+			a.job = nil
+		}
+		a.connected = false
+	}
+	i.serviceDown = true
+	s.update()
+	return nil
+}
+
+// SetDesired changes desired capacity outside the scaler, as an operator
+// would in the console.
+func (s *Sim) SetDesired(desired int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+	s.setDesired(desired)
+	s.update()
+}
+
+// SetParameter sets an SSM parameter, e.g. the scaler's runtime config.
+func (s *Sim) SetParameter(name, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.parameters[name] = value
+}
+
+// Stats returns the simulation's state and counters.
+func (s *Sim) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+	stats := s.stats
+	stats.Desired = s.desired
+	stats.WaitingJobs = len(s.waiting)
+	for _, i := range s.instances {
+		if i.inASG && i.lifecycle == lifecycleInService {
+			stats.InService++
+		}
+		if i.ec2State != ec2Terminated {
+			stats.InstanceTime += s.at.Sub(i.launched)
+		}
+		for _, a := range i.agents {
+			if a.connected {
+				stats.ConnectedAgents++
+			}
+			if a.job != nil {
+				stats.BusyAgents++
+				stats.RunningJobs++
+			}
+		}
+	}
+	return stats
+}
+
+// Violations returns the violations so far, oldest first.
+func (s *Sim) Violations() []Violation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+	return slices.Clone(s.violations)
+}
+
+// Instances returns the IDs of the instances in the ASG, in launch order.
+func (s *Sim) Instances() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance()
+	var ids []string
+	for _, i := range s.asgInstances() {
+		ids = append(ids, i.id)
+	}
+	return ids
+}
+
+// advance runs the simulation up to the clock's time, one event at a time.
+// s.mu must be held.
+func (s *Sim) advance() {
+	now := s.Clock.Now()
+	for {
+		next, ok := s.nextEvent()
+		if !ok || next.After(now) || !next.After(s.at) {
+			break
+		}
+		s.at = next
+		s.update()
+	}
+	if now.After(s.at) {
+		s.at = now
+	}
+	s.update()
+}
+
+// nextEvent returns the time of the next state change that isn't triggered
+// by an API call.
+func (s *Sim) nextEvent() (time.Time, bool) {
+	var next time.Time
+	consider := func(t time.Time) {
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	for _, i := range s.instances {
+		switch {
+		case i.lifecycle == lifecyclePending:
+			consider(i.launched.Add(s.cfg.BootDelay))
+		case i.lifecycle == lifecycleInService && !i.agentsStarted && !i.serviceDown:
+			consider(i.inService.Add(s.cfg.RegistrationDelay))
+		case i.lifecycle == lifecycleWait:
+			consider(i.hookExpires)
+		case i.ec2State == ec2ShuttingDown:
+			consider(i.terminateAt)
+		}
+		for _, a := range i.agents {
+			switch {
+			case a.job != nil:
+				consider(a.job.finishAt)
+			case a.connected && !a.stopping && s.cfg.IdleTimeout > 0:
+				consider(a.idleSince.Add(s.cfg.IdleTimeout))
+			}
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// update applies everything due at s.at, then lets the ASG converge on
+// desired capacity and agents pick up jobs.
+func (s *Sim) update() {
+	t := s.at
+	for _, i := range s.instances {
+		for _, a := range i.agents {
+			if a.job != nil && !a.job.finishAt.After(t) {
+				s.stats.JobsCompleted++
+				a.job = nil
+				a.idleSince = t
+				if a.stopping {
+					s.disconnect(a)
+				}
+			}
+		}
+	}
+
+	if s.cfg.IdleTimeout > 0 {
+		for _, i := range s.instances {
+			for _, a := range i.agents {
+				if !a.connected || a.stopping || a.job != nil || a.idleSince.Add(s.cfg.IdleTimeout).After(t) {
+					continue
+				}
+				if i.connectedAgents() > 1 {
+					s.disconnect(a)
+				} else if !s.selfTerminate(i) {
+					a.idleSince = t // Keep waiting
+				}
+			}
+		}
+	}
+
+	for _, i := range s.instances {
+		if i.lifecycle == lifecyclePending && !i.launched.Add(s.cfg.BootDelay).After(t) {
+			i.lifecycle = lifecycleInService
+			i.inService = t
+		}
+		if i.lifecycle == lifecycleInService && !i.agentsStarted && !i.serviceDown && !i.inService.Add(s.cfg.RegistrationDelay).After(t) {
+			i.agentsStarted = true
+			for n := range s.cfg.AgentsPerInstance {
+				i.agents = append(i.agents, &agent{
+					id:        fmt.Sprintf("agent-%s-%d", i.id, n+1),
+					instance:  i,
+					created:   t,
+					connected: true,
+					idleSince: t,
+				})
+			}
+		}
+		if i.lifecycle == lifecycleWait && (i.connectedAgents() == 0 || !i.hookExpires.After(t)) {
+			s.shutdown(i)
+		}
+		if i.ec2State == ec2ShuttingDown && !i.terminateAt.After(t) {
+			i.ec2State = ec2Terminated
+			if i.inASG {
+				i.lifecycle = lifecycleTerminated
+				i.inASG = false
+			}
+			s.stats.Terminated++
+			s.stats.InstanceTime += i.terminateAt.Sub(i.launched)
+		}
+	}
+	s.instances = slices.DeleteFunc(s.instances, func(i *instance) bool {
+		return i.ec2State == ec2Terminated && !i.terminateAt.Add(terminatedRetention).After(t)
+	})
+
+	s.reconcile()
+	s.assignJobs()
+}
+
+// disconnect stops an idle or stopping agent. The agent service exits with
+// the last agent on the instance.
+func (s *Sim) disconnect(a *agent) {
+	a.connected = false
+	if a.instance.connectedAgents() == 0 {
+		a.instance.serviceDown = true
+	}
+}
+
+// reconcile launches or terminates instances until the ASG's capacity
+// matches desired. It terminates the oldest instances first, like the
+// OldestInstance termination policy.
+func (s *Sim) reconcile() {
+	var capacity []*instance
+	for _, i := range s.asgInstances() {
+		if i.lifecycle == lifecyclePending || i.lifecycle == lifecycleInService {
+			capacity = append(capacity, i)
+		}
+	}
+	from := int64(len(capacity))
+	if from == s.desired {
+		s.desiredCause = ""
+		return
+	}
+
+	cause := fmt.Sprintf("%sAt %s an instance was started in response to a difference between desired and actual capacity, increasing the capacity from %d to %d.",
+		s.desiredCause, s.timestamp(), from, s.desired)
+	for range s.desired - from {
+		s.seq++
+		i := &instance{
+			id:        fmt.Sprintf("i-%017x", s.seq),
+			launched:  s.at,
+			inASG:     true,
+			tags:      make(map[string]string),
+			lifecycle: lifecyclePending,
+			ec2State:  ec2Running,
+		}
+		s.instances = append(s.instances, i)
+		s.stats.Launched++
+		s.recordActivity(cause, "Launching a new EC2 instance: "+i.id)
+	}
+
+	cause = fmt.Sprintf("%sAt %s an instance was taken out of service in response to a difference between desired and actual capacity, shrinking the capacity from %d to %d.",
+		s.desiredCause, s.timestamp(), from, s.desired)
+	slices.SortStableFunc(capacity, func(a, b *instance) int { return a.launched.Compare(b.launched) })
+	for _, i := range capacity[:max(from-s.desired, 0)] {
+		s.terminate(i)
+		s.recordActivity(cause, "Terminating EC2 instance: "+i.id)
+	}
+	s.desiredCause = ""
+}
+
+// terminate starts terminating an instance in the ASG. With a lifecycle hook,
+// its agents finish their jobs first.
+func (s *Sim) terminate(i *instance) {
+	if s.cfg.LifecycleHookTimeout <= 0 {
+		s.shutdown(i)
+		return
+	}
+	i.lifecycle = lifecycleWait
+	i.hookExpires = s.at.Add(s.cfg.LifecycleHookTimeout)
+	for _, a := range i.agents {
+		a.stopping = true
+		if a.connected && a.job == nil {
+			s.disconnect(a)
+		}
+	}
+	if i.connectedAgents() == 0 {
+		s.shutdown(i)
+	}
+}
+
+// shutdown stops an instance. Any job still running on it is lost, which is
+// a violation.
+func (s *Sim) shutdown(i *instance) {
+	for _, a := range i.agents {
+		if a.job != nil {
+			s.violations = append(s.violations, Violation{
+				Time:       s.at,
+				InstanceID: i.id,
+				JobID:      a.job.id,
+				Reason:     fmt.Sprintf("terminated while %s was running job %d", a.id, a.job.id),
+			})
+			log.Printf("🧪 Violation: %s terminated while %s was running job %d", i.id, a.id, a.job.id)
+			s.stats.JobsLost++
+			a.job = nil
+		}
+		a.connected = false
+	}
+	i.serviceDown = true
+	if i.inASG {
+		i.lifecycle = lifecycleProceed
+	}
+	i.ec2State = ec2ShuttingDown
+	i.terminateAt = s.at.Add(s.cfg.TerminationDelay)
+}
+
+// selfTerminate stops the last agent on an instance for want of work and
+// terminates the instance, decrementing desired capacity. It does nothing,
+// and returns false, if that would take the ASG below MinSize.
+func (s *Sim) selfTerminate(i *instance) bool {
+	if !i.inASG || i.lifecycle != lifecycleInService || s.desired <= s.minSize {
+		return false
+	}
+	s.recordActivity(fmt.Sprintf("At %s instance %s taken out of service in response to a user request, shrinking the capacity from %d to %d.",
+		s.timestamp(), i.id, s.desired, s.desired-1), "Terminating EC2 instance: "+i.id)
+	s.desired--
+	s.terminate(i)
+	return true
+}
+
+// assignJobs hands waiting jobs to idle agents, oldest job first.
+func (s *Sim) assignJobs() {
+	for _, i := range s.instances {
+		for _, a := range i.agents {
+			if len(s.waiting) == 0 {
+				return
+			}
+			if !a.connected || a.stopping || a.job != nil {
+				continue
+			}
+			a.job = s.waiting[0]
+			a.job.finishAt = s.at.Add(a.job.duration)
+			s.waits = append(s.waits, s.at.Sub(a.job.queued))
+			s.waiting = s.waiting[1:]
+		}
+	}
+}
+
+func (s *Sim) setDesired(desired int64) {
+	if desired != s.desired {
+		s.desiredCause = fmt.Sprintf("At %s a user request explicitly set group desired capacity changing the desired capacity from %d to %d.  ",
+			s.timestamp(), s.desired, desired)
+	}
+	s.desired = desired
+}
+
+func (s *Sim) recordActivity(cause, description string) {
+	s.seq++
+	s.activities = slices.Insert(s.activities, 0, asgTypes.Activity{
+		ActivityId:           aws.String(fmt.Sprintf("activity-%d", s.seq)),
+		AutoScalingGroupName: aws.String(s.cfg.ASGName),
+		Cause:                aws.String(cause),
+		Description:          aws.String(description),
+		StartTime:            aws.Time(s.at),
+		EndTime:              aws.Time(s.at),
+		StatusCode:           asgTypes.ScalingActivityStatusCodeSuccessful,
+		Progress:             aws.Int32(100),
+	})
+	if len(s.activities) > maxActivities {
+		s.activities = s.activities[:maxActivities]
+	}
+}
+
+func (s *Sim) timestamp() string {
+	return s.at.UTC().Format(time.RFC3339)
+}
+
+// asgInstances returns the instances in the ASG, in launch order.
+func (s *Sim) asgInstances() []*instance {
+	var instances []*instance
+	for _, i := range s.instances {
+		if i.inASG {
+			instances = append(instances, i)
+		}
+	}
+	return instances
+}
+
+func (s *Sim) instance(id string) *instance {
+	for _, i := range s.instances {
+		if i.id == id {
+			return i
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package scalertest
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/buildkite/buildkite-agent-scaler/scaler"
+)
+
+func newScaler(t *testing.T, sim *Sim, params scaler.Params) *scaler.Scaler {
+	t.Helper()
+	params.AutoScalingGroupName = sim.cfg.ASGName
+	params.BuildkiteQueue = sim.cfg.Queue
+	params.AgentsPerInstance = sim.cfg.AgentsPerInstance
+	sc, err := scaler.NewScaler(nil, aws.Config{}, params, sim.Options()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sc
+}
+
+// burst queues a mix of short and long jobs, then more short ones while the
+// long ones run, so the scaler scales in while some agents are busy.
+func burst(sim *Sim, start time.Time) func(now time.Time) {
+	return func(now time.Time) {
+		switch now.Sub(start) {
+		case 0:
+			// The oldest instances get the long jobs, and the ASG
+			// terminates the oldest instances first
+			sim.AddJobs(6, 50*time.Minute)
+			sim.AddJobs(6, 10*time.Minute)
+		case 40 * time.Minute:
+			sim.AddJobs(6, 10*time.Minute)
+		}
+	}
+}
+
+func TestScaleOutAndInWithoutBusyTerminations(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		params scaler.Params
+	}{
+		{name: "standard"},
+		{name: "elastic-ci", params: scaler.Params{ElasticCIMode: true, MinimumInstanceUptime: 10 * time.Minute}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sim := New(Config{MaxSize: 10, AgentsPerInstance: 2, LifecycleHookTimeout: time.Hour})
+			tc.params.ScaleInParams.CooldownPeriod = 5 * time.Minute
+			sc := newScaler(t, sim, tc.params)
+
+			if err := sim.Run(context.Background(), sc, 3*time.Hour, time.Minute, burst(sim, sim.Clock.Now())); err != nil {
+				t.Fatal(err)
+			}
+
+			if v := sim.Violations(); len(v) > 0 {
+				t.Errorf("violations: %+v", v)
+			}
+			stats := sim.Stats()
+			if stats.JobsCompleted != 18 || stats.JobsLost != 0 {
+				t.Errorf("completed %d jobs and lost %d, want all 18 completed", stats.JobsCompleted, stats.JobsLost)
+			}
+			if stats.Launched < 6 {
+				t.Errorf("launched %d instances, want at least 6 for 12 concurrent jobs", stats.Launched)
+			}
+			if stats.Desired != 0 || stats.InService != 0 {
+				t.Errorf("desired=%d in service=%d once the queue drained, want 0", stats.Desired, stats.InService)
+			}
+		})
+	}
+}
+
+func TestElasticCIReplacesInstanceWithDeadAgent(t *testing.T) {
+	sim := New(Config{MinSize: 2, Desired: 2})
+	sc := newScaler(t, sim, scaler.Params{
+		ElasticCIMode:         true,
+		MinSize:               2,
+		MinimumInstanceUptime: 5 * time.Minute,
+	})
+	ctx := context.Background()
+
+	if err := sim.Run(ctx, sc, 10*time.Minute, time.Minute, nil); err != nil {
+		t.Fatal(err)
+	}
+	dead := sim.Instances()[0]
+	if err := sim.KillAgent(dead); err != nil {
+		t.Fatal(err)
+	}
+	if err := sim.Run(ctx, sc, 20*time.Minute, time.Minute, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if slices.Contains(sim.Instances(), dead) {
+		t.Errorf("%s, whose agent died, is still in the ASG", dead)
+	}
+	if stats := sim.Stats(); stats.InService != 2 || stats.ConnectedAgents != 2 {
+		t.Errorf("in service=%d, connected agents=%d, want a replacement to bring both back to 2", stats.InService, stats.ConnectedAgents)
+	}
+}
+
+func TestSelfTerminationIsNotAnOverride(t *testing.T) {
+	sim := New(Config{MinSize: 1, IdleTimeout: 10 * time.Minute, LifecycleHookTimeout: time.Hour})
+	sc := newScaler(t, sim, scaler.Params{
+		MinSize:                   1,
+		ScaleInParams:             scaler.ScaleParams{Disable: true},
+		ExternalChangeGracePeriod: time.Hour,
+	})
+	start := sim.Clock.Now()
+
+	// Idle agents terminate their instances between the two bursts of work,
+	// lowering desired capacity. The second burst must still be scaled for.
+	err := sim.Run(context.Background(), sc, 2*time.Hour, time.Minute, func(now time.Time) {
+		switch now.Sub(start) {
+		case 0:
+			sim.AddJobs(4, 10*time.Minute)
+		case time.Hour:
+			sim.AddJobs(4, 10*time.Minute)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := sim.Violations(); len(v) > 0 {
+		t.Errorf("violations: %+v", v)
+	}
+	if override := sc.State().Override; !override.Detected.IsZero() {
+		t.Errorf("self-terminations taken for a manual override: %+v", override)
+	}
+	// One instance stays at MinSize, so the second burst needs 3 more
+	if stats := sim.Stats(); stats.JobsCompleted != 8 || stats.Launched != 7 {
+		t.Errorf("completed %d of 8 jobs on %d instances, want 7 instances", stats.JobsCompleted, stats.Launched)
+	}
+}
+
+func TestBusyTerminationIsAViolation(t *testing.T) {
+	// Without a lifecycle hook nothing waits for the job
+	sim := New(Config{Desired: 1})
+	sim.Clock.Advance(5 * time.Minute)
+	sim.AddJobs(1, time.Hour)
+
+	sim.SetDesired(0)
+
+	if v := sim.Violations(); len(v) != 1 || v[0].JobID != 1 {
+		t.Errorf("violations = %+v, want job 1 lost with its instance", v)
+	}
+}
@@ -1,7 +1,7 @@
 package scaler
 
 import (
-	"log"
+	"log/slog"
 	"math"
 	"time"
 
@@ -14,43 +14,47 @@ type ScalingCalculator struct {
 	availabilityThreshold float64 // Availability threshold, e.g. 0.5 for 50%
 	elasticCIMode         bool    // Special mode for Elastic CI Stack with additional safety checks
 	maxInstanceCap        int     // Maximum instance count cap (0 means no cap)
+	clock                 Clock   // For the age of metrics; nil means the wall clock
 
 	// Metrics cache to prevent inconsistent calculations
 	lastMetricsTimestamp time.Time
 	lastAgentCount       int64
 	lastInstanceCount    int64
+
+	availability *float64 // Calculated by the latest DesiredCount, nil if it returned before
 }
 
-func (sc *ScalingCalculator) perInstance(count int64) int64 {
+func (sc *ScalingCalculator) perInstance(logger *slog.Logger, count int64) int64 {
 	if sc.agentsPerInstance <= 0 {
-		log.Printf("⚠️  Invalid agentsPerInstance value %d, defaulting to 1", sc.agentsPerInstance)
+		logger.Warn("⚠️  Invalid agentsPerInstance value, defaulting to 1", "agents_per_instance", sc.agentsPerInstance)
 		return count // Default to 1:1 mapping
 	}
 
 	result := int64(math.Ceil(float64(count) / float64(sc.agentsPerInstance)))
 
 	if result < 0 {
-		log.Printf("⚠️  Calculated negative instance count %d, capping at 0", result)
+		logger.Warn("⚠️  Calculated negative instance count, capping at 0", "instances", result)
 		return 0
 	}
 
 	if sc.maxInstanceCap > 0 && result > int64(sc.maxInstanceCap) {
-		log.Printf("⚠️  Calculated instance count %d exceeds max cap, capping at %d", result, sc.maxInstanceCap)
+		logger.Warn("⚠️  Calculated instance count exceeds max cap, capping", "instances", result, "max_instance_cap", sc.maxInstanceCap)
 		return int64(sc.maxInstanceCap)
 	}
 
 	return result
 }
 
-func (sc *ScalingCalculator) DesiredCount(metrics *buildkite.AgentMetrics, asg *AutoscaleGroupDetails) int64 {
-	log.Printf("Calculating desired instance count for Buildkite Jobs")
+func (sc *ScalingCalculator) DesiredCount(logger *slog.Logger, metrics *buildkite.AgentMetrics, asg *AutoscaleGroupDetails) int64 {
+	logger.Debug("Calculating desired instance count for Buildkite Jobs")
+	sc.availability = nil
 
 	// In Elastic CI mode, check if metrics are stale before making scaling decisions
 	if sc.elasticCIMode && !metrics.Timestamp.IsZero() {
-		metricAge := time.Since(metrics.Timestamp)
+		metricAge := orWallClock(sc.clock).Now().Sub(metrics.Timestamp)
 		// If metrics are over 2 minutes old, we should be cautious with scaling decisions
 		if metricAge > 2*time.Minute {
-			log.Printf("⚠️ [Elastic CI Mode] Metrics are %.1f seconds old - too stale for scaling decisions", metricAge.Seconds())
+			logger.Warn("⚠️ [Elastic CI Mode] Metrics are too stale for scaling decisions", slog.Duration("age", metricAge))
 			// For safety, return current desired count to avoid scaling based on stale data
 			return asg.DesiredCount
 		}
@@ -63,10 +67,10 @@ func (sc *ScalingCalculator) DesiredCount(metrics *buildkite.AgentMetrics, asg *
 		// If our cached metrics are newer than what we just got, use the cached values
 		if sc.lastMetricsTimestamp.After(metrics.Timestamp) {
 			// Current metrics are older than our cached values
-			log.Printf("⚠️ [Elastic CI Mode] Using cached agent count %d instead of stale count %d (cached from %s, metrics from %s)",
-				sc.lastAgentCount, actualAgents,
-				sc.lastMetricsTimestamp.Format(time.RFC3339),
-				metrics.Timestamp.Format(time.RFC3339))
+			logger.Warn("⚠️ [Elastic CI Mode] Using cached agent count instead of stale count",
+				"cached", sc.lastAgentCount, "stale", actualAgents,
+				"cached_at", sc.lastMetricsTimestamp.Format(time.RFC3339),
+				"metrics_at", metrics.Timestamp.Format(time.RFC3339))
 			actualAgents = sc.lastAgentCount
 		} else {
 			// Update our cache with the newer values
@@ -93,8 +97,9 @@ func (sc *ScalingCalculator) DesiredCount(metrics *buildkite.AgentMetrics, asg *
 	var currentAvailability = 1.0
 	if expectedAgents > 0 {
 		currentAvailability = float64(actualAgents) / float64(expectedAgents)
-		log.Printf("↳ 🧮 Agent availability: %.2f%% (%d/%d)", currentAvailability*100, actualAgents, expectedAgents)
+		logger.Info("↳ 🧮 Agent availability", "availability", currentAvailability, "agents", actualAgents, "expected", expectedAgents)
 	}
+	sc.availability = &currentAvailability
 
 	// Calculate agents required for workload
 	agentsRequired := metrics.ScheduledJobs
@@ -111,7 +116,7 @@ func (sc *ScalingCalculator) DesiredCount(metrics *buildkite.AgentMetrics, asg *
 
 	var desired int64
 	if agentsRequired > 0 {
-		desired = sc.perInstance(agentsRequired)
+		desired = sc.perInstance(logger, agentsRequired)
 	}
 
 	// Availability-based scaling for all modes
@@ -125,8 +130,8 @@ func (sc *ScalingCalculator) DesiredCount(metrics *buildkite.AgentMetrics, asg *
 				modePrefix = "[Elastic CI Mode] "
 			}
 
-			log.Printf("↳ 🚨 %sAvailability below threshold (%.2f%% < %.2f%%), missing %d agents",
-				modePrefix, currentAvailability*100, sc.availabilityThreshold*100, missingAgents)
+			logger.Warn("↳ 🚨 "+modePrefix+"Availability below threshold",
+				"availability", currentAvailability, "threshold", sc.availabilityThreshold, "missing_agents", missingAgents)
 
 			// Only boost if ASG has converged (actual == desired), otherwise let ASG finish scaling
 			if asg.ActualCount == asg.DesiredCount {
@@ -142,16 +147,18 @@ func (sc *ScalingCalculator) DesiredCount(metrics *buildkite.AgentMetrics, asg *
 					instancesAdded := availabilityTarget - currentJobBasedDesired
 					desired = availabilityTarget
 
-					log.Printf("↳ 📈 %sBoosting desired instances for low availability: %d -> %d (+%d instances). Reason: %d agents online vs %d expected from %d instances (%.2f%% < %.2f%% threshold). ASG Desired: %d, Job-based need: %d",
-						modePrefix, currentJobBasedDesired, desired, instancesAdded, actualAgents, expectedAgents, asg.DesiredCount, currentAvailability*100, sc.availabilityThreshold*100, asg.DesiredCount, currentJobBasedDesired)
+					logger.Info("↳ 📈 "+modePrefix+"Boosting desired instances for low availability",
+						"from", currentJobBasedDesired, "to", desired, "added", instancesAdded,
+						"agents", actualAgents, "expected", expectedAgents, "asg_desired", asg.DesiredCount,
+						"availability", currentAvailability, "threshold", sc.availabilityThreshold)
 				}
 			} else {
-				log.Printf("↳ ⏳ %sNot boosting for low availability - ASG is still converging (%d actual vs %d desired)", modePrefix, asg.ActualCount, asg.DesiredCount)
+				logger.Info("↳ ⏳ "+modePrefix+"Not boosting for low availability, ASG is still converging", "actual", asg.ActualCount, "asg_desired", asg.DesiredCount)
 			}
 		}
 	}
 
-	log.Printf("↳ 🧮 Agents required %d, Instances required %d", agentsRequired, desired)
+	logger.Info("↳ 🧮 Calculated instances required", "agents_required", agentsRequired, "instances_required", desired)
 
 	return desired
 }
@@ -0,0 +1,164 @@
+package scaler
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling/types"
+	"github.com/buildkite/buildkite-agent-scaler/logging"
+)
+
+// ASG tags where the scaler records its own most recent scale-out and
+// scale-in, so cooldowns survive a Lambda cold start without parsing the
+// ASG's activity history.
+const (
+	TagLastScaleOut = RuntimeTagPrefix + "last-scale-out"
+	TagLastScaleIn  = RuntimeTagPrefix + "last-scale-in"
+)
+
+// ScalingRecord is a change to desired capacity made by the scaler.
+type ScalingRecord struct {
+	Time   time.Time
+	From   int64
+	To     int64
+	Reason string
+}
+
+// String formats the record as a tag value, e.g.
+// "2026-01-01T12:00:00Z from=2 to=5 reason=metrics". Only characters allowed
+// in tag values are used.
+func (r ScalingRecord) String() string {
+	return fmt.Sprintf("%s from=%d to=%d reason=%s", r.Time.UTC().Format(time.RFC3339), r.From, r.To, r.Reason)
+}
+
+// parseScalingRecord parses a tag value written by ScalingRecord.String.
+func parseScalingRecord(s string) (ScalingRecord, error) {
+	ts, rest, _ := strings.Cut(strings.TrimSpace(s), " ")
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return ScalingRecord{}, fmt.Errorf("invalid time %q: %w", ts, err)
+	}
+	record := ScalingRecord{Time: t}
+
+	for rest != "" {
+		var field string
+		if strings.HasPrefix(rest, "reason=") {
+			// The reason runs to the end and may contain spaces
+			field, rest = rest, ""
+		} else {
+			field, rest, _ = strings.Cut(rest, " ")
+		}
+		k, v, _ := strings.Cut(field, "=")
+		switch k {
+		case "from":
+			record.From, err = strconv.ParseInt(v, 10, 64)
+		case "to":
+			record.To, err = strconv.ParseInt(v, 10, 64)
+		case "reason":
+			record.Reason = v
+		}
+		if err != nil {
+			return ScalingRecord{}, fmt.Errorf("invalid %s %q: %w", k, v, err)
+		}
+	}
+	return record, nil
+}
+
+// scalingRecorder is implemented by ASG drivers that can store the scaler's
+// scaling records durably.
+type scalingRecorder interface {
+	RecordScaling(ctx context.Context, tag string, record ScalingRecord) error
+}
+
+// RecordScaling stores record in the given ASG tag.
+func (a *ASGDriver) RecordScaling(ctx context.Context, tag string, record ScalingRecord) error {
+	svc := a.autoscalingClient()
+	_, err := svc.CreateOrUpdateTags(ctx, &autoscaling.CreateOrUpdateTagsInput{
+		Tags: []types.Tag{{
+			ResourceId:        aws.String(a.Name),
+			ResourceType:      aws.String("auto-scaling-group"),
+			Key:               aws.String(tag),
+			Value:             aws.String(record.String()),
+			PropagateAtLaunch: aws.Bool(false),
+		}},
+	})
+	return err
+}
+
+// GetLastScalingInAndOutEvents returns when the scaler last scaled out and
+// in, from its records in the ASG tags. For a direction with no record (e.g.
+// an older scaler version made the last change), it falls back to the ASG's
+// activity history. A zero time means no event was found.
+func (a *ASGDriver) GetLastScalingInAndOutEvents(ctx context.Context, findScaleOut, findScaleIn bool) (lastScaleOut, lastScaleIn time.Time, err error) {
+	svc := a.autoscalingClient()
+	output, err := svc.DescribeAutoScalingGroups(ctx, &autoscaling.DescribeAutoScalingGroupsInput{
+		AutoScalingGroupNames: []string{a.Name},
+	})
+	if err != nil {
+		return lastScaleOut, lastScaleIn, err
+	}
+
+	haveScaleOut, haveScaleIn := !findScaleOut, !findScaleIn
+	if len(output.AutoScalingGroups) > 0 {
+		for _, tag := range output.AutoScalingGroups[0].Tags {
+			if tag.Key == nil || tag.Value == nil {
+				continue
+			}
+			var target *time.Time
+			var found *bool
+			switch *tag.Key {
+			case TagLastScaleOut:
+				target, found = &lastScaleOut, &haveScaleOut
+			case TagLastScaleIn:
+				target, found = &lastScaleIn, &haveScaleIn
+			default:
+				continue
+			}
+			record, err := parseScalingRecord(*tag.Value)
+			if err != nil {
+				logging.FromContext(ctx).Warn("⚠️  Ignoring ASG tag", "tag", *tag.Key, "error", err)
+				continue
+			}
+			*target, *found = record.Time, true
+		}
+	}
+
+	if haveScaleOut && haveScaleIn {
+		return lastScaleOut, lastScaleIn, nil
+	}
+
+	logging.FromContext(ctx).Info("↳ No scaler record of the last scaling event, falling back to ASG activity history",
+		"scale_out_found", haveScaleOut, "scale_in_found", haveScaleIn)
+	scaleOutActivity, scaleInActivity, err := a.GetLastScalingInAndOutActivity(ctx, !haveScaleOut, !haveScaleIn)
+	if !haveScaleOut && scaleOutActivity != nil && scaleOutActivity.StartTime != nil {
+		lastScaleOut = *scaleOutActivity.StartTime
+	}
+	if !haveScaleIn && scaleInActivity != nil && scaleInActivity.StartTime != nil {
+		lastScaleIn = *scaleInActivity.StartTime
+	}
+	return lastScaleOut, lastScaleIn, err
+}
+
+// lastRecordedChange returns the newer of the scaler's scale-out and scale-in
+// records in tags, or a zero change if there are none. Unparseable records are
+// skipped; GetLastScalingInAndOutEvents already warns about them.
+func lastRecordedChange(tags map[string]string) CapacityChange {
+	var last CapacityChange
+	for _, tag := range []string{TagLastScaleOut, TagLastScaleIn} {
+		value, ok := tags[tag]
+		if !ok {
+			continue
+		}
+		record, err := parseScalingRecord(value)
+		if err != nil || !record.Time.After(last.Time) {
+			continue
+		}
+		last = CapacityChange{Time: record.Time, From: record.From, To: record.To}
+	}
+	return last
+}
@@ -0,0 +1,64 @@
+package scaler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+func TestScalingRecordRoundTrip(t *testing.T) {
+	record := ScalingRecord{
+		Time:   time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC),
+		From:   2,
+		To:     5,
+		Reason: "runtime-control: pinned",
+	}
+
+	s := record.String()
+	if want := "2026-01-01T12:00:00Z from=2 to=5 reason=runtime-control: pinned"; s != want {
+		t.Errorf("String() = %q, want %q", s, want)
+	}
+
+	got, err := parseScalingRecord(s)
+	if err != nil {
+		t.Fatalf("parseScalingRecord(%q) error: %v", s, err)
+	}
+	if !got.Time.Equal(record.Time) || got.From != record.From || got.To != record.To || got.Reason != record.Reason {
+		t.Errorf("parseScalingRecord(%q) = %+v, want %+v", s, got, record)
+	}
+}
+
+func TestParseScalingRecordErrors(t *testing.T) {
+	for _, bad := range []string{"", "yesterday from=1 to=2", "2026-01-01T12:00:00Z from=one to=2"} {
+		if _, err := parseScalingRecord(bad); err == nil {
+			t.Errorf("parseScalingRecord(%q) = nil error, want error", bad)
+		}
+	}
+}
+
+func TestRunRecordsScalingEvents(t *testing.T) {
+	asg := &asgTestDriver{desiredCapacity: 2}
+	bk := &buildkiteTestDriver{metrics: buildkite.AgentMetrics{ScheduledJobs: 6}}
+	s := Scaler{
+		autoscaling: asg,
+		bk:          bk,
+		scaling:     ScalingCalculator{agentsPerInstance: 1},
+	}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := asg.records[TagLastScaleOut]; got.From != 2 || got.To != 6 || got.Reason != "metrics" {
+		t.Errorf("scale-out record = %+v, want 2 -> 6 for metrics", got)
+	}
+
+	bk.metrics.ScheduledJobs = 1
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := asg.records[TagLastScaleIn]; got.From != 6 || got.To != 1 {
+		t.Errorf("scale-in record = %+v, want 6 -> 1", got)
+	}
+}
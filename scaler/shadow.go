@@ -0,0 +1,209 @@
+package scaler
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/buildkite/buildkite-agent-scaler/logging"
+)
+
+// shadowCommandPrefix marks the IDs of commands a shadow Scaler pretended to
+// send.
+const shadowCommandPrefix = "shadow-"
+
+// ShadowAction is a change a Scaler in shadow mode would have made, see
+// Params.Shadow.
+type ShadowAction struct {
+	Call        string   // The AWS API call, e.g. "SetDesiredCapacity"
+	InstanceIDs []string // The instances it would have acted on, if any
+	Detail      string   // What it would have done, e.g. "desired 5" or a command's comment
+}
+
+func (a ShadowAction) String() string {
+	if len(a.InstanceIDs) == 0 {
+		return fmt.Sprintf("%s (%s)", a.Call, a.Detail)
+	}
+	return fmt.Sprintf("%s on %v (%s)", a.Call, a.InstanceIDs, a.Detail)
+}
+
+// shadowLog collects the actions of a shadow Scaler's Run. The shadow clients
+// share it, and may record concurrently while agents are signalled.
+type shadowLog struct {
+	mu       sync.Mutex
+	actions  []ShadowAction
+	commands map[string][]string // Instances targeted by each pretend command
+	seq      int
+}
+
+func (l *shadowLog) record(ctx context.Context, action ShadowAction) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.actions = append(l.actions, action)
+	logging.FromContext(ctx).Info("👻 [Shadow] Would call", "call", action.Call, "action", action.String())
+}
+
+// take returns the actions recorded since the last take.
+func (l *shadowLog) take() []ShadowAction {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	actions := l.actions
+	l.actions = nil
+	return actions
+}
+
+// wrap replaces the AWS clients in o with shadow clients, which pass reads
+// through to the real ones and record changes instead of making them.
+func (l *shadowLog) wrap(o *options, cfg aws.Config) {
+	if o.autoscaling == nil {
+		o.autoscaling = autoscaling.NewFromConfig(cfg)
+	}
+	if o.ec2 == nil {
+		o.ec2 = ec2.NewFromConfig(cfg)
+	}
+	if o.ssm == nil {
+		o.ssm = ssm.NewFromConfig(cfg)
+	}
+	o.autoscaling = &shadowAutoScaling{AutoScalingAPI: o.autoscaling, log: l}
+	o.ec2 = &shadowEC2{EC2API: o.ec2, log: l}
+	o.ssm = &shadowSSM{SSMAPI: o.ssm, log: l}
+}
+
+type shadowAutoScaling struct {
+	AutoScalingAPI
+	log *shadowLog
+}
+
+func (c *shadowAutoScaling) SetDesiredCapacity(ctx context.Context, params *autoscaling.SetDesiredCapacityInput, _ ...func(*autoscaling.Options)) (*autoscaling.SetDesiredCapacityOutput, error) {
+	c.log.record(ctx, ShadowAction{
+		Call:   "SetDesiredCapacity",
+		Detail: fmt.Sprintf("desired %d", aws.ToInt32(params.DesiredCapacity)),
+	})
+	return &autoscaling.SetDesiredCapacityOutput{}, nil
+}
+
+func (c *shadowAutoScaling) SetInstanceHealth(ctx context.Context, params *autoscaling.SetInstanceHealthInput, _ ...func(*autoscaling.Options)) (*autoscaling.SetInstanceHealthOutput, error) {
+	c.log.record(ctx, ShadowAction{
+		Call:        "SetInstanceHealth",
+		InstanceIDs: []string{aws.ToString(params.InstanceId)},
+		Detail:      aws.ToString(params.HealthStatus),
+	})
+	return &autoscaling.SetInstanceHealthOutput{}, nil
+}
+
+func (c *shadowAutoScaling) CreateOrUpdateTags(ctx context.Context, params *autoscaling.CreateOrUpdateTagsInput, _ ...func(*autoscaling.Options)) (*autoscaling.CreateOrUpdateTagsOutput, error) {
+	var tags []string
+	for _, t := range params.Tags {
+		tags = append(tags, aws.ToString(t.Key)+"="+aws.ToString(t.Value))
+	}
+	c.log.record(ctx, ShadowAction{Call: "CreateOrUpdateTags", Detail: strings.Join(tags, ", ")})
+	return &autoscaling.CreateOrUpdateTagsOutput{}, nil
+}
+
+func (c *shadowAutoScaling) DetachInstances(ctx context.Context, params *autoscaling.DetachInstancesInput, _ ...func(*autoscaling.Options)) (*autoscaling.DetachInstancesOutput, error) {
+	c.log.record(ctx, ShadowAction{
+		Call:        "DetachInstances",
+		InstanceIDs: params.InstanceIds,
+		Detail:      fmt.Sprintf("decrement desired %t", aws.ToBool(params.ShouldDecrementDesiredCapacity)),
+	})
+	return &autoscaling.DetachInstancesOutput{}, nil
+}
+
+type shadowEC2 struct {
+	EC2API
+	log *shadowLog
+}
+
+func (c *shadowEC2) CreateTags(ctx context.Context, params *ec2.CreateTagsInput, _ ...func(*ec2.Options)) (*ec2.CreateTagsOutput, error) {
+	var tags []string
+	for _, t := range params.Tags {
+		tags = append(tags, aws.ToString(t.Key)+"="+aws.ToString(t.Value))
+	}
+	c.log.record(ctx, ShadowAction{Call: "CreateTags", InstanceIDs: params.Resources, Detail: strings.Join(tags, ", ")})
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+func (c *shadowEC2) DeleteTags(ctx context.Context, params *ec2.DeleteTagsInput, _ ...func(*ec2.Options)) (*ec2.DeleteTagsOutput, error) {
+	var tags []string
+	for _, t := range params.Tags {
+		tags = append(tags, aws.ToString(t.Key))
+	}
+	c.log.record(ctx, ShadowAction{Call: "DeleteTags", InstanceIDs: params.Resources, Detail: strings.Join(tags, ", ")})
+	return &ec2.DeleteTagsOutput{}, nil
+}
+
+func (c *shadowEC2) TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, _ ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error) {
+	c.log.record(ctx, ShadowAction{Call: "TerminateInstances", InstanceIDs: params.InstanceIds, Detail: "terminate"})
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
+// shadowSSM sends the commands that check whether agents are running, and
+// pretends to send the rest, e.g. the commands that stop agents. Pretend
+// commands succeed at once on every instance they target.
+type shadowSSM struct {
+	SSMAPI
+	log *shadowLog
+}
+
+func (c *shadowSSM) SendCommand(ctx context.Context, params *ssm.SendCommandInput, optFns ...func(*ssm.Options)) (*ssm.SendCommandOutput, error) {
+	if aws.ToString(params.Comment) == checkCommandComment {
+		return c.SSMAPI.SendCommand(ctx, params, optFns...)
+	}
+
+	c.log.record(ctx, ShadowAction{
+		Call:        "SendCommand",
+		InstanceIDs: params.InstanceIds,
+		Detail:      fmt.Sprintf("%s: %s", aws.ToString(params.DocumentName), aws.ToString(params.Comment)),
+	})
+	c.log.mu.Lock()
+	defer c.log.mu.Unlock()
+	c.log.seq++
+	id := fmt.Sprintf("%s%d", shadowCommandPrefix, c.log.seq)
+	if c.log.commands == nil {
+		c.log.commands = make(map[string][]string)
+	}
+	c.log.commands[id] = slices.Clone(params.InstanceIds)
+	return &ssm.SendCommandOutput{
+		Command: &ssmTypes.Command{CommandId: aws.String(id), InstanceIds: params.InstanceIds},
+	}, nil
+}
+
+func (c *shadowSSM) ListCommandInvocations(ctx context.Context, params *ssm.ListCommandInvocationsInput, optFns ...func(*ssm.Options)) (*ssm.ListCommandInvocationsOutput, error) {
+	id := aws.ToString(params.CommandId)
+	if !strings.HasPrefix(id, shadowCommandPrefix) {
+		return c.SSMAPI.ListCommandInvocations(ctx, params, optFns...)
+	}
+
+	c.log.mu.Lock()
+	defer c.log.mu.Unlock()
+	out := &ssm.ListCommandInvocationsOutput{}
+	for _, instanceID := range c.log.commands[id] {
+		out.CommandInvocations = append(out.CommandInvocations, ssmTypes.CommandInvocation{
+			CommandId:  aws.String(id),
+			InstanceId: aws.String(instanceID),
+			Status:     ssmTypes.CommandInvocationStatusSuccess,
+		})
+	}
+	return out, nil
+}
+
+// shadowSummary counts actions by call, e.g. "SendCommand=2 SetDesiredCapacity=1".
+func shadowSummary(actions []ShadowAction) string {
+	counts := make(map[string]int)
+	for _, a := range actions {
+		counts[a.Call]++
+	}
+	var parts []string
+	for _, call := range slices.Sorted(maps.Keys(counts)) {
+		parts = append(parts, fmt.Sprintf("%s=%d", call, counts[call]))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,123 @@
+package scaler
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+)
+
+func TestShadowScaleInMakesNoChanges(t *testing.T) {
+	now := time.Now()
+	fake := &fakeAWS{desired: 3, launched: map[string]time.Time{
+		"i-a": now.Add(-10 * time.Minute),
+		"i-b": now.Add(-30 * time.Minute), // Oldest
+		"i-c": now.Add(-20 * time.Minute),
+	}}
+
+	s, err := NewScaler(nil, aws.Config{}, Params{
+		AutoScalingGroupName:      "agents",
+		AgentsPerInstance:         1,
+		ElasticCIMode:             true,
+		MinimumInstanceUptime:     time.Hour, // Too young for the dangling check
+		ExternalChangeGracePeriod: time.Hour,
+		Shadow:                    true,
+	}, WithAutoScalingClient(fake), WithEC2Client(fake), WithSSMClient(fake))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.bk = &buildkiteTestDriver{metrics: buildkite.AgentMetrics{
+		OrgSlug:     "llamacorp",
+		RunningJobs: 2,
+		BusyAgents:  2,
+		IdleAgents:  1,
+		TotalAgents: 3,
+	}}
+
+	// The second run sees the ASG's unchanged desired capacity, which would
+	// look like a manual override if detection weren't disabled
+	for range 2 {
+		if _, err := s.Run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(fake.desiredSets) > 0 || len(fake.signalled) > 0 || len(fake.tags) > 0 {
+		t.Errorf("shadow changed the ASG: desired sets %v, signalled %v, tags %v", fake.desiredSets, fake.signalled, fake.tags)
+	}
+	d := s.LastDecision()
+	if d.Action != ActionScaleIn || d.Desired != 2 {
+		t.Errorf("decision = %s to %d, want scale-in to 2", d.Action, d.Desired)
+	}
+	var calls []string
+	for _, a := range d.Shadow {
+		calls = append(calls, a.Call)
+		if a.Call == "SendCommand" && !slices.Equal(a.InstanceIDs, []string{"i-b"}) {
+			t.Errorf("would have stopped agents on %v, want the oldest instance i-b", a.InstanceIDs)
+		}
+	}
+	for _, want := range []string{"SetDesiredCapacity", "SendCommand", "CreateOrUpdateTags"} {
+		if !slices.Contains(calls, want) {
+			t.Errorf("shadow actions %v, want %s", calls, want)
+		}
+	}
+	if len(d.Signals) != 1 || d.Signals[0].Outcome != SignalSent {
+		t.Errorf("decision signals = %+v, want i-b signalled", d.Signals)
+	}
+}
+
+func TestShadowSSMSendsOnlyChecks(t *testing.T) {
+	fake := &fakeAWS{}
+	l := &shadowLog{}
+	c := &shadowSSM{SSMAPI: fake, log: l}
+	ctx := context.Background()
+
+	if _, err := c.SendCommand(ctx, &ssm.SendCommandInput{
+		InstanceIds: []string{"i-a"},
+		Comment:     aws.String(checkCommandComment),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	out, err := c.SendCommand(ctx, &ssm.SendCommandInput{
+		DocumentName: aws.String("AWS-RunShellScript"),
+		InstanceIds:  []string{"i-b", "i-c"},
+		Comment:      aws.String("Gracefully stop Buildkite agent"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(fake.signalled) != 1 || !slices.Equal(fake.signalled[0], []string{"i-a"}) {
+		t.Errorf("sent commands to %v, want only the check to i-a", fake.signalled)
+	}
+	invocations, err := c.ListCommandInvocations(ctx, &ssm.ListCommandInvocationsInput{CommandId: out.Command.CommandId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var succeeded []string
+	for _, inv := range invocations.CommandInvocations {
+		if inv.Status == ssmTypes.CommandInvocationStatusSuccess {
+			succeeded = append(succeeded, aws.ToString(inv.InstanceId))
+		}
+	}
+	if !slices.Equal(succeeded, []string{"i-b", "i-c"}) {
+		t.Errorf("pretend command succeeded on %v, want i-b and i-c", succeeded)
+	}
+	if actions := l.take(); len(actions) != 1 || actions[0].Call != "SendCommand" {
+		t.Errorf("recorded %+v, want the stop command", actions)
+	}
+	if actions := l.take(); len(actions) != 0 {
+		t.Errorf("recorded %+v after take, want none", actions)
+	}
+}
+
+func TestShadowAndDryRunAreExclusive(t *testing.T) {
+	if _, err := NewScaler(nil, aws.Config{}, Params{Shadow: true, DryRun: true}); err == nil {
+		t.Error("NewScaler with Shadow and DryRun succeeded, want an error")
+	}
+}
@@ -0,0 +1,260 @@
+package scaler
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/buildkite/buildkite-agent-scaler/logging"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Outcomes of signalling the agents on an instance to stop.
+const (
+	SignalSent       = "signalled"
+	SignalSSMOffline = "ssm-offline"
+	SignalFailed     = "failed"
+	SignalTimedOut   = "deadline-exceeded"
+)
+
+const (
+	defaultSignalConcurrency = 10
+	defaultSignalDeadline    = 2 * time.Minute
+
+	// SendCommand targets at most 50 instances
+	sendCommandMaxTargets = 50
+)
+
+// SignalOutcome is what happened when the scaler asked the agents on an
+// instance to stop.
+type SignalOutcome struct {
+	InstanceID string
+	Outcome    string // One of the Signal constants
+	Error      string
+}
+
+// SignalParams bounds how long and how widely the scaler signals agents.
+type SignalParams struct {
+	Concurrency int           // SendCommand batches in flight at once (default 10)
+	Deadline    time.Duration // Overall time allowed for signalling (default 2m)
+}
+
+// signalBatch is instances that get the same stop command, and pre-stop
+// commands if any, so one SendCommand covers them all.
+type signalBatch struct {
+	instanceIDs []string
+	preStop     *ssm.SendCommandInput
+	stop        *ssm.SendCommandInput
+}
+
+// SignalAgents asks the agents on each instance to finish their current job
+// and stop, using the stop procedure. It reads the instances' platforms and SSM
+// status from inv, taking an inventory of just these instances if inv is nil,
+// then sends the commands in batches of up to 50 instances, with bounded
+// concurrency and an overall deadline.
+func (a *ASGDriver) SignalAgents(ctx context.Context, inv *InstanceInventory, instanceIDs []string) []SignalOutcome {
+	return a.signalAgents(ctx, a.ec2Client(), a.ssmClient(), inv, instanceIDs)
+}
+
+func (a *ASGDriver) signalAgents(ctx context.Context, ec2Svc describeInstancesAPI, ssmSvc ssmCheckAPI, inv *InstanceInventory, instanceIDs []string) []SignalOutcome {
+	if len(instanceIDs) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, cmp.Or(a.Signal.Deadline, defaultSignalDeadline))
+	defer cancel()
+
+	outcomes := make(map[string]SignalOutcome, len(instanceIDs))
+	record := func(ids []string, outcome string, err error) {
+		for _, id := range ids {
+			o := SignalOutcome{InstanceID: id, Outcome: outcome}
+			if err != nil {
+				o.Error = err.Error()
+			}
+			outcomes[id] = o
+		}
+	}
+	result := func() []SignalOutcome {
+		var results []SignalOutcome
+		for _, id := range instanceIDs {
+			results = append(results, outcomes[id])
+		}
+		return results
+	}
+
+	if inv == nil {
+		asg := AutoscaleGroupDetails{InstanceIDs: instanceIDs}
+		for _, id := range instanceIDs {
+			asg.Instances = append(asg.Instances, InstanceDetails{ID: id})
+		}
+		var err error
+		if inv, err = a.inventory(ctx, ec2Svc, ssmSvc, asg); err != nil {
+			record(instanceIDs, SignalFailed, err)
+			return result()
+		}
+	}
+
+	var online []string
+	platforms := make(map[string]string, len(instanceIDs))
+	for _, id := range instanceIDs {
+		instance, ok := inv.Get(id)
+		// Try instances whose ping status is unknown, SendCommand fails if
+		// they're offline
+		if !ok || !instance.SSMOnline() && instance.SSMPingStatus != ssmPingStatusUnknown {
+			record([]string{id}, SignalSSMOffline, nil)
+			continue
+		}
+		online = append(online, id)
+		platforms[id] = instance.Platform
+	}
+
+	batches, err := a.signalBatches(online, platforms)
+	if err != nil {
+		record(online, SignalFailed, err)
+		return result()
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, cmp.Or(a.Signal.Concurrency, defaultSignalConcurrency))
+	for _, batch := range batches {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			// Batches still in flight record their outcomes too
+			mu.Lock()
+			record(batch.instanceIDs, SignalTimedOut, ctx.Err())
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			outcome, err := SignalSent, a.sendSignalBatch(ctx, ssmSvc, batch)
+			if err != nil {
+				outcome = SignalFailed
+				if ctx.Err() != nil {
+					outcome = SignalTimedOut
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			record(batch.instanceIDs, outcome, err)
+		}()
+	}
+	wg.Wait()
+
+	return result()
+}
+
+// signalBatches groups instances by the commands they need, in chunks of at
+// most sendCommandMaxTargets instances. The built-in commands are the same
+// for every instance on a platform, so they batch well. Templates using
+// {{.InstanceID}} need a command per instance.
+func (a *ASGDriver) signalBatches(instanceIDs []string, platforms map[string]string) ([]signalBatch, error) {
+	groups := make(map[string]*signalBatch)
+	var order []string
+	for _, id := range instanceIDs {
+		vars := StopVars{InstanceID: id, ASGName: a.Name, Platform: cmp.Or(platforms[id], "linux"), Region: a.Cfg.Region}
+		stop, err := a.StopProcedure.stopCommandInput(vars)
+		if err != nil {
+			return nil, err
+		}
+		preStop, err := a.StopProcedure.preStopCommandInput(vars)
+		if err != nil {
+			return nil, err
+		}
+
+		key := commandKey(stop) + "\x00" + commandKey(preStop)
+		group, ok := groups[key]
+		if !ok {
+			group = &signalBatch{stop: stop, preStop: preStop}
+			groups[key] = group
+			order = append(order, key)
+		}
+		group.instanceIDs = append(group.instanceIDs, id)
+	}
+
+	var batches []signalBatch
+	for _, key := range order {
+		group := groups[key]
+		for chunk := range slices.Chunk(group.instanceIDs, sendCommandMaxTargets) {
+			batches = append(batches, signalBatch{instanceIDs: chunk, preStop: group.preStop, stop: group.stop})
+		}
+	}
+	return batches, nil
+}
+
+func commandKey(input *ssm.SendCommandInput) string {
+	if input == nil {
+		return ""
+	}
+	key := aws.ToString(input.DocumentName)
+	for _, k := range slices.Sorted(maps.Keys(input.Parameters)) {
+		key += "\x00" + k + "=" + strings.Join(input.Parameters[k], "\x00")
+	}
+	return key
+}
+
+// sendSignalBatch runs the batch's pre-stop commands and waits for them, then
+// sends the stop command.
+func (a *ASGDriver) sendSignalBatch(ctx context.Context, ssmSvc ssmCheckAPI, batch signalBatch) (err error) {
+	ctx, span := startSpan(ctx, "scaler.SignalBatch", attribute.StringSlice("scaler.instances", batch.instanceIDs))
+	defer func() { endSpan(span, err) }()
+
+	logger := logging.FromContext(ctx)
+	if batch.preStop != nil {
+		preStop := *batch.preStop
+		preStop.InstanceIds = batch.instanceIDs
+		out, err := ssmSvc.SendCommand(ctx, &preStop)
+		if err != nil {
+			logger.Warn("⚠️  Failed to run pre-stop commands", "instances", batch.instanceIDs, "error", err)
+		} else {
+			// Leave at least half the remaining time for the stop command
+			pollDeadline := cmp.Or(a.ssmPollDeadline, 60*time.Second)
+			if deadline, ok := ctx.Deadline(); ok {
+				pollDeadline = min(pollDeadline, time.Until(deadline)/2)
+			}
+			a.sleep(ctx, cmp.Or(a.ssmRegistrationDelay, 3*time.Second))
+			results, err := pollCommandInvocations(ctx, orWallClock(a.clock), ssmSvc, []string{aws.ToString(out.Command.CommandId)}, len(batch.instanceIDs),
+				cmp.Or(a.ssmPollInterval, 3*time.Second), pollDeadline)
+			if err != nil {
+				logger.Warn("⚠️  Failed to wait for pre-stop commands", "instances", batch.instanceIDs, "error", err)
+			}
+			for _, id := range batch.instanceIDs {
+				if inv, ok := results[id]; !ok || inv.Status != ssmTypes.CommandInvocationStatusSuccess {
+					logger.Warn("⚠️  Pre-stop commands did not succeed, stopping the agent anyway", "instance", id, "status", inv.Status)
+				}
+			}
+		}
+	}
+
+	stop := *batch.stop
+	stop.InstanceIds = batch.instanceIDs
+	logger.Info("Stopping agents", "instances", batch.instanceIDs, "document", aws.ToString(stop.DocumentName))
+	if _, err := ssmSvc.SendCommand(ctx, &stop); err != nil {
+		logger.Warn("Failed to stop agents", "instances", batch.instanceIDs, "document", aws.ToString(stop.DocumentName), "error", err)
+		return err
+	}
+	return nil
+}
+
+// signalSummary counts outcomes, e.g. "signalled=3 ssm-offline=1".
+func signalSummary(outcomes []SignalOutcome) string {
+	counts := make(map[string]int)
+	for _, o := range outcomes {
+		counts[o.Outcome]++
+	}
+	var parts []string
+	for _, outcome := range slices.Sorted(maps.Keys(counts)) {
+		parts = append(parts, fmt.Sprintf("%s=%d", outcome, counts[outcome]))
+	}
+	return strings.Join(parts, " ")
+}
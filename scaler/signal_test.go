@@ -0,0 +1,113 @@
+package scaler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmTypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+func onlineSSMStub(ids ...string) *stubSSMClient {
+	var list []ssmTypes.InstanceInformation
+	for _, id := range ids {
+		list = append(list, ssmTypes.InstanceInformation{InstanceId: aws.String(id), PingStatus: ssmTypes.PingStatusOnline})
+	}
+	return &stubSSMClient{describeOut: &ssm.DescribeInstanceInformationOutput{InstanceInformationList: list}}
+}
+
+func TestSignalAgentsBatchesSendCommand(t *testing.T) {
+	var ids []string
+	for i := range 51 {
+		ids = append(ids, fmt.Sprintf("i-%02d", i))
+	}
+	ssmStub := onlineSSMStub(ids[:50]...)
+	// Serial sends, as the stub isn't safe for concurrent use
+	driver := &ASGDriver{Name: "agents", Signal: SignalParams{Concurrency: 1}}
+
+	outcomes := driver.signalAgents(context.Background(), &stubDescribeInstancesClient{}, ssmStub, nil, ids)
+
+	if len(ssmStub.sendBatches) != 1 || len(ssmStub.sendBatches[0]) != 50 {
+		t.Errorf("SendCommand batches = %d, want one of 50 instances", len(ssmStub.sendBatches))
+	}
+	if len(outcomes) != len(ids) {
+		t.Fatalf("got %d outcomes, want %d", len(outcomes), len(ids))
+	}
+	for i, o := range outcomes {
+		want := SignalSent
+		if i == 50 {
+			want = SignalSSMOffline
+		}
+		if o.InstanceID != ids[i] || o.Outcome != want {
+			t.Errorf("outcomes[%d] = %+v, want %s for %s", i, o, want, ids[i])
+		}
+	}
+	if got, want := signalSummary(outcomes), "signalled=50 ssm-offline=1"; got != want {
+		t.Errorf("signalSummary() = %q, want %q", got, want)
+	}
+}
+
+func TestSignalAgentsPerInstanceCommands(t *testing.T) {
+	ssmStub := onlineSSMStub("i-a", "i-b")
+	driver := &ASGDriver{
+		Name:          "agents",
+		StopProcedure: StopProcedure{Command: "drain {{.InstanceID}}"},
+		Signal:        SignalParams{Concurrency: 1},
+	}
+
+	driver.signalAgents(context.Background(), &stubDescribeInstancesClient{}, ssmStub, nil, []string{"i-a", "i-b"})
+
+	// The command differs per instance, so it can't be batched
+	if len(ssmStub.sendBatches) != 2 {
+		t.Errorf("SendCommand batches = %v, want one per instance", ssmStub.sendBatches)
+	}
+}
+
+func TestSignalAgentsSendCommandFails(t *testing.T) {
+	ssmStub := onlineSSMStub("i-a")
+	ssmStub.sendErr = errors.New("throttled")
+	driver := &ASGDriver{Name: "agents", Signal: SignalParams{Concurrency: 1}}
+
+	outcomes := driver.signalAgents(context.Background(), &stubDescribeInstancesClient{}, ssmStub, nil, []string{"i-a"})
+
+	if len(outcomes) != 1 || outcomes[0].Outcome != SignalFailed || outcomes[0].Error != "throttled" {
+		t.Errorf("outcomes = %+v, want i-a failed with the SendCommand error", outcomes)
+	}
+}
+
+// blockingSSMClient's SendCommand doesn't return until its context is done.
+type blockingSSMClient struct {
+	*stubSSMClient
+}
+
+func (blockingSSMClient) SendCommand(ctx context.Context, _ *ssm.SendCommandInput, _ ...func(*ssm.Options)) (*ssm.SendCommandOutput, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestSignalAgentsDeadline(t *testing.T) {
+	ids := []string{"i-a", "i-b", "i-c"}
+	ssmStub := blockingSSMClient{onlineSSMStub(ids...)}
+	// A command per instance, one at a time, so the deadline passes with
+	// one batch in flight and the rest waiting
+	driver := &ASGDriver{
+		Name:          "agents",
+		StopProcedure: StopProcedure{Command: "drain {{.InstanceID}}"},
+		Signal:        SignalParams{Concurrency: 1, Deadline: 20 * time.Millisecond},
+	}
+
+	outcomes := driver.signalAgents(context.Background(), &stubDescribeInstancesClient{}, ssmStub, nil, ids)
+
+	if len(outcomes) != len(ids) {
+		t.Fatalf("got %d outcomes, want %d", len(outcomes), len(ids))
+	}
+	for i, o := range outcomes {
+		if o.InstanceID != ids[i] || o.Outcome != SignalTimedOut {
+			t.Errorf("outcomes[%d] = %+v, want %s timed out", i, o, ids[i])
+		}
+	}
+}
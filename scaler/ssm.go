@@ -7,9 +7,10 @@ import (
 	"github.com/aws/aws-sdk-go-v2/service/ssm"
 )
 
-func RetrieveFromParameterStore(cfg aws.Config, key string) (string, error) {
-	ssmClient := ssm.NewFromConfig(cfg)
-	output, err := ssmClient.GetParameter(context.TODO(), &ssm.GetParameterInput{
+// RetrieveFromParameterStore reads a parameter, decrypting it if it's a
+// SecureString.
+func RetrieveFromParameterStore(ctx context.Context, client SSMAPI, key string) (string, error) {
+	output, err := client.GetParameter(ctx, &ssm.GetParameterInput{
 		Name:           aws.String(key),
 		WithDecryption: aws.Bool(true),
 	})
@@ -0,0 +1,189 @@
+package scaler
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// StopProcedure configures how SignalAgents stops the agents on an
+// instance being scaled in. The zero value uses the built-in commands:
+// systemctl on Linux and nssm on Windows.
+//
+// Command, PreStopCommands and DocumentParameters values are text/template
+// templates, with the fields of StopVars, e.g. "{{.InstanceID}}".
+type StopProcedure struct {
+	Document           string            // SSM document to run instead of a command, e.g. "MyOrg-StopBuildkiteAgent"
+	DocumentParameters map[string]string // Parameters for Document
+	Command            string            // Command to run instead of the built-in one, with AWS-RunShellScript or AWS-RunPowerShellScript
+	PreStopCommands    []string          // Commands run before the agent is stopped, e.g. to flush caches
+}
+
+// StopVars are the variables available to StopProcedure templates.
+type StopVars struct {
+	InstanceID string
+	ASGName    string
+	Platform   string // "linux" or "windows"
+	Region     string
+}
+
+// ParseStopProcedure builds a StopProcedure from its environment variable or
+// flag form: document parameters as key=value pairs separated by newlines or
+// commas, and one pre-stop command per line. It checks that the templates
+// parse.
+func ParseStopProcedure(document, documentParameters, command, preStopCommands string) (StopProcedure, error) {
+	p := StopProcedure{
+		Document: document,
+		Command:  command,
+	}
+	if documentParameters != "" {
+		p.DocumentParameters = parseRuntimeConfig(slog.Default(), documentParameters)
+	}
+	for _, line := range strings.Split(preStopCommands, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			p.PreStopCommands = append(p.PreStopCommands, line)
+		}
+	}
+	if p.Document != "" && p.Command != "" {
+		return StopProcedure{}, fmt.Errorf("stop document %q and stop command are mutually exclusive", p.Document)
+	}
+
+	// Render with placeholder values to catch template errors at startup
+	vars := StopVars{InstanceID: "i-0123456789abcdef0", ASGName: "asg", Platform: "linux", Region: "us-east-1"}
+	templates := append([]string{p.Command}, p.PreStopCommands...)
+	for _, v := range p.DocumentParameters {
+		templates = append(templates, v)
+	}
+	for _, t := range templates {
+		if _, err := renderStopTemplate(t, vars); err != nil {
+			return StopProcedure{}, err
+		}
+	}
+	return p, nil
+}
+
+func renderStopTemplate(text string, vars StopVars) (string, error) {
+	t, err := template.New("stop").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid stop procedure template %q: %w", text, err)
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("invalid stop procedure template %q: %w", text, err)
+	}
+	return b.String(), nil
+}
+
+// markerCommand returns the command that writes the termination marker,
+// keeping the time of the first request if it's already there. The scaler
+// writes it before any stop procedure runs, so the dangling instance check
+// leaves agents that are finishing their job alone.
+func markerCommand(platform string) string {
+	if platform == "windows" {
+		return `$Marker = "C:\buildkite-agent-termination-marker"
+if (-not (Test-Path $Marker)) { Set-Content -Path $Marker -Value "Termination requested at $(Get-Date -Format o)" }`
+	}
+	return `[ -f /tmp/buildkite-agent-termination-marker ] || echo "Termination requested at $(date)" > /tmp/buildkite-agent-termination-marker`
+}
+
+// defaultStopCommand returns the built-in stop command for the platform.
+// With consecutive Lambda invocations selecting the same instance for
+// scale-in, only the first actually signals the agent to finish its current
+// job and stop.
+func defaultStopCommand(platform string) string {
+	if platform == "windows" {
+		return `
+$Requested = "C:\buildkite-agent-stop-requested"
+if (Test-Path $Requested) {
+    Write-Output "Stop already requested, skipping"
+    exit 0
+}
+Set-Content -Path $Requested -Value "Stop requested at $(Get-Date -Format o)"
+# nssm stops a service by sending Ctrl+C, which the agent treats like SIGTERM,
+# but only waits 1.5s by default before killing it. Give the current job up to
+# 2h to finish instead, and don't wait for nssm here.
+nssm set buildkite-agent AppStopMethodConsole 7200000
+Start-Process -FilePath nssm -ArgumentList "stop", "buildkite-agent" -WindowStyle Hidden
+`
+	}
+
+	return `
+if [ -f /tmp/buildkite-agent-stop-requested ]; then
+  echo "Stop already requested, skipping"
+  exit 0
+fi
+echo "Stop requested at $(date)" > /tmp/buildkite-agent-stop-requested
+sudo systemctl stop buildkite-agent.service || sudo /opt/buildkite-agent/bin/buildkite-agent stop --signal SIGTERM
+`
+}
+
+// stopCommandInput builds the SendCommand input that stops the agents on an
+// instance.
+func (p StopProcedure) stopCommandInput(vars StopVars) (*ssm.SendCommandInput, error) {
+	input := &ssm.SendCommandInput{
+		InstanceIds: []string{vars.InstanceID},
+		Comment:     aws.String("Gracefully stop Buildkite agent"),
+	}
+
+	if p.Document != "" {
+		input.DocumentName = aws.String(p.Document)
+		input.Parameters = make(map[string][]string, len(p.DocumentParameters))
+		for _, k := range slices.Sorted(maps.Keys(p.DocumentParameters)) {
+			v, err := renderStopTemplate(p.DocumentParameters[k], vars)
+			if err != nil {
+				return nil, err
+			}
+			input.Parameters[k] = []string{v}
+		}
+		return input, nil
+	}
+
+	command := defaultStopCommand(vars.Platform)
+	if p.Command != "" {
+		var err error
+		if command, err = renderStopTemplate(p.Command, vars); err != nil {
+			return nil, err
+		}
+	}
+	input.DocumentName = aws.String(shellDocument(vars.Platform))
+	input.Parameters = map[string][]string{"commands": {markerCommand(vars.Platform) + "\n" + command}}
+	return input, nil
+}
+
+func shellDocument(platform string) string {
+	if platform == "windows" {
+		return "AWS-RunPowerShellScript"
+	}
+	return "AWS-RunShellScript"
+}
+
+// preStopCommandInput builds the SendCommand input that writes the
+// termination marker and runs the pre-stop commands on an instance. It
+// returns nil if there are no pre-stop commands and the stop command writes
+// the marker itself, i.e. unless the stop procedure is a document.
+func (p StopProcedure) preStopCommandInput(vars StopVars) (*ssm.SendCommandInput, error) {
+	if len(p.PreStopCommands) == 0 && p.Document == "" {
+		return nil, nil
+	}
+	commands := []string{markerCommand(vars.Platform)}
+	for _, c := range p.PreStopCommands {
+		rendered, err := renderStopTemplate(c, vars)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, rendered)
+	}
+	return &ssm.SendCommandInput{
+		InstanceIds:  []string{vars.InstanceID},
+		DocumentName: aws.String(shellDocument(vars.Platform)),
+		Parameters:   map[string][]string{"commands": commands},
+		Comment:      aws.String("Buildkite agent pre-stop hooks"),
+	}, nil
+}
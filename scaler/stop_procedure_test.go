@@ -0,0 +1,130 @@
+package scaler
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestParseStopProcedure(t *testing.T) {
+	p, err := ParseStopProcedure("", "", "", "sync\n\n  /usr/local/bin/flush-cache {{.InstanceID}}  \n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.PreStopCommands) != 2 || p.PreStopCommands[1] != "/usr/local/bin/flush-cache {{.InstanceID}}" {
+		t.Errorf("PreStopCommands = %q", p.PreStopCommands)
+	}
+
+	for _, tc := range []struct {
+		name                                 string
+		document, parameters, command, hooks string
+	}{
+		{name: "document and command", document: "Stop", command: "stop"},
+		{name: "unknown variable", command: "stop {{.Nope}}"},
+		{name: "unclosed action", hooks: "flush {{.InstanceID"},
+		{name: "bad document parameter", document: "Stop", parameters: "InstanceId={{.Instance}}"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := ParseStopProcedure(tc.document, tc.parameters, tc.command, tc.hooks); err == nil {
+				t.Error("ParseStopProcedure() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestStopCommandInput(t *testing.T) {
+	linux := StopVars{InstanceID: "i-123", ASGName: "agents", Platform: "linux", Region: "us-east-1"}
+	windows := StopVars{InstanceID: "i-456", ASGName: "agents", Platform: "windows", Region: "us-east-1"}
+
+	for _, tc := range []struct {
+		name         string
+		procedure    StopProcedure
+		vars         StopVars
+		wantDocument string
+		wantParam    string // "key=substring" expected in the parameters
+	}{
+		{
+			name:         "built-in linux",
+			vars:         linux,
+			wantDocument: "AWS-RunShellScript",
+			wantParam:    "commands=systemctl stop buildkite-agent",
+		},
+		{
+			name:         "built-in windows",
+			vars:         windows,
+			wantDocument: "AWS-RunPowerShellScript",
+			wantParam:    "commands=nssm set buildkite-agent AppStopMethodConsole",
+		},
+		{
+			name:         "custom command",
+			procedure:    StopProcedure{Command: "drain --instance {{.InstanceID}} --asg {{.ASGName}}"},
+			vars:         linux,
+			wantDocument: "AWS-RunShellScript",
+			wantParam:    "commands=drain --instance i-123 --asg agents",
+		},
+		{
+			name:         "document",
+			procedure:    StopProcedure{Document: "MyOrg-StopAgent", DocumentParameters: map[string]string{"Target": "{{.Platform}}/{{.InstanceID}}"}},
+			vars:         windows,
+			wantDocument: "MyOrg-StopAgent",
+			wantParam:    "Target=windows/i-456",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			input, err := tc.procedure.stopCommandInput(tc.vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := aws.ToString(input.DocumentName); got != tc.wantDocument {
+				t.Errorf("DocumentName = %q, want %q", got, tc.wantDocument)
+			}
+			key, want, _ := strings.Cut(tc.wantParam, "=")
+			if got := input.Parameters[key]; len(got) != 1 || !strings.Contains(got[0], want) {
+				t.Errorf("Parameters[%q] = %q, want it to contain %q", key, got, want)
+			}
+		})
+	}
+}
+
+func TestStopProcedureWritesMarker(t *testing.T) {
+	linux := StopVars{InstanceID: "i-123", ASGName: "agents", Platform: "linux", Region: "us-east-1"}
+	windows := StopVars{InstanceID: "i-456", ASGName: "agents", Platform: "windows", Region: "us-east-1"}
+
+	for _, tc := range []struct {
+		name        string
+		procedure   StopProcedure
+		vars        StopVars
+		wantMarker  string // Input expected to write the marker: "stop" or "pre-stop"
+		wantPreStop bool
+	}{
+		{name: "built-in linux", vars: linux, wantMarker: "stop"},
+		{name: "built-in windows", vars: windows, wantMarker: "stop"},
+		{name: "custom command", procedure: StopProcedure{Command: "drain"}, vars: linux, wantMarker: "stop"},
+		{name: "pre-stop commands", procedure: StopProcedure{PreStopCommands: []string{"sync"}}, vars: linux, wantMarker: "pre-stop", wantPreStop: true},
+		{name: "document", procedure: StopProcedure{Document: "MyOrg-StopAgent"}, vars: windows, wantMarker: "pre-stop", wantPreStop: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stop, err := tc.procedure.stopCommandInput(tc.vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			preStop, err := tc.procedure.preStopCommandInput(tc.vars)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (preStop != nil) != tc.wantPreStop {
+				t.Fatalf("preStopCommandInput() = %v, want pre-stop commands %t", preStop, tc.wantPreStop)
+			}
+
+			input := stop
+			if tc.wantMarker == "pre-stop" {
+				input = preStop
+			}
+			commands := input.Parameters["commands"]
+			if len(commands) == 0 || !strings.HasPrefix(commands[0], markerCommand(tc.vars.Platform)) {
+				t.Errorf("%s commands = %q, want them to start by writing the termination marker", tc.wantMarker, commands)
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package scaler
+
+import (
+	"context"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/smithy-go/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/buildkite/buildkite-agent-scaler/scaler"
+
+// Attributes set on the scaler's spans.
+const (
+	attrQueue   = attribute.Key("buildkite.queue")
+	attrOrg     = attribute.Key("buildkite.org")
+	attrASG     = attribute.Key("aws.autoscaling.group")
+	attrConfig  = attribute.Key("scaler.config")
+	attrAction  = attribute.Key("scaler.action")
+	attrReason  = attribute.Key("scaler.reason")
+	attrCurrent = attribute.Key("scaler.desired.current")
+	attrDesired = attribute.Key("scaler.desired")
+	attrActual  = attribute.Key("scaler.actual")
+	attrPending = attribute.Key("scaler.pending")
+)
+
+// WithTracerProvider sets where each Run's trace goes. Without it, a Run's
+// spans are children of the span in the context passed to Run, if any.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *options) { o.tracerProvider = tp }
+}
+
+// startSpan starts a span as a child of the one in ctx, with the same
+// provider, so code below Run doesn't need a tracer of its own.
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records err on span, if there is one, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingAPIOption adds a span for every AWS API call made with the config it
+// is added to, as a child of the span in the call's context. Calls made
+// outside a traced Run aren't traced.
+func tracingAPIOption(stack *middleware.Stack) error {
+	// After the service metadata is registered, and before retries, so a
+	// span covers every attempt
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("ScalerTracing", func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+		if !trace.SpanFromContext(ctx).IsRecording() {
+			return next.HandleInitialize(ctx, in)
+		}
+		service, operation := awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx)
+		ctx, span := trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).Start(ctx, service+"."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("rpc.system", "aws-api"),
+				attribute.String("rpc.service", service),
+				attribute.String("rpc.method", operation),
+			))
+		out, metadata, err := next.HandleInitialize(ctx, in)
+		endSpan(span, err)
+		return out, metadata, err
+	}), middleware.After)
+}
@@ -0,0 +1,135 @@
+package scaler
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/autoscaling"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/buildkite/buildkite-agent-scaler/buildkite"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spansByName returns the ended spans recorded, by name.
+func spansByName(rec *tracetest.SpanRecorder) map[string]sdktrace.ReadOnlySpan {
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range rec.Ended() {
+		spans[span.Name()] = span
+	}
+	return spans
+}
+
+func spanAttr(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestRunTrace(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	fake := &fakeAWS{desired: 1}
+	s, err := NewScaler(nil, aws.Config{}, Params{
+		AutoScalingGroupName: "agents",
+		BuildkiteQueue:       "default",
+		AgentsPerInstance:    1,
+	}, WithAutoScalingClient(fake), WithEC2Client(fake), WithSSMClient(fake),
+		WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.bk = &buildkiteTestDriver{metrics: buildkite.AgentMetrics{OrgSlug: "llamacorp", Queue: "default", ScheduledJobs: 3}}
+
+	if _, err := s.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := spansByName(rec)
+	run, ok := spans["scaler.Run"]
+	if !ok {
+		t.Fatalf("no scaler.Run span in %v", spans)
+	}
+	for _, name := range []string{"scaler.Describe", "buildkite.GetAgentMetrics", "scaler.Decide"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("no %s span", name)
+			continue
+		}
+		if span.Parent().SpanID() != run.SpanContext().SpanID() {
+			t.Errorf("%s isn't a child of scaler.Run", name)
+		}
+	}
+
+	for key, want := range map[attribute.Key]attribute.Value{
+		attrQueue:   attribute.StringValue("default"),
+		attrASG:     attribute.StringValue("agents"),
+		attrOrg:     attribute.StringValue("llamacorp"),
+		attrAction:  attribute.StringValue(ActionScaleOut),
+		attrCurrent: attribute.Int64Value(1),
+		attrDesired: attribute.Int64Value(3),
+	} {
+		if got := spanAttr(run, key); got != want {
+			t.Errorf("scaler.Run %s = %v, want %v", key, got.Emit(), want.Emit())
+		}
+	}
+	if got := spanAttr(spans["buildkite.GetAgentMetrics"], "buildkite.jobs.scheduled"); got.AsInt64() != 3 {
+		t.Errorf("buildkite.jobs.scheduled = %v, want 3", got.Emit())
+	}
+}
+
+// stubHTTPClient answers every request with an empty success.
+type stubHTTPClient struct{}
+
+func (stubHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"text/xml"}},
+		Body:       io.NopCloser(bytes.NewBufferString("<SetDesiredCapacityResponse><ResponseMetadata><RequestId>1</RequestId></ResponseMetadata></SetDesiredCapacityResponse>")),
+		Request:    req,
+	}, nil
+}
+
+func TestTracingAPIOption(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec))
+	client := autoscaling.NewFromConfig(aws.Config{
+		Region:      "us-east-1",
+		Credentials: aws.AnonymousCredentials{},
+		HTTPClient:  stubHTTPClient{},
+		APIOptions:  []func(*middleware.Stack) error{tracingAPIOption},
+	})
+	input := &autoscaling.SetDesiredCapacityInput{AutoScalingGroupName: aws.String("agents"), DesiredCapacity: aws.Int32(2)}
+
+	// Outside a traced Run, calls aren't traced
+	if _, err := client.SetDesiredCapacity(context.Background(), input); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(rec.Ended()); n != 0 {
+		t.Fatalf("recorded %d spans without a parent, want none", n)
+	}
+
+	ctx, run := tp.Tracer("test").Start(context.Background(), "scaler.Run")
+	if _, err := client.SetDesiredCapacity(ctx, input); err != nil {
+		t.Fatal(err)
+	}
+	run.End()
+
+	call, ok := spansByName(rec)["Auto Scaling.SetDesiredCapacity"]
+	if !ok {
+		t.Fatalf("no span for SetDesiredCapacity in %v", spansByName(rec))
+	}
+	if call.Parent().SpanID() != run.SpanContext().SpanID() {
+		t.Error("SetDesiredCapacity span isn't a child of the run")
+	}
+	if got := spanAttr(call, "rpc.method"); got.AsString() != "SetDesiredCapacity" {
+		t.Errorf("rpc.method = %q, want SetDesiredCapacity", got.AsString())
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/scaler"
+)
+
+// scalingFlags are the flags that shape scaling decisions, shared by the
+// scaler and the replay command so a replayed config is the one deployed.
+type scalingFlags struct {
+	agentsPerInstance     *int
+	includeWaiting        *bool
+	elasticCIMode         *bool
+	minimumInstanceUptime *time.Duration
+
+	// scale in/out params
+	scaleInFactor    *float64
+	scaleOutFactor   *float64
+	scaleInCooldown  *time.Duration
+	scaleOutCooldown *time.Duration
+	instanceBuffer   *int
+
+	availabilityThreshold *float64
+
+	// scaling policy params
+	scaleInPolicies      *string
+	scaleInSelectPolicy  *string
+	scaleOutPolicies     *string
+	scaleOutSelectPolicy *string
+
+	// controller params
+	controllerMode          *string
+	controllerSignal        *string
+	controllerKp            *float64
+	controllerKi            *float64
+	controllerKd            *float64
+	controllerIntegralLimit *float64
+
+	// size bound params
+	minSize *int64
+	maxSize *int64
+}
+
+func addScalingFlags(fs *flag.FlagSet) *scalingFlags {
+	return &scalingFlags{
+		agentsPerInstance:     fs.Int("agents-per-instance", 1, "The number of agents per instance"),
+		includeWaiting:        fs.Bool("include-waiting", false, "Whether to include jobs behind a wait step for scaling"),
+		elasticCIMode:         fs.Bool("elastic-ci-mode", false, "Whether to enable Elastic CI mode with additional safety checks"),
+		minimumInstanceUptime: fs.Duration("minimum-instance-uptime", 1*time.Hour, "Minimum instance uptime before being eligible for dangling instance check"),
+
+		scaleInFactor:    fs.Float64("scale-in-factor", 1.0, "A factor to apply to scale ins"),
+		scaleOutFactor:   fs.Float64("scale-out-factor", 1.0, "A factor to apply to scale outs"),
+		scaleInCooldown:  fs.Duration("scale-in-cooldown", 1*time.Hour, "How long to wait between scale in events"),
+		scaleOutCooldown: fs.Duration("scale-out-cooldown", 0, "How long to wait between scale out events"),
+		instanceBuffer:   fs.Int("instance-buffer", 0, "Keep this many instances as extra capacity"),
+
+		availabilityThreshold: fs.Float64("availability-threshold", 0, "Scale out when fewer than this fraction of expected agents are connected, e.g. 0.5 (0 disables)"),
+
+		scaleInPolicies:      fs.String("scale-in-policies", "", "Limits on scale-in per period, e.g. \"5/5m\" or \"10%/5m\""),
+		scaleInSelectPolicy:  fs.String("scale-in-select-policy", scaler.SelectPolicyMax, "Which scale-in policy applies when several are set: max or min"),
+		scaleOutPolicies:     fs.String("scale-out-policies", "", "Limits on scale-out per period, e.g. \"20/1m,100%/1m\""),
+		scaleOutSelectPolicy: fs.String("scale-out-select-policy", scaler.SelectPolicyMax, "Which scale-out policy applies when several are set: max or min"),
+
+		controllerMode:          fs.String("controller-mode", scaler.ControllerModeStep, "How desired capacity is driven: step or pid"),
+		controllerSignal:        fs.String("controller-signal", scaler.ControllerSignalBacklog, "The error signal for the pid controller: backlog or wait"),
+		controllerKp:            fs.Float64("controller-kp", 1.0, "The proportional gain for the pid controller"),
+		controllerKi:            fs.Float64("controller-ki", 0, "The integral gain for the pid controller, per second"),
+		controllerKd:            fs.Float64("controller-kd", 0, "The derivative gain for the pid controller, per second"),
+		controllerIntegralLimit: fs.Float64("controller-integral-limit", 0, "Bound on the pid integral term in instances (0 uses the ASG size range)"),
+
+		minSize: fs.Int64("min-size", 0, "Scaler-enforced minimum desired capacity, within the ASG's own range (0 uses the ASG's MinSize)"),
+		maxSize: fs.Int64("max-size", 0, "Scaler-enforced maximum desired capacity, within the ASG's own range (0 uses the ASG's MaxSize)"),
+	}
+}
+
+// params returns the scaler.Params the flags set.
+func (f *scalingFlags) params() (scaler.Params, error) {
+	scaleInPolicyList, err := scaler.ParseScalingPolicies(*f.scaleInPolicies)
+	if err != nil {
+		return scaler.Params{}, err
+	}
+	scaleInSelect, err := scaler.ParseSelectPolicy(*f.scaleInSelectPolicy)
+	if err != nil {
+		return scaler.Params{}, err
+	}
+	scaleOutPolicyList, err := scaler.ParseScalingPolicies(*f.scaleOutPolicies)
+	if err != nil {
+		return scaler.Params{}, err
+	}
+	scaleOutSelect, err := scaler.ParseSelectPolicy(*f.scaleOutSelectPolicy)
+	if err != nil {
+		return scaler.Params{}, err
+	}
+
+	return scaler.Params{
+		AgentsPerInstance: *f.agentsPerInstance,
+		IncludeWaiting:    *f.includeWaiting,
+		ScaleInParams: scaler.ScaleParams{
+			Factor:         *f.scaleInFactor,
+			CooldownPeriod: *f.scaleInCooldown,
+			Policies:       scaleInPolicyList,
+			SelectPolicy:   scaleInSelect,
+		},
+		ScaleOutParams: scaler.ScaleParams{
+			Factor:         *f.scaleOutFactor,
+			CooldownPeriod: *f.scaleOutCooldown,
+			Policies:       scaleOutPolicyList,
+			SelectPolicy:   scaleOutSelect,
+		},
+		InstanceBuffer:        *f.instanceBuffer,
+		AvailabilityThreshold: *f.availabilityThreshold,
+		ElasticCIMode:         *f.elasticCIMode,
+		MinimumInstanceUptime: *f.minimumInstanceUptime,
+		Controller: scaler.ControllerParams{
+			Mode:          *f.controllerMode,
+			Signal:        *f.controllerSignal,
+			Kp:            *f.controllerKp,
+			Ki:            *f.controllerKi,
+			Kd:            *f.controllerKd,
+			IntegralLimit: *f.controllerIntegralLimit,
+		},
+		MinSize: *f.minSize,
+		MaxSize: *f.maxSize,
+	}, nil
+}
@@ -0,0 +1,58 @@
+// Package tracing exports traces of the scaler's runs over OTLP, so a slow run
+// can be broken down into the calls it made.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/buildkite/buildkite-agent-scaler/version"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// ServiceName is the service the scaler's spans are reported under, unless
+// OTEL_SERVICE_NAME says otherwise.
+const ServiceName = "buildkite-agent-scaler"
+
+// NewTracerProvider returns a provider that batches spans and exports them
+// over OTLP/HTTP to endpoint, the full URL of the collector's traces
+// endpoint, e.g. "http://localhost:4318/v1/traces". An empty endpoint leaves
+// it to the standard OTEL_EXPORTER_OTLP_* environment variables, which also
+// set headers, e.g. for authentication. Callers should Shutdown the provider
+// to flush the last spans.
+func NewTracerProvider(ctx context.Context, endpoint string) (*sdktrace.TracerProvider, error) {
+	var opts []otlptracehttp.Option
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, fmt.Errorf("invalid tracing endpoint %q: expected a URL, e.g. http://localhost:4318/v1/traces", endpoint)
+		}
+		opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+	}
+	exporter, err := otlptracehttp.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP trace exporter: %w", err)
+	}
+
+	// Later options override earlier ones, so the environment wins
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", ServiceName),
+			attribute.String("service.version", version.VersionString()),
+		),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("creating trace resource: %w", err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	), nil
+}
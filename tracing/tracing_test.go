@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestNewTracerProvider(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		paths []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	tp, err := NewTracerProvider(ctx, srv.URL+"/v1/traces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := tp.Tracer("test").Start(ctx, "scaler.Run")
+	span.End()
+	if err := tp.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(paths) != 1 || paths[0] != "POST /v1/traces" {
+		t.Errorf("requests = %v, want one POST /v1/traces", paths)
+	}
+}
+
+func TestNewTracerProviderInvalidEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"localhost:4318", "://nope"} {
+		if _, err := NewTracerProvider(context.Background(), endpoint); err == nil {
+			t.Errorf("NewTracerProvider(%q) succeeded, want an error", endpoint)
+		}
+	}
+}
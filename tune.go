@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/buildkite/buildkite-agent-scaler/scaler/replay"
+)
+
+// runTune runs the tune command: it replays a recorded timeline with every
+// combination of the given parameter values, and reports the Pareto frontier
+// of cost against job wait and the best scoring template.yaml parameters.
+func runTune(args []string) {
+	fs := flag.NewFlagSet("tune", flag.ExitOnError)
+	usage(fs, "Replays recorded queue metrics with each combination of scaling parameters and recommends the best.\n"+
+		"Parameters without a list of values to try keep the value of their scaling flag.")
+	scaling := addScalingFlags(fs)
+	flags := addReplayFlags(fs)
+	var (
+		// grid params
+		scaleInFactors         = fs.String("scale-in-factors", "", "Scale-in factors to try, e.g. \"0.25,0.5,1\"")
+		scaleOutFactors        = fs.String("scale-out-factors", "", "Scale-out factors to try")
+		scaleInCooldowns       = fs.String("scale-in-cooldowns", "", "Scale-in cooldowns to try, e.g. \"5m,30m,1h\"")
+		scaleOutCooldowns      = fs.String("scale-out-cooldowns", "", "Scale-out cooldowns to try")
+		instanceBuffers        = fs.String("instance-buffers", "", "Instance buffers to try, e.g. \"0,1,2\"")
+		availabilityThresholds = fs.String("availability-thresholds", "", "Availability thresholds to try, e.g. \"0,0.5\"")
+		includeWaiting         = fs.String("include-waiting-values", "", "Whether to include waiting jobs, e.g. \"false,true\"")
+
+		// objective params
+		costWeight    = fs.Float64("cost-weight", 1, "Score weight per unit of estimated cost, or per instance hour without --instance-hourly-cost")
+		waitWeight    = fs.Float64("wait-weight", 1, "Score weight per minute of p95 job wait")
+		lostJobWeight = fs.Float64("lost-job-weight", 10, "Score weight per job lost to a busy termination")
+
+		parallelism = fs.Int("parallelism", runtime.NumCPU(), "How many replays to run at once")
+	)
+	_ = fs.Parse(args)
+
+	timeline := flags.timeline(fs)
+	base, err := scaling.params()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var grid replay.Grid
+	for _, err := range []error{
+		parseList(*scaleInFactors, parseFloat, &grid.ScaleInFactors),
+		parseList(*scaleOutFactors, parseFloat, &grid.ScaleOutFactors),
+		parseList(*scaleInCooldowns, time.ParseDuration, &grid.ScaleInCooldowns),
+		parseList(*scaleOutCooldowns, time.ParseDuration, &grid.ScaleOutCooldowns),
+		parseList(*instanceBuffers, strconv.Atoi, &grid.InstanceBuffers),
+		parseList(*availabilityThresholds, parseFloat, &grid.AvailabilityThresholds),
+		parseList(*includeWaiting, strconv.ParseBool, &grid.IncludeWaiting),
+	} {
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	objective := replay.Objective{
+		CostWeight:    *costWeight,
+		WaitWeight:    *waitWeight,
+		LostJobWeight: *lostJobWeight,
+	}
+
+	restore := flags.quiet()
+	results, err := replay.Tune(context.Background(), timeline, base, flags.config(), grid, objective, *parallelism)
+	restore()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	costHeader, cost := "COST", func(r replay.Report) float64 { return r.Cost }
+	if *flags.instanceHourlyCost == 0 {
+		costHeader, cost = "INSTANCE HOURS", func(r replay.Report) float64 { return r.InstanceHours }
+	}
+	frontier := replay.ParetoFrontier(results)
+	fmt.Printf("Pareto frontier of cost against p95 job wait, %d of %d configurations, cheapest first:\n\n", len(frontier), len(results))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "%s\tP50 WAIT\tP95 WAIT\tLOST\tACTIONS\tSCALE-IN FACTOR\tSCALE-OUT FACTOR\tSCALE-IN COOLDOWN\tSCALE-OUT COOLDOWN\tBUFFER\tAVAILABILITY\tWAITING\tSCORE\n", costHeader)
+	for _, r := range frontier {
+		c := r.Candidate
+		fmt.Fprintf(w, "%.2f\t%s\t%s\t%d\t%d\t%g\t%g\t%s\t%s\t%d\t%g\t%t\t%.2f\n",
+			cost(r.Report), r.Report.Wait.P50, r.Report.Wait.P95, r.Report.JobsLost, r.Report.ScalingActions(),
+			c.ScaleInFactor, c.ScaleOutFactor, c.ScaleInCooldown, c.ScaleOutCooldown, c.InstanceBuffer, c.AvailabilityThreshold, c.IncludeWaiting, r.Score)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatal(err)
+	}
+
+	best := results[0]
+	fmt.Printf("\nRecommended template.yaml parameters, scoring %.2f (e.g. for --parameter-overrides):\n\n", best.Score)
+	for _, p := range best.Candidate.TemplateParameters() {
+		fmt.Printf("%s=%s\n", p.Name, p.Value)
+	}
+}
+
+// parseList parses a comma separated list of values into list, leaving it
+// empty if s is.
+func parseList[T any](s string, parse func(string) (T, error), list *[]T) error {
+	if s == "" {
+		return nil
+	}
+	for _, v := range strings.Split(s, ",") {
+		parsed, err := parse(strings.TrimSpace(v))
+		if err != nil {
+			return err
+		}
+		*list = append(*list, parsed)
+	}
+	return nil
+}
+
+func parseFloat(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}